@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+func parseAdminUserIDs(value string) (map[uuid.UUID]bool, error) {
+	admins := map[uuid.UUID]bool{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := uuid.Parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin user ID %q: %w", part, err)
+		}
+		admins[id] = true
+	}
+	return admins, nil
+}
+
+func (cfg *apiConfig) isAdmin(userID uuid.UUID) bool {
+	return cfg.adminUserIDs[userID]
+}
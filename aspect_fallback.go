@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// What to do with a video when ffprobe reports neither an aspect ratio nor
+// usable dimensions.
+const (
+	unknownAspectOther  = "other"
+	unknownAspectReject = "reject"
+	unknownAspectDecode = "decode"
+)
+
+var errUnclassifiableVideo = errors.New("video has no usable dimensions")
+
+func validateUnknownAspectAction(action string) error {
+	switch action {
+	case unknownAspectOther, unknownAspectReject, unknownAspectDecode:
+		return nil
+	}
+	return fmt.Errorf("unknown aspect ratio action: %s", action)
+}
+
+// commonAspectRatios are what frame sizes within aspectRatioTolerance snap
+// to, so e.g. 854x480 is stored as 16:9 rather than 427:240.
+var commonAspectRatios = []struct {
+	ratio string
+	value float64
+}{
+	{"16:9", 16.0 / 9},
+	{"9:16", 9.0 / 16},
+	{"4:3", 4.0 / 3},
+	{"1:1", 1},
+}
+
+// aspectRatioTolerance is the relative difference still counted as a match.
+const aspectRatioTolerance = 0.02
+
+/**
+ * Reduce a frame size to a ratio such as "16:9"
+ * Sizes close to a common ratio snap to it, others are reduced by their
+ * GCD. Returns "" if either side is missing
+ */
+func aspectRatioFromDimensions(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+	value := float64(width) / float64(height)
+	for _, common := range commonAspectRatios {
+		if math.Abs(value-common.value)/common.value <= aspectRatioTolerance {
+			return common.ratio
+		}
+	}
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return fmt.Sprintf("%d:%d", width/a, height/a)
+}
+
+/**
+ * Get the aspect ratio of a video, applying the configured fallback
+ * "" means the video goes under the "other" prefix
+ */
+func (cfg *apiConfig) resolveAspectRatio(ctx context.Context, filePath string) (string, error) {
+	ratio, err := cfg.processor.aspectRatio(ctx, filePath)
+	if err != nil || ratio != "" {
+		return ratio, err
+	}
+
+	switch cfg.unknownAspectAction {
+	case unknownAspectReject:
+		return "", errUnclassifiableVideo
+	case unknownAspectDecode:
+		ratio, err := decodeFrameAspectRatio(ctx, filePath)
+		if err != nil {
+			log.Printf("Couldn't decode a frame of %s for its dimensions: %v", filePath, err)
+			return "", nil
+		}
+		return ratio, nil
+	}
+	return "", nil
+}
+
+/**
+ * Last-resort dimension probe: decode the first frame and measure it
+ * Much slower than reading the container, so only used when that fails
+ */
+func decodeFrameAspectRatio(ctx context.Context, filePath string) (string, error) {
+	framePath := filePath + ".probe.png"
+	command := commandContext(ctx, "ffmpeg", "-y", "-i", filePath, "-map", "0:v:0", "-frames:v", "1", framePath)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err := command.Run()
+	defer os.Remove(framePath)
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+
+	frame, err := os.Open(framePath)
+	if err != nil {
+		return "", err
+	}
+	defer frame.Close()
+	config, _, err := image.DecodeConfig(frame)
+	if err != nil {
+		return "", err
+	}
+	return aspectRatioFromDimensions(config.Width, config.Height), nil
+}
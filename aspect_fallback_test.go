@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ffprobe output with neither display_aspect_ratio nor dimensions
+const dimensionlessProbeOutput = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "avg_frame_rate": "30/1"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac"}
+	],
+	"format": {"duration": "12.500000"}
+}`
+
+func TestAspectRatioFromDimensions(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{width: 1920, height: 1080, want: "16:9"},
+		{width: 854, height: 480, want: "16:9"},
+		{width: 1080, height: 1920, want: "9:16"},
+		{width: 640, height: 480, want: "4:3"},
+		{width: 500, height: 500, want: "1:1"},
+		{width: 2560, height: 1080, want: "64:27"},
+		{width: 0, height: 1080, want: ""},
+	}
+	for _, tt := range tests {
+		if got := aspectRatioFromDimensions(tt.width, tt.height); got != tt.want {
+			t.Errorf("aspectRatioFromDimensions(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestUploadVideoUnknownAspectRatio(t *testing.T) {
+	installFakeProcessingTools(t, dimensionlessProbeOutput)
+	// Decoding a frame finds a 1280x720 picture
+	var frame bytes.Buffer
+	err := png.Encode(&frame, testPNG(1280, 720))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_FRAME", writeTempFile(t, "frame.png", frame.String()))
+	installFakeTool(t, "ffmpeg", `for last in "$@"; do :; done
+case "$last" in
+*.probe.png) cp "$FAKE_FRAME" "$last" ;;
+*) PATH="${PATH#*:}" exec ffmpeg "$@" ;;
+esac
+`)
+
+	tests := []struct {
+		action     string
+		wantCode   int
+		wantPrefix string
+		wantRatio  string
+	}{
+		{action: unknownAspectOther, wantCode: http.StatusOK, wantPrefix: "other/"},
+		{action: unknownAspectReject, wantCode: http.StatusUnprocessableEntity},
+		{action: unknownAspectDecode, wantCode: http.StatusOK, wantPrefix: "landscape/", wantRatio: "16:9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.unknownAspectAction = tt.action
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode != http.StatusOK {
+				if stored.VideoURL != nil || len(store.objects) != 0 {
+					t.Errorf("rejected video was stored")
+				}
+				return
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.VideoURL)
+			if !strings.HasPrefix(key, tt.wantPrefix) {
+				t.Errorf("stored at %s, want under %s", key, tt.wantPrefix)
+			}
+			ratio := ""
+			if stored.AspectRatio != nil {
+				ratio = *stored.AspectRatio
+			}
+			if ratio != tt.wantRatio {
+				t.Errorf("aspect ratio = %q, want %q", ratio, tt.wantRatio)
+			}
+		})
+	}
+}
+
+func TestGetVideoAspectRatioFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams string
+		want    string
+		wantErr error
+	}{
+		{name: "display aspect ratio", streams: `{"codec_type": "video", "width": 1440, "height": 1080, "display_aspect_ratio": "16:9"}`, want: "16:9"},
+		{name: "1920x1080 without DAR", streams: `{"codec_type": "video", "width": 1920, "height": 1080}`, want: "16:9"},
+		{name: "1080x1920 without DAR", streams: `{"codec_type": "video", "width": 1080, "height": 1920, "display_aspect_ratio": "N/A"}`, want: "9:16"},
+		{name: "640x480 with a zero DAR", streams: `{"codec_type": "video", "width": 640, "height": 480, "display_aspect_ratio": "0:1"}`, want: "4:3"},
+		{name: "audio stream first", streams: `{"codec_type": "audio", "codec_name": "aac"}, {"codec_type": "video", "width": 1080, "height": 1080}`, want: "1:1"},
+		{name: "no DAR or dimensions", streams: `{"codec_type": "video"}`, want: ""},
+		{name: "no video stream", streams: `{"codec_type": "audio", "codec_name": "aac"}`, wantErr: errUnreadableVideo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, `{"streams": [`+tt.streams+`]}`)
+			got, err := getVideoAspectRatio(context.Background(), writeTempFile(t, "upload.mp4", testMP4))
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("getVideoAspectRatio = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
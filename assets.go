@@ -1,7 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +23,204 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// randomAssetName returns a random URL-safe name for a stored asset.
+func randomAssetName() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+/**
+ * Get the S3 key of an asset from its stored URL
+ * Handles both the CloudFront form and the "bucket,key" form
+ */
+func (cfg *apiConfig) s3KeyFromURL(assetURL string) (string, bool) {
+	if key, ok := strings.CutPrefix(assetURL, cfg.s3CfDistribution+"/"); ok && key != "" {
+		return key, true
+	}
+	if key, ok := strings.CutPrefix(assetURL, cfg.s3Bucket+","); ok && key != "" {
+		return key, true
+	}
+	return "", false
+}
+
+// cleanupTimeout bounds deletes that run detached from a request or job.
+const cleanupTimeout = 30 * time.Second
+
+/**
+ * Get a context for cleanup that runs detached
+ * For the reaper, and for failures where the request or job context may be
+ * what ran out; the cleanup must still finish after a client is gone
+ */
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+/**
+ * Delete the file behind a stored asset URL
+ * The asset can live on the local disk (assetsRoot) or in the S3 bucket
+ */
+func (cfg *apiConfig) deleteAssetByURL(ctx context.Context, assetURL string) error {
+	// Checked first: on the local backend bucket objects live under
+	// /assets too, in nested folders
+	if bucket, key, ok := cfg.s3ObjectFromURL(assetURL); ok {
+		if isSegmentedKey(key) {
+			return cfg.deleteSegments(ctx, bucket, key)
+		}
+		return cfg.objectStoreFor(bucket).delete(ctx, key)
+	}
+
+	localPrefix := fmt.Sprintf("http://localhost:%s/assets/", cfg.port)
+	if name, ok := strings.CutPrefix(assetURL, localPrefix); ok {
+		// Only ever remove files directly inside assetsRoot
+		err := os.Remove(filepath.Join(cfg.assetsRoot, filepath.Base(name)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unrecognized asset URL: %s", assetURL)
+}
+
+/**
+ * Delete thumbnail files that were replaced on video
+ * previous is the video as it was before the change; anything the video
+ * still references, including candidates, is kept
+ */
+func (cfg *apiConfig) cleanupReplacedThumbnail(ctx context.Context, video database.Video, previous database.Video) {
+	if !cfg.cleanupOldThumbnails {
+		return
+	}
+
+	inUse := map[string]bool{}
+	for _, url := range thumbnailURLs(video) {
+		inUse[url] = true
+	}
+	for _, url := range video.ThumbnailCandidates {
+		inUse[url] = true
+	}
+
+	for _, url := range thumbnailURLs(previous) {
+		if inUse[url] {
+			continue
+		}
+		inUse[url] = true
+		err := cfg.deleteAssetByURL(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't delete old thumbnail %s: %v", url, err)
+		}
+	}
+}
+
+/**
+ * Remove thumbnail files a failed upload stored for video
+ * The video row never pointed at them, so nothing else does. A file that
+ * can't be deleted is logged and left behind
+ */
+func (cfg *apiConfig) discardThumbnails(ctx context.Context, videoID uuid.UUID, urls []string) {
+	deleted := map[string]bool{}
+	for _, url := range urls {
+		if deleted[url] {
+			continue
+		}
+		deleted[url] = true
+		err := cfg.deleteAssetByURL(ctx, url)
+		if err != nil {
+			log.Printf("ERROR: orphaned thumbnail %s of video %s, couldn't remove it: %v", url, videoID, err)
+		}
+	}
+}
+
+// thumbnailURLs lists the primary thumbnail and all of its variants.
+func thumbnailURLs(video database.Video) []string {
+	urls := []string{}
+	if video.ThumbnailURL != nil {
+		urls = append(urls, *video.ThumbnailURL)
+	}
+	for _, variant := range video.ThumbnailVariants {
+		if variant.URL != "" {
+			urls = append(urls, variant.URL)
+		}
+	}
+	return urls
+}
+
+// storyboardURLs lists the storyboard cue file and sprite, if any.
+func storyboardURLs(video database.Video) []string {
+	urls := []string{}
+	if video.StoryboardURL != nil {
+		urls = append(urls, *video.StoryboardURL)
+	}
+	if video.StoryboardSpriteURL != nil {
+		urls = append(urls, *video.StoryboardSpriteURL)
+	}
+	return urls
+}
+
+// videoAssetURLs lists every stored asset that belongs to video.
+func videoAssetURLs(video database.Video) []string {
+	urls := []string{}
+	if video.VideoURL != nil {
+		urls = append(urls, *video.VideoURL)
+	}
+	for _, url := range video.CodecRenditions {
+		urls = append(urls, url)
+	}
+	for _, url := range video.ResolutionRenditions {
+		urls = append(urls, url)
+	}
+	urls = append(urls, thumbnailURLs(video)...)
+	urls = append(urls, video.ThumbnailCandidates...)
+	if video.ContactSheetURL != nil {
+		urls = append(urls, *video.ContactSheetURL)
+	}
+	urls = append(urls, storyboardURLs(video)...)
+	for _, track := range video.AudioTracks {
+		urls = append(urls, track.URL)
+	}
+	for _, caption := range video.Captions {
+		urls = append(urls, caption.URL)
+	}
+	return urls
+}
+
+/**
+ * Delete every stored asset of a video, including its replica
+ * Shared content addressed objects other videos still use are kept. Keeps
+ * going past failures and returns them joined
+ */
+func (cfg *apiConfig) deleteVideoAssets(ctx context.Context, video database.Video) error {
+	errs := []error{}
+	seen := map[string]bool{}
+	for _, url := range videoAssetURLs(video) {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		err := cfg.deleteAssetIfUnreferenced(ctx, url, video.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+		}
+	}
+
+	if cfg.replicationEnabled() && video.VideoURL != nil {
+		shared, err := cfg.assetStillReferenced(*video.VideoURL, video.ID)
+		if err != nil {
+			errs = append(errs, err)
+		} else if key, ok := cfg.s3KeyFromURL(*video.VideoURL); ok && !shared {
+			_, err := cfg.replicaClient.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &cfg.replicaBucket,
+				Key:    &key,
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("replica %s: %w", key, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobTypeProcessUpload = "process_upload"
+
+type processUploadPayload struct {
+	// Bucket holds the raw upload; empty for jobs queued before tenant
+	// buckets staged their own
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key"`
+	MediaType string `json:"media_type"`
+	Profile   string `json:"profile"`
+	// The upload's storageClass override, if any
+	StorageClass string `json:"storage_class,omitempty"`
+}
+
+/**
+ * Queue a saved upload for processing instead of running it in the request
+ * The raw file is stored under raw/ like a direct upload and the client gets
+ * a 202 with the job ID; GET /api/videos/{videoID}/status reports progress.
+ * Reports whether the job was queued
+ */
+func (cfg *apiConfig) queueUploadProcessing(w http.ResponseWriter, r *http.Request, video database.Video, filePath, mediaType string, profile processingProfile) bool {
+	type response struct {
+		VideoID uuid.UUID `json:"video_id"`
+		JobID   uuid.UUID `json:"job_id"`
+		Status  string    `json:"status"`
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return false
+	}
+	key := fmt.Sprintf("raw/%s/%s", video.ID, name)
+	// Raw uploads are staged in the bucket the result goes to
+	bucket, err := cfg.bucketForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
+		return false
+	}
+	err = cfg.validateBucket(r.Context(), bucket)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Storage bucket isn't available", err)
+		return false
+	}
+	err = cfg.uploadFileToBucket(r.Context(), bucket, key, filePath, mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload", err)
+		return false
+	}
+
+	pending := database.VideoStatusPending
+	video.Status = &pending
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.discardRawUpload(r.Context(), bucket, key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return false
+	}
+	job, err := cfg.jobs.enqueue(jobTypeProcessUpload, video.ID, processUploadPayload{
+		Bucket:       bucket,
+		Key:          key,
+		MediaType:    mediaType,
+		Profile:      profile.Name,
+		StorageClass: string(storageClassFrom(r.Context())),
+	})
+	if err != nil {
+		cfg.discardRawUpload(r.Context(), bucket, key)
+		if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusFailed); err != nil {
+			log.Printf("Couldn't mark video %s failed: %v", video.ID, err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue processing", err)
+		return false
+	}
+
+	respondWithJSON(w, http.StatusAccepted, response{
+		VideoID: video.ID,
+		JobID:   job.ID,
+		Status:  pending,
+	})
+	return true
+}
+
+/**
+ * Run a queued upload through the same pipeline as a direct upload
+ * The video row is read at run time, so metadata edits made while the job
+ * waited are kept
+ */
+func (cfg *apiConfig) runProcessUploadJob(ctx context.Context, job database.Job) error {
+	payload := processUploadPayload{}
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return err
+	}
+	profile, ok := cfg.processingProfileFor(payload.Profile)
+	if !ok {
+		return fmt.Errorf("unknown processing profile: %s", payload.Profile)
+	}
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", job.VideoID)
+	}
+
+	release, err := cfg.scheduler.Acquire(ctx, video.UserID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = cfg.db.SetVideoStatus(video.ID, database.VideoStatusProcessing)
+	if err != nil {
+		return err
+	}
+	processing := database.VideoStatusProcessing
+	video.Status = &processing
+
+	procCtx, cancel := context.WithTimeout(withStorageClass(ctx, types.StorageClass(payload.StorageClass)), profile.Deadline)
+	defer cancel()
+	video, err = cfg.finishDirectUpload(procCtx, video, cmp.Or(payload.Bucket, cfg.s3Bucket), payload.Key, payload.MediaType, profile)
+	if err != nil {
+		return err
+	}
+	cfg.webhooks.dispatch(webhookEventReady, video.ID, cfg.videoEventData(ctx, video))
+	return nil
+}
+
+func (cfg *apiConfig) processUploadJobFailed(job database.Job, err error) {
+	if err := cfg.db.SetVideoStatus(job.VideoID, database.VideoStatusFailed); err != nil {
+		log.Printf("Couldn't mark video %s failed: %v", job.VideoID, err)
+	}
+	payload := processUploadPayload{}
+	if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.Key != "" {
+		// The job's context may be what ran out
+		ctx, cancel := cleanupContext()
+		defer cancel()
+		cfg.discardRawUpload(ctx, cmp.Or(payload.Bucket, cfg.s3Bucket), payload.Key)
+	}
+	cfg.webhooks.dispatch(webhookEventFailed, job.VideoID, map[string]string{"stage": "processing"})
+}
+
+// discardRawUpload removes a raw upload that will never be processed.
+func (cfg *apiConfig) discardRawUpload(ctx context.Context, bucket, key string) {
+	err := cfg.objectStoreFor(bucket).delete(ctx, key)
+	if err != nil {
+		log.Printf("Couldn't delete raw upload %s: %v", key, err)
+	}
+}
+
+/**
+ * Report where a video is in processing
+ * status is pending, processing, ready or failed; job_id and error come
+ * from the latest queued processing job, if there was one
+ */
+func (cfg *apiConfig) handlerVideoStatus(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoID uuid.UUID  `json:"video_id"`
+		Status  string     `json:"status"`
+		JobID   *uuid.UUID `json:"job_id,omitempty"`
+		Error   *string    `json:"error,omitempty"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+
+	resp := response{VideoID: videoID, Status: database.VideoStatusPending}
+	switch {
+	case video.Status != nil && *video.Status != database.VideoStatusUploaded:
+		resp.Status = *video.Status
+	case video.VideoURL != nil:
+		// Rows from before statuses were tracked
+		resp.Status = database.VideoStatusReady
+	}
+	job, ok, err := cfg.db.LatestJob(jobTypeProcessUpload, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing job", err)
+		return
+	}
+	if ok {
+		resp.JobID = &job.ID
+		if resp.Status == database.VideoStatusFailed {
+			resp.Error = job.LastError
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
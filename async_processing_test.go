@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// videoStatus is the status endpoint's answer for video.
+func videoStatus(t *testing.T, cfg *apiConfig, video uuid.UUID, token string) (status string, jobID *uuid.UUID, jobErr *string) {
+	req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.String()+"/status", nil)
+	req.SetPathValue("videoID", video.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoStatus(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status endpoint = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Status string     `json:"status"`
+		JobID  *uuid.UUID `json:"job_id"`
+		Error  *string    `json:"error"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Status, resp.JobID, resp.Error
+}
+
+func TestUploadVideoAsync(t *testing.T) {
+	tests := []struct {
+		name       string
+		failFFmpeg bool
+		wantStatus string
+	}{
+		{name: "ready", wantStatus: "ready"},
+		{name: "failed", failFFmpeg: true, wantStatus: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, fakeProbeOutput)
+			if tt.failFFmpeg {
+				installFakeTool(t, "ffmpeg", "echo 'moov atom not found' >&2\nexit 1\n")
+			}
+			cfg, store, video, token := newS3Test(t)
+			cfg.asyncProcessing = true
+			cfg.jobs = newJobQueue(cfg.db, time.Minute, time.Hour)
+			cfg.jobs.register(jobTypeProcessUpload, jobType{run: cfg.runProcessUploadJob, maxAttempts: 1, failed: cfg.processUploadJobFailed})
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("upload status = %d, want 202: %s", w.Code, w.Body)
+			}
+			var accepted struct {
+				JobID  uuid.UUID `json:"job_id"`
+				Status string    `json:"status"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&accepted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted.JobID == uuid.Nil || accepted.Status != "pending" {
+				t.Errorf("accepted %+v, want a pending job", accepted)
+			}
+			status, jobID, _ := videoStatus(t, cfg, video.ID, token)
+			if status != "pending" || jobID == nil || *jobID != accepted.JobID {
+				t.Errorf("before the job runs: %s with job %v, want pending with %s", status, jobID, accepted.JobID)
+			}
+
+			if !cfg.jobs.runNext() {
+				t.Fatal("no job was queued")
+			}
+			status, _, jobErr := videoStatus(t, cfg, video.ID, token)
+			if status != tt.wantStatus {
+				t.Fatalf("after the job: status = %s, want %s", status, tt.wantStatus)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key := range store.objects {
+				if strings.HasPrefix(key, "raw/") {
+					t.Errorf("raw upload %s left behind", key)
+				}
+			}
+			if tt.failFFmpeg {
+				if jobErr == nil || stored.VideoURL != nil {
+					t.Errorf("failed job reported error %v and saved %v", jobErr, stored.VideoURL)
+				}
+				return
+			}
+			if stored.VideoURL == nil {
+				t.Fatal("processed video URL wasn't saved")
+			}
+			if key, _ := cfg.s3KeyFromURL(*stored.VideoURL); store.objects[key] == nil {
+				t.Errorf("processed video %s isn't in the bucket", key)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type audioInfo struct {
+	HasAudio bool
+	Duration float64
+}
+
+/**
+ * Check whether a video has an audio stream
+ * Also returns the container duration, which the silence check needs
+ */
+func getAudioInfo(ctx context.Context, filePath string) (audioInfo, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_entries", "stream=codec_type:format=duration", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return audioInfo{}, err
+	}
+
+	var ffprobeOutput struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return audioInfo{}, err
+	}
+
+	info := audioInfo{}
+	for _, stream := range ffprobeOutput.Streams {
+		if stream.CodecType == "audio" {
+			info.HasAudio = true
+			break
+		}
+	}
+	info.Duration, _ = strconv.ParseFloat(ffprobeOutput.Format.Duration, 64)
+	return info, nil
+}
+
+var (
+	silenceStartPattern = regexp.MustCompile(`silence_start: (-?[0-9.]+)`)
+	silenceEndPattern   = regexp.MustCompile(`silence_end: (-?[0-9.]+)`)
+)
+
+/**
+ * Check whether the audio track is silent from start to end
+ * Decodes the whole audio stream through ffmpeg's silencedetect filter
+ */
+func isAudioSilent(ctx context.Context, filePath string, duration float64) (bool, error) {
+	command := commandContext(ctx, "ffmpeg", "-i", filePath, "-vn", "-af", "silencedetect=noise=-50dB:d=0.5", "-f", "null", "-")
+	var stderr strings.Builder
+	command.Stderr = &stderr
+
+	err := command.Run()
+	if err != nil {
+		return false, err
+	}
+	return parseSilenceDetect(stderr.String(), duration), nil
+}
+
+/**
+ * Parse silencedetect output
+ * The track is silent when the first silence starts at the beginning and
+ * either never ends or only ends with the stream
+ */
+func parseSilenceDetect(output string, duration float64) bool {
+	const tolerance = 0.1
+
+	starts := silenceStartPattern.FindAllStringSubmatch(output, -1)
+	if len(starts) == 0 {
+		return false
+	}
+	start, err := strconv.ParseFloat(starts[0][1], 64)
+	if err != nil || start > tolerance {
+		return false
+	}
+
+	ends := silenceEndPattern.FindAllStringSubmatch(output, -1)
+	if len(ends) == 0 {
+		return true
+	}
+	if len(starts) > 1 {
+		return false
+	}
+	end, err := strconv.ParseFloat(ends[0][1], 64)
+	if err != nil {
+		return false
+	}
+	return duration > 0 && end >= duration-tolerance
+}
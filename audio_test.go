@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseSilenceDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		duration float64
+		want     bool
+	}{
+		{name: "normal audio", output: "size=N/A time=00:00:12.50", duration: 12.5, want: false},
+		{name: "silent throughout", output: "[silencedetect @ 0x1] silence_start: 0\n", duration: 12.5, want: true},
+		{name: "silent until the end", output: "[silencedetect @ 0x1] silence_start: 0.02\n[silencedetect @ 0x1] silence_end: 12.48 | silence_duration: 12.46\n", duration: 12.5, want: true},
+		{name: "quiet intro", output: "[silencedetect @ 0x1] silence_start: 0\n[silencedetect @ 0x1] silence_end: 3 | silence_duration: 3\n", duration: 12.5, want: false},
+		{name: "silence later on", output: "[silencedetect @ 0x1] silence_start: 4.2\n", duration: 12.5, want: false},
+		{name: "gaps", output: "silence_start: 0\nsilence_end: 2\nsilence_start: 5\nsilence_end: 12.5\n", duration: 12.5, want: false},
+		{name: "unknown duration", output: "silence_start: 0\nsilence_end: 12.5\n", duration: 0, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSilenceDetect(tt.output, tt.duration); got != tt.want {
+				t.Errorf("parseSilenceDetect = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAudioInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		probe     string
+		wantAudio bool
+	}{
+		{name: "no audio", probe: `{"streams": [{"codec_type": "video"}], "format": {"duration": "12.5"}}`, wantAudio: false},
+		{name: "audio", probe: fakeProbeOutput, wantAudio: true},
+		{name: "audio only", probe: `{"streams": [{"codec_type": "audio"}], "format": {"duration": "12.5"}}`, wantAudio: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, tt.probe)
+			info, err := getAudioInfo(context.Background(), "upload.mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.HasAudio != tt.wantAudio || info.Duration != 12.5 {
+				t.Errorf("getAudioInfo = %+v, want audio %v over 12.5s", info, tt.wantAudio)
+			}
+		})
+	}
+}
+
+func TestIsAudioSilent(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   bool
+	}{
+		{name: "silent", stderr: `silence_start: 0`, want: true},
+		{name: "normal", stderr: `time=00:00:12.50`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeTool(t, "ffmpeg", "echo '"+tt.stderr+"' >&2\n")
+			silent, err := isAudioSilent(context.Background(), "upload.mp4", 12.5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if silent != tt.want {
+				t.Errorf("isAudioSilent = %v, want %v", silent, tt.want)
+			}
+		})
+	}
+}
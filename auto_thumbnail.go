@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+)
+
+/**
+ * Grab a frame of the video as its thumbnail
+ * The frame is taken at autoThumbnailAt, or halfway through videos shorter
+ * than that, and stored like an uploaded thumbnail. Returns
+ * the thumbnail's URL and bytes
+ */
+func (cfg *apiConfig) generateAutoThumbnail(ctx context.Context, filePath string) (string, []byte, error) {
+	timestamp := cfg.autoThumbnailAt.Seconds()
+	duration, err := getVideoDuration(ctx, filePath)
+	if err == nil && duration < timestamp {
+		timestamp = duration / 2
+	}
+	streams, err := getVideoStreams(ctx, filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't list video streams: %w", err)
+	}
+	streamIndex, err := selectThumbnailStream(streams, cfg.thumbnailStreamIndex)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		return "", nil, err
+	}
+	framePath := filePath + ".thumbnail.jpg"
+	defer os.Remove(framePath)
+	err = extractFrame(ctx, filePath, streamIndex, timestamp, framePath)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := os.ReadFile(framePath)
+	if err != nil {
+		return "", nil, err
+	}
+	url, err := cfg.thumbnailStore.put(ctx, name+thumbnailExtensions["image/jpeg"], bytes.NewReader(data), "image/jpeg")
+	if err != nil {
+		return "", nil, err
+	}
+	return url, data, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A file with cover art, the main picture and a picture-in-picture stream
+const multiStreamProbeOutput = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "disposition": {"default": 0, "attached_pic": 1}},
+		{"index": 1, "codec_type": "video", "disposition": {"default": 1, "attached_pic": 0}},
+		{"index": 2, "codec_type": "video", "disposition": {"default": 0, "attached_pic": 0}},
+		{"index": 3, "codec_type": "audio", "disposition": {"default": 1, "attached_pic": 0}}
+	],
+	"format": {"duration": "12.500000"}
+}`
+
+func TestSelectThumbnailStream(t *testing.T) {
+	coverArt := videoStream{Index: 0}
+	coverArt.Disposition.AttachedPic = 1
+	primary := videoStream{Index: 1}
+	primary.Disposition.Default = 1
+	pip := videoStream{Index: 2}
+
+	tests := []struct {
+		name       string
+		streams    []videoStream
+		configured int
+		want       int
+		wantErr    bool
+	}{
+		{name: "default disposition", streams: []videoStream{coverArt, primary, pip}, configured: -1, want: 1},
+		{name: "configured", streams: []videoStream{coverArt, primary, pip}, configured: 2, want: 2},
+		{name: "out of range", streams: []videoStream{coverArt, primary, pip}, configured: 3, wantErr: true},
+		{name: "no default, skips cover art", streams: []videoStream{coverArt, pip}, configured: -1, want: 1},
+		{name: "only cover art", streams: []videoStream{coverArt}, configured: -1, want: 0},
+		{name: "no video", configured: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := selectThumbnailStream(tt.streams, tt.configured)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %d, %v, want %d (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGenerateThumbnailCandidatesStream(t *testing.T) {
+	installFakeProcessingTools(t, multiStreamProbeOutput)
+	// Records the stream each frame is taken from
+	installFakeTool(t, "ffmpeg", `prev=""
+for arg in "$@"; do
+	if [ "$prev" = "-map" ]; then
+		echo "$arg" >> "$FAKE_FFMPEG_MAPS"
+	fi
+	prev="$arg"
+done
+echo frame > "$prev"
+`)
+	tests := []struct {
+		name       string
+		configured int
+		wantMap    string
+		wantErr    bool
+	}{
+		{name: "primary stream", configured: -1, wantMap: "0:v:1"},
+		{name: "picture-in-picture", configured: 2, wantMap: "0:v:2"},
+		{name: "missing stream", configured: 5, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maps := filepath.Join(t.TempDir(), "maps")
+			t.Setenv("FAKE_FFMPEG_MAPS", maps)
+			cfg, server, video, _ := newS3Test(t)
+			cfg.thumbnailCandidateCount = 1
+			cfg.thumbnailStreamIndex = tt.configured
+			source := filepath.Join(t.TempDir(), "upload.mp4")
+			err := os.WriteFile(source, []byte("video"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			urls, _, err := cfg.generateThumbnailCandidates(context.Background(), cfg.s3Bucket, video.ID, source)
+			if tt.wantErr {
+				if err == nil || len(server.objects) != 0 {
+					t.Errorf("got %v with %d stored, want an error and nothing stored", err, len(server.objects))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(urls) != 1 || len(server.objects) != 1 {
+				t.Errorf("got %d URLs with %d stored, want the extracted frame", len(urls), len(server.objects))
+			}
+			got, _ := os.ReadFile(maps)
+			if strings.TrimSpace(string(got)) != tt.wantMap {
+				t.Errorf("frame taken with -map %q, want %s", got, tt.wantMap)
+			}
+		})
+	}
+}
+
+func TestUploadVideoAutoThumbnail(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Records the frame grab and hands the rest to the copying fake
+	installFakeTool(t, "ffmpeg", `case "$*" in
+*.jpg) echo "$*" > "$FAKE_FFMPEG_FRAME" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	existing := "https://example.com/uploaded.png"
+	tests := []struct {
+		name      string
+		at        time.Duration
+		thumbnail *string
+		wantSeek  string
+	}{
+		{name: "no thumbnail", at: time.Second, wantSeek: "-ss 1.000 "},
+		{name: "shorter than the timestamp", at: time.Minute, wantSeek: "-ss 6.250 "},
+		{name: "uploaded thumbnail kept", at: time.Second, thumbnail: &existing},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := filepath.Join(t.TempDir(), "frame")
+			t.Setenv("FAKE_FFMPEG_FRAME", frame)
+			cfg, _, video, token := newS3Test(t)
+			cfg.autoThumbnailAt = tt.at
+			video.ThumbnailURL = tt.thumbnail
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args, _ := os.ReadFile(frame)
+			if tt.wantSeek == "" {
+				if len(args) != 0 {
+					t.Errorf("grabbed a frame with %q, want none", args)
+				}
+				if (stored.ThumbnailURL == nil) != (tt.thumbnail == nil) || (tt.thumbnail != nil && *stored.ThumbnailURL != *tt.thumbnail) {
+					t.Errorf("thumbnail = %v, want %v", stored.ThumbnailURL, tt.thumbnail)
+				}
+				return
+			}
+			if !strings.Contains(string(args), tt.wantSeek) {
+				t.Errorf("frame grabbed with %q, want %s", args, tt.wantSeek)
+			}
+			if stored.ThumbnailURL == nil || !strings.HasSuffix(*stored.ThumbnailURL, ".jpg") {
+				t.Fatalf("thumbnail = %v, want a generated JPEG", stored.ThumbnailURL)
+			}
+			_, err = os.Stat(filepath.Join(cfg.assetsRoot, path.Base(*stored.ThumbnailURL)))
+			if err != nil {
+				t.Errorf("thumbnail %s wasn't stored in the assets: %v", *stored.ThumbnailURL, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// bannedHashStore answers whether a SHA-256 upload hash (hex encoded) has been
+// banned. Implementations must be safe for concurrent use.
+type bannedHashStore interface {
+	IsBanned(hash string) (bool, error)
+	Reload() error
+}
+
+func newBannedHashStore(source, path string, db database.Client) (bannedHashStore, error) {
+	switch source {
+	case "":
+		return nil, nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("BANNED_HASHES_FILE must be set when BANNED_HASHES_SOURCE is file")
+		}
+		store := &fileBannedHashStore{path: path}
+		return store, store.Reload()
+	case "db":
+		return dbBannedHashStore{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown banned hash source: %s", source)
+	}
+}
+
+/**
+ * File backed store, one hex hash per line
+ * Blank lines and lines starting with # are ignored
+ * The file is re-read whenever its modification time changes
+ */
+type fileBannedHashStore struct {
+	path string
+
+	mu      sync.RWMutex
+	hashes  map[string]struct{}
+	modTime time.Time
+}
+
+func (s *fileBannedHashStore) IsBanned(hash string) (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	stale := !info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if stale {
+		err = s.Reload()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, banned := s.hashes[strings.ToLower(hash)]
+	return banned, nil
+}
+
+func (s *fileBannedHashStore) Reload() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hashes := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hashes[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.hashes = hashes
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
+
+// dbBannedHashStore reads the banned_hashes table on every lookup, so there
+// is nothing to reload.
+type dbBannedHashStore struct {
+	db database.Client
+}
+
+func (s dbBannedHashStore) IsBanned(hash string) (bool, error) {
+	return s.db.IsHashBanned(strings.ToLower(hash))
+}
+
+func (s dbBannedHashStore) Reload() error {
+	return nil
+}
+
+// reloadBannedHashesOn reloads store each time a signal arrives on hup,
+// until hup is closed. main feeds it SIGHUP.
+func reloadBannedHashesOn(store bannedHashStore, hup <-chan os.Signal) {
+	for range hup {
+		if err := store.Reload(); err != nil {
+			log.Printf("Couldn't reload banned hashes: %v", err)
+		}
+	}
+}
+
+/**
+ * Ban a SHA-256 upload hash, for admins
+ * Only the db source can be written to; a file list is edited in place and
+ * picked up on its next change or SIGHUP
+ */
+func (cfg *apiConfig) handlerBanHash(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Hash   string `json:"hash"`
+		Reason string `json:"reason"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if !cfg.isAdmin(userID) {
+		respondWithError(w, http.StatusForbidden, "Only admins can ban content", nil)
+		return
+	}
+	if _, ok := cfg.bannedHashes.(dbBannedHashStore); !ok {
+		respondWithError(w, http.StatusConflict, "Banned hashes aren't stored in the database, set BANNED_HASHES_SOURCE=db", nil)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	hash := strings.ToLower(strings.TrimSpace(params.Hash))
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+		respondWithError(w, http.StatusBadRequest, "hash must be a hex encoded SHA-256", err)
+		return
+	}
+	err = cfg.db.BanHash(hash, params.Reason)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't ban hash", err)
+		return
+	}
+	log.Printf("audit: banned hash=%s by user=%s reason=%q", hash, userID, params.Reason)
+	params.Hash = hash
+	respondWithJSON(w, http.StatusCreated, params)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func testHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFileBannedHashStore(t *testing.T) {
+	banned := testHash("banned")
+	path := writeTempFile(t, "banned.txt", "# known bad uploads\n\n"+strings.ToUpper(banned)+"\n")
+	store, err := newBannedHashStore("file", path, newTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hash string
+		want bool
+	}{
+		{hash: banned, want: true},
+		{hash: strings.ToUpper(banned), want: true},
+		{hash: testHash("fine"), want: false},
+		{hash: "# known bad uploads", want: false},
+	}
+	for _, tt := range tests {
+		got, err := store.IsBanned(tt.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("IsBanned(%s) = %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestFileBannedHashStoreReload(t *testing.T) {
+	first, second := testHash("first"), testHash("second")
+	path := writeTempFile(t, "banned.txt", first+"\n")
+	store, err := newBannedHashStore("file", path, newTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the modification time so only the signal can pick the edit up
+	err = os.WriteFile(path, []byte(first+"\n"+second+"\n"), 0644)
+	if err == nil {
+		err = os.Chtimes(path, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.IsBanned(second); got {
+		t.Fatal("edit was picked up without a reload")
+	}
+
+	hup := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		reloadBannedHashesOn(store, hup)
+		close(done)
+	}()
+	hup <- syscall.SIGHUP
+	// The send only hands the signal over, a second one waits for the reload
+	hup <- syscall.SIGHUP
+	close(hup)
+	<-done
+	if got, _ := store.IsBanned(second); !got {
+		t.Error("SIGHUP didn't reload the banned hash file")
+	}
+
+	// A changed modification time is picked up without a signal
+	err = os.WriteFile(path, []byte(second+"\n"), 0644)
+	if err == nil {
+		later := info.ModTime().Add(time.Minute)
+		err = os.Chtimes(path, later, later)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.IsBanned(first); got {
+		t.Error("hash removed from the file is still banned")
+	}
+}
+
+func TestDBBannedHashStore(t *testing.T) {
+	db := newTestDB(t)
+	store, err := newBannedHashStore("db", "", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned := testHash("banned")
+	if got, _ := store.IsBanned(banned); got {
+		t.Fatal("hash is banned before BanHash")
+	}
+	err = db.BanHash(banned, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every lookup reads the table, so a reload is a no-op
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{banned, strings.ToUpper(banned)} {
+		got, err := store.IsBanned(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got {
+			t.Errorf("IsBanned(%s) = false after BanHash", hash)
+		}
+	}
+}
+
+func TestHandlerBanHash(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	cfg.adminUserIDs = map[uuid.UUID]bool{video.UserID: true}
+	cfg.bannedHashes = dbBannedHashStore{db: cfg.db}
+	otherToken, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned := testHash("banned")
+
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{name: "not an admin", token: otherToken, body: `{"hash": "` + banned + `"}`, wantStatus: http.StatusForbidden},
+		{name: "not a hash", token: token, body: `{"hash": "abc"}`, wantStatus: http.StatusBadRequest},
+		{name: "admin", token: token, body: `{"hash": "` + strings.ToUpper(banned) + `", "reason": "test"}`, wantStatus: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/banned-hashes", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			cfg.handlerBanHash(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+
+	if got, _ := cfg.bannedHashes.IsBanned(banned); !got {
+		t.Error("hash isn't banned after the admin request")
+	}
+	// The multipart, direct and trim paths all check through here
+	err = cfg.checkBannedHash(banned, video)
+	if err == nil || err.Error() != "This content is not allowed" {
+		t.Errorf("checkBannedHash = %v, want a rejection", err)
+	}
+}
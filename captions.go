@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const captionSourceUpload = "upload"
+
+// errMalformedCaption means an uploaded caption file isn't valid WebVTT
+// or SRT.
+var errMalformedCaption = errors.New("malformed caption file")
+
+// captionCue is one timed piece of caption text.
+type captionCue struct {
+	Start time.Duration
+	End   time.Duration
+	// Settings are the WebVTT cue settings after the end time, if any
+	Settings string
+	Text     []string
+}
+
+// captionBlocks splits caption text into blank-line separated blocks,
+// dropping a byte order mark and normalising line endings. first is the
+// line number of each block's first line.
+func captionBlocks(data []byte) (blocks [][]string, first []int) {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	block := []string{}
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = []string{}
+			}
+			continue
+		}
+		if len(block) == 0 {
+			first = append(first, i+1)
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+	return blocks, first
+}
+
+/**
+ * Parse a cue timing line like "00:01.000 --> 00:02.500 align:start"
+ * SRT uses a comma before the milliseconds and has no settings
+ */
+func parseCueTiming(line string, srt bool) (captionCue, error) {
+	start, rest, ok := strings.Cut(line, "-->")
+	if !ok {
+		return captionCue{}, fmt.Errorf("missing -->")
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return captionCue{}, fmt.Errorf("missing end time")
+	}
+	if srt && len(fields) > 1 {
+		return captionCue{}, fmt.Errorf("unexpected text after end time")
+	}
+
+	cue := captionCue{Settings: strings.Join(fields[1:], " ")}
+	var err error
+	cue.Start, err = parseCueTimestamp(strings.TrimSpace(start), srt)
+	if err != nil {
+		return captionCue{}, err
+	}
+	cue.End, err = parseCueTimestamp(fields[0], srt)
+	if err != nil {
+		return captionCue{}, err
+	}
+	if cue.End < cue.Start {
+		return captionCue{}, fmt.Errorf("cue ends before it starts")
+	}
+	return cue, nil
+}
+
+// parseCueTimestamp parses [HH:]MM:SS.mmm, or HH:MM:SS,mmm for SRT.
+func parseCueTimestamp(value string, srt bool) (time.Duration, error) {
+	separator := "."
+	if srt {
+		separator = ","
+	}
+	clock, millis, ok := strings.Cut(value, separator)
+	if !ok || len(millis) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) < 2 || len(parts) > 3 || (srt && len(parts) != 3) {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	total := time.Duration(0)
+	units := []time.Duration{time.Hour, time.Minute, time.Second}[3-len(parts):]
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		// Hours may have any number of digits, minutes and seconds have two
+		if err != nil || n < 0 || ((i > 0 || len(parts) == 2) && (len(part) != 2 || n > 59)) {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		total += time.Duration(n) * units[i]
+	}
+	n, err := strconv.Atoi(millis)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return total + time.Duration(n)*time.Millisecond, nil
+}
+
+/**
+ * Check that data is a WebVTT file with at least one valid cue
+ * NOTE, STYLE and REGION blocks are allowed and skipped
+ */
+func validateWebVTT(data []byte) error {
+	blocks, first := captionBlocks(data)
+	if len(blocks) == 0 {
+		return fmt.Errorf("%w: empty file", errMalformedCaption)
+	}
+	header := blocks[0][0]
+	if header != "WEBVTT" && !strings.HasPrefix(header, "WEBVTT ") && !strings.HasPrefix(header, "WEBVTT\t") {
+		return fmt.Errorf("%w: missing WEBVTT header", errMalformedCaption)
+	}
+
+	cues := 0
+	for i, block := range blocks[1:] {
+		keyword, _, _ := strings.Cut(block[0], " ")
+		switch keyword {
+		case "NOTE", "STYLE", "REGION":
+			continue
+		}
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			// The first line is a cue identifier
+			timing = 1
+		}
+		if timing >= len(block) {
+			return fmt.Errorf("%w: line %d: cue without timing", errMalformedCaption, first[i+1])
+		}
+		_, err := parseCueTiming(block[timing], false)
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %v", errMalformedCaption, first[i+1]+timing, err)
+		}
+		cues++
+	}
+	if cues == 0 {
+		return fmt.Errorf("%w: no cues", errMalformedCaption)
+	}
+	return nil
+}
+
+// parseSRT reads the cues of a SubRip file.
+func parseSRT(data []byte) ([]captionCue, error) {
+	blocks, first := captionBlocks(data)
+	cues := []captionCue{}
+	for i, block := range blocks {
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			if _, err := strconv.Atoi(strings.TrimSpace(block[0])); err != nil {
+				return nil, fmt.Errorf("%w: line %d: expected a cue number", errMalformedCaption, first[i])
+			}
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("%w: line %d: cue without timing", errMalformedCaption, first[i])
+		}
+		cue, err := parseCueTiming(block[timing], true)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", errMalformedCaption, first[i]+timing, err)
+		}
+		cue.Text = block[timing+1:]
+		cues = append(cues, cue)
+	}
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("%w: no cues", errMalformedCaption)
+	}
+	return cues, nil
+}
+
+// renderWebVTT writes cues as a WebVTT file.
+func renderWebVTT(cues []captionCue) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&buf, "\n%s --> %s", formatVTTTimestamp(cue.Start.Seconds()), formatVTTTimestamp(cue.End.Seconds()))
+		if cue.Settings != "" {
+			buf.WriteString(" " + cue.Settings)
+		}
+		buf.WriteString("\n")
+		for _, line := range cue.Text {
+			// "-->" would start a new cue in WebVTT
+			buf.WriteString(strings.ReplaceAll(line, "-->", "--&gt;") + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+/**
+ * Turn an uploaded caption file of mediaType into WebVTT
+ * WebVTT is validated and kept as is, SRT is converted
+ */
+func captionToWebVTT(data []byte, mediaType string) ([]byte, error) {
+	switch mediaType {
+	case "text/vtt":
+		err := validateWebVTT(data)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	case "application/x-subrip":
+		cues, err := parseSRT(data)
+		if err != nil {
+			return nil, err
+		}
+		return renderWebVTT(cues), nil
+	}
+	return nil, fmt.Errorf("unsupported caption type %s", mediaType)
+}
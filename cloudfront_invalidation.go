@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// cloudFrontInvalidationBatch is the most paths sent in one invalidation.
+// A distribution allows 3000 paths in progress at once, so a single video
+// never takes up all of them.
+const cloudFrontInvalidationBatch = 1000
+
+func (cfg *apiConfig) cloudFrontInvalidationEnabled() bool {
+	return cfg.cloudFrontClient != nil && cfg.cloudFrontDistributionID != ""
+}
+
+/**
+ * Clear CloudFront's cache of the files behind asset URLs
+ * Only URLs served through the distribution are sent. Best effort: failures
+ * are logged, the caller has already stored its change
+ */
+func (cfg *apiConfig) invalidateAssetURLs(ctx context.Context, urls []string) {
+	if !cfg.cloudFrontInvalidationEnabled() {
+		return
+	}
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, url := range urls {
+		key, ok := cfg.s3KeyFromURL(url)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		paths = append(paths, "/"+key)
+	}
+
+	for start := 0; start < len(paths); start += cloudFrontInvalidationBatch {
+		batch := paths[start:min(start+cloudFrontInvalidationBatch, len(paths))]
+		_, err := cfg.cloudFrontClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+			DistributionId: &cfg.cloudFrontDistributionID,
+			InvalidationBatch: &types.InvalidationBatch{
+				CallerReference: aws.String(fmt.Sprintf("%d-%d", time.Now().UnixNano(), start)),
+				Paths: &types.Paths{
+					Items:    batch,
+					Quantity: aws.Int32(int32(len(batch))),
+				},
+			},
+		})
+		if err != nil {
+			log.Printf("Couldn't invalidate %d CloudFront paths: %v", len(batch), err)
+		}
+	}
+}
+
+// invalidateReplacedVideo clears the cached video file and renditions of
+// previous once they have been replaced.
+func (cfg *apiConfig) invalidateReplacedVideo(ctx context.Context, previous database.Video) {
+	if previous.VideoURL == nil {
+		return
+	}
+	urls := []string{*previous.VideoURL}
+	for _, url := range previous.CodecRenditions {
+		urls = append(urls, url)
+	}
+	for _, url := range previous.ResolutionRenditions {
+		urls = append(urls, url)
+	}
+	cfg.invalidateAssetURLs(ctx, urls)
+}
+
+// invalidateReplacedThumbnail clears the cached thumbnail and variants of
+// previous once they have been replaced.
+func (cfg *apiConfig) invalidateReplacedThumbnail(ctx context.Context, previous database.Video) {
+	cfg.invalidateAssetURLs(ctx, thumbnailURLs(previous))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+)
+
+// fakeCloudFront records the paths of each invalidation it's sent.
+type fakeCloudFront struct {
+	mu      sync.Mutex
+	fail    bool
+	batches [][]string
+}
+
+func newFakeCloudFrontClient(t *testing.T, fake *fakeCloudFront) *cloudfront.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if fake.fail || !strings.HasSuffix(r.URL.Path, "/distribution/EDFDVBD6EXAMPLE/invalidation") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var batch struct {
+			Paths []string `xml:"Paths>Items>Path"`
+		}
+		err := xml.NewDecoder(r.Body).Decode(&batch)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.batches = append(fake.batches, batch.Paths)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "<Invalidation><Id>I1</Id><Status>InProgress</Status></Invalidation>")
+	}))
+	t.Cleanup(server.Close)
+	return cloudfront.New(cloudfront.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		RetryMaxAttempts: 1,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+}
+
+func TestInvalidateAssetURLsBatches(t *testing.T) {
+	cfg, _, _, _ := newS3Test(t)
+	fake := &fakeCloudFront{}
+	cfg.cloudFrontClient = newFakeCloudFrontClient(t, fake)
+	cfg.cloudFrontDistributionID = "EDFDVBD6EXAMPLE"
+
+	urls := []string{}
+	for i := range 2500 {
+		urls = append(urls, cfg.assetURLForObject(cfg.s3Bucket, fmt.Sprintf("landscape/%04d.mp4", i)))
+	}
+	// Duplicates and files CloudFront doesn't serve aren't sent
+	urls = append(urls, urls[0], "http://localhost:8091/assets/local.png")
+	cfg.invalidateAssetURLs(context.Background(), urls)
+
+	sizes := []int{}
+	for _, batch := range fake.batches {
+		sizes = append(sizes, len(batch))
+	}
+	if !slices.Equal(sizes, []int{1000, 1000, 500}) {
+		t.Fatalf("sent batches of %v paths, want 1000, 1000 and 500", sizes)
+	}
+	if fake.batches[0][0] != "/landscape/0000.mp4" {
+		t.Errorf("first path = %s, want /landscape/0000.mp4", fake.batches[0][0])
+	}
+}
+
+func TestUploadThumbnailInvalidatesPrevious(t *testing.T) {
+	tests := []struct {
+		name string
+		fail bool
+	}{
+		{name: "invalidated"},
+		{name: "invalidation fails", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, token := newS3Test(t)
+			cfg.thumbnailStore = s3ThumbnailStore{cfg: cfg}
+			fake := &fakeCloudFront{fail: tt.fail}
+			cfg.cloudFrontClient = newFakeCloudFrontClient(t, fake)
+			cfg.cloudFrontDistributionID = "EDFDVBD6EXAMPLE"
+
+			previous := []string{}
+			for i := range 2 {
+				w := httptest.NewRecorder()
+				cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+				// Invalidation is best effort and never fails the upload
+				if w.Code != http.StatusOK {
+					t.Fatalf("upload %d status = %d: %s", i, w.Code, w.Body)
+				}
+				if i == 0 {
+					stored, err := cfg.db.GetVideo(video.ID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, url := range thumbnailURLs(stored) {
+						key, _ := cfg.s3KeyFromURL(url)
+						previous = append(previous, "/"+key)
+					}
+				}
+			}
+			if tt.fail {
+				if len(fake.batches) != 0 {
+					t.Errorf("failing distribution accepted %v", fake.batches)
+				}
+				return
+			}
+			if len(fake.batches) != 1 {
+				t.Fatalf("sent %d invalidations, want 1 for the replaced thumbnail", len(fake.batches))
+			}
+			got := slices.Sorted(slices.Values(fake.batches[0]))
+			slices.Sort(previous)
+			previous = slices.Compact(previous)
+			if !slices.Equal(got, previous) {
+				t.Errorf("invalidated %v, want the first upload's %v", got, previous)
+			}
+		})
+	}
+}
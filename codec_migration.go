@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const jobTypeCodecMigrate = "codec_migrate"
+
+type codecMigratePayload struct {
+	FromCodec string `json:"from_codec"`
+}
+
+// parseDeprecatedCodecs reads DEPRECATED_CODECS, a comma separated list of
+// ffprobe codec names such as "mpeg4,vp8".
+func parseDeprecatedCodecs(value string) []string {
+	codecs := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			codecs = append(codecs, name)
+		}
+	}
+	return codecs
+}
+
+func (cfg *apiConfig) isDeprecatedCodec(codec string) bool {
+	for _, deprecated := range cfg.deprecatedCodecs {
+		if deprecated == codec {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Queue a re-encode of every video stored in a deprecated codec
+ * Admin only. Jobs are spaced CODEC_MIGRATION_INTERVAL apart, continuing
+ * after any that are still pending, and videos that already have a
+ * migration queued are skipped, so triggering again resumes the run
+ */
+func (cfg *apiConfig) handlerAdminCodecMigration(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Found         int `json:"found"`
+		Queued        int `json:"queued"`
+		AlreadyQueued int `json:"already_queued"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if !cfg.isAdmin(userID) {
+		respondWithError(w, http.StatusForbidden, "Only admins can migrate codecs", nil)
+		return
+	}
+	if len(cfg.deprecatedCodecs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No codecs are deprecated", nil)
+		return
+	}
+
+	videos, err := cfg.db.GetVideosByCodec(cfg.deprecatedCodecs, cfg.codecMigrationBatch)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find affected videos", err)
+		return
+	}
+
+	runAt := time.Now()
+	latest, ok, err := cfg.db.LatestPendingJobRunAt(jobTypeCodecMigrate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check migration queue", err)
+		return
+	}
+	if ok && latest.After(runAt) {
+		runAt = latest.Add(cfg.codecMigrationInterval)
+	}
+
+	resp := response{Found: len(videos)}
+	for _, video := range videos {
+		payload := codecMigratePayload{FromCodec: *video.VideoCodec}
+		encoded, err := jobPayload(payload)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't encode job", err)
+			return
+		}
+		active, err := cfg.db.HasActiveJob(jobTypeCodecMigrate, video.ID, encoded)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check migration queue", err)
+			return
+		}
+		if active {
+			resp.AlreadyQueued++
+			continue
+		}
+		_, err = cfg.jobs.enqueueAt(jobTypeCodecMigrate, video.ID, payload, runAt)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue migration", err)
+			return
+		}
+		resp.Queued++
+		runAt = runAt.Add(cfg.codecMigrationInterval)
+	}
+
+	respondWithJSON(w, http.StatusAccepted, resp)
+}
+
+/**
+ * Re-encode a video off a deprecated codec and swap it in
+ * The new file is probed before the video row points at it, and the old
+ * object is only deleted once the row has been updated
+ */
+func (cfg *apiConfig) runCodecMigrateJob(ctx context.Context, job database.Job) error {
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.VideoURL == nil || video.VideoCodec == nil || !cfg.isDeprecatedCodec(*video.VideoCodec) {
+		// Re-uploaded or already migrated while the job waited
+		return nil
+	}
+	// The migrated file stays in the bucket of the original
+	bucket, sourceKey, ok := cfg.s3ObjectFromURL(*video.VideoURL)
+	if !ok {
+		return fmt.Errorf("couldn't find video object for %s", job.VideoID)
+	}
+
+	if !cfg.reencodeLocks.TryLock(job.VideoID) {
+		return fmt.Errorf("video %s is busy", job.VideoID)
+	}
+	defer cfg.reencodeLocks.Unlock(job.VideoID)
+	release, err := cfg.scheduler.Acquire(ctx, video.UserID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	target := reencodeCodecs[cfg.codecMigrationTarget]
+	sourcePath, err := cfg.downloadObjectFromBucket(ctx, bucket, sourceKey, "migrate-source")
+	if err != nil {
+		return fmt.Errorf("couldn't download original: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	outputPath := sourcePath + "." + cfg.codecMigrationTarget + target.extension
+	args := append([]string{"-y", "-i", sourcePath}, target.args...)
+	args = append(args, outputPath)
+	command := commandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err = command.Run()
+	defer os.Remove(outputPath)
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+
+	err = verifyMigratedVideo(ctx, sourcePath, outputPath, cfg.codecMigrationTarget)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimSuffix(sourceKey, path.Ext(sourceKey)) + "." + cfg.codecMigrationTarget + target.extension
+	err = cfg.uploadFileToBucket(ctx, bucket, key, outputPath, target.contentType)
+	if err != nil {
+		return fmt.Errorf("couldn't upload migrated video: %w", err)
+	}
+	newURL := cfg.assetURLForObject(bucket, key)
+
+	// Reload so we don't overwrite changes made while encoding
+	current, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if current.VideoURL == nil || *current.VideoURL != *video.VideoURL {
+		log.Printf("Video %s was replaced during codec migration, discarding result", job.VideoID)
+		return cfg.deleteAssetIfUnreferenced(ctx, newURL, job.VideoID)
+	}
+	codec := cfg.codecMigrationTarget
+	size := info.Size()
+	current.VideoURL = &newURL
+	current.VideoCodec = &codec
+	current.FileSize = &size
+	current.BitRate = nil
+	if current.Duration != nil && *current.Duration > 0 {
+		bitRate := int64(float64(size*8) / *current.Duration)
+		current.BitRate = &bitRate
+	}
+	current.ReplicationStatus = nil
+	replicate := cfg.replicationEnabled() && bucket == cfg.s3Bucket
+	if replicate {
+		pending := database.ReplicationPending
+		current.ReplicationStatus = &pending
+	}
+	err = cfg.db.UpdateVideo(current)
+	if err != nil {
+		cfg.rollbackAsset(ctx, newURL, job.VideoID)
+		return err
+	}
+	if replicate {
+		cfg.replicateObject(job.VideoID, key)
+	}
+
+	err = cfg.deleteAssetIfUnreferenced(ctx, *video.VideoURL)
+	if err != nil {
+		log.Printf("Couldn't delete deprecated original of video %s: %v", job.VideoID, err)
+	}
+	log.Printf("Migrated video %s from %s to %s", job.VideoID, *video.VideoCodec, codec)
+	return nil
+}
+
+func (cfg *apiConfig) codecMigrateJobFailed(job database.Job, err error) {
+	payload := codecMigratePayload{}
+	json.Unmarshal([]byte(job.Payload), &payload)
+	cfg.webhooks.dispatch(webhookEventFailed, job.VideoID, map[string]string{"stage": "codec_migration", "codec": payload.FromCodec})
+}
+
+/**
+ * Check a migrated file before it replaces the original
+ * It must be in the target codec and about as long as the source
+ */
+func verifyMigratedVideo(ctx context.Context, sourcePath, outputPath, targetCodec string) error {
+	codec, err := getVideoCodec(ctx, outputPath)
+	if err != nil {
+		return fmt.Errorf("couldn't probe migrated video: %w", err)
+	}
+	if codec != targetCodec {
+		return fmt.Errorf("migrated video is %q, expected %q", codec, targetCodec)
+	}
+	sourceDuration, err := getVideoDuration(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	outputDuration, err := getVideoDuration(ctx, outputPath)
+	if err != nil {
+		return err
+	}
+	if math.Abs(sourceDuration-outputDuration) > 1 {
+		return fmt.Errorf("migrated video is %.1fs long, original is %.1fs", outputDuration, sourceDuration)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestParseDeprecatedCodecs(t *testing.T) {
+	got := parseDeprecatedCodecs(" MPEG4, vp8,,")
+	if len(got) != 2 || got[0] != "mpeg4" || got[1] != "vp8" {
+		t.Errorf("parseDeprecatedCodecs = %v, want [mpeg4 vp8]", got)
+	}
+}
+
+func TestCodecMigration(t *testing.T) {
+	// The fake ffmpeg output probes as 12.5s of H.264
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.deprecatedCodecs = []string{"mpeg4"}
+	cfg.codecMigrationTarget = "h264"
+	cfg.codecMigrationBatch = 500
+	cfg.reencodeLocks = newVideoLocker()
+	cfg.jobs = newJobQueue(cfg.db, time.Minute, time.Hour)
+	cfg.jobs.register(jobTypeCodecMigrate, jobType{run: cfg.runCodecMigrateJob, maxAttempts: 3, failed: cfg.codecMigrateJobFailed})
+	cfg.adminUserIDs = map[uuid.UUID]bool{video.UserID: true}
+
+	// A deprecated fixture and a video that is already fine
+	const sourceKey = "landscape/legacy.mp4"
+	store.objects[sourceKey] = []byte("mpeg4 video")
+	sourceURL := cfg.assetURLForObject(cfg.s3Bucket, sourceKey)
+	legacy := "mpeg4"
+	video.VideoURL = &sourceURL
+	video.VideoCodec = &legacy
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "current", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentURL, h264 := cfg.s3CfDistribution+"/landscape/current.mp4", "h264"
+	current.VideoURL = &currentURL
+	current.VideoCodec = &h264
+	err = cfg.db.UpdateVideo(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		token             string
+		wantCode          int
+		wantFound         int
+		wantQueued        int
+		wantAlreadyQueued int
+	}{
+		{name: "not an admin", token: otherToken, wantCode: http.StatusForbidden},
+		{name: "first run", token: token, wantCode: http.StatusAccepted, wantFound: 1, wantQueued: 1},
+		// Triggering again resumes instead of queueing twice
+		{name: "second run", token: token, wantCode: http.StatusAccepted, wantFound: 1, wantAlreadyQueued: 1},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/admin/codec_migration", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		cfg.handlerAdminCodecMigration(w, req)
+		if w.Code != tt.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+		if tt.wantCode != http.StatusAccepted {
+			continue
+		}
+		var resp struct {
+			Found         int `json:"found"`
+			Queued        int `json:"queued"`
+			AlreadyQueued int `json:"already_queued"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Found != tt.wantFound || resp.Queued != tt.wantQueued || resp.AlreadyQueued != tt.wantAlreadyQueued {
+			t.Errorf("%s: got %+v, want found %d, queued %d, already queued %d", tt.name, resp, tt.wantFound, tt.wantQueued, tt.wantAlreadyQueued)
+		}
+	}
+
+	if !cfg.jobs.runNext() {
+		t.Fatal("no migration job was queued")
+	}
+	if cfg.jobs.runNext() {
+		t.Error("more than one migration job was queued")
+	}
+	migrated, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const migratedKey = "landscape/legacy.h264.mp4"
+	if want := cfg.assetURLForObject(cfg.s3Bucket, migratedKey); *migrated.VideoURL != want {
+		t.Errorf("video URL = %s, want %s", *migrated.VideoURL, want)
+	}
+	if *migrated.VideoCodec != "h264" {
+		t.Errorf("video codec = %s, want h264", *migrated.VideoCodec)
+	}
+	if _, ok := store.objects[migratedKey]; !ok {
+		t.Errorf("%s wasn't stored", migratedKey)
+	}
+	// The original only goes once the row points at the new file
+	if _, ok := store.objects[sourceKey]; ok {
+		t.Errorf("deprecated original %s wasn't removed", sourceKey)
+	}
+	unchanged, err := cfg.db.GetVideo(current.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *unchanged.VideoURL != currentURL {
+		t.Errorf("H.264 video was migrated to %s", *unchanged.VideoURL)
+	}
+}
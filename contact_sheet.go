@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// contactSheetGrid is the layout of a contact sheet, in cells.
+type contactSheetGrid struct {
+	Columns int
+	Rows    int
+}
+
+func (g contactSheetGrid) Cells() int {
+	return g.Columns * g.Rows
+}
+
+// parseContactSheetGrid parses a grid like "4x4" (columns x rows).
+func parseContactSheetGrid(value string) (contactSheetGrid, error) {
+	columns, rows, ok := strings.Cut(strings.ToLower(value), "x")
+	if !ok {
+		return contactSheetGrid{}, fmt.Errorf("grid must look like 4x4, got %q", value)
+	}
+	grid := contactSheetGrid{}
+	var err error
+	grid.Columns, err = strconv.Atoi(strings.TrimSpace(columns))
+	if err != nil || grid.Columns < 1 {
+		return contactSheetGrid{}, fmt.Errorf("invalid column count %q", columns)
+	}
+	grid.Rows, err = strconv.Atoi(strings.TrimSpace(rows))
+	if err != nil || grid.Rows < 1 {
+		return contactSheetGrid{}, fmt.Errorf("invalid row count %q", rows)
+	}
+	return grid, nil
+}
+
+/**
+ * Build a contact sheet of a video and upload it to S3
+ * Frames are sampled every contactSheetInterval, or spread evenly across
+ * the whole video when no interval is set, and tiled into one JPEG. Cells
+ * past the end of the video stay blank
+ */
+func (cfg *apiConfig) generateContactSheet(ctx context.Context, bucket string, videoID uuid.UUID, filePath string) (string, error) {
+	rate := ""
+	if cfg.contactSheetInterval > 0 {
+		rate = strconv.FormatFloat(1/cfg.contactSheetInterval.Seconds(), 'f', -1, 64)
+	} else {
+		duration, err := getVideoDuration(ctx, filePath)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get duration: %w", err)
+		}
+		if duration <= 0 {
+			return "", errDurationUnknown
+		}
+		rate = strconv.FormatFloat(float64(cfg.contactSheetGrid.Cells())/duration, 'f', -1, 64)
+	}
+
+	sheetPath := filePath + ".contact-sheet.jpg"
+	defer os.Remove(sheetPath)
+	filter := fmt.Sprintf("fps=%s,scale=%d:-2,tile=%dx%d", rate, cfg.contactSheetTileWidth, cfg.contactSheetGrid.Columns, cfg.contactSheetGrid.Rows)
+	err := runFFmpeg(ctx, "-y", "-i", filePath, "-map", "0:v:0", "-vf", filter, "-frames:v", "1", "-q:v", "3", sheetPath)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("contact-sheets/%s/%s.jpg", videoID, name)
+	err = cfg.uploadFileToBucket(ctx, bucket, key, sheetPath, "image/jpeg")
+	if err != nil {
+		return "", err
+	}
+	return cfg.assetURLForObject(bucket, key), nil
+}
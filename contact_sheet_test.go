@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContactSheetGrid(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      contactSheetGrid
+		wantCells int
+		wantErr   bool
+	}{
+		{value: "4x4", want: contactSheetGrid{Columns: 4, Rows: 4}, wantCells: 16},
+		{value: "3X2", want: contactSheetGrid{Columns: 3, Rows: 2}, wantCells: 6},
+		{value: "5 x 1", want: contactSheetGrid{Columns: 5, Rows: 1}, wantCells: 5},
+		{value: "4", wantErr: true},
+		{value: "0x4", wantErr: true},
+		{value: "4xa", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseContactSheetGrid(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseContactSheetGrid(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || got.Cells() != tt.wantCells {
+			t.Errorf("parseContactSheetGrid(%q) = %+v with %d cells, want %+v with %d", tt.value, got, got.Cells(), tt.want, tt.wantCells)
+		}
+	}
+}
+
+func TestUploadVideoContactSheet(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Records how the sheet is tiled
+	installFakeTool(t, "ffmpeg", `case "$*" in
+*.contact-sheet.jpg) echo "$*" > "$FAKE_FFMPEG_SHEET" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	tests := []struct {
+		name       string
+		grid       string
+		interval   time.Duration
+		wantFilter string
+	}{
+		// 6 cells spread across the 12.5 second video
+		{name: "whole video", grid: "3x2", wantFilter: "fps=0.48,scale=160:-2,tile=3x2"},
+		{name: "interval", grid: "4x4", interval: 2 * time.Second, wantFilter: "fps=0.5,scale=160:-2,tile=4x4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sheet := filepath.Join(t.TempDir(), "sheet")
+			t.Setenv("FAKE_FFMPEG_SHEET", sheet)
+			cfg, store, video, token := newS3Test(t)
+			grid, err := parseContactSheetGrid(tt.grid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.contactSheets = true
+			cfg.contactSheetGrid = grid
+			cfg.contactSheetInterval = tt.interval
+			cfg.contactSheetTileWidth = 160
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			args, _ := os.ReadFile(sheet)
+			if !strings.Contains(string(args), "-vf "+tt.wantFilter+" ") || !strings.Contains(string(args), "-frames:v 1") {
+				t.Errorf("sheet built with %q, want one %s frame", args, tt.wantFilter)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.ContactSheetURL == nil {
+				t.Fatal("contact sheet URL wasn't saved")
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.ContactSheetURL)
+			if !strings.HasPrefix(key, "contact-sheets/"+video.ID.String()+"/") || store.contentTypes[key] != "image/jpeg" {
+				t.Errorf("sheet stored at %s as %q, want a JPEG under contact-sheets/%s/", key, store.contentTypes[key], video.ID)
+			}
+		})
+	}
+
+	// Off by default
+	cfg, _, video, token := newS3Test(t)
+	t.Setenv("FAKE_FFMPEG_SHEET", filepath.Join(t.TempDir(), "sheet"))
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ContactSheetURL != nil {
+		t.Errorf("contact sheet %s built while disabled", *stored.ContactSheetURL)
+	}
+}
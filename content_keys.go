@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// Content addressed videos live under this prefix, e.g.
+// "videos/3f/3fa9...e1.mp4". The same bytes always map to the same key, so
+// one object can back videos of several users.
+const contentKeyPrefix = "videos/"
+
+// Content addressed objects never change, so clients can cache them forever.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+func contentKey(sum []byte, ext string) string {
+	digest := hex.EncodeToString(sum)
+	return contentKeyPrefix + digest[:2] + "/" + digest + ext
+}
+
+/**
+ * Hash the rest of file with SHA-256
+ * The file is rewound to where it was so it can still be uploaded
+ */
+func hashFile(file io.ReadSeeker) ([]byte, error) {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// storedObjectExists asks S3 directly, skipping the exists cache, since a
+// stale answer would leave a video pointing at nothing.
+func (cfg *apiConfig) storedObjectExists(ctx context.Context, bucket, key string) (bool, error) {
+	return cfg.headObject(ctx, bucket, key)
+}
+
+// assetLocker serializes storing and deleting one shared object, so an
+// upload can't find content in place that a cleanup is about to remove.
+type assetLocker struct {
+	mu    sync.Mutex
+	locks map[string]*assetLock
+}
+
+type assetLock struct {
+	sync.Mutex
+	holders int
+}
+
+func newAssetLocker() *assetLocker {
+	return &assetLocker{locks: map[string]*assetLock{}}
+}
+
+// lock blocks until url is free and returns the func unlocking it.
+func (l *assetLocker) lock(url string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[url]
+	if !ok {
+		lock = &assetLock{}
+		l.locks[url] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(l.locks, url)
+		}
+		l.mu.Unlock()
+	}
+}
+
+/**
+ * Reserve the content key of sum for a video and make sure it is stored
+ * Under the key's lock: the reservation is recorded first so a concurrent
+ * cleanup counts it, then store is called unless identical content is
+ * already there. The reservation is dropped again when that fails
+ */
+func (cfg *apiConfig) claimContentKey(ctx context.Context, bucket string, videoID uuid.UUID, sum []byte, ext string, store func(key string) error) (string, error) {
+	key := contentKey(sum, ext)
+	url := cfg.assetURLForObject(bucket, key)
+	unlock := cfg.assetLocks.lock(url)
+	defer unlock()
+
+	err := cfg.db.ReserveAssetReference(url, videoID)
+	if err != nil {
+		return "", err
+	}
+	exists, err := cfg.storedObjectExists(ctx, bucket, key)
+	if err == nil && !exists {
+		err = store(key)
+	}
+	if err != nil {
+		if err := cfg.db.ReleaseAssetReference(url, videoID); err != nil {
+			log.Printf("Couldn't release reservation of %s for video %s: %v", url, videoID, err)
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+/**
+ * Store a local file in bucket under its content key
+ * Nothing is uploaded when an identical object is already there
+ */
+func (cfg *apiConfig) uploadContentAddressed(ctx context.Context, bucket string, videoID uuid.UUID, filePath, ext, contentType string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	sum, err := hashFile(file)
+	if err != nil {
+		return "", err
+	}
+	return cfg.claimContentKey(ctx, bucket, videoID, sum, ext, func(key string) error {
+		// The store marks content keys immutable
+		return cfg.objectStoreFor(bucket).put(ctx, key, file, contentType)
+	})
+}
+
+/**
+ * Move an object stored under stagedKey to the content key of sum
+ * For uploads streamed into the bucket before their hash was known. The
+ * object is copied inside the bucket, or just dropped when identical
+ * content is already stored. Returns the content key
+ */
+func (cfg *apiConfig) moveToContentKey(ctx context.Context, bucket string, videoID uuid.UUID, stagedKey string, sum []byte, ext, contentType string) (string, error) {
+	key, err := cfg.claimContentKey(ctx, bucket, videoID, sum, ext, func(key string) error {
+		if cfg.local != nil && bucket == cfg.s3Bucket {
+			staged, err := cfg.local.open(stagedKey)
+			if err != nil {
+				return err
+			}
+			defer staged.Close()
+			return cfg.local.put(ctx, key, staged, contentType)
+		}
+		copySource := url.PathEscape(bucket) + "/" + url.PathEscape(stagedKey)
+		cacheControl := immutableCacheControl
+		input := &s3.CopyObjectInput{
+			Bucket:            &bucket,
+			Key:               &key,
+			CopySource:        &copySource,
+			ContentType:       &contentType,
+			CacheControl:      &cacheControl,
+			MetadataDirective: types.MetadataDirectiveReplace,
+		}
+		cfg.encryption.applyCopy(input)
+		input.StorageClass = storageClassFor(ctx, key, contentType, cfg.storageClass)
+		_, err := cfg.s3Client.CopyObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = cfg.objectStoreFor(bucket).delete(ctx, stagedKey)
+	if err != nil {
+		log.Printf("Couldn't delete staged upload %s: %v", stagedKey, err)
+	}
+	return key, nil
+}
+
+func (cfg *apiConfig) isContentAddressedURL(assetURL string) bool {
+	_, key, ok := cfg.s3ObjectFromURL(assetURL)
+	return ok && strings.HasPrefix(key, contentKeyPrefix)
+}
+
+/**
+ * Check whether videos other than excluding still reference a shared asset
+ * Only content addressed objects can be shared; anything else is never in use
+ */
+func (cfg *apiConfig) assetStillReferenced(assetURL string, excluding ...uuid.UUID) (bool, error) {
+	if !cfg.isContentAddressedURL(assetURL) {
+		return false, nil
+	}
+	refs, err := cfg.db.CountAssetReferences(assetURL, excluding)
+	return refs > 0, err
+}
+
+// deleteAssetIfUnreferenced is deleteAssetByURL for assets that may be shared
+// with videos other than excluding.
+func (cfg *apiConfig) deleteAssetIfUnreferenced(ctx context.Context, assetURL string, excluding ...uuid.UUID) error {
+	if cfg.isContentAddressedURL(assetURL) {
+		unlock := cfg.assetLocks.lock(assetURL)
+		defer unlock()
+	}
+	inUse, err := cfg.assetStillReferenced(assetURL, excluding...)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		log.Printf("Keeping shared asset %s, other videos still use it", assetURL)
+		return nil
+	}
+	return cfg.deleteAssetByURL(ctx, assetURL)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestUploadContentAddressed(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []string
+		wantKeys int
+	}{
+		{name: "same bytes twice", contents: []string{"video bytes", "video bytes"}, wantKeys: 1},
+		{name: "different bytes", contents: []string{"video bytes", "other bytes"}, wantKeys: 2},
+		{name: "same bytes three times", contents: []string{"a", "a", "a"}, wantKeys: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, _, _ := newS3Test(t)
+
+			keys := map[string]bool{}
+			for i, content := range tt.contents {
+				path := writeTempFile(t, "upload.mp4", content)
+				key, err := cfg.uploadContentAddressed(context.Background(), cfg.s3Bucket, uuid.New(), path, ".mp4", "video/mp4")
+				if err != nil {
+					t.Fatalf("upload %d: %v", i, err)
+				}
+				if !strings.HasPrefix(key, contentKeyPrefix) || !strings.HasSuffix(key, ".mp4") {
+					t.Errorf("upload %d got key %q, want videos/<sha256>.mp4", i, key)
+				}
+				keys[key] = true
+			}
+			if len(keys) != tt.wantKeys {
+				t.Errorf("got %d distinct keys, want %d", len(keys), tt.wantKeys)
+			}
+			if store.puts != tt.wantKeys || len(store.objects) != tt.wantKeys {
+				t.Errorf("store got %d puts holding %d objects, want %d", store.puts, len(store.objects), tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestContentKey(t *testing.T) {
+	sum := []byte{0x3f, 0xa9, 0x00, 0xe1}
+	if got, want := contentKey(sum, ".mp4"), "videos/3f/3fa900e1.mp4"; got != want {
+		t.Errorf("contentKey = %q, want %q", got, want)
+	}
+}
+
+func TestUploadVideoContentAddressed(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.contentAddressedKeys = true
+	other, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "same bytes", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake ffmpeg passes the upload through, so it is what gets hashed
+	sum := sha256.Sum256([]byte(testMP4))
+	wantKey := contentKey(sum[:], ".mp4")
+	for _, v := range []database.Video{video, other} {
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, v, token, "video/mp4", testMP4))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		stored, err := cfg.db.GetVideo(v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := cfg.assetURLForObject(cfg.s3Bucket, wantKey); stored.VideoURL == nil || *stored.VideoURL != want {
+			t.Errorf("video URL = %v, want %s", stored.VideoURL, want)
+		}
+	}
+	if store.puts != 1 || len(store.objects) != 1 {
+		t.Errorf("store got %d puts holding %d objects, want the shared object stored once", store.puts, len(store.objects))
+	}
+}
+
+func TestCountAssetReferences(t *testing.T) {
+	db := newTestDB(t)
+	shared := "https://cdn.example.com/videos/3f/3fa9.mp4"
+	newVideo := func() database.Video {
+		video, err := db.CreateVideo(database.CreateVideoParams{Title: "video", UserID: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return video
+	}
+	count := func(excluding ...uuid.UUID) int {
+		refs, err := db.CountAssetReferences(shared, excluding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refs
+	}
+
+	upload, rendition, other := newVideo(), newVideo(), newVideo()
+	upload.VideoURL = &shared
+	rendition.CodecRenditions = database.StringMap{"av1": shared}
+	// A longer URL with the shared one as its prefix isn't a reference
+	longer := shared + ".av1.mp4"
+	other.VideoURL = &longer
+	for _, video := range []database.Video{upload, rendition, other} {
+		if err := db.UpdateVideo(video); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := count(); got != 2 {
+		t.Errorf("references = %d, want the upload and the rendition", got)
+	}
+	if got := count(upload.ID); got != 1 {
+		t.Errorf("references excluding the upload = %d, want 1", got)
+	}
+
+	// A reservation counts until it is released or taken up by the row
+	if err := db.ReserveAssetReference(shared, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != 3 {
+		t.Errorf("references with a reservation = %d, want 3", got)
+	}
+	if err := db.ReleaseAssetReference(shared, other.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rendition.CodecRenditions = nil
+	if err := db.UpdateVideo(rendition); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteVideo(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != 0 {
+		t.Errorf("references after the rendition was dropped and the upload deleted = %d, want 0", got)
+	}
+}
+
+func TestSharedAssetSurvivesConcurrentCleanup(t *testing.T) {
+	cfg, store, _, _ := newS3Test(t)
+	ctx := context.Background()
+	path := writeTempFile(t, "upload.mp4", "video bytes")
+
+	for i := 0; i < 20; i++ {
+		deleted, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "deleted", UserID: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploaded, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "uploaded", UserID: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := cfg.uploadContentAddressed(ctx, cfg.s3Bucket, deleted.ID, path, ".mp4", "video/mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := cfg.assetURLForObject(cfg.s3Bucket, key)
+		deleted.VideoURL = &url
+		if err := cfg.db.UpdateVideo(deleted); err != nil {
+			t.Fatal(err)
+		}
+
+		// One video goes away while another uploads the same bytes
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := cfg.db.DeleteVideo(deleted.ID); err != nil {
+				t.Error(err)
+			}
+			if err := cfg.deleteAssetIfUnreferenced(context.Background(), url); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := cfg.uploadContentAddressed(ctx, cfg.s3Bucket, uploaded.ID, path, ".mp4", "video/mp4")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			uploaded.VideoURL = &url
+			if err := cfg.db.UpdateVideo(uploaded); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		store.mu.Lock()
+		_, stored := store.objects[key]
+		store.mu.Unlock()
+		if !stored {
+			t.Fatalf("round %d: %s was deleted while video %s uses it", i, key, uploaded.ID)
+		}
+		if err := cfg.db.DeleteVideo(uploaded.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.deleteAssetIfUnreferenced(context.Background(), url); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAssetReferencesBackfill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	db, err := database.NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := "https://cdn.example.com/videos/3f/3fa9.mp4"
+	video, err := db.CreateVideo(database.CreateVideoParams{Title: "video", UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video.CodecRenditions = database.StringMap{"av1": shared}
+	if err := db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	// A database from before the table existed
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec("DROP TABLE asset_refs")
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = database.NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := db.CountAssetReferences(shared, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs != 1 {
+		t.Errorf("references after the migration = %d, want the rendition's", refs)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const xmlContentType = "application/xml"
+
+/**
+ * Check whether the client's Accept header asks for XML
+ * Whichever of XML and JSON is listed first wins, anything else means JSON
+ */
+func acceptsXML(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case xmlContentType, "text/xml":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// respondWithContent writes payload as XML for clients that ask for it when
+// XML_RESPONSES is enabled, and as JSON otherwise.
+func (cfg *apiConfig) respondWithContent(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	if !cfg.xmlResponses || !acceptsXML(r.Header.Get("Accept")) {
+		respondWithJSON(w, code, payload)
+		return
+	}
+	respondWithXML(w, code, payload)
+}
+
+func respondWithXML(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", xmlContentType)
+	dat, err := xml.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling XML: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+	w.Write(dat)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsXML(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "*/*", want: false},
+		{accept: "application/json", want: false},
+		{accept: "application/xml", want: true},
+		{accept: "text/xml; charset=utf-8", want: true},
+		{accept: "application/json, application/xml", want: false},
+		{accept: "text/html, application/xml;q=0.9, */*;q=0.8", want: true},
+	}
+	for _, tt := range tests {
+		if got := acceptsXML(tt.accept); got != tt.want {
+			t.Errorf("acceptsXML(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// xmlVideo is the part of a <video> response the tests check.
+type xmlVideo struct {
+	XMLName         xml.Name `xml:"video"`
+	ID              string   `xml:"id"`
+	Title           string   `xml:"title"`
+	VideoURL        string   `xml:"video_url"`
+	DurationSeconds float64  `xml:"duration_seconds"`
+	AspectRatio     string   `xml:"aspect_ratio"`
+}
+
+func TestUploadVideoXMLResponse(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tests := []struct {
+		name     string
+		enabled  bool
+		accept   string
+		wantType string
+	}{
+		{name: "XML requested", enabled: true, accept: "application/xml", wantType: xmlContentType},
+		{name: "no Accept", enabled: true, wantType: "application/json"},
+		{name: "JSON preferred", enabled: true, accept: "application/json, application/xml", wantType: "application/json"},
+		{name: "XML disabled", enabled: false, accept: "application/xml", wantType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, token := newS3Test(t)
+			cfg.xmlResponses = tt.enabled
+
+			req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if tt.wantType != xmlContentType {
+				if !json.Valid(w.Body.Bytes()) {
+					t.Errorf("body isn't JSON: %s", w.Body)
+				}
+				return
+			}
+			if !strings.HasPrefix(w.Body.String(), xml.Header) {
+				t.Errorf("body doesn't start with the XML declaration: %s", w.Body)
+			}
+			var got xmlVideo
+			err := xml.Unmarshal(w.Body.Bytes(), &got)
+			if err != nil {
+				t.Fatalf("body isn't a <video>: %v: %s", err, w.Body)
+			}
+			if got.ID != video.ID.String() || got.VideoURL == "" || got.AspectRatio != "16:9" {
+				t.Errorf("XML video = %+v, want the uploaded video's id, URL and 16:9", got)
+			}
+		})
+	}
+}
+
+func TestVideoGetXMLResponse(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	cfg.xmlResponses = true
+
+	req := newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String(), video, token, "")
+	req.Header.Set("Accept", "application/xml")
+	w := httptest.NewRecorder()
+	cfg.handlerVideoGet(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var got xmlVideo
+	err := xml.Unmarshal(w.Body.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("body isn't a <video>: %v: %s", err, w.Body)
+	}
+	if got.ID != video.ID.String() || got.Title != video.Title {
+		t.Errorf("XML video = %+v, want id %s titled %q", got, video.ID, video.Title)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// sniffBytes is how much of an upload content sniffing looks at, the same
+// as http.DetectContentType.
+const sniffBytes = 512
+
+// peekUpload reads the head of an upload for sniffing and returns a reader
+// that still yields the whole upload.
+func peekUpload(r io.Reader) ([]byte, io.Reader, error) {
+	head := make([]byte, sniffBytes)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	head = head[:n]
+	return head, io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// hasFtypBox reports whether head starts with an ISO base media ftyp box.
+func hasFtypBox(head []byte) bool {
+	return len(head) >= 8 && string(head[4:8]) == "ftyp"
+}
+
+// quickTimeAtoms are top-level atoms older QuickTime files start with
+// instead of ftyp.
+var quickTimeAtoms = map[string]bool{"moov": true, "mdat": true, "wide": true, "free": true, "skip": true, "pnot": true}
+
+/**
+ * Check the head of an upload is really of the declared media type
+ * mp4 and QuickTime are recognized by their first box, everything else by
+ * http.DetectContentType
+ */
+func contentMatchesMediaType(mediaType string, head []byte) bool {
+	switch mediaType {
+	case "video/mp4":
+		return hasFtypBox(head) || http.DetectContentType(head) == "video/mp4"
+	case "video/quicktime":
+		return hasFtypBox(head) || (len(head) >= 8 && quickTimeAtoms[string(head[4:8])])
+	}
+	return http.DetectContentType(head) == mediaType
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPeekUpload(t *testing.T) {
+	for _, content := range []string{"", testMP4, strings.Repeat("a", sniffBytes*3)} {
+		head, r, err := peekUpload(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := content[:min(len(content), sniffBytes)]; string(head) != want {
+			t.Errorf("head is %d bytes, want %d", len(head), len(want))
+		}
+		// The head isn't lost to the later copy
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != content {
+			t.Errorf("reader yields %d bytes, want all %d", len(rest), len(content))
+		}
+	}
+}
+
+func TestContentMatchesMediaType(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		content   string
+		want      bool
+	}{
+		{name: "mp4", mediaType: "video/mp4", content: testMP4, want: true},
+		{name: "quicktime with ftyp", mediaType: "video/quicktime", content: testMP4, want: true},
+		{name: "old quicktime", mediaType: "video/quicktime", content: "\x00\x00\x00\x08wide\x00\x00\x00\x10mdat", want: true},
+		{name: "text labeled mp4", mediaType: "video/mp4", content: "#!/bin/sh\necho not a video\n"},
+		{name: "executable labeled mp4", mediaType: "video/mp4", content: "\x7fELF\x02\x01\x01\x00"},
+		{name: "text labeled quicktime", mediaType: "video/quicktime", content: "hello world, not a movie"},
+		{name: "too short", mediaType: "video/mp4", content: "\x00\x00"},
+		{name: "png", mediaType: "image/png", content: "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", want: true},
+		{name: "mp4 labeled png", mediaType: "image/png", content: testMP4},
+	}
+	for _, tt := range tests {
+		if got := contentMatchesMediaType(tt.mediaType, []byte(tt.content)); got != tt.want {
+			t.Errorf("%s: contentMatchesMediaType = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadVideoRejectsMislabeledContent(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", "#!/bin/sh\necho not a video\n"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", w.Code, w.Body)
+	}
+	if len(store.objects) != 0 {
+		t.Errorf("mislabeled upload stored %d files", len(store.objects))
+	}
+
+	// The sniffed head still makes it into the stored file
+	w = httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	for key, content := range store.objects {
+		if strings.HasPrefix(key, "landscape/") && string(content) != testMP4 {
+			t.Errorf("%s holds %q, want the whole upload", key, content)
+		}
+	}
+}
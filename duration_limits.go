@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	missingDurationAllow  = "allow"
+	missingDurationReject = "reject"
+)
+
+/**
+ * Check a video's probed duration against MIN_VIDEO_DURATION and
+ * MAX_VIDEO_DURATION
+ * Returns why the video is rejected, or "" when it is fine
+ */
+func (cfg *apiConfig) checkVideoDuration(ctx context.Context, filePath string) (string, error) {
+	if cfg.minVideoDuration <= 0 && cfg.maxVideoDuration <= 0 {
+		return "", nil
+	}
+	seconds, err := getVideoDuration(ctx, filePath)
+	if errors.Is(err, errDurationUnknown) {
+		if cfg.missingDurationAction == missingDurationReject {
+			return "Couldn't determine the video's duration", nil
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	duration := time.Duration(seconds * float64(time.Second))
+	if cfg.minVideoDuration > 0 && duration < cfg.minVideoDuration {
+		return fmt.Sprintf("Video is %.2fs long, the minimum is %s", seconds, cfg.minVideoDuration), nil
+	}
+	if cfg.maxVideoDuration > 0 && duration > cfg.maxVideoDuration {
+		return fmt.Sprintf("Video is %.2fs long, the maximum is %s", seconds, cfg.maxVideoDuration), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadVideoDurationWindow(t *testing.T) {
+	tests := []struct {
+		name          string
+		duration      string
+		missingAction string
+		wantCode      int
+	}{
+		{name: "in range", duration: "12.500000", wantCode: http.StatusOK},
+		{name: "too short", duration: "0.400000", wantCode: http.StatusUnprocessableEntity},
+		{name: "too long", duration: "7200.000000", wantCode: http.StatusUnprocessableEntity},
+		{name: "unknown allowed", duration: "N/A", missingAction: missingDurationAllow, wantCode: http.StatusOK},
+		{name: "unknown rejected", duration: "N/A", missingAction: missingDurationReject, wantCode: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, strings.Replace(fakeProbeOutput, `"duration": "12.500000"`, `"duration": "`+tt.duration+`"`, 1))
+			cfg, store, video, token := newS3Test(t)
+			cfg.minVideoDuration = time.Second
+			cfg.maxVideoDuration = time.Hour
+			cfg.missingDurationAction = tt.missingAction
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode == http.StatusOK {
+				return
+			}
+			// Rejected before anything reaches S3
+			if len(store.objects) != 0 {
+				t.Errorf("rejected video stored %d files", len(store.objects))
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.VideoURL != nil {
+				t.Errorf("rejected video was saved as %s", *stored.VideoURL)
+			}
+		})
+	}
+}
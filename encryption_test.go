@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseServerSideEncryption(t *testing.T) {
+	tests := []struct {
+		mode, kmsKeyID string
+		want           serverSideEncryption
+		wantErr        bool
+	}{
+		{want: serverSideEncryption{}},
+		{mode: "AES256", want: serverSideEncryption{Algorithm: types.ServerSideEncryptionAes256}},
+		{mode: "aws:kms", kmsKeyID: "alias/tubely", want: serverSideEncryption{Algorithm: types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/tubely"}},
+		// KMS without a key would quietly use the AWS managed key
+		{mode: "aws:kms", wantErr: true},
+		{mode: "AES256", kmsKeyID: "alias/tubely", wantErr: true},
+		{kmsKeyID: "alias/tubely", wantErr: true},
+		{mode: "aes256", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseServerSideEncryption(tt.mode, tt.kmsKeyID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseServerSideEncryption(%q, %q) error = %v, want error %v", tt.mode, tt.kmsKeyID, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseServerSideEncryption(%q, %q) = %+v, want %+v", tt.mode, tt.kmsKeyID, got, tt.want)
+		}
+	}
+}
+
+func TestS3ObjectStorePutEncryption(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption serverSideEncryption
+		wantSSE    string
+		wantKeyID  string
+	}{
+		{name: "bucket default"},
+		{name: "AES256", encryption: serverSideEncryption{Algorithm: types.ServerSideEncryptionAes256}, wantSSE: "AES256"},
+		{name: "KMS", encryption: serverSideEncryption{Algorithm: types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/tubely"}, wantSSE: "aws:kms", wantKeyID: "alias/tubely"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &putRecorder{}
+			server := httptest.NewServer(recorder)
+			t.Cleanup(server.Close)
+			client := newEndpointS3Client(server.URL)
+			cfg := &apiConfig{s3Client: client, s3Bucket: "tubely-test", encryption: tt.encryption}
+			cfg.store = s3ObjectStore{client: client, bucket: cfg.s3Bucket, encryption: tt.encryption}
+
+			// Thumbnails go through the same stores as videos
+			for _, bucket := range []string{cfg.s3Bucket, "tenant-bucket"} {
+				err := cfg.objectStoreFor(bucket).put(context.Background(), "thumbnails/cover.png", strings.NewReader("content"), "image/png")
+				if err != nil {
+					t.Fatalf("put to %s: %v", bucket, err)
+				}
+				if got := recorder.header.Get("X-Amz-Server-Side-Encryption"); got != tt.wantSSE {
+					t.Errorf("%s: server-side encryption = %q, want %q", bucket, got, tt.wantSSE)
+				}
+				if got := recorder.header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != tt.wantKeyID {
+					t.Errorf("%s: KMS key = %q, want %q", bucket, got, tt.wantKeyID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// eventPublisher sends encoded webhook events to a message broker.
+type eventPublisher interface {
+	Publish(ctx context.Context, eventType string, body []byte) error
+}
+
+type snsPublisher struct {
+	client   *sns.Client
+	topicARN string
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, eventType string, body []byte) error {
+	_, err := p.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: &p.topicARN,
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: &eventType},
+		},
+	})
+	return err
+}
+
+type sqsPublisher struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, eventType string, body []byte) error {
+	_, err := p.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    &p.queueURL,
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: &eventType},
+		},
+	})
+	return err
+}
+
+/**
+ * Build a publisher for an SNS topic or SQS queue ARN
+ * e.g. arn:aws:sns:us-east-1:123456789012:tubely-events or
+ * arn:aws:sqs:us-east-1:123456789012:tubely-events
+ */
+func newEventPublisher(awsCfg aws.Config, arn string) (eventPublisher, error) {
+	parts := strings.Split(arn, ":")
+	if len(parts) != 6 || parts[0] != "arn" {
+		return nil, fmt.Errorf("invalid ARN: %s", arn)
+	}
+	service, region, account, name := parts[2], parts[3], parts[4], parts[5]
+	switch service {
+	case "sns":
+		client := sns.NewFromConfig(awsCfg, func(o *sns.Options) {
+			o.Region = region
+		})
+		return &snsPublisher{client: client, topicARN: arn}, nil
+	case "sqs":
+		client := sqs.NewFromConfig(awsCfg, func(o *sqs.Options) {
+			o.Region = region
+		})
+		queueURL := fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", region, account, name)
+		return &sqsPublisher{client: client, queueURL: queueURL}, nil
+	}
+	return nil, fmt.Errorf("events can only go to sns or sqs, not %s", service)
+}
+
+/**
+ * Publish one event, retrying with backoff
+ * Runs in the background like webhook delivery; the last failure is logged
+ */
+func (d *webhookDispatcher) publish(publisher eventPublisher, eventType string, body []byte) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= d.publishAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = publisher.Publish(ctx, eventType, body)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt < d.publishAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Printf("Couldn't publish %s event after %d attempts: %v", eventType, d.publishAttempts, err)
+}
+
+// addPublisher sends future events to publisher as well, creating the
+// dispatcher when no webhooks are configured.
+func (d *webhookDispatcher) addPublisher(publisher eventPublisher, attempts int) *webhookDispatcher {
+	if d == nil {
+		d = &webhookDispatcher{client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	d.publishers = append(d.publishers, publisher)
+	d.publishAttempts = max(attempts, 1)
+	return d
+}
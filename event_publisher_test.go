@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/google/uuid"
+)
+
+// fakePublisher sends every message to published after failing the first
+// failures attempts.
+type fakePublisher struct {
+	mu        sync.Mutex
+	failures  int
+	attempts  int
+	published chan webhookEvent
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, eventType string, body []byte) error {
+	p.mu.Lock()
+	p.attempts++
+	fail := p.attempts <= p.failures
+	p.mu.Unlock()
+	if fail {
+		return errors.New("broker unavailable")
+	}
+	event := webhookEvent{}
+	err := json.Unmarshal(body, &event)
+	if err != nil || event.Type != eventType {
+		return errors.New("malformed event")
+	}
+	p.published <- event
+	return nil
+}
+
+func TestEventPublisherPerEvent(t *testing.T) {
+	publisher := &fakePublisher{published: make(chan webhookEvent, 8)}
+	// No webhook endpoints, just the publisher
+	dispatcher := (*webhookDispatcher)(nil).addPublisher(publisher, 1)
+
+	videoID := uuid.New()
+	for _, event := range webhookEventTypes {
+		dispatcher.dispatch(event, videoID, map[string]string{"stage": "test"})
+	}
+	got := []string{}
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(webhookEventTypes) {
+		select {
+		case event := <-publisher.published:
+			if event.VideoID != videoID {
+				t.Errorf("%s event is for video %s, want %s", event.Type, event.VideoID, videoID)
+			}
+			got = append(got, event.Type)
+		case <-timeout:
+			t.Fatalf("only published %v", got)
+		}
+	}
+	select {
+	case event := <-publisher.published:
+		t.Errorf("extra %s event published", event.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	want := slices.Clone(webhookEventTypes)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("published %v, want one of each of %v", got, want)
+	}
+}
+
+func TestEventPublisherRetries(t *testing.T) {
+	publisher := &fakePublisher{failures: 1, published: make(chan webhookEvent, 1)}
+	dispatcher := (&webhookDispatcher{}).addPublisher(publisher, 2)
+
+	dispatcher.dispatch(webhookEventReady, uuid.New(), nil)
+	select {
+	case event := <-publisher.published:
+		if event.Type != webhookEventReady {
+			t.Errorf("published %s, want %s", event.Type, webhookEventReady)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't published after the broker recovered")
+	}
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if publisher.attempts != 2 {
+		t.Errorf("%d attempts, want 2", publisher.attempts)
+	}
+}
+
+func TestNewEventPublisher(t *testing.T) {
+	tests := []struct {
+		arn          string
+		wantQueueURL string
+		wantErr      bool
+	}{
+		{arn: "arn:aws:sns:us-east-1:123456789012:tubely-events"},
+		{arn: "arn:aws:sqs:eu-west-1:123456789012:tubely-events", wantQueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/tubely-events"},
+		{arn: "arn:aws:s3:::tubely-events", wantErr: true},
+		{arn: "tubely-events", wantErr: true},
+	}
+	for _, tt := range tests {
+		publisher, err := newEventPublisher(aws.Config{}, tt.arn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newEventPublisher(%s) error = %v, want error %v", tt.arn, err, tt.wantErr)
+			continue
+		}
+		switch p := publisher.(type) {
+		case *snsPublisher:
+			if p.topicARN != tt.arn {
+				t.Errorf("%s: topic ARN = %s", tt.arn, p.topicARN)
+			}
+		case *sqsPublisher:
+			if p.queueURL != tt.wantQueueURL {
+				t.Errorf("%s: queue URL = %s, want %s", tt.arn, p.queueURL, tt.wantQueueURL)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// filenamePolicy decides which client-supplied upload filenames are accepted.
+type filenamePolicy struct {
+	Enabled bool
+	// Longest accepted name, in characters
+	MaxLength int
+	// Allow names like "video.mp4.exe" that hide their real type
+	AllowDoubleExtension bool
+}
+
+// Extensions that are suspicious anywhere before the final one
+var disguisingExtensions = map[string]bool{
+	".mp4": true, ".mov": true, ".m4v": true, ".webm": true, ".mkv": true, ".avi": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".wav": true,
+	".pdf": true, ".doc": true, ".docx": true, ".txt": true,
+	".exe": true, ".scr": true, ".bat": true, ".cmd": true, ".com": true, ".msi": true,
+	".js": true, ".vbs": true, ".ps1": true, ".sh": true, ".jar": true, ".apk": true,
+}
+
+// isBidiControl reports whether char reorders displayed text, which can make
+// "video\u202e4pm.exe" display as "videoexe.mp4".
+func isBidiControl(char rune) bool {
+	switch {
+	case char >= '\u202a' && char <= '\u202e':
+		return true
+	case char >= '\u2066' && char <= '\u2069':
+		return true
+	case char == '\u200e', char == '\u200f', char == '\u061c':
+		return true
+	}
+	return false
+}
+
+/**
+ * Check an uploaded filename against the policy
+ * Returns an error describing the first violation found
+ */
+func (p filenamePolicy) check(name string) error {
+	if !p.Enabled || name == "" {
+		return nil
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("filename is not valid UTF-8")
+	}
+	if p.MaxLength > 0 && utf8.RuneCountInString(name) > p.MaxLength {
+		return fmt.Errorf("filename is longer than %d characters", p.MaxLength)
+	}
+	for _, char := range name {
+		if unicode.IsControl(char) {
+			return fmt.Errorf("filename contains control characters")
+		}
+		if isBidiControl(char) {
+			return fmt.Errorf("filename contains text direction overrides")
+		}
+	}
+	if !p.AllowDoubleExtension {
+		base := strings.TrimSuffix(name, path.Ext(name))
+		if disguisingExtensions[strings.ToLower(path.Ext(base))] {
+			return fmt.Errorf("filename has a double extension")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestFilenamePolicyCheck(t *testing.T) {
+	policy := filenamePolicy{Enabled: true, MaxLength: 20}
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{name: "plain", filename: "holiday.mp4"},
+		{name: "dotted name", filename: "holiday.2024.mp4"},
+		{name: "no name", filename: ""},
+		{name: "double extension", filename: "video.mp4.exe", wantErr: true},
+		{name: "double extension in caps", filename: "invoice.PDF.mp4", wantErr: true},
+		{name: "null byte", filename: "video.mp4\x00.exe", wantErr: true},
+		{name: "newline", filename: "video\n.mp4", wantErr: true},
+		{name: "RTL override", filename: "video‮4pm.exe", wantErr: true},
+		{name: "isolate", filename: "clip⁧.mp4", wantErr: true},
+		{name: "too long", filename: strings.Repeat("a", 17) + ".mp4", wantErr: true},
+		{name: "invalid UTF-8", filename: "vid\xffeo.mp4", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := policy.check(tt.filename)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: check(%q) = %v, want error %v", tt.name, tt.filename, err, tt.wantErr)
+		}
+	}
+
+	// Each rule can be relaxed
+	relaxed := filenamePolicy{Enabled: true, AllowDoubleExtension: true}
+	for _, filename := range []string{"video.mp4.exe", strings.Repeat("a", 300) + ".mp4"} {
+		if err := relaxed.check(filename); err != nil {
+			t.Errorf("relaxed check(%q) = %v, want it accepted", filename, err)
+		}
+	}
+	if err := (filenamePolicy{}).check("video‮4pm.exe"); err != nil {
+		t.Errorf("disabled policy rejected a filename: %v", err)
+	}
+}
+
+func TestUploadVideoRejectsSuspiciousFilename(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tests := []struct {
+		name string
+		// The filename parameter of the part's Content-Disposition
+		disposition string
+		wantCode    int
+	}{
+		{name: "plain", disposition: `filename="holiday.mp4"`, wantCode: http.StatusOK},
+		{name: "double extension", disposition: `filename="holiday.mp4.exe"`, wantCode: http.StatusBadRequest},
+		{name: "RTL override", disposition: `filename="holiday‮4pm.exe"`, wantCode: http.StatusBadRequest},
+		// Raw control characters don't parse, but encoded ones do
+		{name: "encoded null byte", disposition: `filename*=UTF-8''holiday%00.mp4`, wantCode: http.StatusBadRequest},
+		{name: "encoded RTL override", disposition: `filename*=UTF-8''holiday%E2%80%AE4pm.exe`, wantCode: http.StatusBadRequest},
+		{name: "too long", disposition: `filename="` + strings.Repeat("a", 300) + `.mp4"`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		cfg, store, video, token := newS3Test(t)
+		cfg.filenamePolicy = filenamePolicy{Enabled: true, MaxLength: 255}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "video/mp4")
+		body, formType := videoUploadBody(t, header, testMP4)
+		// videoUploadBody names the file upload.mp4
+		body = strings.Replace(body, `filename="upload.mp4"`, tt.disposition, 1)
+		req := newVideoRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), video, token, body)
+		req.Header.Set("Content-Type", formType)
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+			continue
+		}
+		if tt.wantCode == http.StatusOK {
+			continue
+		}
+		if !strings.Contains(w.Body.String(), "Rejected filename") {
+			t.Errorf("%s: rejected for another reason: %s", tt.name, w.Body)
+		}
+		if len(store.objects) != 0 {
+			t.Errorf("%s: rejected upload stored %d files", tt.name, len(store.objects))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// gcsObjectStore keeps objects in one Cloud Storage bucket, writing,
+// deleting and signing through the Cloud Storage client.
+type gcsObjectStore struct {
+	client  *storage.Client
+	bucket  string
+	metrics *uploadMetrics
+	// googleAccessID and privateKey sign URLs; when empty the client signs
+	// with the service account it was authenticated as
+	googleAccessID string
+	privateKey     []byte
+}
+
+/**
+ * Open the Cloud Storage bucket
+ * Credentials come from Application Default Credentials; with
+ * STORAGE_EMULATOR_HOST set the client talks to that emulator instead
+ */
+func newGCSObjectStore(ctx context.Context, bucket string, metrics *uploadMetrics) (*gcsObjectStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObjectStore{client: client, bucket: bucket, metrics: metrics}, nil
+}
+
+func (s *gcsObjectStore) put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := s.client.Bucket(s.bucket).Object(key).NewWriter(ctx)
+	writer.ContentType = contentType
+	if strings.HasPrefix(key, contentKeyPrefix) {
+		writer.CacheControl = immutableCacheControl
+	}
+	n, err := io.Copy(writer, body)
+	if err != nil {
+		// Cancelling before Close abandons the upload
+		cancel()
+		writer.Close()
+		return err
+	}
+	err = writer.Close()
+	if err == nil {
+		s.metrics.addPutBytes(n)
+	}
+	return err
+}
+
+func (s *gcsObjectStore) delete(ctx context.Context, key string) error {
+	err := s.client.Bucket(s.bucket).Object(key).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// presign returns a V4 signed GET URL for key, the Cloud Storage
+// counterpart of a presigned S3 GetObject.
+func (s *gcsObjectStore) presign(key string, expireTime time.Duration, overrides presignOverrides) (string, error) {
+	query := url.Values{}
+	if overrides.ContentDisposition != "" {
+		query.Set("response-content-disposition", overrides.ContentDisposition)
+	}
+	if overrides.ContentType != "" {
+		query.Set("response-content-type", overrides.ContentType)
+	}
+	return s.client.Bucket(s.bucket).SignedURL(key, &storage.SignedURLOptions{
+		Scheme:          storage.SigningSchemeV4,
+		Method:          http.MethodGet,
+		Expires:         time.Now().Add(expireTime),
+		QueryParameters: query,
+		GoogleAccessID:  s.googleAccessID,
+		PrivateKey:      s.privateKey,
+	})
+}
+
+/**
+ * Get a presigned GET URL for an object
+ * On gcs the default bucket is signed by the Cloud Storage client; tenant
+ * buckets and S3 go through the S3 presigner
+ */
+func (cfg *apiConfig) signGetURL(ctx context.Context, bucket, key string, expireTime time.Duration, overrides presignOverrides) (string, error) {
+	if cfg.gcs != nil && bucket == cfg.gcs.bucket {
+		return cfg.gcs.presign(key, expireTime, overrides)
+	}
+	return generatePresignedURL(ctx, cfg.s3Client, bucket, key, expireTime, overrides)
+}
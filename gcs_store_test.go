@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gcsEmulator is a minimal Cloud Storage JSON API: multipart uploads and
+// deletes, which is all gcsObjectStore uses.
+type gcsEmulator struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]gcsEmulatorObject
+}
+
+type gcsEmulatorObject struct {
+	data         []byte
+	contentType  string
+	cacheControl string
+}
+
+func (e *gcsEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	uploadPath := "/upload/storage/v1/b/" + e.bucket + "/o"
+	objectPrefix := "/storage/v1/b/" + e.bucket + "/o/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == uploadPath:
+		e.upload(w, r)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, objectPrefix):
+		name := strings.TrimPrefix(r.URL.Path, objectPrefix)
+		if _, ok := e.objects[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": 404, "message": "No such object"}})
+			return
+		}
+		delete(e.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// upload stores a multipart/related upload: JSON metadata, then the media.
+func (e *gcsEmulator) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	var metadata struct {
+		Name         string `json:"name"`
+		ContentType  string `json:"contentType"`
+		CacheControl string `json:"cacheControl"`
+	}
+	part, err := reader.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&metadata)
+	}
+	if err == nil {
+		part, err = reader.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(part)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.objects[metadata.Name] = gcsEmulatorObject{data: data, contentType: metadata.ContentType, cacheControl: metadata.CacheControl}
+	json.NewEncoder(w).Encode(map[string]any{
+		"bucket":       e.bucket,
+		"name":         metadata.Name,
+		"contentType":  metadata.ContentType,
+		"cacheControl": metadata.CacheControl,
+		"size":         strconv.Itoa(len(data)),
+	})
+}
+
+func newEmulatedGCSStore(t *testing.T) (*gcsObjectStore, *gcsEmulator) {
+	emulator := &gcsEmulator{bucket: "tubely-test", objects: map[string]gcsEmulatorObject{}}
+	server := httptest.NewServer(emulator)
+	t.Cleanup(server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	store, err := newGCSObjectStore(context.Background(), emulator.bucket, newUploadMetrics())
+	if err != nil {
+		t.Fatalf("newGCSObjectStore: %v", err)
+	}
+	t.Cleanup(func() { store.client.Close() })
+	return store, emulator
+}
+
+func TestGCSObjectStorePutAndDelete(t *testing.T) {
+	store, emulator := newEmulatedGCSStore(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		key              string
+		wantCacheControl string
+	}{
+		{key: "landscape/abc.mp4"},
+		{key: contentKey([]byte{0x3f, 0xa9}, ".mp4"), wantCacheControl: immutableCacheControl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			err := store.put(ctx, tt.key, strings.NewReader("video bytes"), "video/mp4")
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			object, ok := emulator.objects[tt.key]
+			if !ok {
+				t.Fatalf("%s wasn't stored", tt.key)
+			}
+			if string(object.data) != "video bytes" || object.contentType != "video/mp4" {
+				t.Errorf("stored %q as %q, want %q as video/mp4", object.data, object.contentType, "video bytes")
+			}
+			if object.cacheControl != tt.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", object.cacheControl, tt.wantCacheControl)
+			}
+
+			err = store.delete(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, ok := emulator.objects[tt.key]; ok {
+				t.Errorf("%s is still stored after delete", tt.key)
+			}
+			// Deleting what is already gone is not an error, like S3
+			err = store.delete(ctx, tt.key)
+			if err != nil {
+				t.Errorf("second delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestGCSObjectStorePresign(t *testing.T) {
+	store, _ := newEmulatedGCSStore(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.googleAccessID = "tubely@example.iam.gserviceaccount.com"
+	store.privateKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cfg := &apiConfig{s3Bucket: store.bucket, gcs: store}
+
+	signed, err := cfg.signGetURL(context.Background(), store.bucket, "landscape/abc.mp4", 15*time.Minute, presignOverrides{ContentDisposition: `attachment; filename="abc.mp4"`})
+	if err != nil {
+		t.Fatalf("signGetURL: %v", err)
+	}
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(parsed.Path, "/tubely-test/landscape/abc.mp4") {
+		t.Errorf("signed URL path = %q, want it to end in the bucket and key", parsed.Path)
+	}
+	query := parsed.Query()
+	// Expires is counted from signing, a moment after the call
+	expires, _ := strconv.Atoi(query.Get("X-Goog-Expires"))
+	if query.Get("X-Goog-Signature") == "" || expires < 890 || expires > 900 {
+		t.Errorf("signed URL %s isn't a V4 signature valid for 15 minutes", signed)
+	}
+	if got := query.Get("response-content-disposition"); got != `attachment; filename="abc.mp4"` {
+		t.Errorf("response-content-disposition = %q", got)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var audioTrackExtensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"audio/mp4":  ".m4a",
+	"audio/aac":  ".aac",
+	"audio/ogg":  ".ogg",
+	"audio/webm": ".webm",
+}
+
+func (cfg *apiConfig) handlerUploadAudioTrack(w http.ResponseWriter, r *http.Request) {
+	const maxUploadSize = 200 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+
+	language := strings.TrimSpace(r.FormValue("language"))
+	if !isValidLanguageTag(language) {
+		respondWithError(w, http.StatusBadRequest, "Invalid language tag", nil)
+		return
+	}
+
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+	err = cfg.filenamePolicy.check(header.Filename)
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemRejectedFilename, "Rejected filename: "+err.Error(), err)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type", err)
+		return
+	}
+	extension, ok := audioTrackExtensions[mediaType]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
+		return
+	}
+
+	tmpFile, err := os.CreateTemp("", "audio-track"+extension)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
+		return
+	}
+
+	// Make sure the file really is audio
+	audio, err := getAudioInfo(r.Context(), tmpFile.Name())
+	if err != nil || !audio.HasAudio {
+		respondWithError(w, http.StatusBadRequest, "File is not a valid audio track", err)
+		return
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		return
+	}
+	bucket, err := cfg.bucketForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
+		return
+	}
+	key := fmt.Sprintf("audio/%s/%s-%s%s", videoID, language, name, extension)
+	err = cfg.uploadFileToBucket(r.Context(), bucket, key, tmpFile.Name(), mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+		return
+	}
+
+	// One track per language, a new upload replaces the old one
+	track := database.AudioTrack{
+		Language:    language,
+		URL:         cfg.assetURLForObject(bucket, key),
+		ContentType: mediaType,
+	}
+	replaced := []string{}
+	tracks := database.AudioTracks{}
+	for _, existing := range video.AudioTracks {
+		if strings.EqualFold(existing.Language, language) {
+			replaced = append(replaced, existing.URL)
+			continue
+		}
+		tracks = append(tracks, existing)
+	}
+	video.AudioTracks = append(tracks, track)
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	for _, url := range replaced {
+		err := cfg.deleteAssetByURL(r.Context(), url)
+		if err != nil {
+			log.Printf("Couldn't delete replaced audio track %s: %v", url, err)
+		}
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
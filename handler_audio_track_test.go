@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func audioTrackUploadRequest(t *testing.T, video database.Video, token, language string) *http.Request {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("language", language)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="audio"; filename="dub.m4a"`)
+	header.Set("Content-Type", "audio/mp4")
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("audio " + language))
+	form.Close()
+	req := newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/audio-track", video, token, body.String())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestUploadAudioTrack(t *testing.T) {
+	installFakeProcessingTools(t, `{"streams": [{"codec_type": "audio"}], "format": {"duration": "12.5"}}`)
+	cfg, store, video, token := newS3Test(t)
+	otherToken, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		language string
+		wantCode int
+	}{
+		{name: "english", token: token, language: "en", wantCode: http.StatusOK},
+		{name: "spanish", token: token, language: "es-MX", wantCode: http.StatusOK},
+		{name: "bad language tag", token: token, language: "not a language", wantCode: http.StatusBadRequest},
+		{name: "not the owner", token: otherToken, language: "fr", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerUploadAudioTrack(w, audioTrackUploadRequest(t, video, tt.token, tt.language))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.AudioTracks) != 2 || len(store.objects) != 2 {
+		t.Fatalf("stored %d tracks and %d files, want 2 of each", len(stored.AudioTracks), len(store.objects))
+	}
+	for i, language := range []string{"en", "es-MX"} {
+		track := stored.AudioTracks[i]
+		if track.Language != language || track.ContentType != "audio/mp4" {
+			t.Errorf("track %d = %+v, want %s audio/mp4", i, track, language)
+		}
+		key, ok := cfg.s3KeyFromURL(track.URL)
+		if !ok || !strings.HasPrefix(key, "audio/"+video.ID.String()+"/"+language+"-") {
+			t.Errorf("track %d URL %s isn't under the video's audio prefix", i, track.URL)
+		}
+		if string(store.objects[key]) != "audio "+language {
+			t.Errorf("track %d stored %q, want the uploaded file", i, store.objects[key])
+		}
+	}
+
+	// A second upload for a language replaces its track
+	w := httptest.NewRecorder()
+	cfg.handlerUploadAudioTrack(w, audioTrackUploadRequest(t, video, token, "EN"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("replacement status = %d: %s", w.Code, w.Body)
+	}
+	stored, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.AudioTracks) != 2 || len(store.objects) != 2 {
+		t.Errorf("after replacing en: %d tracks and %d files, want 2 of each", len(stored.AudioTracks), len(store.objects))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	bulkDeleteDeleted   = "deleted"
+	bulkDeleteNotFound  = "not-found"
+	bulkDeleteForbidden = "forbidden"
+	bulkDeleteFailed    = "failed"
+)
+
+type bulkDeleteResult struct {
+	ID     uuid.UUID `json:"id"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+/**
+ * Delete many of the caller's videos at once
+ * Each ID gets its own result; one failing video doesn't stop the rest
+ */
+func (cfg *apiConfig) handlerVideosBulkDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IDs []uuid.UUID `json:"ids"`
+	}
+	type response struct {
+		Results []bulkDeleteResult `json:"results"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.IDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No video IDs given", nil)
+		return
+	}
+	if len(params.IDs) > cfg.bulkDeleteMaxIDs {
+		respondWithErrorType(w, http.StatusBadRequest, problemTooManyVideoIDs, fmt.Sprintf("At most %d video IDs can be deleted at once", cfg.bulkDeleteMaxIDs), nil)
+		return
+	}
+
+	results := make([]bulkDeleteResult, len(params.IDs))
+	owned := map[uuid.UUID]database.Video{}
+	for i, id := range params.IDs {
+		results[i] = bulkDeleteResult{ID: id}
+		if _, ok := owned[id]; ok {
+			continue
+		}
+		video, err := cfg.db.GetVideo(id)
+		switch {
+		case err != nil:
+			results[i].Status, results[i].Error = bulkDeleteFailed, err.Error()
+		case video.ID == uuid.Nil:
+			results[i].Status = bulkDeleteNotFound
+		case video.UserID != userID:
+			results[i].Status = bulkDeleteForbidden
+		default:
+			owned[id] = video
+		}
+	}
+
+	failures := cfg.deleteVideosAssets(r.Context(), owned)
+	for id := range owned {
+		if failures[id] != nil {
+			continue
+		}
+		err := cfg.db.DeleteVideo(id)
+		if err != nil {
+			failures[id] = err
+			continue
+		}
+		cfg.webhooks.dispatch(webhookEventDeleted, id, nil)
+	}
+	for i := range results {
+		if _, ok := owned[results[i].ID]; !ok {
+			continue
+		}
+		results[i].Status = bulkDeleteDeleted
+		if err := failures[results[i].ID]; err != nil {
+			results[i].Status, results[i].Error = bulkDeleteFailed, err.Error()
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Results: results})
+}
+
+/**
+ * Delete the stored assets of several videos with batched S3 calls
+ * Returns the first failure for each video that couldn't be fully cleaned up
+ */
+func (cfg *apiConfig) deleteVideosAssets(ctx context.Context, videos map[uuid.UUID]database.Video) map[uuid.UUID]error {
+	failures := map[uuid.UUID]error{}
+	owners := map[string]uuid.UUID{}
+	keys := []string{}
+	replicaKeys := []string{}
+	replicaSeen := map[string]bool{}
+	deleting := make([]uuid.UUID, 0, len(videos))
+	for id := range videos {
+		deleting = append(deleting, id)
+	}
+	for _, video := range videos {
+		for _, url := range videoAssetURLs(video) {
+			// Shared objects stay while videos outside this batch use them,
+			// checked and deleted one by one under their lock
+			if cfg.isContentAddressedURL(url) {
+				err := cfg.deleteAssetIfUnreferenced(ctx, url, deleting...)
+				if err != nil && failures[video.ID] == nil {
+					failures[video.ID] = err
+				}
+				continue
+			}
+			key, ok := cfg.s3KeyFromURL(url)
+			if !ok || isSegmentedKey(key) {
+				// Local assets and segmented outputs are removed one by one
+				err := cfg.deleteAssetByURL(ctx, url)
+				if err != nil && failures[video.ID] == nil {
+					failures[video.ID] = err
+				}
+				continue
+			}
+			if _, seen := owners[key]; seen {
+				continue
+			}
+			owners[key] = video.ID
+			keys = append(keys, key)
+		}
+		if cfg.replicationEnabled() && video.VideoURL != nil {
+			inUse, err := cfg.assetStillReferenced(*video.VideoURL, deleting...)
+			if key, ok := cfg.s3KeyFromURL(*video.VideoURL); ok && err == nil && !inUse && !replicaSeen[key] {
+				replicaSeen[key] = true
+				replicaKeys = append(replicaKeys, key)
+			}
+		}
+	}
+
+	for key, err := range cfg.deleteObjects(ctx, cfg.s3Bucket, keys) {
+		if failures[owners[key]] == nil {
+			failures[owners[key]] = fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if len(replicaKeys) > 0 {
+		// The primary copies are gone, a stale replica is only logged
+		for key, err := range deleteObjectsBatched(ctx, cfg.replicaClient, cfg.replicaBucket, replicaKeys) {
+			log.Printf("Couldn't delete replica %s: %v", key, err)
+		}
+	}
+	return failures
+}
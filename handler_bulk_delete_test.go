@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestVideosBulkDelete(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+	cfg.bulkDeleteMaxIDs = 10
+	other, err := cfg.db.CreateUser(database.CreateUserParams{Email: "other@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "second", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unowned, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "not mine", UserID: other.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []database.Video{video, second, unowned} {
+		key := fmt.Sprintf("landscape/%d.mp4", i)
+		store.objects[key] = []byte("video")
+		videoURL := cfg.s3CfDistribution + "/" + key
+		v.VideoURL = &videoURL
+		err := cfg.db.UpdateVideo(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := uuid.New()
+
+	body, err := json.Marshal(map[string][]uuid.UUID{"ids": {video.ID, unowned.ID, missing, second.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerVideosBulkDelete(w, newVideoRequest(http.MethodPost, "/api/videos/bulk-delete", video, token, string(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Results []bulkDeleteResult `json:"results"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []bulkDeleteResult{
+		{ID: video.ID, Status: bulkDeleteDeleted},
+		{ID: unowned.ID, Status: bulkDeleteForbidden},
+		{ID: missing, Status: bulkDeleteNotFound},
+		{ID: second.ID, Status: bulkDeleteDeleted},
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(resp.Results), len(want))
+	}
+	for i, result := range resp.Results {
+		if result != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, result, want[i])
+		}
+	}
+
+	// Both owned videos went in one batch
+	if store.batchDeletes != 1 {
+		t.Errorf("%d DeleteObjects calls, want 1", store.batchDeletes)
+	}
+	for i, wantKept := range []bool{false, false, true} {
+		if _, ok := store.objects[fmt.Sprintf("landscape/%d.mp4", i)]; ok != wantKept {
+			t.Errorf("landscape/%d.mp4 kept = %v, want %v", i, ok, wantKept)
+		}
+	}
+	for _, id := range []uuid.UUID{video.ID, second.ID} {
+		if deleted, err := cfg.db.GetVideo(id); err == nil && deleted.ID != uuid.Nil {
+			t.Errorf("video %s is still stored", id)
+		}
+	}
+	if kept, err := cfg.db.GetVideo(unowned.ID); err != nil || kept.ID != unowned.ID {
+		t.Errorf("another user's video was deleted: %v", err)
+	}
+}
+
+func TestVideosBulkDeleteLimits(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	cfg.bulkDeleteMaxIDs = 2
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "no IDs", body: `{"ids": []}`},
+		{name: "over the cap", body: fmt.Sprintf(`{"ids": ["%s", "%s", "%s"]}`, uuid.New(), uuid.New(), uuid.New())},
+		{name: "not JSON", body: "ids"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideosBulkDelete(w, newVideoRequest(http.MethodPost, "/api/videos/bulk-delete", video, token, tt.body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400: %s", tt.name, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Thumbnail types a browser may upload straight to S3, by extension
+var directThumbnailTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+/**
+ * Hand out a presigned POST form for uploading a thumbnail straight to S3
+ * The key is picked here and the policy pins the content type and size
+ */
+func (cfg *apiConfig) handlerThumbnailUploadURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		URL       string            `json:"url"`
+		Fields    map[string]string `json:"fields"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	extension, ok := directThumbnailTypes[params.ContentType]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
+		return
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return
+	}
+	key := fmt.Sprintf("thumbnails/%s/%s.%s", video.ID, name, extension)
+	bucket, ok := cfg.directUploadBucket(w, r, video)
+	if !ok {
+		return
+	}
+
+	presignClient := s3.NewPresignClient(cfg.s3Client)
+	post, err := presignClient.PresignPostObject(r.Context(), &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}, func(options *s3.PresignPostOptions) {
+		options.Expires = directUploadExpiry
+		options.Conditions = append(options.Conditions,
+			map[string]string{"Content-Type": params.ContentType},
+			[]any{"content-length-range", cfg.minThumbnailBytes, cfg.directThumbnailMaxBytes},
+		)
+		cfg.encryption.applyPost(options)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+	post.Values["Content-Type"] = params.ContentType
+	for name, value := range cfg.encryption.headers() {
+		post.Values[name] = value
+	}
+
+	video.PendingThumbnailKey = &key
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		URL:       post.URL,
+		Fields:    post.Values,
+		Key:       key,
+		ExpiresAt: time.Now().UTC().Add(directUploadExpiry),
+	})
+}
+
+/**
+ * Finish a direct thumbnail upload
+ * The stored object is checked the same way a multipart upload is before it
+ * becomes the video's thumbnail
+ */
+func (cfg *apiConfig) handlerThumbnailUploadComplete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.PendingThumbnailKey == nil {
+		respondWithError(w, http.StatusBadRequest, "No thumbnail upload was started for this video", nil)
+		return
+	}
+	key := *video.PendingThumbnailKey
+	bucket, ok := cfg.directUploadBucket(w, r, video)
+	if !ok {
+		return
+	}
+
+	output, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if isS3NotFound(err) {
+		respondWithError(w, http.StatusConflict, "The thumbnail hasn't been uploaded yet", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch uploaded thumbnail", err)
+		return
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(output.Body, cfg.directThumbnailMaxBytes+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't read uploaded thumbnail", err)
+		return
+	}
+
+	// The policy pinned these, but don't trust what was stored blindly
+	reject, rejectType := "", ""
+	mediaType := ""
+	if output.ContentType != nil {
+		mediaType = *output.ContentType
+	}
+	switch {
+	case int64(len(data)) > cfg.directThumbnailMaxBytes:
+		reject = "Thumbnail is too large"
+	case int64(len(data)) < cfg.minThumbnailBytes:
+		reject = "Empty or truncated file"
+	case directThumbnailTypes[mediaType] == "" || !strings.HasSuffix(key, "."+directThumbnailTypes[mediaType]):
+		reject = "Invalid media type"
+	case http.DetectContentType(data) != mediaType:
+		reject = "Thumbnail content doesn't match its media type"
+	default:
+		err := checkThumbnailDimensions(bytes.NewReader(data), cfg.thumbnailMaxDimension)
+		switch {
+		case errors.Is(err, errThumbnailTooLarge):
+			reject, rejectType = err.Error(), problemThumbnailTooLarge
+		case err != nil:
+			reject = "Couldn't read thumbnail dimensions"
+		}
+	}
+	if reject == "" {
+		// Hashed as uploaded, like a multipart upload
+		sum := sha256.Sum256(data)
+		err = cfg.checkBannedHash(hex.EncodeToString(sum[:]), video)
+		if err != nil {
+			var rejection *uploadRejection
+			if errors.As(err, &rejection) {
+				cfg.discardPendingThumbnail(r.Context(), video, bucket, key)
+			}
+			respondWithUploadError(w, r.Context(), "Couldn't check thumbnail hash", err)
+			return
+		}
+	}
+	if reject == "" && cfg.stripThumbnailMetadata {
+		stripped, err := stripImageMetadata(data, mediaType, cfg.thumbnailJPEGQuality)
+		switch {
+		case err != nil:
+			reject = "Couldn't decode thumbnail"
+		case !bytes.Equal(stripped, data):
+			// Overwrite what the browser uploaded so the metadata isn't served
+			err = cfg.objectStoreFor(bucket).put(r.Context(), key, bytes.NewReader(stripped), mediaType)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't store cleaned thumbnail", err)
+				return
+			}
+			data = stripped
+		}
+	}
+	mismatch := ""
+	if reject == "" && cfg.thumbnailAspectCheck != thumbnailAspectCheckOff && video.AspectRatio != nil {
+		mismatch, err = thumbnailAspectMismatch(bytes.NewReader(data), *video.AspectRatio, cfg.thumbnailAspectTolerance)
+		if err != nil {
+			reject = "Couldn't read thumbnail dimensions"
+		} else if mismatch != "" && cfg.thumbnailAspectCheck == thumbnailAspectCheckReject {
+			reject, rejectType = mismatch, problemThumbnailAspectMismatch
+		}
+	}
+	if reject != "" {
+		cfg.discardPendingThumbnail(r.Context(), video, bucket, key)
+		respondWithErrorType(w, http.StatusUnprocessableEntity, rejectType, reject, nil)
+		return
+	}
+
+	thumbnailURL := cfg.assetURLForObject(bucket, key)
+	previous := video
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailVariants = database.ThumbnailVariants{
+		newThumbnailVariant(data, mediaType, thumbnailURL),
+	}
+	video.PendingThumbnailKey = nil
+	cfg.setVideoLQIP(&video, data)
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.cleanupReplacedThumbnail(r.Context(), video, previous)
+	cfg.invalidateReplacedThumbnail(r.Context(), previous)
+
+	type response struct {
+		ThumbnailURL string                     `json:"thumbnail_url"`
+		Variants     database.ThumbnailVariants `json:"variants,omitempty"`
+		Warnings     []string                   `json:"warnings,omitempty"`
+	}
+	resp := response{
+		ThumbnailURL: thumbnailURL,
+		Variants:     video.ThumbnailVariants,
+	}
+	if mismatch != "" {
+		resp.Warnings = []string{mismatch}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// discardPendingThumbnail removes a rejected direct upload so the key can't
+// be completed later.
+func (cfg *apiConfig) discardPendingThumbnail(ctx context.Context, video database.Video, bucket, key string) {
+	err := cfg.objectStoreFor(bucket).delete(ctx, key)
+	if err != nil {
+		log.Printf("Couldn't delete rejected thumbnail %s: %v", key, err)
+	}
+	video.PendingThumbnailKey = nil
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		log.Printf("Couldn't clear pending thumbnail of video %s: %v", video.ID, err)
+	}
+}
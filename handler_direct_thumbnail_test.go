@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func TestThumbnailUploadURLPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		otherUser     bool
+		wantStatus    int
+		wantType      string
+		wantExtension string
+	}{
+		{name: "jpeg", body: `{"content_type": "image/jpeg"}`, wantStatus: http.StatusOK, wantType: "image/jpeg", wantExtension: ".jpeg"},
+		{name: "png", body: `{"content_type": "image/png"}`, wantStatus: http.StatusOK, wantType: "image/png", wantExtension: ".png"},
+		{name: "unsupported type", body: `{"content_type": "image/gif"}`, wantStatus: http.StatusBadRequest},
+		{name: "no type", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "not the owner", body: `{"content_type": "image/png"}`, otherUser: true, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, token := newS3Test(t)
+			cfg.minThumbnailBytes = 16
+			cfg.directThumbnailMaxBytes = 2 << 20
+			if tt.otherUser {
+				var err error
+				token, err = auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerThumbnailUploadURL(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/thumbnail-url", video, token, tt.body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if stored.PendingThumbnailKey != nil {
+					t.Errorf("refused request left pending key %s", *stored.PendingThumbnailKey)
+				}
+				return
+			}
+
+			var resp struct {
+				Fields    map[string]string `json:"fields"`
+				Key       string            `json:"key"`
+				ExpiresAt time.Time         `json:"expires_at"`
+			}
+			err = json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The server picks the key
+			if !strings.HasPrefix(resp.Key, "thumbnails/"+video.ID.String()+"/") || !strings.HasSuffix(resp.Key, tt.wantExtension) {
+				t.Errorf("key = %s, want a %s under the video's thumbnails", resp.Key, tt.wantExtension)
+			}
+			if stored.PendingThumbnailKey == nil || *stored.PendingThumbnailKey != resp.Key {
+				t.Errorf("pending key = %v, want %s", stored.PendingThumbnailKey, resp.Key)
+			}
+			if until := time.Until(resp.ExpiresAt); until > directUploadExpiry || until < directUploadExpiry-time.Minute {
+				t.Errorf("form expires in %s, want about %s", until, directUploadExpiry)
+			}
+			if resp.Fields["Content-Type"] != tt.wantType {
+				t.Errorf("Content-Type field = %q, want %q", resp.Fields["Content-Type"], tt.wantType)
+			}
+
+			encoded, err := base64.StdEncoding.DecodeString(resp.Fields["policy"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var policy struct {
+				Conditions []json.RawMessage `json:"conditions"`
+			}
+			err = json.Unmarshal(encoded, &policy)
+			if err != nil {
+				t.Fatalf("policy %s: %v", encoded, err)
+			}
+			conditions := map[string]bool{}
+			for _, condition := range policy.Conditions {
+				conditions[string(condition)] = true
+			}
+			for _, want := range []string{
+				`{"Content-Type":"` + tt.wantType + `"}`,
+				`["content-length-range",16,2097152]`,
+				`{"key":"` + resp.Key + `"}`,
+			} {
+				if !conditions[want] {
+					t.Errorf("policy %s doesn't have %s", encoded, want)
+				}
+			}
+		})
+	}
+}
+
+func TestThumbnailUploadComplete(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+	cfg.minThumbnailBytes = 16
+	cfg.directThumbnailMaxBytes = 2 << 20
+	target := "/api/videos/" + video.ID.String() + "/thumbnail-url"
+
+	w := httptest.NewRecorder()
+	cfg.handlerThumbnailUploadComplete(w, newVideoRequest(http.MethodPost, target+"/complete", video, token, ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("completion before a URL was issued: status = %d, want 400", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerThumbnailUploadURL(w, newVideoRequest(http.MethodPost, target, video, token, `{"content_type": "image/png"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var issued struct {
+		Key string `json:"key"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerThumbnailUploadComplete(w, newVideoRequest(http.MethodPost, target+"/complete", video, token, ""))
+	if w.Code != http.StatusConflict {
+		t.Errorf("completion before the upload: status = %d, want 409", w.Code)
+	}
+
+	// What the browser's POST would have stored
+	var image bytes.Buffer
+	err = png.Encode(&image, testPNG(200, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.objects[issued.Key] = image.Bytes()
+	w = httptest.NewRecorder()
+	cfg.handlerThumbnailUploadComplete(w, newVideoRequest(http.MethodPost, target+"/complete", video, token, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("completion status = %d: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cfg.assetURLForObject(cfg.s3Bucket, issued.Key); stored.ThumbnailURL == nil || *stored.ThumbnailURL != want {
+		t.Errorf("thumbnail URL = %v, want %s", stored.ThumbnailURL, want)
+	}
+	if stored.PendingThumbnailKey != nil {
+		t.Errorf("pending key %s wasn't cleared", *stored.PendingThumbnailKey)
+	}
+}
+
+func TestThumbnailUploadCompleteBannedHash(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+	cfg.minThumbnailBytes = 16
+	cfg.directThumbnailMaxBytes = 2 << 20
+	var image bytes.Buffer
+	err := png.Encode(&image, testPNG(200, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(image.Bytes())
+	hashes, err := newBannedHashStore("file", writeTempFile(t, "banned.txt", hex.EncodeToString(sum[:])+"\n"), cfg.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.bannedHashes = hashes
+	key := "thumbnails/" + video.ID.String() + "/banned.png"
+	store.objects[key] = image.Bytes()
+	video.PendingThumbnailKey = &key
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerThumbnailUploadComplete(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/thumbnail-url/complete", video, token, ""))
+	// The same response a banned multipart upload gets
+	if w.Code != http.StatusUnavailableForLegalReasons || !strings.Contains(w.Body.String(), "This content is not allowed") {
+		t.Fatalf("status = %d: %s, want 451 This content is not allowed", w.Code, w.Body)
+	}
+	if _, ok := store.objects[key]; ok {
+		t.Errorf("banned thumbnail %s is still stored", key)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ThumbnailURL != nil || stored.PendingThumbnailKey != nil {
+		t.Errorf("thumbnail %v, pending %v, want neither", stored.ThumbnailURL, stored.PendingThumbnailKey)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// directUploadExpiry is how long a presigned POST form stays usable.
+const directUploadExpiry = 15 * time.Minute
+
+// rawUploadExtensions are the raw key extensions of the types a direct
+// upload can declare; completion reads the type back from the key.
+var rawUploadExtensions = map[string]string{
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"video/quicktime": ".mov",
+}
+
+// directUploadMediaType checks the type a client declared for a direct
+// upload, which is video/mp4 when it declared none.
+func directUploadMediaType(value string) (string, error) {
+	if value == "" {
+		return "video/mp4", nil
+	}
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := rawUploadExtensions[mediaType]; !ok {
+		return "", fmt.Errorf("unsupported media type: %s", mediaType)
+	}
+	return mediaType, nil
+}
+
+// rawUploadMediaType is the media type a raw upload key was created for.
+func rawUploadMediaType(key string) string {
+	ext := path.Ext(key)
+	for mediaType, rawExt := range rawUploadExtensions {
+		if rawExt == ext {
+			return mediaType
+		}
+	}
+	return "video/mp4"
+}
+
+/**
+ * Get the video for a direct upload request, checking ownership
+ * Writes the error response and returns false when the request can't go on
+ */
+func (cfg *apiConfig) directUploadVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+	addLogFields(w, "video_id", videoID, "user_id", userID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "User does not own video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// directUploadBucket is the bucket a video's direct uploads are staged in,
+// the one its owner's results are stored in.
+func (cfg *apiConfig) directUploadBucket(w http.ResponseWriter, r *http.Request, video database.Video) (string, bool) {
+	bucket, err := cfg.bucketForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
+		return "", false
+	}
+	err = cfg.validateBucket(r.Context(), bucket)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Storage bucket isn't available", err)
+		return "", false
+	}
+	return bucket, true
+}
+
+/**
+ * Hand out a presigned POST form so the browser can upload straight to S3
+ * The raw object lands under raw/ and is only served after completion. The
+ * optional JSON body declares the content_type, which the policy enforces
+ */
+func (cfg *apiConfig) handlerDirectUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		URL       string            `json:"url"`
+		Fields    map[string]string `json:"fields"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := cfg.allowReupload(w, r, video); !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	contentType, err := directUploadMediaType(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type", err)
+		return
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return
+	}
+	key := fmt.Sprintf("raw/%s/%s%s", video.ID, name, rawUploadExtensions[contentType])
+	bucket, ok := cfg.directUploadBucket(w, r, video)
+	if !ok {
+		return
+	}
+
+	presignClient := s3.NewPresignClient(cfg.s3Client)
+	post, err := presignClient.PresignPostObject(r.Context(), &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}, func(options *s3.PresignPostOptions) {
+		options.Expires = directUploadExpiry
+		options.Conditions = append(options.Conditions,
+			[]any{"content-length-range", cfg.minVideoBytes, cfg.directUploadMaxBytes},
+			[]any{"eq", "$Content-Type", contentType},
+		)
+		cfg.encryption.applyPost(options)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+	post.Values["Content-Type"] = contentType
+	for name, value := range cfg.encryption.headers() {
+		post.Values[name] = value
+	}
+
+	video.PendingUploadKey = &key
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		URL:       post.URL,
+		Fields:    post.Values,
+		Key:       key,
+		ExpiresAt: time.Now().UTC().Add(directUploadExpiry),
+	})
+}
+
+/**
+ * Hand out a presigned PUT URL, for clients that send the file as the body
+ * The signature covers the declared content type and the exact size, which
+ * stands in for the POST policy's size range. Completion is the same as for
+ * POST
+ */
+func (cfg *apiConfig) handlerCreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		Method    string            `json:"method"`
+		URL       string            `json:"url"`
+		Headers   map[string]string `json:"headers"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := cfg.allowReupload(w, r, video); !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	contentType, err := directUploadMediaType(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type", err)
+		return
+	}
+	if params.Size < cfg.minVideoBytes {
+		respondWithError(w, http.StatusBadRequest, "Empty or truncated file", nil)
+		return
+	}
+	if params.Size > cfg.directUploadMaxBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "File is too large", nil)
+		return
+	}
+	err = cfg.checkUploadQuota(video, params.Size)
+	if err != nil {
+		if errors.Is(err, errUploadQuotaExceeded) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return
+	}
+	key := fmt.Sprintf("raw/%s/%s%s", video.ID, name, rawUploadExtensions[contentType])
+	bucket, ok := cfg.directUploadBucket(w, r, video)
+	if !ok {
+		return
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        &bucket,
+		Key:           &key,
+		ContentType:   &contentType,
+		ContentLength: &params.Size,
+	}
+	cfg.encryption.applyPut(input)
+	presignClient := s3.NewPresignClient(cfg.s3Client)
+	req, err := presignClient.PresignPutObject(r.Context(), input, s3.WithPresignExpires(directUploadExpiry))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	video.PendingUploadKey = &key
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	headers := cfg.encryption.headers()
+	headers["Content-Type"] = contentType
+	respondWithJSON(w, http.StatusOK, response{
+		Method:    req.Method,
+		URL:       req.URL,
+		Headers:   headers,
+		Key:       key,
+		ExpiresAt: time.Now().UTC().Add(directUploadExpiry),
+	})
+}
+
+/**
+ * Finish a direct upload: faststart the raw object and publish it
+ * Calling this again for a ready video just returns it unchanged
+ */
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.PendingUploadKey == nil {
+		if video.Status != nil && *video.Status == database.VideoStatusReady {
+			video, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+				return
+			}
+			cfg.respondWithContent(w, r, http.StatusOK, video)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "No direct upload was started for this video", nil)
+		return
+	}
+	rawKey := *video.PendingUploadKey
+
+	if !cfg.uploadLocks.TryLock(video.ID) {
+		respondWithError(w, http.StatusConflict, "This video is already being processed", nil)
+		return
+	}
+	defer cfg.uploadLocks.Unlock(video.ID)
+
+	bucket, ok := cfg.directUploadBucket(w, r, video)
+	if !ok {
+		return
+	}
+	exists, err := cfg.objectExists(r.Context(), bucket, rawKey)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check uploaded object", err)
+		return
+	}
+	if !exists {
+		respondWithError(w, http.StatusConflict, "The file hasn't been uploaded yet", nil)
+		return
+	}
+	previous := video
+	uploaded := database.VideoStatusUploaded
+	video.Status = &uploaded
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	release, err := cfg.scheduler.AcquireBounded(r.Context(), video.UserID)
+	if err != nil {
+		respondWithSchedulerError(w, cfg.processingRetryAfter, err)
+		return
+	}
+	defer release()
+
+	// Direct uploads always run under the default profile's deadline
+	profile, _ := cfg.processingProfileFor("")
+	procCtx, cancel := context.WithTimeout(r.Context(), profile.Deadline)
+	defer cancel()
+	videoID := video.ID
+	video, err = cfg.finishDirectUpload(procCtx, video, bucket, rawKey, rawUploadMediaType(rawKey), profile)
+	if err != nil {
+		var rejection *uploadRejection
+		switch {
+		case errors.As(err, &rejection):
+			cfg.discardDirectUpload(r.Context(), previous, bucket, rawKey)
+		case errors.Is(procCtx.Err(), context.DeadlineExceeded):
+			cfg.abortUpload(procCtx, videoID, nil)
+		default:
+			cfg.webhooks.dispatch(webhookEventFailed, videoID, map[string]string{"stage": "direct_upload"})
+		}
+		respondWithUploadError(w, procCtx, "Couldn't process uploaded video", err)
+		return
+	}
+	cfg.webhooks.dispatch(webhookEventReady, video.ID, cfg.videoEventData(r.Context(), video))
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	cfg.respondWithContent(w, r, http.StatusOK, video)
+}
+
+/**
+ * Process a raw upload of mediaType in bucket and publish it
+ * Used by direct uploads, trimmed clips and queued processing of multipart
+ * uploads, which all pass validateVideoSource first. The result is stored
+ * next to the raw object, which is removed once the video points at it
+ */
+func (cfg *apiConfig) finishDirectUpload(ctx context.Context, video database.Video, bucket, rawKey, mediaType string, profile processingProfile) (database.Video, error) {
+	previous := video
+	err := cfg.validateBucket(ctx, bucket)
+	if err != nil {
+		return video, err
+	}
+	sourcePath, err := cfg.downloadObjectFromBucket(ctx, bucket, rawKey, "direct-upload")
+	if err != nil {
+		return video, fmt.Errorf("couldn't download raw upload: %w", err)
+	}
+	defer os.Remove(sourcePath)
+	checkedPath, err := cfg.validateVideoSource(ctx, video, videoSource{path: sourcePath, mediaType: mediaType})
+	if err != nil {
+		return video, err
+	}
+	if checkedPath != sourcePath {
+		defer os.Remove(checkedPath)
+		sourcePath = checkedPath
+	}
+
+	prefix := "other"
+	aspectRatio, err := cfg.resolveAspectRatio(ctx, sourcePath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't get aspect ratio: %w", err)
+	}
+	video.AspectRatio = nil
+	if aspectRatio != "" {
+		video.AspectRatio = &aspectRatio
+	}
+	switch aspectRatio {
+	case "16:9":
+		prefix = "landscape"
+	case "9:16":
+		prefix = "portrait"
+	}
+
+	audio, err := getAudioInfo(ctx, sourcePath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't probe audio: %w", err)
+	}
+	video.HasAudio = &audio.HasAudio
+
+	format := profile.Format
+	processedPath, segmentsDir, err := cfg.convertForOutput(ctx, sourcePath, format, mediaType)
+	if err != nil {
+		return video, fmt.Errorf("couldn't convert video to %s: %w", format.Name, err)
+	}
+	defer os.Remove(processedPath)
+	if segmentsDir != "" {
+		defer os.RemoveAll(segmentsDir)
+	}
+
+	info, err := os.Stat(processedPath)
+	if err != nil {
+		return video, err
+	}
+	fileSize := info.Size()
+	if segmentsDir != "" {
+		fileSize, err = dirSize(segmentsDir)
+		if err != nil {
+			return video, err
+		}
+	}
+	err = cfg.checkUploadQuota(video, fileSize)
+	if err != nil {
+		return video, err
+	}
+	video.FileSize = &fileSize
+	metadata, err := getVideoMetadata(ctx, processedPath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't get video metadata: %w", err)
+	}
+	metadata.apply(&video)
+
+	key := ""
+	if cfg.contentAddressedKeys && !format.Segmented {
+		key, err = cfg.uploadContentAddressed(ctx, bucket, video.ID, processedPath, format.Extension, format.ContentType)
+		if err != nil {
+			return video, fmt.Errorf("couldn't upload processed video: %w", err)
+		}
+	} else {
+		name, err := randomAssetName()
+		if err != nil {
+			return video, err
+		}
+		key = format.objectKey(prefix, name)
+		err = cfg.uploadFileToBucket(ctx, bucket, key, processedPath, format.ContentType)
+		if err != nil {
+			return video, fmt.Errorf("couldn't upload processed video: %w", err)
+		}
+		if segmentsDir != "" {
+			err = cfg.uploadSegments(ctx, bucket, key, segmentsDir, format)
+			if err != nil {
+				cfg.rollbackAsset(ctx, cfg.assetURLForObject(bucket, key), video.ID)
+				return video, err
+			}
+		}
+	}
+
+	videoURL := cfg.assetURLForObject(bucket, key)
+	if previous.VideoURL != nil {
+		// Nothing derived from the old upload is regenerated here
+		dropDerivedAssets(&video)
+	}
+	ready := database.VideoStatusReady
+	video.VideoURL = &videoURL
+	video.Status = &ready
+	video.PendingUploadKey = nil
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		if previous.VideoURL == nil || *previous.VideoURL != videoURL {
+			cfg.rollbackAsset(ctx, videoURL, video.ID)
+		}
+		return video, err
+	}
+
+	err = cfg.objectStoreFor(bucket).delete(ctx, rawKey)
+	if err != nil {
+		log.Printf("Couldn't delete raw upload %s: %v", rawKey, err)
+	}
+	if previous.VideoURL != nil {
+		// Shared objects are counted, in case the re-upload was identical
+		cfg.cleanupReplacedAssets(ctx, video, previous, true)
+	}
+	return video, nil
+}
+
+// discardDirectUpload drops a raw upload the checks rejected and puts the
+// video back the way it was before completion started.
+func (cfg *apiConfig) discardDirectUpload(ctx context.Context, previous database.Video, bucket, rawKey string) {
+	cfg.discardRawUpload(ctx, bucket, rawKey)
+	previous.PendingUploadKey = nil
+	err := cfg.db.UpdateVideo(previous)
+	if err != nil {
+		log.Printf("Couldn't reset video %s after a rejected upload: %v", previous.ID, err)
+	}
+}
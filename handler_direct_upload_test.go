@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestDirectUploadCompleteRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		extension  string
+		content    string
+		banned     bool
+		wantStatus int
+	}{
+		{name: "not a video", extension: ".mp4", content: "just some text, not a video", wantStatus: http.StatusBadRequest},
+		{name: "mp4 declared as webm", extension: ".webm", content: testMP4, wantStatus: http.StatusBadRequest},
+		{name: "banned hash", extension: ".mp4", content: testMP4, banned: true, wantStatus: http.StatusUnavailableForLegalReasons},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			if tt.banned {
+				sum := sha256.Sum256([]byte(tt.content))
+				path := writeTempFile(t, "banned.txt", hex.EncodeToString(sum[:])+"\n")
+				hashes, err := newBannedHashStore("file", path, cfg.db)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.bannedHashes = hashes
+			}
+			rawKey := "raw/" + video.ID.String() + "/upload" + tt.extension
+			store.objects[rawKey] = []byte(tt.content)
+			video.PendingUploadKey = &rawKey
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerDirectUploadComplete(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/direct-upload/complete", video, token, ""))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if _, ok := store.objects[rawKey]; ok {
+				t.Errorf("rejected raw upload %s is still stored", rawKey)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.PendingUploadKey != nil || stored.VideoURL != nil {
+				t.Errorf("video after a rejected upload: pending %v, url %v, want neither", stored.PendingUploadKey, stored.VideoURL)
+			}
+		})
+	}
+}
+
+func TestDirectUploadComplete(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.reencodeLocks = newVideoLocker()
+	rawKey := "raw/" + video.ID.String() + "/upload.mp4"
+	store.objects[rawKey] = []byte(testMP4)
+	video.PendingUploadKey = &rawKey
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/videos/" + video.ID.String() + "/direct-upload/complete"
+
+	w := httptest.NewRecorder()
+	cfg.handlerDirectUploadComplete(w, newVideoRequest(http.MethodPost, target, video, token, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status == nil || *stored.Status != database.VideoStatusReady || stored.PendingUploadKey != nil {
+		t.Fatalf("video is %v with pending upload %v, want ready", stored.Status, stored.PendingUploadKey)
+	}
+	if _, ok := store.objects[rawKey]; ok {
+		t.Errorf("raw upload %s is still stored", rawKey)
+	}
+	key, ok := cfg.s3KeyFromURL(*stored.VideoURL)
+	if !ok || string(store.objects[key]) != testMP4 {
+		t.Errorf("processed video %s holds %q, want the raw upload run through faststart", key, store.objects[key])
+	}
+
+	// Completing again returns the ready video without processing it twice
+	puts := store.puts
+	w = httptest.NewRecorder()
+	cfg.handlerDirectUploadComplete(w, newVideoRequest(http.MethodPost, target, video, token, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("second completion status = %d, want 200: %s", w.Code, w.Body)
+	}
+	again, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != puts || *again.VideoURL != *stored.VideoURL {
+		t.Errorf("second completion stored %d more files and moved the video to %s", store.puts-puts, *again.VideoURL)
+	}
+}
+
+func TestDirectUploadCreatePolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantType      string
+		wantExtension string
+		wantStatus    int
+	}{
+		{name: "no body", wantType: "video/mp4", wantExtension: ".mp4", wantStatus: http.StatusOK},
+		{name: "webm", body: `{"content_type": "video/webm"}`, wantType: "video/webm", wantExtension: ".webm", wantStatus: http.StatusOK},
+		{name: "quicktime", body: `{"content_type": "video/quicktime"}`, wantType: "video/quicktime", wantExtension: ".mov", wantStatus: http.StatusOK},
+		{name: "not a video type", body: `{"content_type": "image/png"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, token := newS3Test(t)
+			w := httptest.NewRecorder()
+			cfg.handlerDirectUploadCreate(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/direct-upload", video, token, tt.body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Fields map[string]string `json:"fields"`
+				Key    string            `json:"key"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(resp.Key, tt.wantExtension) || rawUploadMediaType(resp.Key) != tt.wantType {
+				t.Errorf("key %s doesn't carry %s", resp.Key, tt.wantType)
+			}
+			if resp.Fields["Content-Type"] != tt.wantType {
+				t.Errorf("Content-Type field = %q, want %q", resp.Fields["Content-Type"], tt.wantType)
+			}
+			policy, err := base64.StdEncoding.DecodeString(resp.Fields["policy"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `["eq","$Content-Type","` + tt.wantType + `"]`; !strings.Contains(string(policy), want) {
+				t.Errorf("policy %s doesn't pin the content type with %s", policy, want)
+			}
+		})
+	}
+}
+
+func TestDirectUploadCreateProtectsProcessedVideos(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	cfg.protectProcessedVideos = true
+	videoURL := cfg.s3CfDistribution + "/landscape/old.mp4"
+	ready := database.VideoStatusReady
+	video.VideoURL = &videoURL
+	video.Status = &ready
+	video.CodecRenditions = database.StringMap{"av1": cfg.s3CfDistribution + "/landscape/old.av1.mp4"}
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := "/api/videos/" + video.ID.String() + "/direct-upload"
+	w := httptest.NewRecorder()
+	cfg.handlerDirectUploadCreate(w, newVideoRequest(http.MethodPost, target, video, token, ""))
+	if w.Code != http.StatusConflict {
+		t.Errorf("without force: status = %d, want 409", w.Code)
+	}
+	w = httptest.NewRecorder()
+	cfg.handlerDirectUploadCreate(w, newVideoRequest(http.MethodPost, target+"?force=true", video, token, ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("with force: status = %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestRawUploadMediaType(t *testing.T) {
+	for mediaType, extension := range rawUploadExtensions {
+		if got := rawUploadMediaType("raw/id/name" + extension); got != mediaType {
+			t.Errorf("rawUploadMediaType(%s) = %s, want %s", extension, got, mediaType)
+		}
+	}
+	// Keys from before the type was part of the key were always mp4
+	if got := rawUploadMediaType("raw/id/name"); got != "video/mp4" {
+		t.Errorf("rawUploadMediaType without extension = %s, want video/mp4", got)
+	}
+}
+
+func TestCreateUploadURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantType      string
+		wantExtension string
+		wantStatus    int
+	}{
+		{name: "mp4 by default", body: `{"size": 2048}`, wantType: "video/mp4", wantExtension: ".mp4", wantStatus: http.StatusOK},
+		{name: "webm", body: `{"size": 2048, "content_type": "video/webm"}`, wantType: "video/webm", wantExtension: ".webm", wantStatus: http.StatusOK},
+		{name: "not a video type", body: `{"size": 2048, "content_type": "text/html"}`, wantStatus: http.StatusBadRequest},
+		{name: "empty", body: `{"size": 0}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, token := newS3Test(t)
+			cfg.minVideoBytes = 1
+			w := httptest.NewRecorder()
+			cfg.handlerCreateUploadURL(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload-url", video, token, tt.body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Method  string            `json:"method"`
+				URL     string            `json:"url"`
+				Headers map[string]string `json:"headers"`
+				Key     string            `json:"key"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Method != http.MethodPut {
+				t.Errorf("method = %s, want PUT", resp.Method)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.PendingUploadKey == nil || *stored.PendingUploadKey != resp.Key {
+				t.Errorf("pending key %v doesn't match the returned key %s", stored.PendingUploadKey, resp.Key)
+			}
+			if !strings.HasSuffix(resp.Key, tt.wantExtension) || resp.Headers["Content-Type"] != tt.wantType {
+				t.Errorf("key %s with Content-Type %s, want %s", resp.Key, resp.Headers["Content-Type"], tt.wantType)
+			}
+			if !strings.Contains(resp.URL, "/"+resp.Key+"?") || !strings.Contains(resp.URL, "content-type") {
+				t.Errorf("URL %s doesn't sign the key and content type", resp.URL)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoDownload(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.IsExpired(time.Now()) {
+		respondWithError(w, http.StatusGone, "Video has expired", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has not been uploaded yet", nil)
+		return
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	rate, err := cfg.downloadRateForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get download rate", err)
+		return
+	}
+
+	filename := downloadFilename(r.URL.Query().Get("filename"), video.Title, key)
+	disposition := `attachment; filename="` + filename + `"`
+
+	// Unthrottled users can fetch straight from S3 with the headers forced
+	if cfg.downloadPresigned && rate <= 0 {
+		url, _, err := cfg.presignGetURL(r.Context(), bucket, key, cfg.presignExpiry, presignOverrides{
+			ContentDisposition: disposition,
+			ContentType:        mime.TypeByExtension(path.Ext(key)),
+		})
+		if errors.Is(err, errObjectNotFound) {
+			respondWithError(w, http.StatusNotFound, "Video asset not found", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't presign video download", err)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	if cfg.local != nil && bucket == cfg.s3Bucket {
+		cfg.serveLocalDownload(w, key, disposition, rate)
+		return
+	}
+
+	object, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if isS3NotFound(err) {
+		respondWithError(w, http.StatusNotFound, "Video asset not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't get video from S3", err)
+		return
+	}
+	defer object.Body.Close()
+
+	if object.ContentType != nil {
+		w.Header().Set("Content-Type", *object.ContentType)
+	}
+	if object.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*object.ContentLength, 10))
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(newThrottledWriter(w, rate), object.Body)
+	if err != nil {
+		log.Printf("Couldn't stream video %s: %v", videoID, err)
+	}
+}
+
+// serveLocalDownload streams a download from the local storage backend.
+func (cfg *apiConfig) serveLocalDownload(w http.ResponseWriter, key, disposition string, rate int64) {
+	file, err := cfg.local.open(key)
+	if errors.Is(err, os.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Video asset not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video", err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video", err)
+		return
+	}
+
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(newThrottledWriter(w, rate), file)
+	if err != nil {
+		log.Printf("Couldn't stream video %s: %v", key, err)
+	}
+}
+
+// maxDownloadFilenameLength keeps sanitized names well inside header limits.
+const maxDownloadFilenameLength = 100
+
+/**
+ * Build a safe attachment filename for a download
+ * Uses requested when given, otherwise the video title, and always keeps the
+ * stored object's extension. Anything outside a conservative ASCII set is
+ * dropped so the name can't break out of the header
+ */
+func downloadFilename(requested, title, key string) string {
+	ext := path.Ext(key)
+	name := requested
+	if name == "" {
+		name = title
+	}
+	name = strings.TrimSuffix(name, ext)
+
+	var b strings.Builder
+	for _, char := range name {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9':
+			b.WriteRune(char)
+		case char == '-', char == '_', char == '.', char == ' ':
+			b.WriteRune(char)
+		}
+	}
+	name = strings.Trim(b.String(), " .")
+	if len(name) > maxDownloadFilenameLength {
+		name = name[:maxDownloadFilenameLength]
+	}
+	if name == "" {
+		return path.Base(key)
+	}
+	return name + ext
+}
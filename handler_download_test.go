@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDownloadFilename(t *testing.T) {
+	tests := []struct {
+		requested string
+		title     string
+		key       string
+		want      string
+	}{
+		{title: "My Trip", key: "landscape/abc.mp4", want: "My Trip.mp4"},
+		{requested: "holiday.mp4", title: "My Trip", key: "landscape/abc.mp4", want: "holiday.mp4"},
+		{requested: `../../etc/passwd"; x=y`, key: "landscape/abc.mp4", want: "etcpasswd xy.mp4"},
+		{requested: "clip.exe", key: "landscape/abc.mp4", want: "clip.exe.mp4"},
+		{title: "日本語", key: "landscape/abc.mp4", want: "abc.mp4"},
+	}
+	for _, tt := range tests {
+		if got := downloadFilename(tt.requested, tt.title, tt.key); got != tt.want {
+			t.Errorf("downloadFilename(%q, %q, %q) = %q, want %q", tt.requested, tt.title, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestVideoDownloadPresigned(t *testing.T) {
+	cfg, server, video, token := newS3Test(t)
+	cfg.downloadPresigned = true
+	server.objects["landscape/abc.mp4"] = []byte("video")
+	videoURL := cfg.s3CfDistribution + "/landscape/abc.mp4"
+	video.VideoURL = &videoURL
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/download?filename=holiday%22.mp4", video, token, "")
+	w := httptest.NewRecorder()
+	cfg.handlerVideoDownload(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if got, want := query.Get("response-content-disposition"), `attachment; filename="holiday.mp4"`; got != want {
+		t.Errorf("response-content-disposition = %q, want %q", got, want)
+	}
+	if got := query.Get("response-content-type"); got != "video/mp4" {
+		t.Errorf("response-content-type = %q, want video/mp4", got)
+	}
+	if query.Get("X-Amz-Signature") == "" {
+		t.Errorf("download URL %s isn't signed", location)
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -22,11 +23,5 @@ func (cfg *apiConfig) handlerThumbnailGet(w http.ResponseWriter, r *http.Request
 	}
 
 	w.Header().Set("Content-Type", tn.mediaType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(tn.data)))
-
-	_, err = w.Write(tn.data)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error writing response", err)
-		return
-	}
+	http.ServeContent(w, r, videoID.String(), time.Time{}, bytes.NewReader(tn.data))
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Status: "error", Error: err.Error()}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+/**
+ * Report whether this node can process uploads
+ * ffmpeg and ffprobe must be on PATH and the bucket must answer a
+ * HeadBucket within healthTimeout. 503 when anything fails, so load
+ * balancers and deploys can take the node out
+ */
+func (cfg *apiConfig) handlerHealth(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+
+	resp := response{Status: "ok", Checks: map[string]healthCheck{}}
+	for _, tool := range processingTools {
+		_, err := cfg.toolLookup.lookPath(tool)
+		resp.Checks[tool] = newHealthCheck(err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.healthTimeout)
+	defer cancel()
+	var err error
+	if cfg.local != nil {
+		_, err = os.Stat(cfg.local.root)
+	} else {
+		_, err = cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &cfg.s3Bucket})
+	}
+	resp.Checks["s3"] = newHealthCheck(err)
+
+	code := http.StatusOK
+	for _, check := range resp.Checks {
+		if check.Status != "ok" {
+			resp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	respondWithJSON(w, code, resp)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// installStubTools makes a PATH holding only stub binaries named names.
+func installStubTools(t *testing.T, names ...string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub tools are shell scripts")
+	}
+	dir := t.TempDir()
+	for _, name := range names {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\necho \""+name+" version 6.1.1 Copyright\"\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	return dir
+}
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		tools      []string
+		bucketCode int
+		bucketWait time.Duration
+		wantCode   int
+		wantFailed []string
+	}{
+		{name: "healthy", tools: []string{"ffmpeg", "ffprobe"}, bucketCode: http.StatusOK, wantCode: http.StatusOK},
+		{name: "no ffmpeg", tools: []string{"ffprobe"}, bucketCode: http.StatusOK, wantCode: http.StatusServiceUnavailable, wantFailed: []string{"ffmpeg"}},
+		{name: "no ffprobe", tools: []string{"ffmpeg"}, bucketCode: http.StatusOK, wantCode: http.StatusServiceUnavailable, wantFailed: []string{"ffprobe"}},
+		{name: "no bucket", tools: []string{"ffmpeg", "ffprobe"}, bucketCode: http.StatusNotFound, wantCode: http.StatusServiceUnavailable, wantFailed: []string{"s3"}},
+		{name: "no access", tools: []string{"ffmpeg", "ffprobe"}, bucketCode: http.StatusForbidden, wantCode: http.StatusServiceUnavailable, wantFailed: []string{"s3"}},
+		{name: "bucket too slow", tools: []string{"ffmpeg", "ffprobe"}, bucketCode: http.StatusOK, bucketWait: time.Second, wantCode: http.StatusServiceUnavailable, wantFailed: []string{"s3"}},
+		{name: "nothing works", bucketCode: http.StatusNotFound, wantCode: http.StatusServiceUnavailable, wantFailed: []string{"ffmpeg", "ffprobe", "s3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installStubTools(t, tt.tools...)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead || r.URL.Path != "/tubely-test" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				select {
+				case <-time.After(tt.bucketWait):
+				case <-r.Context().Done():
+				}
+				w.WriteHeader(tt.bucketCode)
+			}))
+			t.Cleanup(server.Close)
+			cfg := &apiConfig{
+				s3Client:      newEndpointS3Client(server.URL),
+				s3Bucket:      "tubely-test",
+				toolLookup:    newToolLookup(),
+				healthTimeout: 100 * time.Millisecond,
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var resp struct {
+				Status string                 `json:"status"`
+				Checks map[string]healthCheck `json:"checks"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failed := map[string]bool{}
+			for _, name := range tt.wantFailed {
+				failed[name] = true
+			}
+			for _, name := range []string{"ffmpeg", "ffprobe", "s3"} {
+				check, ok := resp.Checks[name]
+				if !ok {
+					t.Errorf("no %s check in %v", name, resp.Checks)
+					continue
+				}
+				wantStatus := "ok"
+				if failed[name] {
+					wantStatus = "error"
+				}
+				if check.Status != wantStatus || (check.Error != "") != failed[name] {
+					t.Errorf("%s check = %+v, want %s", name, check, wantStatus)
+				}
+			}
+			if (resp.Status == "ok") != (len(tt.wantFailed) == 0) {
+				t.Errorf("status = %q with %v failing", resp.Status, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestHealthCachesToolLookup(t *testing.T) {
+	dir := installStubTools(t, "ffmpeg", "ffprobe")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+	cfg := &apiConfig{s3Client: newEndpointS3Client(server.URL), s3Bucket: "tubely-test", toolLookup: newToolLookup(), healthTimeout: time.Second}
+
+	w := httptest.NewRecorder()
+	cfg.handlerHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	// Found tools aren't looked up again, the bucket is checked every time
+	err := os.Remove(filepath.Join(dir, "ffmpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	w = httptest.NewRecorder()
+	cfg.handlerHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var resp struct {
+		Checks map[string]healthCheck `json:"checks"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Checks["ffmpeg"].Status != "ok" || resp.Checks["s3"].Status != "error" {
+		t.Errorf("checks = %+v, want the cached ffmpeg and a failed bucket", resp.Checks)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type manifestAsset struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        *int64 `json:"size,omitempty"`
+	Codec       string `json:"codec,omitempty"`
+	Language    string `json:"language,omitempty"`
+	Label       string `json:"label,omitempty"`
+}
+
+// videoManifest lists every stored asset of a video. Asset types the video
+// doesn't have are left out.
+type videoManifest struct {
+	VideoID             uuid.UUID                `json:"video_id"`
+	Title               string                   `json:"title"`
+	AspectRatio         *string                  `json:"aspect_ratio,omitempty"`
+	Video               *manifestAsset           `json:"video,omitempty"`
+	Renditions          map[string]manifestAsset `json:"renditions,omitempty"`
+	Resolutions         map[string]manifestAsset `json:"resolutions,omitempty"`
+	Thumbnail           *manifestAsset           `json:"thumbnail,omitempty"`
+	ThumbnailVariants   []manifestAsset          `json:"thumbnail_variants,omitempty"`
+	ThumbnailCandidates []manifestAsset          `json:"thumbnail_candidates,omitempty"`
+	AudioTracks         []manifestAsset          `json:"audio_tracks,omitempty"`
+	Captions            []manifestAsset          `json:"captions,omitempty"`
+}
+
+func (cfg *apiConfig) handlerVideoManifest(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.IsExpired(time.Now()) {
+		respondWithError(w, http.StatusGone, "Video has expired", nil)
+		return
+	}
+
+	manifest, err := cfg.buildVideoManifest(r.Context(), video)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video asset not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build manifest", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, manifest)
+}
+
+func (cfg *apiConfig) buildVideoManifest(ctx context.Context, video database.Video) (videoManifest, error) {
+	manifest := videoManifest{
+		VideoID:     video.ID,
+		Title:       video.Title,
+		AspectRatio: video.AspectRatio,
+	}
+
+	if video.VideoURL != nil {
+		url, err := cfg.signAssetURL(ctx, *video.VideoURL)
+		if err != nil {
+			return videoManifest{}, err
+		}
+		manifest.Video = &manifestAsset{
+			URL:         url,
+			ContentType: contentTypeForKey(*video.VideoURL),
+			Size:        video.FileSize,
+		}
+		if video.VideoCodec != nil {
+			manifest.Video.Codec = *video.VideoCodec
+		}
+	}
+
+	if len(video.CodecRenditions) > 0 {
+		manifest.Renditions = map[string]manifestAsset{}
+		for codecName, renditionURL := range video.CodecRenditions {
+			url, err := cfg.signAssetURL(ctx, renditionURL)
+			if err != nil {
+				return videoManifest{}, err
+			}
+			asset := manifestAsset{URL: url, Codec: codecName}
+			if codec, ok := reencodeCodecs[codecName]; ok {
+				asset.ContentType = codec.contentType
+			}
+			manifest.Renditions[codecName] = asset
+		}
+	}
+
+	if len(video.ResolutionRenditions) > 0 {
+		manifest.Resolutions = map[string]manifestAsset{}
+		for name, renditionURL := range video.ResolutionRenditions {
+			url, err := cfg.signAssetURL(ctx, renditionURL)
+			if err != nil {
+				return videoManifest{}, err
+			}
+			manifest.Resolutions[name] = manifestAsset{URL: url, ContentType: "video/mp4", Codec: "h264"}
+		}
+	}
+
+	if video.ThumbnailURL != nil {
+		url, err := cfg.signAssetURL(ctx, *video.ThumbnailURL)
+		if err != nil {
+			return videoManifest{}, err
+		}
+		manifest.Thumbnail = &manifestAsset{URL: url}
+	}
+
+	for _, variant := range video.ThumbnailVariants {
+		if !variant.Servable() {
+			continue
+		}
+		url, err := cfg.signAssetURL(ctx, variant.URL)
+		if err != nil {
+			return videoManifest{}, err
+		}
+		manifest.ThumbnailVariants = append(manifest.ThumbnailVariants, manifestAsset{
+			URL:         url,
+			ContentType: variant.ContentType,
+		})
+	}
+
+	for _, candidateURL := range video.ThumbnailCandidates {
+		url, err := cfg.signAssetURL(ctx, candidateURL)
+		if err != nil {
+			return videoManifest{}, err
+		}
+		manifest.ThumbnailCandidates = append(manifest.ThumbnailCandidates, manifestAsset{
+			URL:         url,
+			ContentType: "image/jpeg",
+		})
+	}
+
+	for _, track := range video.AudioTracks {
+		url, err := cfg.signAssetURL(ctx, track.URL)
+		if err != nil {
+			return videoManifest{}, err
+		}
+		manifest.AudioTracks = append(manifest.AudioTracks, manifestAsset{
+			URL:         url,
+			ContentType: track.ContentType,
+			Language:    track.Language,
+		})
+	}
+	sort.Slice(manifest.AudioTracks, func(i, j int) bool {
+		return manifest.AudioTracks[i].Language < manifest.AudioTracks[j].Language
+	})
+
+	for _, caption := range video.Captions {
+		url, err := cfg.signAssetURL(ctx, caption.URL)
+		if err != nil {
+			return videoManifest{}, err
+		}
+		manifest.Captions = append(manifest.Captions, manifestAsset{
+			URL:         url,
+			ContentType: "text/vtt",
+			Language:    caption.Language,
+			Label:       caption.Label,
+		})
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestVideoManifest(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	assetURL := func(key string) string {
+		return cfg.assetURLForObject(cfg.s3Bucket, key)
+	}
+	videoURL := assetURL("landscape/video.mp4")
+	thumbnailURL := assetURL("thumbnails/cover.png")
+	size := int64(1024)
+	codec := "h264"
+
+	tests := []struct {
+		name     string
+		update   func(*database.Video)
+		wantKeys []string
+	}{
+		{
+			name:     "no assets",
+			update:   func(*database.Video) {},
+			wantKeys: []string{"title", "video_id"},
+		},
+		{
+			name: "video and thumbnail",
+			update: func(v *database.Video) {
+				v.VideoURL = &videoURL
+				v.ThumbnailURL = &thumbnailURL
+			},
+			wantKeys: []string{"thumbnail", "title", "video", "video_id"},
+		},
+		{
+			name: "every asset type",
+			update: func(v *database.Video) {
+				v.VideoURL = &videoURL
+				v.FileSize = &size
+				v.VideoCodec = &codec
+				v.CodecRenditions = database.StringMap{"av1": assetURL("landscape/video.av1.mp4")}
+				v.ResolutionRenditions = database.StringMap{"480p": assetURL("landscape/video.480p.mp4")}
+				v.ThumbnailURL = &thumbnailURL
+				v.ThumbnailVariants = database.ThumbnailVariants{
+					{ContentType: "image/webp", URL: assetURL("thumbnails/cover.webp"), Status: database.VariantReady},
+					// Not servable yet, so not listed
+					{ContentType: "image/avif", URL: assetURL("thumbnails/cover.avif"), Status: database.VariantPending},
+				}
+				v.ThumbnailCandidates = database.StringList{assetURL("thumbnails/candidate-0.jpeg")}
+				v.AudioTracks = database.AudioTracks{{Language: "es", URL: assetURL("audio/es.m4a"), ContentType: "audio/mp4"}}
+				v.Captions = database.Captions{{Language: "en", Label: "English", URL: assetURL("captions/en.vtt")}}
+			},
+			wantKeys: []string{"audio_tracks", "captions", "renditions", "resolutions", "thumbnail", "thumbnail_candidates", "thumbnail_variants", "title", "video", "video_id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := video
+			tt.update(&updated)
+			err := cfg.db.UpdateVideo(updated)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerVideoManifest(w, newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/manifest", video, token, ""))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			manifest := map[string]json.RawMessage{}
+			err = json.Unmarshal(w.Body.Bytes(), &manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{}
+			for key := range manifest {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, tt.wantKeys) {
+				t.Errorf("manifest lists %v, want %v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestBuildVideoManifest(t *testing.T) {
+	cfg, _, video, _ := newS3Test(t)
+	videoURL := cfg.s3CfDistribution + "/landscape/video.mp4"
+	size := int64(1024)
+	codec := "h264"
+	video.VideoURL = &videoURL
+	video.FileSize = &size
+	video.VideoCodec = &codec
+	video.ThumbnailVariants = database.ThumbnailVariants{
+		{ContentType: "image/webp", URL: cfg.s3CfDistribution + "/thumbnails/cover.webp"},
+		{ContentType: "image/avif", URL: cfg.s3CfDistribution + "/thumbnails/cover.avif", Status: database.VariantFailed},
+	}
+	video.AudioTracks = database.AudioTracks{
+		{Language: "fr", URL: cfg.s3CfDistribution + "/audio/fr.m4a", ContentType: "audio/mp4"},
+		{Language: "de", URL: cfg.s3CfDistribution + "/audio/de.m4a", ContentType: "audio/mp4"},
+	}
+
+	manifest, err := cfg.buildVideoManifest(context.Background(), video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Video == nil || *manifest.Video.Size != size || manifest.Video.Codec != codec || manifest.Video.ContentType != "video/mp4" {
+		t.Errorf("video = %+v, want its size, codec and content type", manifest.Video)
+	}
+	if len(manifest.ThumbnailVariants) != 1 || manifest.ThumbnailVariants[0].ContentType != "image/webp" {
+		t.Errorf("thumbnail variants = %+v, want only the servable webp", manifest.ThumbnailVariants)
+	}
+	if len(manifest.AudioTracks) != 2 || manifest.AudioTracks[0].Language != "de" || manifest.AudioTracks[1].Language != "fr" {
+		t.Errorf("audio tracks = %+v, want de then fr", manifest.AudioTracks)
+	}
+}
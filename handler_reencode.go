@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type reencodeCodec struct {
+	args        []string
+	extension   string
+	contentType string
+}
+
+// Codecs a video can be re-encoded to. The original H.264 upload is always
+// kept for compatibility; h264 itself is the usual target for moving videos
+// off a deprecated codec.
+var reencodeCodecs = map[string]reencodeCodec{
+	"h264": {
+		args:        []string{"-c:v", "libx264", "-preset", "medium", "-crf", "23", "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "faststart", "-f", "mp4"},
+		extension:   ".mp4",
+		contentType: "video/mp4",
+	},
+	"av1": {
+		args:        []string{"-c:v", "libsvtav1", "-preset", "8", "-crf", "35", "-c:a", "copy", "-movflags", "faststart", "-f", "mp4"},
+		extension:   ".mp4",
+		contentType: "video/mp4",
+	},
+	"vp9": {
+		args:        []string{"-c:v", "libvpx-vp9", "-crf", "33", "-b:v", "0", "-c:a", "libopus", "-f", "webm"},
+		extension:   ".webm",
+		contentType: "video/webm",
+	},
+	"hevc": {
+		args:        []string{"-c:v", "libx265", "-crf", "28", "-tag:v", "hvc1", "-c:a", "copy", "-movflags", "faststart", "-f", "mp4"},
+		extension:   ".mp4",
+		contentType: "video/mp4",
+	},
+}
+
+func parseReencodeCodecs(value string) (map[string]bool, error) {
+	allowed := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := reencodeCodecs[name]; !ok {
+			return nil, fmt.Errorf("unsupported re-encode codec: %s", name)
+		}
+		allowed[name] = true
+	}
+	return allowed, nil
+}
+
+func (cfg *apiConfig) handlerVideoReencode(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Codec string `json:"codec"`
+	}
+	type response struct {
+		VideoID uuid.UUID `json:"video_id"`
+		Codec   string    `json:"codec"`
+		Status  string    `json:"status"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.reencodeCodecs[params.Codec] {
+		respondWithError(w, http.StatusBadRequest, "Unsupported codec", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID && !cfg.isAdmin(userID) {
+		respondWithError(w, http.StatusForbidden, "You can't re-encode this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has not been uploaded yet", nil)
+		return
+	}
+	if _, _, ok := cfg.s3ObjectFromURL(*video.VideoURL); !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	payload := reencodePayload{Codec: params.Codec}
+	encoded, err := jobPayload(payload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't encode job", err)
+		return
+	}
+	active, err := cfg.db.HasActiveJob(jobTypeReencode, videoID, encoded)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check re-encode queue", err)
+		return
+	}
+	if active {
+		respondWithError(w, http.StatusConflict, "A re-encode is already running for this video", nil)
+		return
+	}
+	_, err = cfg.jobs.enqueue(jobTypeReencode, videoID, payload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue re-encode", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, response{
+		VideoID: videoID,
+		Codec:   params.Codec,
+		Status:  "queued",
+	})
+}
+
+const jobTypeReencode = "reencode"
+
+type reencodePayload struct {
+	Codec string `json:"codec"`
+}
+
+/**
+ * Run a queued re-encode job
+ * The source is read from the video at run time, so a re-upload while the
+ * job waited is what gets encoded
+ */
+func (cfg *apiConfig) runReencodeJob(ctx context.Context, job database.Job) error {
+	payload := reencodePayload{}
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return err
+	}
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.VideoURL == nil {
+		return fmt.Errorf("video %s has no upload", job.VideoID)
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(*video.VideoURL)
+	if !ok {
+		return fmt.Errorf("couldn't find video object for %s", job.VideoID)
+	}
+
+	if !cfg.reencodeLocks.TryLock(job.VideoID) {
+		return fmt.Errorf("video %s is busy", job.VideoID)
+	}
+	defer cfg.reencodeLocks.Unlock(job.VideoID)
+	release, err := cfg.scheduler.Acquire(ctx, video.UserID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = cfg.reencodeVideo(ctx, video, bucket, key, payload.Codec)
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-encoded video %s to %s", job.VideoID, payload.Codec)
+	return nil
+}
+
+func (cfg *apiConfig) reencodeJobFailed(job database.Job, err error) {
+	payload := reencodePayload{}
+	json.Unmarshal([]byte(job.Payload), &payload)
+	cfg.webhooks.dispatch(webhookEventFailed, job.VideoID, map[string]string{"stage": "reencode", "codec": payload.Codec})
+}
+
+/**
+ * Re-encode the stored original to codecName
+ * The result is uploaded next to the original, in the same bucket, and
+ * recorded as a rendition. Content banned since it was published isn't
+ * encoded again
+ */
+func (cfg *apiConfig) reencodeVideo(ctx context.Context, source database.Video, bucket, sourceKey, codecName string) error {
+	codec := reencodeCodecs[codecName]
+
+	sourcePath, err := cfg.downloadObjectFromBucket(ctx, bucket, sourceKey, "reencode-source")
+	if err != nil {
+		return fmt.Errorf("couldn't download original: %w", err)
+	}
+	defer os.Remove(sourcePath)
+	if cfg.bannedHashes != nil {
+		hash, err := sha256File(sourcePath)
+		if err != nil {
+			return err
+		}
+		err = cfg.checkBannedHash(hash, source)
+		if err != nil {
+			return err
+		}
+	}
+
+	outputPath := sourcePath + "." + codecName + codec.extension
+	args := append([]string{"-y", "-i", sourcePath}, codec.args...)
+	args = append(args, outputPath)
+	command := commandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err = command.Run()
+	defer os.Remove(outputPath)
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+
+	key := strings.TrimSuffix(sourceKey, path.Ext(sourceKey)) + "." + codecName + codec.extension
+	err = cfg.uploadFileToBucket(ctx, bucket, key, outputPath, codec.contentType)
+	if err != nil {
+		return fmt.Errorf("couldn't upload rendition: %w", err)
+	}
+
+	// Reload so we don't overwrite changes made while encoding
+	video, err := cfg.db.GetVideo(source.ID)
+	if err != nil {
+		return err
+	}
+	if video.CodecRenditions == nil {
+		video.CodecRenditions = database.StringMap{}
+	}
+	video.CodecRenditions[codecName] = cfg.assetURLForObject(bucket, key)
+	return cfg.db.UpdateVideo(video)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// fakeS3Server is a path-style S3 endpoint for a single bucket, keeping
+// objects in memory by key. It counts puts and DeleteObjects batches, and
+// is also the config's objectStore.
+type fakeS3Server struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// Content-Type each object was stored with
+	contentTypes map[string]string
+	puts         int
+	copies       int
+	batchDeletes int
+}
+
+func (s *fakeS3Server) put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	s.contentTypes[key] = contentType
+	s.puts++
+	return nil
+}
+
+func (s *fakeS3Server) delete(ctx context.Context, key string) error {
+	// Like the SDK, nothing is sent once ctx is done
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			_, sourceKey, _ := strings.Cut(source, "/")
+			sourceKey, _ = url.PathUnescape(sourceKey)
+			data, ok := s.objects[sourceKey]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.objects[key] = data
+			s.contentTypes[key] = s.contentTypes[sourceKey]
+			s.copies++
+			w.Write([]byte("<CopyObjectResult><ETag>\"fake\"</ETag></CopyObjectResult>"))
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+		s.contentTypes[key] = r.Header.Get("Content-Type")
+		s.puts++
+	case http.MethodHead, http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodPost:
+		if !r.URL.Query().Has("delete") {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var batch struct {
+			Objects []struct {
+				Key string
+			} `xml:"Object"`
+		}
+		err := xml.NewDecoder(r.Body).Decode(&batch)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, object := range batch.Objects {
+			delete(s.objects, object.Key)
+		}
+		s.batchDeletes++
+		w.Write([]byte("<DeleteResult></DeleteResult>"))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3Server) object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+// newEndpointS3Client is an S3 client talking to a local test server.
+func newEndpointS3Client(endpoint string) *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-2",
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		// Retried like the real client, without the backoff
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		}),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+}
+
+// testMP4 starts with an ftyp box so it sniffs as mp4.
+const testMP4 = "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41 not really a video"
+
+// newS3Test is newThumbnailTest with the bucket "tubely-test" served by a
+// fakeS3Server and a CloudFront distribution in front of it.
+func newS3Test(t *testing.T) (*apiConfig, *fakeS3Server, database.Video, string) {
+	cfg, video, token := newThumbnailTest(t)
+	server := &fakeS3Server{objects: map[string][]byte{}, contentTypes: map[string]string{}}
+	endpoint := httptest.NewServer(server)
+	t.Cleanup(endpoint.Close)
+	cfg.s3Client = newEndpointS3Client(endpoint.URL)
+	cfg.s3Bucket = "tubely-test"
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.store = server
+	cfg.uploadLocks = newVideoLocker()
+	cfg.assetLocks = newAssetLocker()
+	cfg.directUploadMaxBytes = 1 << 30
+	profiles, err := parseProcessingProfiles("", time.Minute, "mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.processingProfiles = profiles
+	return cfg, server, video, token
+}
+
+func TestVideoReencode(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, server, video, token := newS3Test(t)
+	server.objects["landscape/original.mp4"] = []byte("original video")
+	cfg.reencodeCodecs = map[string]bool{"av1": true}
+	cfg.reencodeLocks = newVideoLocker()
+	cfg.jobs = newJobQueue(cfg.db, time.Minute, time.Hour)
+	cfg.jobs.register(jobTypeReencode, jobType{run: cfg.runReencodeJob, maxAttempts: 3, failed: cfg.reencodeJobFailed})
+	videoURL := cfg.s3CfDistribution + "/landscape/original.mp4"
+	video.VideoURL = &videoURL
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{name: "unsupported codec", token: token, body: `{"codec": "vp9"}`, wantCode: http.StatusBadRequest},
+		{name: "not the owner", token: otherToken, body: `{"codec": "av1"}`, wantCode: http.StatusForbidden},
+		{name: "queued", token: token, body: `{"codec": "av1"}`, wantCode: http.StatusAccepted},
+		{name: "already queued", token: token, body: `{"codec": "av1"}`, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoReencode(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/reencode", video, tt.token, tt.body))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+	}
+
+	if !cfg.jobs.runNext() {
+		t.Fatal("no re-encode job was queued")
+	}
+	const renditionKey = "landscape/original.av1.mp4"
+	if _, ok := server.object(renditionKey); !ok {
+		t.Fatalf("%s wasn't stored", renditionKey)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cfg.s3CfDistribution + "/" + renditionKey; stored.CodecRenditions["av1"] != want {
+		t.Errorf("av1 rendition = %q, want %s", stored.CodecRenditions["av1"], want)
+	}
+	if *stored.VideoURL != videoURL {
+		t.Errorf("video URL = %s, want the original kept", *stored.VideoURL)
+	}
+	payload, err := jobPayload(reencodePayload{Codec: "av1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, err := cfg.db.HasActiveJob(jobTypeReencode, video.ID, payload); err != nil || active {
+		t.Errorf("re-encode job active = %v, %v after it ran, want done", active, err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Server preference between formats the client accepts equally; smaller
+// formats first. JPEG is the universal fallback.
+var thumbnailFormatPreference = []string{"image/avif", "image/webp", "image/jpeg", "image/png", "image/gif"}
+
+func newThumbnailVariant(data []byte, contentType, url string) database.ThumbnailVariant {
+	return readThumbnailVariant(bytes.NewReader(data), contentType, url)
+}
+
+// readThumbnailVariant is newThumbnailVariant reading the image header from r.
+func readThumbnailVariant(r io.Reader, contentType, url string) database.ThumbnailVariant {
+	variant := database.ThumbnailVariant{ContentType: contentType, URL: url}
+	if config, _, err := image.DecodeConfig(r); err == nil {
+		variant.Width = config.Width
+		variant.Height = config.Height
+	}
+	return variant
+}
+
+/**
+ * Redirect to the thumbnail variant that best fits the client
+ * The format comes from the Accept header, the size from client hints
+ */
+func (cfg *apiConfig) handlerThumbnailNegotiate(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.ThumbnailURL == nil {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", nil)
+		return
+	}
+	if video.IsExpired(time.Now()) {
+		respondWithError(w, http.StatusGone, "Video has expired", nil)
+		return
+	}
+
+	target := *video.ThumbnailURL
+	variant, ok := pickThumbnailVariant(video.ThumbnailVariants, r.Header.Get("Accept"), clientHintWidth(r.Header))
+	if ok {
+		target = variant.URL
+	}
+	target, err = cfg.signAssetURL(r.Context(), target)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign thumbnail URL", err)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept, Sec-CH-Width, Width, Sec-CH-DPR, DPR, Sec-CH-Viewport-Width, Viewport-Width")
+	w.Header().Set("Accept-CH", "Sec-CH-Width, Sec-CH-DPR, Sec-CH-Viewport-Width")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// acceptQuality returns the q value the Accept header gives contentType.
+func acceptQuality(accept, contentType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	typeGroup, _, _ := strings.Cut(contentType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		specificity := -1
+		switch {
+		case mediaRange == contentType:
+			specificity = 2
+		case mediaRange == typeGroup+"/*":
+			specificity = 1
+		case mediaRange == "*/*":
+			specificity = 0
+		}
+		if specificity < bestSpecificity || specificity < 0 {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
+
+/**
+ * Read the wanted image width in physical pixels from client hints
+ * Returns 0 when the client sent no hints
+ */
+func clientHintWidth(header http.Header) int {
+	for _, name := range []string{"Sec-CH-Width", "Width"} {
+		if width, err := strconv.Atoi(header.Get(name)); err == nil && width > 0 {
+			return width
+		}
+	}
+
+	viewport := 0
+	for _, name := range []string{"Sec-CH-Viewport-Width", "Viewport-Width"} {
+		if width, err := strconv.Atoi(header.Get(name)); err == nil && width > 0 {
+			viewport = width
+			break
+		}
+	}
+	if viewport == 0 {
+		return 0
+	}
+	dpr := 1.0
+	for _, name := range []string{"Sec-CH-DPR", "DPR"} {
+		if parsed, err := strconv.ParseFloat(header.Get(name), 64); err == nil && parsed > 0 {
+			dpr = parsed
+			break
+		}
+	}
+	return int(float64(viewport) * dpr)
+}
+
+/**
+ * Choose the best variant for the client
+ * Formats the client rejects are skipped unless nothing else is left, in
+ * which case JPEG is preferred. Within a format the smallest variant at least
+ * wantWidth wide wins, otherwise the largest one.
+ */
+func pickThumbnailVariant(variants []database.ThumbnailVariant, accept string, wantWidth int) (database.ThumbnailVariant, bool) {
+	variants = slices.DeleteFunc(slices.Clone(variants), func(v database.ThumbnailVariant) bool { return !v.Servable() })
+	if len(variants) == 0 {
+		return database.ThumbnailVariant{}, false
+	}
+
+	bestFormat, bestQuality, bestRank := "", 0.0, len(thumbnailFormatPreference)
+	for _, variant := range variants {
+		quality := acceptQuality(accept, variant.ContentType)
+		rank := slices.Index(thumbnailFormatPreference, variant.ContentType)
+		if rank < 0 {
+			rank = len(thumbnailFormatPreference)
+		}
+		if quality > bestQuality || (quality == bestQuality && quality > 0 && rank < bestRank) {
+			bestFormat, bestQuality, bestRank = variant.ContentType, quality, rank
+		}
+	}
+	if bestFormat == "" {
+		bestFormat = "image/jpeg"
+		if !slices.ContainsFunc(variants, func(v database.ThumbnailVariant) bool { return v.ContentType == bestFormat }) {
+			bestFormat = variants[0].ContentType
+		}
+	}
+
+	var chosen *database.ThumbnailVariant
+	for i := range variants {
+		variant := &variants[i]
+		if variant.ContentType != bestFormat {
+			continue
+		}
+		switch {
+		case chosen == nil:
+			chosen = variant
+		case wantWidth > 0 && variant.Width >= wantWidth && (chosen.Width < wantWidth || variant.Width < chosen.Width):
+			chosen = variant
+		case (wantWidth <= 0 || chosen.Width < wantWidth) && variant.Width > chosen.Width:
+			chosen = variant
+		}
+	}
+	return *chosen, true
+}
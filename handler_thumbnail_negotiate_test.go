@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		want        float64
+	}{
+		{accept: "", contentType: "image/webp", want: 1},
+		{accept: "image/webp,*/*;q=0.8", contentType: "image/webp", want: 1},
+		{accept: "image/webp,*/*;q=0.8", contentType: "image/jpeg", want: 0.8},
+		// The most specific range wins over a broader one
+		{accept: "image/*;q=0.5,image/avif;q=0", contentType: "image/avif", want: 0},
+		{accept: "image/*;q=0.5,image/avif;q=0", contentType: "image/png", want: 0.5},
+		{accept: "image/jpeg", contentType: "image/webp", want: 0},
+	}
+	for _, tt := range tests {
+		if got := acceptQuality(tt.accept, tt.contentType); got != tt.want {
+			t.Errorf("acceptQuality(%q, %s) = %v, want %v", tt.accept, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestClientHintWidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{name: "no hints", want: 0},
+		{name: "width", header: map[string]string{"Sec-CH-Width": "640"}, want: 640},
+		{name: "viewport and DPR", header: map[string]string{"Sec-CH-Viewport-Width": "400", "Sec-CH-DPR": "2"}, want: 800},
+		{name: "viewport only", header: map[string]string{"Viewport-Width": "400"}, want: 400},
+		{name: "garbage", header: map[string]string{"Width": "wide"}, want: 0},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		for name, value := range tt.header {
+			header.Set(name, value)
+		}
+		if got := clientHintWidth(header); got != tt.want {
+			t.Errorf("%s: width = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPickThumbnailVariant(t *testing.T) {
+	variants := []database.ThumbnailVariant{
+		{ContentType: "image/jpeg", Width: 320, URL: "jpeg-320"},
+		{ContentType: "image/jpeg", Width: 1280, URL: "jpeg-1280"},
+		{ContentType: "image/webp", Width: 320, URL: "webp-320"},
+		{ContentType: "image/webp", Width: 1280, URL: "webp-1280"},
+	}
+	tests := []struct {
+		name      string
+		accept    string
+		wantWidth int
+		want      string
+	}{
+		{name: "webp client", accept: "image/webp,image/*;q=0.8", want: "webp-1280"},
+		{name: "jpeg-only client", accept: "image/jpeg", want: "jpeg-1280"},
+		{name: "anything goes", accept: "*/*", want: "webp-1280"},
+		{name: "small screen", accept: "image/webp", wantWidth: 300, want: "webp-320"},
+		{name: "between sizes", accept: "image/webp", wantWidth: 640, want: "webp-1280"},
+		// Nothing stored as avif
+		{name: "avif client", accept: "image/avif", want: "jpeg-1280"},
+	}
+	for _, tt := range tests {
+		got, ok := pickThumbnailVariant(variants, tt.accept, tt.wantWidth)
+		if !ok || got.URL != tt.want {
+			t.Errorf("%s: picked %s, %v, want %s", tt.name, got.URL, ok, tt.want)
+		}
+	}
+	if _, ok := pickThumbnailVariant(nil, "image/webp", 0); ok {
+		t.Error("picked a variant from none")
+	}
+}
+
+func TestThumbnailNegotiate(t *testing.T) {
+	cfg, video, _ := newThumbnailTest(t)
+	original := "https://cdn.example.com/thumbnails/cover.png"
+	video.ThumbnailURL = &original
+	video.ThumbnailVariants = database.ThumbnailVariants{
+		{ContentType: "image/jpeg", Width: 640, URL: "https://cdn.example.com/thumbnails/cover.jpeg"},
+		{ContentType: "image/webp", Width: 640, URL: "https://cdn.example.com/thumbnails/cover.webp"},
+	}
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "webp client", accept: "image/webp,image/*;q=0.8", want: "https://cdn.example.com/thumbnails/cover.webp"},
+		{name: "jpeg-only client", accept: "image/jpeg", want: "https://cdn.example.com/thumbnails/cover.jpeg"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/thumbnail", nil)
+		req.SetPathValue("videoID", video.ID.String())
+		req.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		cfg.handlerThumbnailNegotiate(w, req)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s: %d to %s, want 302 to %s", tt.name, w.Code, w.Header().Get("Location"), tt.want)
+		}
+		if w.Header().Get("Vary") == "" {
+			t.Errorf("%s: response doesn't vary on Accept", tt.name)
+		}
+	}
+}
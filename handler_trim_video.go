@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+/**
+ * Publish part of a stored video as a new video of the same owner
+ * The cut is stream copied when start is on a keyframe and re-encoded
+ * otherwise; copied cuts only need the start aligned, since decoding can
+ * stop on any frame. The clip then goes through the direct upload pipeline,
+ * which faststarts it
+ */
+func (cfg *apiConfig) handlerTrimVideo(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Title string  `json:"title"`
+	}
+
+	source, ok := cfg.directUploadVideo(w, r)
+	if !ok {
+		return
+	}
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Start < 0 || params.End <= params.Start {
+		respondWithError(w, http.StatusBadRequest, "end must be after start, and start can't be negative", nil)
+		return
+	}
+	if source.VideoURL == nil || (source.Status != nil && *source.Status != database.VideoStatusReady) {
+		respondWithError(w, http.StatusConflict, "The video hasn't been processed yet", nil)
+		return
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(*source.VideoURL)
+	if !ok || isSegmentedKey(key) || !strings.HasSuffix(key, ".mp4") {
+		respondWithError(w, http.StatusBadRequest, "Only mp4 videos can be trimmed", nil)
+		return
+	}
+	trim := trimRange{Start: params.Start, End: params.End}
+	if source.Duration != nil {
+		err = trim.validate(*source.Duration)
+		if err != nil {
+			respondWithErrorType(w, http.StatusBadRequest, problemInvalidTrimRange, err.Error(), err)
+			return
+		}
+	}
+
+	title := strings.TrimSpace(params.Title)
+	if title == "" {
+		title = source.Title + " (clip)"
+	}
+	if cfg.uniqueVideoTitles {
+		existing, err := cfg.db.GetVideoByTitle(source.UserID, title)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video title", err)
+			return
+		}
+		if existing.ID != uuid.Nil {
+			respondWithError(w, http.StatusConflict, "You already have a video with this title", nil)
+			return
+		}
+	}
+
+	release, err := cfg.scheduler.AcquireBounded(r.Context(), source.UserID)
+	if err != nil {
+		respondWithSchedulerError(w, cfg.processingRetryAfter, err)
+		return
+	}
+	defer release()
+	profile, _ := cfg.processingProfileFor("")
+	procCtx, cancel := context.WithTimeout(r.Context(), profile.Deadline)
+	defer cancel()
+
+	sourcePath, err := cfg.downloadObjectFromBucket(procCtx, bucket, key, "trim-source")
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't download video", err)
+		return
+	}
+	defer os.Remove(sourcePath)
+	if source.Duration == nil {
+		// Rows from before durations were stored
+		duration, err := getVideoDuration(procCtx, sourcePath)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't get video duration", err)
+			return
+		}
+		err = trim.validate(duration)
+		if err != nil {
+			respondWithErrorType(w, http.StatusBadRequest, problemInvalidTrimRange, err.Error(), err)
+			return
+		}
+	}
+	aligned, err := isKeyframeAt(procCtx, sourcePath, trim.Start)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't find keyframes", err)
+		return
+	}
+	trim.Accurate = !aligned
+	trimmedPath, err := trimVideo(procCtx, sourcePath, trim)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't trim video", err)
+		return
+	}
+	defer os.Remove(trimmedPath)
+
+	clip, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: source.Description,
+		UserID:      source.UserID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		return
+	}
+	name, err := randomAssetName()
+	if err != nil {
+		cfg.discardTrimmedClip(r.Context(), clip.ID, "", "")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return
+	}
+	rawKey := fmt.Sprintf("raw/%s/%s.mp4", clip.ID, name)
+	// Staged where the clip will be stored, which may not be the source's bucket
+	clipBucket, err := cfg.bucketForUser(clip.UserID)
+	if err != nil {
+		cfg.discardTrimmedClip(r.Context(), clip.ID, "", "")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
+		return
+	}
+	err = cfg.uploadFileToBucket(procCtx, clipBucket, rawKey, trimmedPath, "video/mp4")
+	if err != nil {
+		cfg.discardTrimmedClip(r.Context(), clip.ID, "", "")
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't upload clip", err)
+		return
+	}
+	clip, err = cfg.finishDirectUpload(procCtx, clip, clipBucket, rawKey, "video/mp4", profile)
+	if err != nil {
+		cfg.discardTrimmedClip(r.Context(), clip.ID, clipBucket, rawKey)
+		respondWithUploadError(w, procCtx, "Couldn't process clip", err)
+		return
+	}
+	cfg.webhooks.dispatch(webhookEventReady, clip.ID, cfg.videoEventData(r.Context(), clip))
+
+	clip, err = cfg.dbVideoToSignedVideo(r.Context(), clip, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	cfg.respondWithContent(w, r, http.StatusCreated, clip)
+}
+
+// discardTrimmedClip removes the row and raw upload of a clip that failed
+// before it was published.
+func (cfg *apiConfig) discardTrimmedClip(ctx context.Context, clipID uuid.UUID, bucket, rawKey string) {
+	if rawKey != "" {
+		cfg.discardRawUpload(ctx, bucket, rawKey)
+	}
+	err := cfg.db.DeleteVideo(clipID)
+	if err != nil {
+		log.Printf("Couldn't delete failed clip %s: %v", clipID, err)
+	}
+}
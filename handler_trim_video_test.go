@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestTrimVideo(t *testing.T) {
+	// The probed video is 12.5s long with keyframes at 0, 2 and 4s
+	installFakeProcessingTools(t, fakeProbeOutput)
+	installFakeTool(t, "ffmpeg", `for last in "$@"; do :; done
+case "$last" in
+*.trimmed.mp4) echo "$*" > "$FAKE_FFMPEG_TRIM" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantArgs []string
+	}{
+		{name: "on a keyframe", body: `{"start": 2, "end": 6}`, wantCode: http.StatusCreated, wantArgs: []string{"-ss 2.000 -i", "-t 4.000", "-c copy"}},
+		{name: "between keyframes", body: `{"start": 3, "end": 6, "title": "highlight"}`, wantCode: http.StatusCreated, wantArgs: []string{"-ss 3.000 -t 3.000 -c:v libx264"}},
+		{name: "end past the end", body: `{"start": 2, "end": 15}`, wantCode: http.StatusBadRequest},
+		{name: "start past the end", body: `{"start": 13, "end": 14}`, wantCode: http.StatusBadRequest},
+		{name: "end before start", body: `{"start": 6, "end": 2}`, wantCode: http.StatusBadRequest},
+		{name: "negative start", body: `{"start": -1, "end": 2}`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := filepath.Join(t.TempDir(), "args")
+			t.Setenv("FAKE_FFMPEG_TRIM", args)
+			cfg, store, video, token := newS3Test(t)
+			store.objects["landscape/source.mp4"] = []byte(testMP4)
+			videoURL := cfg.s3CfDistribution + "/landscape/source.mp4"
+			duration := 12.5
+			video.VideoURL = &videoURL
+			video.Duration = &duration
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerTrimVideo(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/trim", video, token, tt.body))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			recorded, err := os.ReadFile(args)
+			if tt.wantCode != http.StatusCreated {
+				if err == nil {
+					t.Errorf("video was trimmed: ffmpeg %s", recorded)
+				}
+				if len(store.objects) != 1 {
+					t.Errorf("rejected trim left %d files, want only the source", len(store.objects))
+				}
+				return
+			}
+			for _, want := range tt.wantArgs {
+				if !strings.Contains(string(recorded), want) {
+					t.Errorf("ffmpeg %s, want %q", strings.TrimSpace(string(recorded)), want)
+				}
+			}
+
+			clip := database.Video{}
+			err = json.NewDecoder(w.Body).Decode(&clip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clip.ID == video.ID || clip.UserID != video.UserID {
+				t.Errorf("clip %s of user %s, want a new video of user %s", clip.ID, clip.UserID, video.UserID)
+			}
+			stored, err := cfg.db.GetVideo(clip.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.VideoURL == nil {
+				t.Fatal("clip wasn't published")
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.VideoURL)
+			if _, ok := store.objects[key]; !ok || strings.HasPrefix(key, "raw/") {
+				t.Errorf("clip stored at %s, want a processed object", key)
+			}
+			if strings.Contains(tt.body, "highlight") != (stored.Title == "highlight") {
+				t.Errorf("clip title = %q", stored.Title)
+			}
+			source, err := cfg.db.GetVideo(video.ID)
+			if err != nil || source.VideoURL == nil || *source.VideoURL != videoURL {
+				t.Errorf("source video changed to %+v", source)
+			}
+		})
+	}
+}
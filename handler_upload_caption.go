@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// captionExtensionTypes is used when the browser doesn't send a useful
+// content type, which is common for .srt files.
+var captionExtensionTypes = map[string]string{
+	".vtt": "text/vtt",
+	".srt": "application/x-subrip",
+}
+
+func (cfg *apiConfig) handlerUploadCaption(w http.ResponseWriter, r *http.Request) {
+	const maxUploadSize = 2 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+
+	language := strings.TrimSpace(r.URL.Query().Get("language"))
+	if !isValidLanguageTag(language) {
+		respondWithError(w, http.StatusBadRequest, "Invalid language tag", nil)
+		return
+	}
+
+	file, header, err := r.FormFile("caption")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+	err = cfg.filenamePolicy.check(header.Filename)
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemRejectedFilename, "Rejected filename: "+err.Error(), err)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/vtt" && mediaType != "application/x-subrip") {
+		mediaType = captionExtensionTypes[strings.ToLower(filepath.Ext(header.Filename))]
+	}
+	if mediaType == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read file", err)
+		return
+	}
+	vtt, err := captionToWebVTT(data, mediaType)
+	if errors.Is(err, errMalformedCaption) {
+		respondWithErrorType(w, http.StatusBadRequest, problemMalformedCaption, err.Error(), err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't convert captions", err)
+		return
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		return
+	}
+	bucket, err := cfg.bucketForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
+		return
+	}
+	key := fmt.Sprintf("captions/%s/%s-%s.vtt", videoID, language, name)
+	err = cfg.objectStoreFor(bucket).put(r.Context(), key, bytes.NewReader(vtt), "text/vtt")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+		return
+	}
+	captionURL := cfg.assetURLForObject(bucket, key)
+
+	// One uploaded track per language; embedded tracks are left alone
+	replaced := []string{}
+	captions := database.Captions{}
+	for _, existing := range video.Captions {
+		if existing.Source == captionSourceUpload && strings.EqualFold(existing.Language, language) {
+			replaced = append(replaced, existing.URL)
+			continue
+		}
+		captions = append(captions, existing)
+	}
+	video.Captions = append(captions, database.Caption{
+		Language: language,
+		Label:    strings.TrimSpace(r.FormValue("label")),
+		URL:      captionURL,
+		Source:   captionSourceUpload,
+	})
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.rollbackAsset(r.Context(), captionURL, videoID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	for _, url := range replaced {
+		err := cfg.deleteAssetByURL(r.Context(), url)
+		if err != nil {
+			log.Printf("Couldn't delete replaced caption %s: %v", url, err)
+		}
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
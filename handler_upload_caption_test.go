@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	testVTT = "WEBVTT\n\nNOTE made by hand\n\n1\n00:00:01.000 --> 00:00:03.500 line:90%\nHello\n\n00:03.500 --> 00:05.000\nWorld\n"
+	testSRT = "1\r\n00:00:01,000 --> 00:00:03,500\r\nHello\r\nthere\r\n\r\n2\r\n00:00:03,500 --> 00:00:05,000\r\nWorld\r\n"
+)
+
+func TestCaptionToWebVTT(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		mediaType string
+		want      string
+		wantErr   bool
+	}{
+		{name: "valid VTT", data: testVTT, mediaType: "text/vtt", want: testVTT},
+		{
+			name:      "SRT converted",
+			data:      testSRT,
+			mediaType: "application/x-subrip",
+			want:      "WEBVTT\n\n00:00:01.000 --> 00:00:03.500\nHello\nthere\n\n00:00:03.500 --> 00:00:05.000\nWorld\n",
+		},
+		{name: "VTT without header", data: "00:00:01.000 --> 00:00:02.000\nHi\n", mediaType: "text/vtt", wantErr: true},
+		{name: "malformed VTT cue", data: "WEBVTT\n\n00:00:01.000 -> 00:00:02.000\nHi\n", mediaType: "text/vtt", wantErr: true},
+		{name: "VTT cue ending before it starts", data: "WEBVTT\n\n00:00:05.000 --> 00:00:02.000\nHi\n", mediaType: "text/vtt", wantErr: true},
+		{name: "malformed SRT cue", data: "1\n00:00:01.000 --> 00:00:02,000\nHi\n", mediaType: "application/x-subrip", wantErr: true},
+		{name: "SRT without cue number", data: "one\n00:00:01,000 --> 00:00:02,000\nHi\n", mediaType: "application/x-subrip", wantErr: true},
+		{name: "empty VTT", data: "WEBVTT\n", mediaType: "text/vtt", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := captionToWebVTT([]byte(tt.data), tt.mediaType)
+		if tt.wantErr {
+			if !errors.Is(err, errMalformedCaption) {
+				t.Errorf("%s: error = %v, want errMalformedCaption", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newCaptionUploadRequest uploads content as the caption form file in
+// language.
+func newCaptionUploadRequest(t *testing.T, video database.Video, token, language, fileName, contentType, content string) *http.Request {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="caption"; filename="`+fileName+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+	req := newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/captions", video, token, body.String())
+	req.URL.RawQuery = url.Values{"language": {language}}.Encode()
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestUploadCaption(t *testing.T) {
+	tests := []struct {
+		name        string
+		language    string
+		fileName    string
+		contentType string
+		content     string
+		wantCode    int
+		wantVTT     string
+	}{
+		{name: "valid VTT", language: "en", fileName: "en.vtt", contentType: "text/vtt", content: testVTT, wantCode: http.StatusOK, wantVTT: testVTT},
+		// Browsers rarely know the SubRip type
+		{name: "SRT by extension", language: "pt-BR", fileName: "pt.srt", contentType: "application/octet-stream", content: testSRT, wantCode: http.StatusOK, wantVTT: "WEBVTT\n\n00:00:01.000 --> 00:00:03.500\nHello\nthere\n"},
+		{name: "malformed cue", language: "en", fileName: "en.vtt", contentType: "text/vtt", content: "WEBVTT\n\n00:00:01 --> soon\nHi\n", wantCode: http.StatusBadRequest},
+		{name: "not BCP-47", language: "english please", fileName: "en.vtt", contentType: "text/vtt", content: testVTT, wantCode: http.StatusBadRequest},
+		{name: "no language", fileName: "en.vtt", contentType: "text/vtt", content: testVTT, wantCode: http.StatusBadRequest},
+		{name: "not captions", language: "en", fileName: "en.txt", contentType: "text/plain", content: testVTT, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadCaption(w, newCaptionUploadRequest(t, video, token, tt.language, tt.fileName, tt.contentType, tt.content))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				if len(store.objects) != 0 {
+					t.Errorf("rejected caption stored %d files", len(store.objects))
+				}
+				return
+			}
+			got := database.Video{}
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Captions) != 1 || got.Captions[0].Language != tt.language {
+				t.Fatalf("response captions = %+v, want one %s track", got.Captions, tt.language)
+			}
+			key, _ := cfg.s3KeyFromURL(got.Captions[0].URL)
+			if !strings.HasPrefix(key, "captions/"+video.ID.String()+"/"+tt.language+"-") || !strings.HasSuffix(key, ".vtt") {
+				t.Errorf("caption stored at %s, want captions/%s/%s-<name>.vtt", key, video.ID, tt.language)
+			}
+			if stored := string(store.objects[key]); !strings.HasPrefix(stored, tt.wantVTT) || store.contentTypes[key] != "text/vtt" {
+				t.Errorf("stored %q as %q, want WebVTT starting %q", stored, store.contentTypes[key], tt.wantVTT)
+			}
+		})
+	}
+}
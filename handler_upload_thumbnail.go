@@ -1,19 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/xml"
 	//"encoding/base64"
 	"crypto/rand"
 	"encoding/base64"
-	"fmt"
+	"errors"
 	"io"
+	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
@@ -24,38 +29,66 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	ctx := r.Context()
+	trace.SpanFromContext(ctx).SetAttributes(videoIDAttribute(videoIDString))
+
+	_, authSpan := tracer().Start(ctx, "thumbnail.auth")
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
+		endSpan(authSpan, err)
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
 
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	endSpan(authSpan, err)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	addLogFields(w, "video_id", videoID, "user_id", userID)
+	requestLogger(w).Info("uploading thumbnail")
 
 	const maxMemory = 10 << 20
+	// Leave room for the multipart framing and other fields
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.thumbnailMaxBytes+1<<20)
 	r.ParseMultipartForm(maxMemory)
 
 	// "thumbnail" should match the HTML form input name
 	file, header, err := r.FormFile("thumbnail")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
 		return
 	}
 	defer file.Close()
+	addLogFields(w, "bytes", header.Size)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("upload.size", header.Size))
+	if header.Size > cfg.thumbnailMaxBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", nil)
+		return
+	}
+	err = cfg.filenamePolicy.check(header.Filename)
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemRejectedFilename, "Rejected filename: "+err.Error(), err)
+		return
+	}
 
 	ContentType := header.Header.Get("Content-Type")
-	data, err := io.ReadAll(file)
+	upload, err := readThumbnailUpload(file)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't read file", err)
 		return
 	}
+	if header.Size < cfg.minThumbnailBytes {
+		respondWithError(w, http.StatusBadRequest, "Empty or truncated file", nil)
+		return
+	}
 
 	VideoMeta, err := cfg.db.GetVideo(videoID)
 	if err != nil {
@@ -74,17 +107,76 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
+	addLogFields(w, "media_type", mediaType)
+	extension, ok := thumbnailExtensions[mediaType]
+	if !ok {
 		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
 		return
 	}
-
-	parts := strings.Split(mediaType, "/")
-	if len(parts) != 2 {
-		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
+	if !contentMatchesMediaType(mediaType, upload.head) {
+		respondWithError(w, http.StatusBadRequest, "File content doesn't match its media type", nil)
+		return
+	}
+	_, probeSpan := tracer().Start(ctx, "thumbnail.probe", trace.WithAttributes(attribute.String("image.media_type", mediaType)))
+	err = checkThumbnailDimensions(upload.reader(), cfg.thumbnailMaxDimension)
+	var gifErr error
+	if err == nil && mediaType == "image/gif" {
+		gifErr = checkStaticGIF(upload.reader())
+	}
+	endSpan(probeSpan, errors.Join(err, gifErr))
+	if errors.Is(err, errThumbnailTooLarge) {
+		respondWithErrorType(w, http.StatusRequestEntityTooLarge, problemThumbnailTooLarge, err.Error(), err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail dimensions", err)
+		return
+	}
+	if gifErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid GIF thumbnail", gifErr)
 		return
 	}
-	extension := parts[1]
+
+	// Only read the whole image when something has to decode or rewrite it;
+	// otherwise it is streamed to the store as uploaded
+	var data []byte
+	if cfg.thumbnailNeedsWholeImage() {
+		data, err = io.ReadAll(upload.reader())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read file", err)
+			return
+		}
+	}
+
+	// Drop EXIF and friends before anything is stored or measured; the
+	// orientation they carry is applied first
+	if cfg.stripThumbnailMetadata {
+		_, stripSpan := tracer().Start(ctx, "thumbnail.strip_metadata")
+		data, err = stripImageMetadata(data, mediaType, cfg.thumbnailJPEGQuality)
+		endSpan(stripSpan, err)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode thumbnail", err)
+			return
+		}
+	}
+
+	// Catch cover art that doesn't fit the video
+	warnings := []string{}
+	if cfg.thumbnailAspectCheck != thumbnailAspectCheckOff && VideoMeta.AspectRatio != nil {
+		mismatch, err := thumbnailAspectMismatch(upload.readerOf(data), *VideoMeta.AspectRatio, cfg.thumbnailAspectTolerance)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail dimensions", err)
+			return
+		}
+		if mismatch != "" {
+			if cfg.thumbnailAspectCheck == thumbnailAspectCheckReject {
+				respondWithErrorType(w, http.StatusUnprocessableEntity, problemThumbnailAspectMismatch, mismatch, nil)
+				return
+			}
+			warnings = append(warnings, mismatch)
+		}
+	}
+
 	randomBytes := make([]byte, 32)
 	_, err = rand.Read(randomBytes)
 	if err != nil {
@@ -92,18 +184,27 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	name := base64.RawURLEncoding.EncodeToString(randomBytes)
-	fileName := name + "." + extension
-	filePath := filepath.Join(cfg.assetsRoot, fileName)
-	filePoint, err := os.Create(filePath)
+	fileName := name + extension
+	_, storeSpan := tracer().Start(ctx, "thumbnail.store", trace.WithAttributes(
+		attribute.Int64("upload.size", header.Size),
+		attribute.String("thumbnail.file", fileName),
+	))
+	thumbnailURL, err := cfg.thumbnailStore.put(ctx, fileName, upload.readerOf(data), mediaType)
+	endSpan(storeSpan, err)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
 		return
 	}
-	defer filePoint.Close()
-
-	io.Copy(filePoint, strings.NewReader(string(data)))
-
-
+	// Anything stored from here on goes again if the video isn't updated
+	createdAssets := []string{thumbnailURL}
+	saved := false
+	defer func() {
+		if !saved {
+			cleanupCtx, cancel := cleanupContext()
+			defer cancel()
+			cfg.discardThumbnails(cleanupCtx, videoID, createdAssets)
+		}
+	}()
 
 	// videoThumbnails[videoID] = thumbnail{
 	// 	data:      data,
@@ -111,13 +212,134 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	// }
 
 	//dataEnc := base64.StdEncoding.EncodeToString(data)
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, fileName)
+	previous := VideoMeta
+	VideoMeta.ThumbnailVariants = database.ThumbnailVariants{
+		readThumbnailVariant(upload.readerOf(data), mediaType, thumbnailURL),
+	}
+	// Offer WebP alongside a JPEG default so clients can negotiate
+	asyncVariants := cfg.thumbnailDualFormat && cfg.thumbnailVariantsAsync
+	if asyncVariants {
+		VideoMeta.ThumbnailVariants = append(VideoMeta.ThumbnailVariants, pendingThumbnailVariants(mediaType)...)
+	} else if cfg.thumbnailDualFormat {
+		_, formatsSpan := tracer().Start(ctx, "thumbnail.formats")
+		jpegURL, renditions, err := cfg.storeThumbnailFormats(ctx, data, mediaType, thumbnailURL, name)
+		formatsSpan.SetAttributes(attribute.Int("thumbnail.renditions", len(renditions)))
+		endSpan(formatsSpan, err)
+		for _, rendition := range renditions {
+			createdAssets = append(createdAssets, rendition.url)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't convert thumbnail", err)
+			return
+		}
+		thumbnailURL = jpegURL
+		VideoMeta.ThumbnailVariants = database.ThumbnailVariants{}
+		for _, rendition := range renditions {
+			VideoMeta.ThumbnailVariants = append(VideoMeta.ThumbnailVariants, newThumbnailVariant(rendition.data, rendition.contentType, rendition.url))
+		}
+	}
+	// Narrower JPEGs so grid tiles don't fetch the full image
+	sizes := database.StringMap{}
+	_, sizesSpan := tracer().Start(ctx, "thumbnail.sizes")
+	sized, err := cfg.storeThumbnailSizes(ctx, data, name)
+	sizesSpan.SetAttributes(attribute.Int("thumbnail.renditions", len(sized)))
+	endSpan(sizesSpan, err)
+	for _, rendition := range sized {
+		createdAssets = append(createdAssets, rendition.url)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resize thumbnail", err)
+		return
+	}
+	for _, rendition := range sized {
+		variant := newThumbnailVariant(rendition.data, rendition.contentType, rendition.url)
+		VideoMeta.ThumbnailVariants = append(VideoMeta.ThumbnailVariants, variant)
+		sizes[strconv.Itoa(variant.Width)] = rendition.url
+	}
 	VideoMeta.ThumbnailURL = &thumbnailURL
+	cfg.setVideoLQIP(&VideoMeta, data)
 	err = cfg.db.UpdateVideo(VideoMeta)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
+	saved = true
+
+	// Remove the replaced thumbnail, best effort
+	cfg.cleanupReplacedThumbnail(ctx, VideoMeta, previous)
+	cfg.invalidateReplacedThumbnail(ctx, previous)
+	if asyncVariants {
+		_, err = cfg.jobs.enqueue(jobTypeThumbnailVariants, videoID, thumbnailVariantsPayload{
+			FileName:  fileName,
+			Name:      name,
+			MediaType: mediaType,
+		})
+		if err != nil {
+			log.Printf("Couldn't queue thumbnail variants for video %s: %v", videoID, err)
+		}
+	}
+
+	type response struct {
+		XMLName      xml.Name                   `json:"-" xml:"thumbnail"`
+		ThumbnailURL string                     `json:"thumbnail_url" xml:"thumbnail_url"`
+		Variants     database.ThumbnailVariants `json:"variants,omitempty" xml:"variant,omitempty"`
+		Sizes        database.StringMap         `json:"sizes,omitempty" xml:"sizes,omitempty"`
+		Warnings     []string                   `json:"warnings,omitempty" xml:"warning,omitempty"`
+	}
+	cfg.respondWithContent(w, r, http.StatusOK, response{
+		ThumbnailURL: thumbnailURL,
+		Variants:     VideoMeta.ThumbnailVariants,
+		Sizes:        sizes,
+		Warnings:     warnings,
+	})
+}
+
+// thumbnailUpload is an uploaded thumbnail read straight from the multipart
+// file. head is its start, read up front for type sniffing.
+type thumbnailUpload struct {
+	file multipart.File
+	size int64
+	head []byte
+}
+
+func readThumbnailUpload(file multipart.File) (thumbnailUpload, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return thumbnailUpload{}, err
+	}
+	head := make([]byte, 512)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return thumbnailUpload{}, err
+	}
+	return thumbnailUpload{file: file, size: size, head: head[:n]}, nil
+}
+
+/**
+ * Read the whole thumbnail from the start
+ * Each call is an independent pass over the file, which is never
+ * buffered. The reader seeks, so the S3 client can size the body and
+ * rewind it to retry a put
+ */
+func (u thumbnailUpload) reader() io.ReadSeeker {
+	return io.NewSectionReader(u.file, 0, u.size)
+}
+
+// readerOf reads data when the thumbnail was read into memory, e.g. to
+// strip its metadata, and streams the upload otherwise.
+func (u thumbnailUpload) readerOf(data []byte) io.ReadSeeker {
+	if data != nil {
+		return bytes.NewReader(data)
+	}
+	return u.reader()
+}
 
-	respondWithJSON(w, http.StatusOK, struct{}{})
+// thumbnailNeedsWholeImage reports whether an upload has to be held in
+// memory: stripping metadata, the renditions made during the request, the
+// size variants and the placeholder all decode the full image.
+func (cfg *apiConfig) thumbnailNeedsWholeImage() bool {
+	return cfg.stripThumbnailMetadata ||
+		(cfg.thumbnailDualFormat && !cfg.thumbnailVariantsAsync) ||
+		len(cfg.thumbnailSizes) > 0 ||
+		cfg.lqipEnabled
 }
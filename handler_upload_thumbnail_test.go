@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func newTestDB(t *testing.T) database.Client {
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return db
+}
+
+// newThumbnailTest builds a config over a temp database and assets
+// directory holding one video, and returns it with its owner's token.
+func newThumbnailTest(t *testing.T) (*apiConfig, database.Video, string) {
+	cfg := &apiConfig{
+		db:                    newTestDB(t),
+		jwtSecret:             "test-secret",
+		assetsRoot:            t.TempDir(),
+		port:                  "8091",
+		scheduler:             newProcessingScheduler(2, 1, 10),
+		thumbnailMaxBytes:     10 << 20,
+		thumbnailMaxDimension: 8192,
+	}
+	cfg.thumbnailStore = localThumbnailStore{cfg: cfg}
+	cfg.processor = ffmpegProcessor{cfg: cfg}
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "upload", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, video, token
+}
+
+func newVideoRequest(method, target string, video database.Video, token, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.SetPathValue("videoID", video.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// failingThumbnailStore fails to store any file whose name ends in failOn.
+type failingThumbnailStore struct {
+	thumbnailStore
+	failOn string
+}
+
+func (s failingThumbnailStore) put(ctx context.Context, fileName string, body io.Reader, contentType string) (string, error) {
+	if s.failOn != "" && strings.HasSuffix(fileName, s.failOn) {
+		return "", errors.New("store unavailable")
+	}
+	return s.thumbnailStore.put(ctx, fileName, body, contentType)
+}
+
+func newThumbnailUploadRequest(t *testing.T, video database.Video, token string) *http.Request {
+	var image bytes.Buffer
+	err := png.Encode(&image, testPNG(200, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thumbnailUploadRequest(t, video, token, "image/png", image.Bytes())
+}
+
+// thumbnailUploadRequest builds a multipart upload of content as the
+// thumbnail form file, declared as mediaType.
+func thumbnailUploadRequest(t *testing.T, video database.Video, token, mediaType string, content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="thumbnail"; filename="cover.png"`)
+	header.Set("Content-Type", mediaType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	req := newVideoRequest(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), video, token, body.String())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func testPNG(width, height int) image.Image {
+	return image.NewGray(image.Rect(0, 0, width, height))
+}
+
+func TestUploadThumbnailReplacesPrevious(t *testing.T) {
+	tests := []struct {
+		name     string
+		cleanup  bool
+		wantKept bool
+	}{
+		{name: "cleanup on", cleanup: true, wantKept: false},
+		{name: "cleanup off", cleanup: false, wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, video, token := newThumbnailTest(t)
+			cfg.cleanupOldThumbnails = tt.cleanup
+			files := []string{}
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+				if w.Code != http.StatusOK {
+					t.Fatalf("upload %d status = %d: %s", i, w.Code, w.Body)
+				}
+				stored, err := cfg.db.GetVideo(video.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				name, ok := strings.CutPrefix(*stored.ThumbnailURL, "http://localhost:8091/assets/")
+				if !ok {
+					t.Fatalf("thumbnail URL = %s, want a local asset", *stored.ThumbnailURL)
+				}
+				files = append(files, filepath.Join(cfg.assetsRoot, name))
+			}
+
+			for i, file := range files {
+				_, err := os.Stat(file)
+				// The second upload is always kept
+				want := i == 1 || tt.wantKept
+				if (err == nil) != want {
+					t.Errorf("upload %d's %s kept = %v, want %v", i, filepath.Base(file), err == nil, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadThumbnailReplacementFails(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+	cfg.thumbnailMaxBytes = 10 << 20
+	cfg.thumbnailMaxDimension = 8192
+	cfg.thumbnailSizes = []thumbnailSize{{Width: 80, Quality: 80}}
+	cfg.cleanupOldThumbnails = true
+	thumbnails := failingThumbnailStore{thumbnailStore: s3ThumbnailStore{cfg: cfg}}
+	cfg.thumbnailStore = thumbnails
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first upload status = %d: %s", w.Code, w.Body)
+	}
+	original, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep := map[string][]byte{}
+	for key, data := range store.objects {
+		keep[key] = data
+	}
+	if len(keep) != 2 {
+		t.Fatalf("first upload stored %d files, want the thumbnail and one size", len(keep))
+	}
+
+	// The replacement's source is stored, its resized copy isn't
+	thumbnails.failOn = "-80w.jpeg"
+	cfg.thumbnailStore = thumbnails
+	w = httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("replacement status = %d, want 500: %s", w.Code, w.Body)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stored.ThumbnailURL != *original.ThumbnailURL {
+		t.Errorf("thumbnail URL = %s, want the original %s", *stored.ThumbnailURL, *original.ThumbnailURL)
+	}
+	if len(store.objects) != len(keep) {
+		t.Errorf("bucket holds %d files after the failed replacement, want the original %d", len(store.objects), len(keep))
+	}
+	for key := range keep {
+		if _, ok := store.objects[key]; !ok {
+			t.Errorf("original %s was deleted", key)
+		}
+	}
+}
+
+func TestUploadThumbnailRejectsEmptyFile(t *testing.T) {
+	cfg, video, token := newThumbnailTest(t)
+	cfg.minThumbnailBytes = 1
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video, token, "image/png", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Empty or truncated file") {
+		t.Errorf("status = %d, want 400 Empty or truncated file: %s", w.Code, w.Body)
+	}
+	files, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("empty thumbnail was stored")
+	}
+}
+
+func TestUploadThumbnailAspectCheck(t *testing.T) {
+	tests := []struct {
+		mode        string
+		wantCode    int
+		wantWarning bool
+	}{
+		{mode: thumbnailAspectCheckOff, wantCode: http.StatusOK},
+		{mode: thumbnailAspectCheckWarn, wantCode: http.StatusOK, wantWarning: true},
+		{mode: thumbnailAspectCheckReject, wantCode: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg, video, token := newThumbnailTest(t)
+			cfg.thumbnailAspectCheck = tt.mode
+			cfg.thumbnailAspectTolerance = 0.1
+			ratio := "16:9"
+			video.AspectRatio = &ratio
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Portrait cover art on a landscape video
+			var portrait bytes.Buffer
+			err = png.Encode(&portrait, testPNG(90, 160))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video, token, "image/png", portrait.Bytes()))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			warned := strings.Contains(w.Body.String(), "Thumbnail is 90x160 but the video is 16:9")
+			if tt.wantCode == http.StatusOK && warned != tt.wantWarning {
+				t.Errorf("warned = %v, want %v: %s", warned, tt.wantWarning, w.Body)
+			}
+			files, err := os.ReadDir(cfg.assetsRoot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := len(files) != 0; stored != (tt.wantCode == http.StatusOK) {
+				t.Errorf("thumbnail stored = %v with status %d", stored, w.Code)
+			}
+		})
+	}
+}
+
+func TestThumbnailUploadReader(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "shorter than the head", size: 100},
+		{name: "exactly the head", size: 512},
+		{name: "longer than the head", size: 64 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+			file := openTempFile(t, content)
+			upload, err := readThumbnailUpload(file)
+			if err != nil {
+				t.Fatalf("readThumbnailUpload: %v", err)
+			}
+			if want := min(tt.size, 512); len(upload.head) != want {
+				t.Errorf("head is %d bytes, want %d", len(upload.head), want)
+			}
+			// Every pass sees the whole file, head included
+			for pass := 0; pass < 2; pass++ {
+				got, err := io.ReadAll(upload.reader())
+				if err != nil {
+					t.Fatalf("pass %d: %v", pass, err)
+				}
+				if !bytes.Equal(got, content) {
+					t.Errorf("pass %d read %d bytes, want the %d uploaded", pass, len(got), len(content))
+				}
+			}
+		})
+	}
+}
+
+func openTempFile(tb testing.TB, content []byte) *os.File {
+	path := filepath.Join(tb.TempDir(), "thumbnail")
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { file.Close() })
+	return file
+}
+
+// discardObjectStore drops everything written to it.
+
+type discardObjectStore struct{}
+
+func (discardObjectStore) put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	_, err := io.Copy(io.Discard, body)
+	return err
+}
+
+func (discardObjectStore) delete(ctx context.Context, key string) error {
+	return nil
+}
+
+// Storing a 10 MB thumbnail: buffering it first allocates the whole image
+// per upload, streaming only the sniffed head and copy buffers.
+func BenchmarkThumbnailStorePut(b *testing.B) {
+	content := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 10<<20)...)
+	file := openTempFile(b, content)
+	store := s3ThumbnailStore{cfg: &apiConfig{store: discardObjectStore{}}}
+	ctx := context.Background()
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			file.Seek(0, io.SeekStart)
+			data, err := io.ReadAll(file)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = store.put(ctx, "bench.png", bytes.NewReader(data), "image/png")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			file.Seek(0, io.SeekStart)
+			upload, err := readThumbnailUpload(file)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = store.put(ctx, "bench.png", upload.reader(), "image/png")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestUploadThumbnailTypes(t *testing.T) {
+	encoded := func(encode func(w io.Writer) error) []byte {
+		var buf bytes.Buffer
+		err := encode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	jpegData := encoded(func(w io.Writer) error { return jpeg.Encode(w, testImage(), nil) })
+	pngData := encoded(func(w io.Writer) error { return png.Encode(w, testImage()) })
+	gifData := encoded(func(w io.Writer) error { return gif.Encode(w, testImage(), nil) })
+	animatedGIF := encoded(func(w io.Writer) error {
+		return gif.EncodeAll(w, &gif.GIF{Image: []*image.Paletted{testImage(), testImage()}, Delay: []int{10, 10}})
+	})
+
+	tests := []struct {
+		name          string
+		mediaType     string
+		content       []byte
+		wantCode      int
+		wantExtension string
+	}{
+		{name: "jpeg", mediaType: "image/jpeg", content: jpegData, wantCode: http.StatusOK, wantExtension: ".jpg"},
+		{name: "png", mediaType: "image/png", content: pngData, wantCode: http.StatusOK, wantExtension: ".png"},
+		{name: "webp", mediaType: "image/webp", content: []byte(testWebP), wantCode: http.StatusOK, wantExtension: ".webp"},
+		{name: "static gif", mediaType: "image/gif", content: gifData, wantCode: http.StatusOK, wantExtension: ".gif"},
+		{name: "animated gif", mediaType: "image/gif", content: animatedGIF, wantCode: http.StatusBadRequest},
+		{name: "unsupported type", mediaType: "image/bmp", content: pngData, wantCode: http.StatusBadRequest},
+		{name: "content of another type", mediaType: "image/jpeg", content: pngData, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.thumbnailMaxBytes = 10 << 20
+			cfg.thumbnailMaxDimension = 8192
+			cfg.thumbnailStore = s3ThumbnailStore{cfg: cfg}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video, token, tt.mediaType, tt.content))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				if len(store.objects) != 0 {
+					t.Errorf("rejected thumbnail stored %d files", len(store.objects))
+				}
+				return
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, key, _ := cfg.s3ObjectFromURL(*stored.ThumbnailURL)
+			if filepath.Ext(key) != tt.wantExtension {
+				t.Errorf("stored as %s, want a %s file", key, tt.wantExtension)
+			}
+			if store.contentTypes[key] != tt.mediaType {
+				t.Errorf("stored with type %q, want %q", store.contentTypes[key], tt.mediaType)
+			}
+		})
+	}
+}
+
+// pngHeader is a PNG that claims to be width by height but holds no pixel
+// data, so anything past image.DecodeConfig fails on it.
+func pngHeader(width, height int) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[8:], uint32(height))
+	ihdr[12] = 8 // bit depth, then grayscale, deflate, no filter or interlace
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, 13)
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestUploadThumbnailLimits(t *testing.T) {
+	var small bytes.Buffer
+	err := png.Encode(&small, testPNG(200, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := func(size int) []byte {
+		return append(bytes.Clone(small.Bytes()), make([]byte, size-small.Len())...)
+	}
+	tests := []struct {
+		name     string
+		content  []byte
+		wantCode int
+		wantBody string
+	}{
+		{name: "within limits", content: small.Bytes(), wantCode: http.StatusOK},
+		{name: "file over the byte limit", content: padded(64 << 10), wantCode: http.StatusRequestEntityTooLarge, wantBody: "Thumbnail is too large"},
+		{name: "request over the byte limit", content: padded(2 << 20), wantCode: http.StatusRequestEntityTooLarge, wantBody: "Thumbnail is too large"},
+		{name: "too wide", content: pngHeader(20000, 100), wantCode: http.StatusRequestEntityTooLarge, wantBody: "20000x100"},
+		{name: "too tall", content: pngHeader(100, 20000), wantCode: http.StatusRequestEntityTooLarge, wantBody: "100x20000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.thumbnailMaxBytes = 32 << 10
+			cfg.thumbnailMaxDimension = 4096
+			cfg.thumbnailStore = s3ThumbnailStore{cfg: cfg}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video, token, "image/png", tt.content))
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Fatalf("status = %d, want %d %s: %s", w.Code, tt.wantCode, tt.wantBody, w.Body)
+			}
+			if tt.wantCode != http.StatusOK && len(store.objects) != 0 {
+				t.Errorf("oversized thumbnail reached the bucket")
+			}
+		})
+	}
+}
@@ -1,28 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
+	"net/textproto"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// What a second concurrent upload to the same video does.
+const (
+	duplicateUploadReject = "reject"
+	duplicateUploadQueue  = "queue"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 
-	http.MaxBytesReader(w, r.Body, 1<<30)
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
 
 	//Get videoID from URL
 	videoIDString := r.PathValue("videoID")
@@ -31,17 +47,24 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
 		return
 	}
+	ctx := r.Context()
+	trace.SpanFromContext(ctx).SetAttributes(videoIDAttribute(videoIDString))
+
 	// Authenticate user
+	_, authSpan := tracer().Start(ctx, "upload.auth")
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
+		endSpan(authSpan, err)
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	endSpan(authSpan, err)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	addLogFields(w, "video_id", videoID, "user_id", userID)
 
 	// Load video from database
 	videoDb, err := cfg.db.GetVideo(videoID)
@@ -56,26 +79,126 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Upload video to memory
-	file, header, err := r.FormFile("video")
+	// One upload per video at a time, so a double submit can't race
+	if cfg.duplicateUploadAction == duplicateUploadQueue {
+		err = cfg.uploadLocks.Lock(r.Context(), videoID)
+		if err != nil {
+			respondWithError(w, http.StatusServiceUnavailable, "Upload cancelled while waiting for another upload", err)
+			return
+		}
+	} else if !cfg.uploadLocks.TryLock(videoID) {
+		respondWithError(w, http.StatusConflict, "Another upload for this video is in progress", nil)
+		return
+	}
+	defer cfg.uploadLocks.Unlock(videoID)
+
+	// Re-uploading over a processed video needs ?force=true
+	previousVideo := videoDb
+	forced, ok := cfg.allowReupload(w, r, videoDb)
+	if !ok {
+		return
+	}
+	if forced {
+		videoDb.CodecRenditions = nil
+	}
+
+	// Stream the file part, r.FormFile would spool it to memory and disk
+	// before we could look at a byte
+	form, err := readUploadForm(r, "video")
+	if respondWithBodyError(w, err) {
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
 		return
 	}
+	file := form.file
 	defer file.Close()
+	err = cfg.filenamePolicy.check(file.FileName())
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemRejectedFilename, "Rejected filename: "+err.Error(), err)
+		return
+	}
+
+	// Ephemeral videos are removed by the reaper after expiresIn
+	var expiresAt *time.Time
+	if expiresIn := form.value("expiresIn"); expiresIn != "" {
+		ttl, err := time.ParseDuration(expiresIn)
+		if err != nil || ttl <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid expiresIn", err)
+			return
+		}
+		if ttl > cfg.maxVideoTTL {
+			respondWithErrorType(w, http.StatusBadRequest, problemExpiresInTooLong, fmt.Sprintf("expiresIn can't be more than %s", cfg.maxVideoTTL), nil)
+			return
+		}
+		expiry := time.Now().UTC().Add(ttl)
+		expiresAt = &expiry
+	}
+
+	profile, ok := cfg.processingProfileFor(form.value("profile"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Unknown processing profile", nil)
+		return
+	}
+
+	// Archival uploads can pick a colder storage class for the video
+	if value := form.value("storageClass"); value != "" {
+		class, err := parseStorageClass(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid storageClass", err)
+			return
+		}
+		ctx = withStorageClass(ctx, class)
+		r = r.WithContext(ctx)
+	}
 
-	// Check if is file mp4 video
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	// Only keep the requested segment of the upload
+	trim, err := parseTrimRange(form.value("trimStart"), form.value("trimEnd"), form.value("trimAccurate"), cfg.trimAccurate)
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemInvalidTrimRange, err.Error(), err)
+		return
+	}
+
+	// Check if is file a video we can process, anything but mp4 is transcoded
+	mediaType, _, err := mime.ParseMediaType(file.Header.Get("Content-Type"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid media type", err)
 		return
 	}
-	if mediaType != "video/mp4" {
+	if !uploadVideoTypes[mediaType] {
 		respondWithError(w, http.StatusBadRequest, "Invalid media type", err)
 		return
 	}
+	addLogFields(w, "media_type", mediaType)
+	// Faststart mp4s that need no processing skip the temp file
+	var upload io.Reader = file
+	if cfg.canStreamPassthrough(videoDb, mediaType, file.Header, trim, profile) {
+		prefix, err := readUploadPrefix(file)
+		if respondWithBodyError(w, err) {
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read file", err)
+			return
+		}
+		if len(prefix) == 0 {
+			respondWithError(w, http.StatusBadRequest, "Empty or truncated file", nil)
+			return
+		}
+		if !contentMatchesMediaType(mediaType, prefix) {
+			respondWithError(w, http.StatusBadRequest, "File content doesn't match its media type", nil)
+			return
+		}
+		if probe, ok := cfg.probeFastStartPrefix(ctx, prefix); ok {
+			cfg.handleStreamPassthrough(w, r, videoDb, previousVideo, forced, expiresAt, profile, probe, io.MultiReader(bytes.NewReader(prefix), file), file.Header)
+			return
+		}
+		upload = io.MultiReader(bytes.NewReader(prefix), file)
+	}
+
 	//Save file in tempory folder
-	tmpFile, err := os.CreateTemp("","video.mp4")
+	tmpFile, err := os.CreateTemp("", "video-upload")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
 		return
@@ -83,103 +206,658 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
 
-	_,err = io.Copy(tmpFile, file)
+	// Gzipped parts are inflated on the way to disk
+	received := &countingReader{r: upload}
+	var source io.Reader = received
+	encoding := strings.ToLower(strings.TrimSpace(file.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(received)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid gzip data", err)
+			return
+		}
+		defer gzipReader.Close()
+		// Read one byte past the cap so we can tell it was exceeded
+		source = io.LimitReader(gzipReader, cfg.maxDecompressedBytes+1)
+	default:
+		respondWithErrorType(w, http.StatusUnsupportedMediaType, problemUnsupportedEncoding, "Unsupported content encoding: "+encoding, nil)
+		return
+	}
+
+	// Don't trust the declared type, check the bytes
+	head, source, err := peekUpload(source)
+	if respondWithBodyError(w, received.err) {
+		return
+	}
 	if err != nil {
+		if encoding == "gzip" {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decompress file", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read file", err)
+		return
+	}
+	// Nothing to sniff, so say what is actually wrong
+	if len(head) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Empty or truncated file", nil)
+		return
+	}
+	if !contentMatchesMediaType(mediaType, head) {
+		respondWithError(w, http.StatusBadRequest, "File content doesn't match its media type", nil)
+		return
+	}
+
+	// Hash the upload while it streams to disk
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hasher), source)
+	if respondWithBodyError(w, received.err) {
+		return
+	}
+	if err != nil {
+		if encoding == "gzip" {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decompress file", err)
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
 		return
 	}
+	if encoding == "gzip" && written > cfg.maxDecompressedBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Decompressed file is too large", nil)
+		return
+	}
+	addLogFields(w, "bytes", received.n)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("upload.size", written))
+	// A part shorter than it declared was cut off mid-upload
+	if declared := declaredPartSize(file.Header); cfg.checkUploadSize && declared >= 0 && received.n != declared {
+		respondWithErrorType(w, http.StatusBadRequest, problemUploadTruncated, fmt.Sprintf("Upload truncated: expected %d bytes, received %d", declared, received.n), nil)
+		return
+	}
+	if written < cfg.minVideoBytes {
+		respondWithError(w, http.StatusBadRequest, "Empty or truncated file", nil)
+		return
+	}
+	uploadHash := hex.EncodeToString(hasher.Sum(nil))
 
-	//reset pointer to start of file
-	tmpFile.Seek(0,io.SeekStart)
+	// Trimming needs the local file, so trimmed uploads are processed here
+	if cfg.asyncProcessing && trim == nil {
+		// The job runs the other checks, banned content isn't even staged
+		err = cfg.checkBannedHash(uploadHash, videoDb)
+		if err != nil {
+			respondWithUploadError(w, ctx, "Couldn't check upload hash", err)
+			return
+		}
+		videoDb.ExpiresAt = expiresAt
+		if cfg.queueUploadProcessing(w, r, videoDb, tmpFile.Name(), mediaType, profile) && forced {
+			cfg.cleanupReuploadedVideo(ctx, videoDb, previousVideo)
+		}
+		return
+	}
 
+	//reset pointer to start of file
+	tmpFile.Seek(0, io.SeekStart)
 
-	//Choose prefix/folder for S3
-	prefix := "other"
-	aspectRation, err := getVideoAspectRatio(tmpFile.Name())
+	// Wait for a processing slot so no user can monopolize ffmpeg
+	release, err := cfg.scheduler.AcquireBounded(r.Context(), userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		respondWithSchedulerError(w, cfg.processingRetryAfter, err)
 		return
 	}
-	switch aspectRation {
-	case "16:9":
-		prefix = "landscape"
-	case "9:16":
-		prefix = "portrait"
+	defer release()
+
+	// Every processing step shares the profile's deadline
+	procCtx, cancel := context.WithTimeout(ctx, profile.Deadline)
+	defer cancel()
+	// Record what the pipeline does for the owner's processing report
+	recorder := cfg.newProcessingRecorder()
+	recorder.input("content_type", mediaType)
+	recorder.input("size", strconv.FormatInt(written, 10))
+	recorder.input("sha256", uploadHash)
+	recorder.input("profile", profile.Name)
+	procCtx = withProcessingRecorder(procCtx, recorder)
+	createdAssets := []string{}
+	stored := false
+	defer func() {
+		if !stored {
+			cfg.abortUpload(procCtx, videoID, createdAssets)
+			cfg.saveFailedReport(videoID, recorder)
+		}
+	}()
+
+	sourcePath := tmpFile.Name()
+	if trim != nil {
+		duration, err := getVideoDuration(procCtx, sourcePath)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't get video duration", err)
+			return
+		}
+		err = trim.validate(duration)
+		if err != nil {
+			respondWithErrorType(w, http.StatusBadRequest, problemInvalidTrimRange, err.Error(), err)
+			return
+		}
+		endStep := recorder.step("trim")
+		trimmedPath, err := trimVideo(procCtx, sourcePath, *trim)
+		endStep(err)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't trim video", err)
+			return
+		}
+		defer os.Remove(trimmedPath)
+		sourcePath = trimmedPath
 	}
 
-	//Move header to start of file
-	processedFileName, err := processVideoForFastStart(tmpFile.Name())
+	// Trimmed clips are checked as published, against the upload's own
+	// head and hash
+	checkedPath, err := cfg.validateVideoSource(procCtx, videoDb, videoSource{path: sourcePath, mediaType: mediaType, head: head, sha256: uploadHash})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+		respondWithUploadError(w, procCtx, "Couldn't check video", err)
 		return
 	}
-	defer os.Remove(processedFileName)
-	processedFile, err := os.OpenFile(processedFileName, os.O_RDONLY, 0666)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+	if checkedPath != sourcePath {
+		defer os.Remove(checkedPath)
+		sourcePath = checkedPath
+	}
+
+	prefix, ok := cfg.probeUploadedVideo(w, procCtx, &videoDb, sourcePath)
+	if !ok {
 		return
 	}
 
-	
-	//Upload video to S3
-	randomBites := make([]byte, 32)
-	_, err = rand.Read(randomBites)
+	//The video and the assets derived from it go to the user's tenant bucket
+	bucket, err := cfg.bucketForUser(userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
 		return
 	}
-	name :=base64.URLEncoding.EncodeToString(randomBites)
-	fileName := prefix + "/" + name + ".mp4"
-	_, err = cfg.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &cfg.s3Bucket,
-		Key: &fileName,
-		Body: processedFile,
-		ContentType: &mediaType,
-	} )
+	err = cfg.validateBucket(procCtx, bucket)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Storage bucket isn't available", err)
 		return
 	}
+	createdAssets = append(createdAssets, cfg.generateUploadAssets(w, procCtx, &videoDb, bucket, sourcePath)...)
+
+	format := profile.Format
+	output, ok := cfg.transcodeUpload(w, procCtx, &videoDb, sourcePath, mediaType, format)
+	if !ok {
+		return
+	}
+	defer output.remove()
+	fileName, ok := cfg.storeTranscodedUpload(w, procCtx, videoID, bucket, prefix, format, output)
+	videoUrl := cfg.assetURLForObject(bucket, fileName)
+	if fileName != "" {
+		// Rolling back the playlist also removes any segments stored with
+		// it, a shared object stays while other videos use it
+		createdAssets = append(createdAssets, videoUrl)
+	}
+	if !ok {
+		return
+	}
+
+	//Encode smaller renditions for slow connections, never upscaling
+	videoDb.ResolutionRenditions = nil
+	if cfg.resolutionRenditions {
+		endStep := recorder.step("resolution_renditions")
+		renditions, err := cfg.generateResolutionRenditions(procCtx, sourcePath, bucket, prefix)
+		endStep(err)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't encode renditions", err)
+			return
+		}
+		videoDb.ResolutionRenditions = renditions
+		for _, url := range renditions {
+			createdAssets = append(createdAssets, url)
+		}
+	}
 
 	//Update video in database
-	videoUrl := fmt.Sprintf("%s/%s", cfg.s3CfDistribution, fileName)
 	//videoUrl := fmt.Sprintf("%s,%s", cfg.s3Bucket, fileName)
 	videoDb.VideoURL = &videoUrl
+	videoDb.ExpiresAt = expiresAt
+	ready := database.VideoStatusReady
+	videoDb.Status = &ready
+	videoDb.ReplicationStatus = nil
+	if cfg.replicationEnabled() && bucket == cfg.s3Bucket {
+		pending := database.ReplicationPending
+		videoDb.ReplicationStatus = &pending
+	}
+	videoDb.ProcessingReport = recorder.finish(reportOutcomeReady)
 	err = cfg.db.UpdateVideo(videoDb)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
+	stored = true
+	cfg.cleanupReplacedAssets(ctx, videoDb, previousVideo, forced)
+	if cfg.replicationEnabled() && bucket == cfg.s3Bucket {
+		cfg.replicateObject(videoID, fileName)
+	}
+	cfg.webhooks.dispatch(webhookEventReady, videoID, cfg.videoEventData(ctx, videoDb))
+
+	videoDb, err = cfg.dbVideoToSignedVideo(ctx, videoDb, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	cfg.respondWithContent(w, r, http.StatusOK, newUploadVideoResponse(videoDb, output.metadata))
+
+}
+
+/**
+ * Probe a checked upload and record what was found on video
+ * Returns the key prefix for the video's orientation. Responds and reports
+ * false when the video can't be probed
+ */
+func (cfg *apiConfig) probeUploadedVideo(w http.ResponseWriter, procCtx context.Context, video *database.Video, sourcePath string) (string, bool) {
+	recorder := processingRecorderFrom(procCtx)
 
-	// videoDb, err = cfg.dbVideoToSignedVideo(videoDb)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
-	// 	return
-	// }
+	//Choose prefix/folder for S3
+	prefix := "other"
+	_, probeSpan := tracer().Start(procCtx, "upload.probe")
+	endStep := recorder.step("probe_aspect_ratio")
+	aspectRation, err := cfg.resolveAspectRatio(procCtx, sourcePath)
+	endStep(err)
+	endSpan(probeSpan, err)
+	if errors.Is(err, errUnclassifiableVideo) {
+		respondWithError(w, http.StatusUnprocessableEntity, "Couldn't determine the video's dimensions", err)
+		return "", false
+	}
+	if errors.Is(err, errUnreadableVideo) {
+		respondWithError(w, http.StatusUnprocessableEntity, "File has no readable video stream, it may be truncated", err)
+		return "", false
+	}
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		return "", false
+	}
+	video.AspectRatio = nil
+	if aspectRation != "" {
+		video.AspectRatio = &aspectRation
+	}
+	recorder.input("aspect_ratio", aspectRation)
+	switch aspectRation {
+	case "16:9":
+		prefix = "landscape"
+	case "9:16":
+		prefix = "portrait"
+	}
+	trace.SpanFromContext(procCtx).SetAttributes(attribute.String("video.orientation", prefix))
 
-	respondWithJSON(w, http.StatusOK, videoDb)
+	//Flag videos without audio so clients can warn users
+	endStep = recorder.step("probe_audio")
+	audio, err := getAudioInfo(procCtx, sourcePath)
+	endStep(err)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't probe audio", err)
+		return "", false
+	}
+	video.HasAudio = &audio.HasAudio
+	recorder.input("has_audio", strconv.FormatBool(audio.HasAudio))
+	video.IsSilent = nil
+	if audio.HasAudio && cfg.detectSilentAudio {
+		endStep := recorder.step("detect_silence")
+		silent, err := isAudioSilent(procCtx, sourcePath, audio.Duration)
+		endStep(err)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't check audio for silence", err)
+			return "", false
+		}
+		video.IsSilent = &silent
+	}
 
+	//Record keyframe spacing to tell whether stream-copy segmenting is viable
+	video.KeyframeInterval, video.GOPSize, video.RegularKeyframes = nil, nil, nil
+	if cfg.analyzeKeyframes {
+		endStep := recorder.step("analyze_keyframes")
+		gop, err := getGOPInfo(procCtx, sourcePath)
+		endStep(err)
+		if err != nil {
+			requestLogger(w).Warn("Couldn't analyze keyframes", "error", err.Error())
+			recorder.warn("couldn't analyze keyframes")
+		} else {
+			video.KeyframeInterval = &gop.KeyframeInterval
+			video.GOPSize = &gop.GOPSize
+			video.RegularKeyframes = &gop.Regular
+		}
+	}
+	return prefix, true
 }
 
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-	presignClient := s3.NewPresignClient(s3Client)
-	presignResult, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+/**
+ * Generate the optional assets derived from an upload into bucket
+ * Thumbnail candidates, a fallback thumbnail, the contact sheet, storyboard
+ * and embedded captions, as configured. A failed step is logged and noted
+ * in the report, the upload goes on without it. Returns the URLs stored
+ */
+func (cfg *apiConfig) generateUploadAssets(w http.ResponseWriter, procCtx context.Context, video *database.Video, bucket, sourcePath string) []string {
+	recorder := processingRecorderFrom(procCtx)
+	createdAssets := []string{}
+
+	//Generate poster candidates the owner can choose from
+	oldCandidates := video.ThumbnailCandidates
+	if cfg.autoThumbnailCandidates && cfg.thumbnailCandidateCount > 0 {
+		endStep := recorder.step("thumbnail_candidates")
+		candidates, poster, err := cfg.generateThumbnailCandidates(procCtx, bucket, video.ID, sourcePath)
+		endStep(err)
+		if err != nil {
+			requestLogger(w).Warn("Couldn't generate thumbnail candidates", "error", err.Error())
+			recorder.warn("couldn't generate thumbnail candidates")
+		} else {
+			video.ThumbnailCandidates = candidates
+			createdAssets = append(createdAssets, candidates...)
+			// Only replace posters we picked, never one the owner uploaded
+			if cfg.autoPoster && len(candidates) > 0 && (video.ThumbnailURL == nil || slices.Contains(oldCandidates, *video.ThumbnailURL)) {
+				selected := candidates[poster]
+				video.ThumbnailURL = &selected
+				video.ThumbnailVariants = database.ThumbnailVariants{
+					{ContentType: "image/jpeg", URL: selected},
+				}
+				video.LQIP = nil
+			}
+		}
+	}
+
+	//Fall back to a frame of the video when it has no thumbnail at all
+	if cfg.autoThumbnailAt > 0 && video.ThumbnailURL == nil {
+		endStep := recorder.step("auto_thumbnail")
+		thumbnailURL, data, err := cfg.generateAutoThumbnail(procCtx, sourcePath)
+		endStep(err)
+		if err != nil {
+			requestLogger(w).Warn("Couldn't generate a thumbnail", "error", err.Error())
+			recorder.warn("couldn't generate a thumbnail")
+		} else {
+			video.ThumbnailURL = &thumbnailURL
+			video.ThumbnailVariants = database.ThumbnailVariants{
+				newThumbnailVariant(data, "image/jpeg", thumbnailURL),
+			}
+			cfg.setVideoLQIP(video, data)
+			createdAssets = append(createdAssets, thumbnailURL)
+		}
+	}
+
+	//Tile frames from across the video so moderators can review it at a glance
+	video.ContactSheetURL = nil
+	if cfg.contactSheets {
+		endStep := recorder.step("contact_sheet")
+		sheetURL, err := cfg.generateContactSheet(procCtx, bucket, video.ID, sourcePath)
+		endStep(err)
+		if err != nil {
+			requestLogger(w).Warn("Couldn't generate contact sheet", "error", err.Error())
+			recorder.warn("couldn't generate a contact sheet")
+		} else {
+			video.ContactSheetURL = &sheetURL
+			createdAssets = append(createdAssets, sheetURL)
+		}
+	}
+
+	//Tile frames at a fixed interval for previews while scrubbing
+	video.StoryboardURL, video.StoryboardSpriteURL = nil, nil
+	if cfg.storyboards {
+		endStep := recorder.step("storyboard")
+		cuesURL, spriteURL, err := cfg.generateStoryboard(procCtx, bucket, video.ID, sourcePath)
+		endStep(err)
+		if err != nil {
+			requestLogger(w).Warn("Couldn't generate storyboard", "error", err.Error())
+			recorder.warn("couldn't generate a storyboard")
+		} else {
+			video.StoryboardURL, video.StoryboardSpriteURL = &cuesURL, &spriteURL
+			createdAssets = append(createdAssets, cuesURL, spriteURL)
+		}
+	}
+
+	//Pull embedded subtitle tracks out as WebVTT captions
+	if cfg.extractSubtitles {
+		endStep := recorder.step("extract_subtitles")
+		captions, err := cfg.extractEmbeddedCaptions(procCtx, bucket, video.ID, sourcePath)
+		endStep(err)
+		if err != nil {
+			requestLogger(w).Warn("Couldn't extract subtitles", "error", err.Error())
+			recorder.warn("couldn't extract subtitles")
+		} else {
+			replaceEmbeddedCaptions(video, captions)
+			for _, caption := range captions {
+				createdAssets = append(createdAssets, caption.URL)
+			}
+		}
+	}
+	return createdAssets
+}
+
+// transcodedUpload is an upload converted to its output format, on disk.
+type transcodedUpload struct {
+	path string
+	// segmentsDir holds the segments of a segmented format, else empty
+	segmentsDir string
+	metadata    videoMetadata
+}
+
+// remove deletes the converted files.
+func (t transcodedUpload) remove() {
+	os.Remove(t.path)
+	if t.segmentsDir != "" {
+		os.RemoveAll(t.segmentsDir)
+	}
+}
+
+/**
+ * Convert a checked upload to format
+ * video gets the output's size, once it is within the owner's quota, and
+ * metadata. Responds and reports false on failure; otherwise the caller
+ * removes the output
+ */
+func (cfg *apiConfig) transcodeUpload(w http.ResponseWriter, procCtx context.Context, video *database.Video, sourcePath, mediaType string, format outputFormat) (transcodedUpload, bool) {
+	recorder := processingRecorderFrom(procCtx)
+
+	//Convert to the profile's output format, for mp4 that moves the header to the start of the file
+	_, fastStartSpan := tracer().Start(procCtx, "upload.faststart", trace.WithAttributes(attribute.String("output.format", format.Name)))
+	endStep := recorder.step("convert_" + format.Name)
+	processedFileName, segmentsDir, err := cfg.convertForOutput(procCtx, sourcePath, format, mediaType)
+	endStep(err)
+	endSpan(fastStartSpan, err)
+	if err != nil {
+		cfg.webhooks.dispatch(webhookEventFailed, video.ID, map[string]string{"stage": "faststart"})
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't process video", err)
+		return transcodedUpload{}, false
+	}
+	output := transcodedUpload{path: processedFileName, segmentsDir: segmentsDir}
+	done := false
+	defer func() {
+		if !done {
+			output.remove()
+		}
+	}()
+
+	// Record what we are about to store
+	processedInfo, err := os.Stat(processedFileName)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't process video", err)
+		return transcodedUpload{}, false
+	}
+	fileSize := processedInfo.Size()
+	if segmentsDir != "" {
+		fileSize, err = dirSize(segmentsDir)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't process video", err)
+			return transcodedUpload{}, false
+		}
+	}
+	err = cfg.checkUploadQuota(*video, fileSize)
+	if errors.Is(err, errUploadQuotaExceeded) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", err)
+		return transcodedUpload{}, false
+	}
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return transcodedUpload{}, false
+	}
+	video.FileSize = &fileSize
+	endStep = recorder.step("probe_metadata")
+	output.metadata, err = getVideoMetadata(procCtx, processedFileName)
+	endStep(err)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return transcodedUpload{}, false
+	}
+	output.metadata.apply(video)
+	done = true
+	return output, true
+}
+
+/**
+ * Store a transcoded upload of videoID in bucket, under prefix
+ * Returns the key it went to, with the segments of a segmented format
+ * alongside. The key is set as soon as anything was stored, so the caller
+ * can roll it back even when this responded with an error and reported false
+ */
+func (cfg *apiConfig) storeTranscodedUpload(w http.ResponseWriter, procCtx context.Context, videoID uuid.UUID, bucket, prefix string, format outputFormat, output transcodedUpload) (string, bool) {
+	recorder := processingRecorderFrom(procCtx)
+	processedFile, err := os.Open(output.path)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't process video", err)
+		return "", false
+	}
+	defer processedFile.Close()
+
+	// A playlist's bytes don't identify its segments, so only single file
+	// formats can be stored by content
+	contentAddressed := cfg.contentAddressedKeys && !format.Segmented
+	fileName := ""
+	if !contentAddressed {
+		randomBites := make([]byte, 32)
+		_, err = rand.Read(randomBites)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+			return "", false
+		}
+		name := base64.URLEncoding.EncodeToString(randomBites)
+		fileName = format.objectKey(prefix, name)
+	}
+
+	_, putSpan := tracer().Start(procCtx, "upload.s3_put", trace.WithAttributes(attribute.String("s3.key", fileName)))
+	endStep := recorder.step("store")
+	if contentAddressed {
+		// Identical content already stored is shared instead of uploaded
+		fileName, err = cfg.uploadContentAddressed(procCtx, bucket, videoID, output.path, format.Extension, format.ContentType)
+		putSpan.SetAttributes(attribute.String("s3.key", fileName))
+	} else {
+		err = cfg.objectStoreFor(bucket).put(procCtx, fileName, processedFile, format.ContentType)
+	}
+	endStep(err)
+	endSpan(putSpan, err)
+	if err != nil {
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+		return "", false
+	}
+	if output.segmentsDir != "" {
+		endStep := recorder.step("store_segments")
+		err = cfg.uploadSegments(procCtx, bucket, fileName, output.segmentsDir, format)
+		endStep(err)
+		if err != nil {
+			respondWithProcessingError(w, procCtx, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+			return fileName, false
+		}
+	}
+	return fileName, true
+}
+
+// uploadVideoResponse is the stored video plus the running time ffprobe
+// reported, so clients don't have to probe the file themselves.
+type uploadVideoResponse struct {
+	database.Video
+	DurationSeconds *float64 `json:"duration_seconds,omitempty" xml:"duration_seconds,omitempty"`
+}
+
+func newUploadVideoResponse(video database.Video, metadata videoMetadata) uploadVideoResponse {
+	resp := uploadVideoResponse{Video: video}
+	if metadata.Duration > 0 {
+		resp.DurationSeconds = &metadata.Duration
+	}
+	return resp
+}
+
+/**
+ * Get a presigned GET URL, reusing a cached one while it is still valid
+ * Also returns when the URL stops working, at least expireTime from now.
+ * Cached URLs are signed for longer so they last that long while cached
+ */
+func (cfg *apiConfig) presignGetURL(ctx context.Context, bucket, key string, expireTime time.Duration, overrides presignOverrides) (string, time.Time, error) {
+	cacheKey := bucket + "/" + key
+	if overrides != (presignOverrides{}) {
+		cacheKey += "?" + overrides.ContentDisposition + "&" + overrides.ContentType
+	}
+	if cfg.presignCache != nil {
+		if url, expiresAt, ok := cfg.presignCache.get(cacheKey, expireTime); ok {
+			return url, expiresAt, nil
+		}
+		expireTime = cfg.presignCache.signingLifetime(expireTime)
+	}
+
+	// Don't hand out links to objects that aren't there
+	if cfg.verifyPresignedObjects {
+		exists, err := cfg.objectExists(ctx, bucket, key)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if !exists {
+			return "", time.Time{}, errObjectNotFound
+		}
+	}
+
+	expiresAt := time.Now().Add(expireTime).UTC()
+	url, err := cfg.signGetURL(ctx, bucket, key, expireTime, overrides)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if cfg.presignCache != nil {
+		cfg.presignCache.add(cacheKey, url, expiresAt)
+	}
+	return url, expiresAt, nil
+}
+
+// presignOverrides are response headers S3 sends in place of the stored
+// ones when the presigned URL is used. Empty fields are left alone.
+type presignOverrides struct {
+	ContentDisposition string
+	ContentType        string
+}
+
+func generatePresignedURL(ctx context.Context, s3Client *s3.Client, bucket, key string, expireTime time.Duration, overrides presignOverrides) (string, error) {
+	input := &s3.GetObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
-	}, s3.WithPresignExpires(expireTime))
+	}
+	if overrides.ContentDisposition != "" {
+		input.ResponseContentDisposition = &overrides.ContentDisposition
+	}
+	if overrides.ContentType != "" {
+		input.ResponseContentType = &overrides.ContentType
+	}
+
+	presignClient := s3.NewPresignClient(s3Client)
+	presignResult, err := presignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(expireTime))
 	if err != nil {
 		return "", err
 	}
 	return presignResult.URL, nil
 }
 
-func getVideoAspectRatio(filePath string) (string, error){
+// errUnreadableVideo means ffprobe found no video stream in an upload,
+// usually because it is truncated or isn't a video at all.
+var errUnreadableVideo = errors.New("file has no readable video stream")
+
+func getVideoAspectRatio(ctx context.Context, filePath string) (string, error) {
 	//Run ffprobe to get video metadata
-	command := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	var out strings.Builder
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+	var out, stderr strings.Builder
 	command.Stdout = &out
+	command.Stderr = &stderr
 
 	err := command.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return "", fmt.Errorf("%w: %s", errUnreadableVideo, strings.TrimSpace(stderr.String()))
+	}
 	if err != nil {
 		return "", err
 	}
@@ -187,10 +865,14 @@ func getVideoAspectRatio(filePath string) (string, error){
 	//Parse ffprobe output
 	var ffprobeOutput struct {
 		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-			DisplayAspectRatio string `json:"display_aspect_ratio"`
-
+			CodecType          string          `json:"codec_type"`
+			Width              int             `json:"width"`
+			Height             int             `json:"height"`
+			DisplayAspectRatio string          `json:"display_aspect_ratio"`
+			SideDataList       []probeSideData `json:"side_data_list"`
+			Tags               struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
 		} `json:"streams"`
 	}
 	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
@@ -198,26 +880,138 @@ func getVideoAspectRatio(filePath string) (string, error){
 		return "", err
 	}
 
-	//Return aspect ratio
+	//Return aspect ratio of the first video stream
+	index := -1
+	for i, candidate := range ffprobeOutput.Streams {
+		if candidate.CodecType == "video" {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return "", errUnreadableVideo
+	}
+	stream := ffprobeOutput.Streams[index]
+	//Sizes are of the stored frames; a phone held upright stores them sideways
+	rotated := isQuarterTurn(streamRotation(stream.SideDataList, stream.Tags.Rotate))
+	switch stream.DisplayAspectRatio {
+	case "", "N/A", "0:1":
+		//Fall back to the coded size, which is "" when that is missing too
+		if rotated {
+			return aspectRatioFromDimensions(stream.Height, stream.Width), nil
+		}
+		return aspectRatioFromDimensions(stream.Width, stream.Height), nil
+	}
+	if rotated {
+		return swapAspectRatio(stream.DisplayAspectRatio), nil
+	}
+	return stream.DisplayAspectRatio, nil
+}
+
+// getVideoCodec returns the codec name of the first video stream.
+func getVideoCodec(ctx context.Context, filePath string) (string, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-print_format", "json", "-show_entries", "stream=codec_name", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return "", err
+	}
+
+	var ffprobeOutput struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return "", err
+	}
 	if len(ffprobeOutput.Streams) == 0 {
-		return "", errors.New("No streams found")
+		return "", nil
 	}
-	return ffprobeOutput.Streams[0].DisplayAspectRatio, nil
+	return ffprobeOutput.Streams[0].CodecName, nil
 }
 
 /**
- * Process video for fast start
- * Convert video file with meta data from the end of the file to the beginning
+ * Produce a faststart mp4 from an upload of inputType
+ * mp4 is only remuxed; WebM, QuickTime and, with APPLY_ROTATION, rotated
+ * mp4s are transcoded to H.264
  */
-func processVideoForFastStart(filePath string) (string, error) {
+func (cfg *apiConfig) processVideoForFastStart(ctx context.Context, filePath, inputType string) (string, error) {
+	if inputType != "video/mp4" {
+		return reencodeForFastStart(ctx, filePath)
+	}
+	if cfg.applyRotation {
+		metadata, err := getVideoMetadata(ctx, filePath)
+		if err != nil {
+			return "", err
+		}
+		if metadata.Rotation != 0 {
+			// Only a transcode can turn the frames; ffmpeg applies the
+			// rotation and drops the tag while doing so
+			return reencodeForFastStart(ctx, filePath)
+		}
+	}
+	// A stream copy is quick, taking longer than processTimeout means ffmpeg hangs
+	copyCtx, cancel := cfg.withProcessTimeout(ctx)
+	defer cancel()
 	tmpName := filePath + ".processing"
+	err := runFFmpeg(copyCtx, "-y", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", tmpName)
+	err = processTimeoutError(copyCtx, err)
+	if err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
 
-	command := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", tmpName)
-	err := command.Run()
+// reencodeForFastStart transcodes to H.264/AAC with the header at the start.
+func reencodeForFastStart(ctx context.Context, filePath string) (string, error) {
+	tmpName := filePath + ".processing"
+	args := append([]string{"-y", "-i", filePath}, reencodeCodecs["h264"].args...)
+	err := runFFmpeg(ctx, append(args, tmpName)...)
 	if err != nil {
+		os.Remove(tmpName)
 		return "", err
 	}
 	return tmpName, nil
 }
 
+// Video types handlerUploadVideo accepts, e.g. iPhone recordings are
+// QuickTime and OBS records WebM
+var uploadVideoTypes = map[string]bool{
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/quicktime": true,
+}
 
+// countingReader counts the bytes read through it. err keeps the first
+// error other than io.EOF, which readers further down may have wrapped or
+// swallowed.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// declaredPartSize is the Content-Length a multipart part declared for
+// itself, or -1 when it didn't. Browsers leave it out, scripted clients
+// that resume uploads send it.
+func declaredPartSize(header textproto.MIMEHeader) int64 {
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
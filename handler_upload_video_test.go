@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// newVideoUploadRequest builds a multipart upload of content as the video
+// form file, declared as contentType.
+func newVideoUploadRequest(t *testing.T, video database.Video, token, contentType, content string) *http.Request {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	body, formType := videoUploadBody(t, header, content)
+	req := newVideoRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), video, token, body)
+	req.Header.Set("Content-Type", formType)
+	return req
+}
+
+// videoUploadBody encodes content as the video form file with the given
+// part headers. Returns the body and its multipart Content-Type.
+func videoUploadBody(t *testing.T, header textproto.MIMEHeader, content string) (string, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	header.Set("Content-Disposition", `form-data; name="video"; filename="upload.mp4"`)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+	return body.String(), form.FormDataContentType()
+}
+
+func TestUploadVideoRejectsEmptyFile(t *testing.T) {
+	cfg, server, video, token := newS3Test(t)
+	cfg.minVideoBytes = 1
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", ""))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Empty or truncated file") {
+		t.Errorf("status = %d, want 400 Empty or truncated file: %s", w.Code, w.Body)
+	}
+	if len(server.objects) != 0 {
+		t.Errorf("empty upload reached the bucket")
+	}
+}
+
+func TestUploadVideoGzipEncoded(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	gzipped := func(content string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(content))
+		zw.Close()
+		return buf.String()
+	}
+	// Tiny compressed, far over the cap inflated
+	bomb := gzipped(testMP4 + strings.Repeat("\x00", 1<<20))
+
+	tests := []struct {
+		name     string
+		encoding string
+		content  string
+		wantCode int
+	}{
+		{name: "gzip", encoding: "gzip", content: gzipped(testMP4), wantCode: http.StatusOK},
+		{name: "identity", encoding: "identity", content: testMP4, wantCode: http.StatusOK},
+		{name: "decompression bomb", encoding: "gzip", content: bomb, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "not gzip", encoding: "gzip", content: testMP4, wantCode: http.StatusBadRequest},
+		{name: "unsupported", encoding: "br", content: testMP4, wantCode: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.maxDecompressedBytes = 64 << 10
+
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", "video/mp4")
+			header.Set("Content-Encoding", tt.encoding)
+			body, formType := videoUploadBody(t, header, tt.content)
+			req := newVideoRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), video, token, body)
+			req.Header.Set("Content-Type", formType)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				if len(store.objects) != 0 {
+					t.Errorf("rejected upload reached the bucket")
+				}
+				return
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.VideoURL)
+			if string(store.objects[key]) != testMP4 {
+				t.Errorf("stored %q, want the decompressed video", store.objects[key])
+			}
+		})
+	}
+}
+
+func TestUploadVideoDuplicateInFlight(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// The first probe holds its upload until released
+	installFakeTool(t, "ffprobe", `if [ ! -e "$FAKE_RELEASE" ]; then
+	touch "$FAKE_STARTED"
+	while [ ! -e "$FAKE_RELEASE" ]; do sleep 0.01; done
+fi
+PATH="${PATH#*:}" exec ffprobe "$@"
+`)
+	tests := []struct {
+		action      string
+		wantSecond  int
+		wantUploads int
+	}{
+		{action: duplicateUploadReject, wantSecond: http.StatusConflict, wantUploads: 1},
+		{action: duplicateUploadQueue, wantSecond: http.StatusOK, wantUploads: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			dir := t.TempDir()
+			started := filepath.Join(dir, "started")
+			release := filepath.Join(dir, "release")
+			t.Setenv("FAKE_STARTED", started)
+			t.Setenv("FAKE_RELEASE", release)
+			cfg, store, video, token := newS3Test(t)
+			cfg.duplicateUploadAction = tt.action
+
+			upload := func(req *http.Request, codes chan<- int) {
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, req)
+				codes <- w.Code
+			}
+			first := make(chan int, 1)
+			go upload(newVideoUploadRequest(t, video, token, "video/mp4", testMP4), first)
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if _, err := os.Stat(started); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					os.WriteFile(release, nil, 0644)
+					t.Fatal("the first upload never reached processing")
+				}
+			}
+
+			// A double submit while the first is processing
+			second := make(chan int, 1)
+			go upload(newVideoUploadRequest(t, video, token, "video/mp4", testMP4), second)
+			if tt.action == duplicateUploadReject {
+				if code := <-second; code != tt.wantSecond {
+					t.Errorf("second upload status = %d, want %d", code, tt.wantSecond)
+				}
+			} else {
+				select {
+				case code := <-second:
+					t.Errorf("second upload finished with %d while the first was processing", code)
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			err := os.WriteFile(release, nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code := <-first; code != http.StatusOK {
+				t.Errorf("first upload status = %d, want 200", code)
+			}
+			if tt.action == duplicateUploadQueue {
+				if code := <-second; code != tt.wantSecond {
+					t.Errorf("second upload status = %d, want %d", code, tt.wantSecond)
+				}
+			}
+			if store.puts != tt.wantUploads {
+				t.Errorf("%d objects written, want %d", store.puts, tt.wantUploads)
+			}
+		})
+	}
+}
+
+func TestUploadVideoTranscodesToMP4(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Records how each upload was converted
+	installFakeTool(t, "ffmpeg", `for last in "$@"; do :; done
+case "$last" in
+*.processing) echo "$*" > "$FAKE_FFMPEG_CONVERT" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	tests := []struct {
+		mediaType string
+		content   string
+		wantCode  int
+		wantArgs  string
+	}{
+		// Already mp4, so only the header moves
+		{mediaType: "video/mp4", content: testMP4, wantCode: http.StatusOK, wantArgs: "-c copy -movflags faststart"},
+		// A MOV shares the mp4 box layout
+		{mediaType: "video/quicktime", content: testMP4, wantCode: http.StatusOK, wantArgs: "-c:v libx264"},
+		{mediaType: "video/webm", content: "\x1a\x45\xdf\xa3 webm video", wantCode: http.StatusOK, wantArgs: "-c:v libx264"},
+		{mediaType: "video/x-msvideo", content: testMP4, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mediaType, func(t *testing.T) {
+			args := filepath.Join(t.TempDir(), "args")
+			t.Setenv("FAKE_FFMPEG_CONVERT", args)
+			cfg, store, video, token := newS3Test(t)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, tt.mediaType, tt.content))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			recorded, err := os.ReadFile(args)
+			if err != nil {
+				t.Fatalf("upload wasn't converted: %v", err)
+			}
+			if !strings.Contains(string(recorded), tt.wantArgs) {
+				t.Errorf("ffmpeg %s, want %q", strings.TrimSpace(string(recorded)), tt.wantArgs)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.VideoURL)
+			if !strings.HasSuffix(key, ".mp4") || store.contentTypes[key] != "video/mp4" {
+				t.Errorf("stored as %s with type %q, want an .mp4 of video/mp4", key, store.contentTypes[key])
+			}
+		})
+	}
+}
+
+func TestUploadVideoClientCancels(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "pid")
+	t.Setenv("FAKE_FFMPEG_PID", pidFile)
+	// Hangs until it's killed
+	installFakeTool(t, "ffmpeg", `echo $$ > "$FAKE_FFMPEG_PID.tmp"
+mv "$FAKE_FFMPEG_PID.tmp" "$FAKE_FFMPEG_PID"
+exec sleep 30
+`)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cfg, store, video, token := newS3Test(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4).WithContext(ctx)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg.handlerUploadVideo(w, req)
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ffmpeg never started")
+		}
+		data, err := os.ReadFile(pidFile)
+		if err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still running after the client went away")
+	}
+
+	if process, err := os.FindProcess(pid); err == nil && process.Signal(syscall.Signal(0)) == nil {
+		t.Errorf("ffmpeg (pid %d) is still running", pid)
+	}
+	if len(store.objects) != 0 || store.puts != 0 {
+		t.Errorf("stored %d files after the client went away", len(store.objects))
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+func TestUploadVideoRollsBackOnSaveFailure(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, _, _ := newS3Test(t)
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	db, err := database.NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.db = db
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "upload", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file a re-upload replaces isn't this request's to delete
+	previousURL := cfg.s3CfDistribution + "/landscape/previous.mp4"
+	video.VideoURL = &previousURL
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.objects["landscape/previous.mp4"] = []byte(testMP4)
+
+	// Saving the new video URL fails
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec(`CREATE TRIGGER fail_save BEFORE UPDATE OF video_url ON videos
+		WHEN NEW.video_url IS NOT OLD.video_url
+		BEGIN SELECT RAISE(ABORT, 'disk I/O error'); END`)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", w.Code, w.Body)
+	}
+	if store.puts != 1 {
+		t.Fatalf("%d puts, want the one new upload", store.puts)
+	}
+	keys := []string{}
+	for key := range store.objects {
+		keys = append(keys, key)
+	}
+	if len(keys) != 1 || keys[0] != "landscape/previous.mp4" {
+		t.Errorf("bucket holds %v, want the new upload deleted and only the previous file kept", keys)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoURL == nil || *stored.VideoURL != previousURL {
+		t.Errorf("video URL = %v, want the previous %s", stored.VideoURL, previousURL)
+	}
+}
+
+func TestUploadVideoRejectsGarbage(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		probe    string
+		wantCode int
+		wantMsg  string
+	}{
+		// Caught by content sniffing before ffprobe runs
+		{name: "10 bytes of garbage", content: "0123456789", wantCode: http.StatusBadRequest},
+		{
+			name:     "mp4 cut off after its header",
+			content:  testMP4[:24],
+			probe:    "echo 'moov atom not found' >&2\nexit 1\n",
+			wantCode: http.StatusUnprocessableEntity,
+			wantMsg:  "no readable video stream",
+		},
+		{
+			name:     "mp4 with only audio",
+			content:  testMP4,
+			probe:    `echo '{"streams": [{"codec_type": "audio", "codec_name": "aac"}]}'` + "\n",
+			wantCode: http.StatusUnprocessableEntity,
+			wantMsg:  "no readable video stream",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, fakeProbeOutput)
+			if tt.probe != "" {
+				installFakeTool(t, "ffprobe", tt.probe)
+			}
+			cfg, store, video, token := newS3Test(t)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", tt.content))
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantMsg) {
+				t.Errorf("status = %d, want %d %s: %s", w.Code, tt.wantCode, tt.wantMsg, w.Body)
+			}
+			if len(store.objects) != 0 {
+				t.Errorf("unreadable upload reached the bucket: %d objects", len(store.objects))
+			}
+		})
+	}
+}
+
+// ffprobe output for a 12.5s 1280x720 H.264 clip
+const sampleProbeOutput = `{
+	"streams": [{"codec_name": "h264", "width": 1280, "height": 720, "bit_rate": "2500000"}],
+	"format": {"duration": "12.500000", "bit_rate": "2600000"}
+}`
+
+func TestUploadVideoResponse(t *testing.T) {
+	metadata, err := parseVideoMetadata([]byte(sampleProbeOutput))
+	if err != nil {
+		t.Fatalf("parseVideoMetadata: %v", err)
+	}
+	aspectRatio := "16:9"
+	video := database.Video{AspectRatio: &aspectRatio}
+	metadata.apply(&video)
+
+	data, err := json.Marshal(newUploadVideoResponse(video, metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field string
+		want  any
+	}{
+		{field: "width", want: 1280.0},
+		{field: "height", want: 720.0},
+		{field: "duration_seconds", want: 12.5},
+		{field: "aspect_ratio", want: "16:9"},
+	}
+	for _, tt := range tests {
+		if got[tt.field] != tt.want {
+			t.Errorf("%s = %v, want %v", tt.field, got[tt.field], tt.want)
+		}
+	}
+
+	xmlData, err := xml.Marshal(newUploadVideoResponse(video, metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(xmlData), "<video>") || !strings.Contains(string(xmlData), "<duration_seconds>12.5</duration_seconds>") {
+		t.Errorf("XML response = %s, want a <video> with duration_seconds", xmlData)
+	}
+}
+
+func TestUploadVideoResponseWithoutDuration(t *testing.T) {
+	data, err := json.Marshal(newUploadVideoResponse(database.Video{}, videoMetadata{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "duration_seconds") {
+		t.Errorf("response %s has duration_seconds for a video ffprobe gave no duration", data)
+	}
+}
+
+func TestUploadVideoRejectsBannedHash(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		cfg, store, video, token := newS3Test(t)
+		cfg.asyncProcessing = async
+		path := writeTempFile(t, "banned.txt", testHash(testMP4)+"\n")
+		hashes, err := newBannedHashStore("file", path, cfg.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.bannedHashes = hashes
+
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+		if w.Code != http.StatusUnavailableForLegalReasons {
+			t.Errorf("async %v: status = %d, want 451: %s", async, w.Code, w.Body)
+		}
+		if len(store.objects) != 0 {
+			t.Errorf("async %v: banned upload reached the bucket: %d objects", async, len(store.objects))
+		}
+	}
+}
+
+func TestUploadVideoRejectsTruncatedUpload(t *testing.T) {
+	content := testMP4 + strings.Repeat("\x00", 4096)
+	full, formType := videoUploadBody(t, textproto.MIMEHeader{"Content-Type": {"video/mp4"}}, content)
+	declared, declaredType := videoUploadBody(t, textproto.MIMEHeader{
+		"Content-Type":   {"video/mp4"},
+		"Content-Length": {"8192"},
+	}, content)
+	tests := []struct {
+		name     string
+		body     string
+		formType string
+	}{
+		// The connection dropped halfway through the file part
+		{name: "body cut off", body: full[:len(full)-2048], formType: formType},
+		{name: "part shorter than its Content-Length", body: declared, formType: declaredType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.checkUploadSize = true
+			req := newVideoRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), video, token, tt.body)
+			req.Header.Set("Content-Type", tt.formType)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Upload truncated") {
+				t.Errorf("status = %d, want 400 Upload truncated: %s", w.Code, w.Body)
+			}
+			if len(store.objects) != 0 {
+				t.Errorf("truncated upload reached the bucket: %d objects", len(store.objects))
+			}
+		})
+	}
+}
+
+// uploadWatcher samples heap and temp dir usage while a request body is
+// read, to see how much of the upload the handler holds at once.
+type uploadWatcher struct {
+	r          io.Reader
+	tmpDir     string
+	baseHeap   uint64
+	read       int64
+	nextSample int64
+	peakHeap   uint64
+	peakDisk   int64
+}
+
+func (u *uploadWatcher) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.read += int64(n)
+	if u.read >= u.nextSample || err != nil {
+		u.sample()
+		u.nextSample += 1 << 20
+	}
+	return n, err
+}
+
+func (u *uploadWatcher) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > u.baseHeap {
+		u.peakHeap = max(u.peakHeap, stats.HeapAlloc-u.baseHeap)
+	}
+	entries, _ := os.ReadDir(u.tmpDir)
+	disk := int64(0)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			disk += info.Size()
+		}
+	}
+	u.peakDisk = max(u.peakDisk, disk)
+}
+
+func TestUploadVideoStreamsFilePart(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	cfg, _, video, token := newS3Test(t)
+
+	// Small enough that r.FormFile would have kept all of it in memory
+	const size = 24 << 20
+	content := testMP4 + strings.Repeat("\x00", size-len(testMP4))
+	req := newVideoUploadRequest(t, video, token, "video/mp4", content)
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	watcher := &uploadWatcher{r: req.Body, tmpDir: tmpDir, baseHeap: stats.HeapAlloc}
+	req.Body = io.NopCloser(watcher)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	t.Logf("read %d bytes: heap grew by at most %d bytes, temp dir held at most %d", watcher.read, watcher.peakHeap, watcher.peakDisk)
+	if watcher.peakHeap > size/4 {
+		t.Errorf("heap grew by %d bytes while a %d byte upload was read, want it streamed", watcher.peakHeap, size)
+	}
+	// The handler's own temp copy is all that should be on disk
+	if watcher.peakDisk > size+1<<20 {
+		t.Errorf("temp dir held %d bytes while a %d byte upload was read, want one copy", watcher.peakDisk, size)
+	}
+}
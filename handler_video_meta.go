@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -37,6 +41,18 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	}
 	params.UserID = userID
 
+	if cfg.uniqueVideoTitles {
+		existing, err := cfg.db.GetVideoByTitle(userID, params.Title)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check video title", err)
+			return
+		}
+		if existing.ID != uuid.Nil {
+			respondWithError(w, http.StatusConflict, "You already have a video with this title", nil)
+			return
+		}
+	}
+
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
@@ -70,16 +86,29 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 	if video.UserID != userID {
 		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
 		return
 	}
 
+	// Objects that are already gone don't fail the delete, so a retry after
+	// a partial failure finishes the job
+	err = cfg.deleteVideoAssets(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video files", err)
+		return
+	}
+
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.webhooks.dispatch(webhookEventDeleted, videoID, nil)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -97,13 +126,26 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.IsExpired(time.Now()) {
+		respondWithError(w, http.StatusGone, "Video has expired", nil)
+		return
+	}
 
-	// video, err = cfg.dbVideoToSignedVideo(video)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Couldn't get signed video", err)
-	// 	return
-	// }
-	respondWithJSON(w, http.StatusOK, video)
+	expiry, err := cfg.requestPresignExpiry(r)
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemInvalidExpiry, err.Error(), err)
+		return
+	}
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video, expiry)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video asset not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get signed video", err)
+		return
+	}
+	cfg.respondWithContent(w, r, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -118,42 +160,106 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	expiry, err := cfg.requestPresignExpiry(r)
+	if err != nil {
+		respondWithErrorType(w, http.StatusBadRequest, problemInvalidExpiry, err.Error(), err)
+		return
+	}
+
 	videos, err := cfg.db.GetVideos(userID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
-	// for i, video := range videos {
-	// 	video, err = cfg.dbVideoToSignedVideo(video)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusInternalServerError, "Couldn't get signed video", err)
-	// 		return
-	// 	}
-	// 	videos[i] = video
-	// }
-	respondWithJSON(w, http.StatusOK, videos)
+	for i, video := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideo(r.Context(), video, expiry)
+		if errors.Is(err, errObjectNotFound) {
+			// One lost upload shouldn't hide the whole list, the video is
+			// listed without a URL
+			log.Printf("Video %s points at a missing object %s", video.ID, *video.VideoURL)
+			videos[i].VideoURL = nil
+			continue
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get signed video", err)
+			return
+		}
+	}
+	cfg.respondWithContent(w, r, http.StatusOK, videoList(videos))
+}
+
+// videoList is a JSON array but needs a root element in XML.
+type videoList []database.Video
+
+func (l videoList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "videos"}
+	return e.EncodeElement(struct {
+		Videos []database.Video `xml:"video"`
+	}{l}, start)
 }
 
 /**
- * This function is used to get the signed URL of the video
+ * Sign an asset URL stored in the "bucket,key" form
+ * Any other URL is already public and returned unchanged
  */
-func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
+func (cfg *apiConfig) signAssetURL(ctx context.Context, assetURL string) (string, error) {
+	url, _, err := cfg.signAssetURLFor(ctx, assetURL, cfg.presignExpiry)
+	return url, err
+}
 
-	if video.VideoURL == nil {
-		return video, nil
+// signAssetURLFor is signAssetURL with a lifetime of expiry. The returned
+// time is nil for URLs that don't expire.
+func (cfg *apiConfig) signAssetURLFor(ctx context.Context, assetURL string, expiry time.Duration) (string, *time.Time, error) {
+	bucket, key, ok := strings.Cut(assetURL, ",")
+	if !ok {
+		return assetURL, nil, nil
 	}
-	part := strings.Split(*video.VideoURL, ",")
-	if len(part) != 2 {
-		return video, fmt.Errorf("Invalid video URL")
+	url, expiresAt, err := cfg.presignGetURL(ctx, bucket, key, expiry, presignOverrides{})
+	if err != nil {
+		return "", nil, err
 	}
+	return url, &expiresAt, nil
+}
 
-	newUrl, err := generatePresignedURL(cfg.s3Client, part[0], part[1], time.Hour)
+/**
+ * Swap the stored video URL for one clients can play
+ * Videos in a private bucket are kept in the "bucket,key" form and get a
+ * presigned GET valid for expiry, with VideoURLExpiresAt telling clients
+ * when it stops working; CloudFront URLs are left alone. Every response
+ * carrying video metadata goes through this
+ */
+func (cfg *apiConfig) dbVideoToSignedVideo(ctx context.Context, video database.Video, expiry time.Duration) (database.Video, error) {
+	if video.VideoURL == nil {
+		return video, nil
+	}
+	url, expiresAt, err := cfg.signAssetURLFor(ctx, *video.VideoURL, expiry)
 	if err != nil {
 		return video, err
 	}
-
-	video.VideoURL = &newUrl
-
+	video.VideoURL = &url
+	video.VideoURLExpiresAt = expiresAt
 	return video, nil
-}
\ No newline at end of file
+}
+
+/**
+ * Get the presigned URL lifetime a request asks for with ?expiry=30m
+ * Defaults to presignExpiry; anything above presignMaxExpiry is an error
+ */
+func (cfg *apiConfig) requestPresignExpiry(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("expiry")
+	if value == "" {
+		return cfg.presignExpiry, nil
+	}
+	expiry, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry: %w", err)
+	}
+	if expiry <= 0 {
+		return 0, errors.New("expiry must be positive")
+	}
+	if expiry > cfg.presignMaxExpiry {
+		return 0, fmt.Errorf("expiry can't be longer than %s", cfg.presignMaxExpiry)
+	}
+	return expiry, nil
+}
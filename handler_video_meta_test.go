@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestVideoMetaCreateUniqueTitles(t *testing.T) {
+	tests := []struct {
+		name     string
+		unique   bool
+		title    string
+		wantCode int
+	}{
+		{name: "collision, flag off", unique: false, title: "Upload", wantCode: http.StatusCreated},
+		{name: "collision, flag on", unique: true, title: "upload", wantCode: http.StatusConflict},
+		{name: "case and whitespace, flag on", unique: true, title: "  UPLOAD ", wantCode: http.StatusConflict},
+		{name: "new title, flag on", unique: true, title: "upload two", wantCode: http.StatusCreated},
+		{name: "new title, flag off", unique: false, title: "upload three", wantCode: http.StatusCreated},
+		// Titles are only unique per user
+		{name: "another user's title, flag on", unique: true, title: "someone else's", wantCode: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The user already has a video titled "upload"
+			cfg, video, token := newThumbnailTest(t)
+			cfg.uniqueVideoTitles = tt.unique
+			other, err := cfg.db.CreateUser(database.CreateUserParams{Email: "other@example.com", Password: "hash"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cfg.db.CreateVideo(database.CreateVideoParams{Title: "someone else's", UserID: other.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := json.Marshal(map[string]string{"title": tt.title, "description": "a video"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerVideoMetaCreate(w, newVideoRequest(http.MethodPost, "/api/videos", video, token, string(body)))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestVideoMetaDelete(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+	otherToken, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	videoURL := cfg.s3CfDistribution + "/landscape/delete.mp4"
+	thumbnailURL := cfg.localAssetURL("delete.png")
+	video.VideoURL, video.ThumbnailURL = &videoURL, &thumbnailURL
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.objects["landscape/delete.mp4"] = []byte(testMP4)
+	thumbnailPath := filepath.Join(cfg.assetsRoot, "delete.png")
+	err = os.WriteFile(thumbnailPath, []byte("thumbnail"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Its S3 object is already gone
+	gone, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "gone", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	goneURL := cfg.s3CfDistribution + "/landscape/gone.mp4"
+	gone.VideoURL = &goneURL
+	err = cfg.db.UpdateVideo(gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		video    database.Video
+		token    string
+		wantCode int
+	}{
+		{name: "someone else", video: video, token: otherToken, wantCode: http.StatusForbidden},
+		{name: "missing", video: database.Video{ID: uuid.New()}, token: token, wantCode: http.StatusNotFound},
+		{name: "owner", video: video, token: token, wantCode: http.StatusNoContent},
+		{name: "object already gone", video: gone, token: token, wantCode: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoMetaDelete(w, newVideoRequest(http.MethodDelete, "/api/videos/"+tt.video.ID.String(), tt.video, tt.token, ""))
+		if w.Code != tt.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+		if tt.wantCode != http.StatusNoContent {
+			continue
+		}
+		stored, err := cfg.db.GetVideo(tt.video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.ID != uuid.Nil {
+			t.Errorf("%s: video row still exists", tt.name)
+		}
+	}
+	if _, ok := store.objects["landscape/delete.mp4"]; ok {
+		t.Error("video object wasn't deleted")
+	}
+	if _, err := os.Stat(thumbnailPath); !os.IsNotExist(err) {
+		t.Errorf("local thumbnail wasn't deleted: %v", err)
+	}
+}
+
+func TestVideoGetPresignExpiry(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	cfg.s3Client = newTestS3Client()
+	cfg.s3PrivateBucket = true
+	cfg.presignExpiry, cfg.presignMaxExpiry = 15*time.Minute, time.Hour
+	videoURL := cfg.assetURLForObject(cfg.s3Bucket, "landscape/expiry.mp4")
+	video.VideoURL = &videoURL
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantCode   int
+		wantExpiry time.Duration
+	}{
+		{name: "default", wantCode: http.StatusOK, wantExpiry: 15 * time.Minute},
+		{name: "override", query: "30m", wantCode: http.StatusOK, wantExpiry: 30 * time.Minute},
+		{name: "at the cap", query: "1h", wantCode: http.StatusOK, wantExpiry: time.Hour},
+		{name: "over the cap", query: "2h", wantCode: http.StatusBadRequest},
+		{name: "negative", query: "-5m", wantCode: http.StatusBadRequest},
+		{name: "invalid", query: "soon", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String(), video, token, "")
+		if tt.query != "" {
+			req.URL.RawQuery = url.Values{"expiry": {tt.query}}.Encode()
+		}
+		w := httptest.NewRecorder()
+		cfg.handlerVideoGet(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		got := database.Video{}
+		err := json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := url.Parse(*got.VideoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(int(tt.wantExpiry.Seconds())); signed.Query().Get("X-Amz-Expires") != want {
+			t.Errorf("%s: URL %s isn't signed for %s", tt.name, *got.VideoURL, tt.wantExpiry)
+		}
+		if got.VideoURLExpiresAt == nil {
+			t.Errorf("%s: no expiry in the response", tt.name)
+		} else if until := time.Until(*got.VideoURLExpiresAt); until > tt.wantExpiry || until < tt.wantExpiry-time.Minute {
+			t.Errorf("%s: expires in %s, want about %s", tt.name, until, tt.wantExpiry)
+		}
+	}
+}
+
+// newTestS3Client can presign but never reaches AWS.
+func newTestS3Client() *s3.Client {
+	return s3.New(s3.Options{
+		Region: "us-east-2",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+}
+
+func TestDBVideoToSignedVideo(t *testing.T) {
+	tests := []struct {
+		name          string
+		privateBucket bool
+		key           string
+		wantSigned    bool
+	}{
+		{name: "public bucket", key: "landscape/abc.mp4", wantSigned: false},
+		{name: "private bucket", privateBucket: true, key: "landscape/abc.mp4", wantSigned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &apiConfig{
+				s3Bucket:         "tubely-test",
+				s3CfDistribution: "https://cdn.example.com",
+				s3PrivateBucket:  tt.privateBucket,
+				s3Client:         newTestS3Client(),
+				presignExpiry:    15 * time.Minute,
+			}
+			stored := cfg.assetURLForObject(cfg.s3Bucket, tt.key)
+			video, err := cfg.dbVideoToSignedVideo(context.Background(), database.Video{VideoURL: &stored}, cfg.presignExpiry)
+			if err != nil {
+				t.Fatalf("dbVideoToSignedVideo: %v", err)
+			}
+			signed := strings.Contains(*video.VideoURL, "X-Amz-Signature=")
+			if signed != tt.wantSigned {
+				t.Errorf("VideoURL = %q, signed %v, want %v", *video.VideoURL, signed, tt.wantSigned)
+			}
+			if tt.wantSigned && video.VideoURLExpiresAt == nil {
+				t.Error("VideoURLExpiresAt is nil for a presigned URL")
+			}
+			if !tt.wantSigned && *video.VideoURL != "https://cdn.example.com/"+tt.key {
+				t.Errorf("VideoURL = %q, want the CloudFront URL", *video.VideoURL)
+			}
+		})
+	}
+}
+
+func TestVideoHandlersWithMissingObject(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+	cfg.s3PrivateBucket = true
+	cfg.verifyPresignedObjects = true
+	cfg.presignExpiry, cfg.presignMaxExpiry = 15*time.Minute, time.Hour
+
+	stored, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "stored", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, key := range map[*database.Video]string{&video: "landscape/missing.mp4", &stored: "landscape/stored.mp4"} {
+		url := cfg.assetURLForObject(cfg.s3Bucket, key)
+		v.VideoURL = &url
+		if err := cfg.db.UpdateVideo(*v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.objects["landscape/stored.mp4"] = []byte(testMP4)
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoGet(w, newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String(), video, token, ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of the video with a missing object: status = %d, want 404", w.Code)
+	}
+
+	// The list still has both, the missing one without a URL
+	w = httptest.NewRecorder()
+	cfg.handlerVideosRetrieve(w, newVideoRequest(http.MethodGet, "/api/videos", video, token, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var videos []database.Video
+	err = json.NewDecoder(w.Body).Decode(&videos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := map[uuid.UUID]*string{}
+	for _, v := range videos {
+		urls[v.ID] = v.VideoURL
+	}
+	if len(videos) != 2 || urls[video.ID] != nil || urls[stored.ID] == nil {
+		t.Errorf("listed %d videos with URLs %v, want both with only the stored one's URL", len(videos), urls)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+/**
+ * Rewrite a thumbnail so none of its metadata is published
+ * EXIF (GPS position, camera serials), XMP, PNG text chunks and GIF
+ * comments and application blocks are dropped by decoding to pixels and
+ * encoding again. A JPEG's EXIF orientation is applied to the pixels
+ * first, so it still shows the right way up. WebP can't be re-encoded
+ * here, so its EXIF and XMP chunks are cut from the container instead
+ */
+func stripImageMetadata(data []byte, mediaType string, jpegQuality int) ([]byte, error) {
+	switch mediaType {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		img = applyOrientation(img, jpegOrientation(data))
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = png.Encode(&buf, img)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/gif":
+		// Thumbnails are single frame GIFs, see checkStaticGIF
+		img, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = gif.Encode(&buf, img, nil)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/webp":
+		return stripWebPMetadata(data)
+	}
+	return data, nil
+}
+
+// VP8X flags announcing the metadata chunks of an extended WebP.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+/**
+ * Cut the EXIF and XMP chunks out of a WebP
+ * Every other chunk is copied as is, the VP8X flags announcing metadata
+ * are cleared and the RIFF size is fixed up
+ */
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+	out := append([]byte{}, data[:12]...)
+	offset := 12
+	for offset < len(data) {
+		if offset+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk header")
+		}
+		fourCC := string(data[offset : offset+4])
+		size := int64(binary.LittleEndian.Uint32(data[offset+4:]))
+		// Chunks are padded to an even size
+		end := int64(offset) + 8 + size + size%2
+		if end > int64(len(data)) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		chunk := data[offset:end]
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk = append([]byte{}, chunk...)
+			if len(chunk) > 8 {
+				chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, chunk...)
+		}
+		offset = int(end)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+/**
+ * Read the EXIF orientation of a JPEG, 1 (upright) to 8
+ * Walks the segments up to the image data looking for an APP1 Exif block
+ * and reads tag 0x0112 from its first IFD. Returns 1 when there is none
+ */
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	offset := 2
+	for offset+4 <= len(data) && data[offset] == 0xFF {
+		marker := data[offset+1]
+		// Start of scan: the metadata segments are all before it
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		end := offset + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		segment := data[offset+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		offset = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from a TIFF header and IFD0.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+/**
+ * Turn and mirror img as EXIF orientation describes
+ * 2-4 mirror or turn it half way, 5-8 also swap width and height
+ */
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	outW, outH := w, h
+	if orientation >= 5 {
+		outW, outH = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return out
+}
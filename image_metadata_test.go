@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// secret stands in for a GPS position or camera serial in the metadata.
+const secret = "GPS 52.5200N 13.4050E serial 0xC0FFEE"
+
+// testWebP is a 1x1 lossless WebP.
+const testWebP = "RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00"
+
+func testImage() *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	img.SetColorIndex(1, 1, 1)
+	return img
+}
+
+// jpegWithEXIF inserts an APP1 Exif segment holding secret after SOI.
+func jpegWithEXIF(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte("Exif\x00\x00"), secret...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(segment, payload...)...), data[2:]...)
+}
+
+// pngWithText inserts a tEXt chunk holding secret after IHDR.
+func pngWithText(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append([]byte("tEXtComment\x00"), secret...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)-4))
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(body))
+	data := buf.Bytes()
+	// Signature (8) and IHDR (25)
+	return append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+}
+
+// gifWithComment adds a comment and an XMP application block holding secret.
+func gifWithComment(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := gif.Encode(&buf, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment := append([]byte{0x21, 0xFE, byte(len(secret))}, secret...)
+	comment = append(comment, 0)
+	xmp := append([]byte{0x21, 0xFF, 11}, "XMP DataXMP"...)
+	xmp = append(append(xmp, byte(len(secret))), secret...)
+	xmp = append(xmp, 0)
+	data := buf.Bytes()
+	// Right before the trailer
+	return append(append(append(append([]byte{}, data[:len(data)-1]...), comment...), xmp...), 0x3B)
+}
+
+// webpWithMetadata wraps testWebP's image in VP8X with EXIF and XMP chunks.
+func webpWithMetadata() []byte {
+	riffChunk := func(fourCC string, payload []byte) []byte {
+		chunk := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+		chunk = append(chunk, payload...)
+		if len(payload)%2 == 1 {
+			chunk = append(chunk, 0)
+		}
+		return chunk
+	}
+	// Flags, reserved, then canvas width and height minus one in 24 bits
+	vp8x := []byte{webpFlagEXIF | webpFlagXMP, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	body := []byte("WEBP")
+	body = append(body, riffChunk("VP8X", vp8x)...)
+	body = append(body, []byte(testWebP[12:])...)
+	body = append(body, riffChunk("EXIF", []byte(secret))...)
+	body = append(body, riffChunk("XMP ", []byte("<x:xmpmeta>"+secret+"</x:xmpmeta>"))...)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		data      []byte
+	}{
+		{mediaType: "image/jpeg", data: jpegWithEXIF(t)},
+		{mediaType: "image/png", data: pngWithText(t)},
+		{mediaType: "image/gif", data: gifWithComment(t)},
+		{mediaType: "image/webp", data: webpWithMetadata()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mediaType, func(t *testing.T) {
+			if !bytes.Contains(tt.data, []byte(secret)) {
+				t.Fatal("test image doesn't carry the metadata")
+			}
+			stripped, err := stripImageMetadata(tt.data, tt.mediaType, 90)
+			if err != nil {
+				t.Fatalf("stripImageMetadata: %v", err)
+			}
+			if bytes.Contains(stripped, []byte(secret)) {
+				t.Errorf("metadata survived in the %s", tt.mediaType)
+			}
+
+			// What is left still decodes to the same size
+			var config image.Config
+			if tt.mediaType == "image/webp" {
+				config, err = webp.DecodeConfig(bytes.NewReader(stripped))
+			} else {
+				config, _, err = image.DecodeConfig(bytes.NewReader(stripped))
+			}
+			if err != nil {
+				t.Fatalf("stripped %s doesn't decode: %v", tt.mediaType, err)
+			}
+			want := 4
+			if tt.mediaType == "image/webp" {
+				want = 1
+			}
+			if config.Width != want || config.Height != want {
+				t.Errorf("stripped image is %dx%d, want %dx%d", config.Width, config.Height, want, want)
+			}
+		})
+	}
+}
+
+func TestStripWebPMetadataFlags(t *testing.T) {
+	stripped, err := stripWebPMetadata(webpWithMetadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := stripped[20]; flags&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Errorf("VP8X flags = %#x, still announce EXIF or XMP", flags)
+	}
+	if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(stripped)-8)
+	}
+	_, err = webp.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Errorf("stripped WebP doesn't decode: %v", err)
+	}
+
+	_, err = stripWebPMetadata([]byte("RIFF\x00\x00\x00\x00WEBPVP8L\xff\x00\x00\x00"))
+	if err == nil {
+		t.Error("a chunk running past the end was accepted")
+	}
+}
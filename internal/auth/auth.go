@@ -22,6 +22,9 @@ const (
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// ErrInvalidSubject is returned when a token's subject isn't a user ID.
+var ErrInvalidSubject = errors.New("token subject is not a valid user ID")
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -73,9 +76,21 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 		return uuid.Nil, errors.New("invalid issuer")
 	}
 
-	id, err := uuid.Parse(userIDString)
+	return parseSubject(userIDString)
+}
+
+// parseSubject only accepts the canonical hyphenated form MakeJWT writes;
+// uuid.Parse alone would also take braces, "urn:uuid:" and bare hex.
+func parseSubject(subject string) (uuid.UUID, error) {
+	if len(subject) != 36 {
+		return uuid.Nil, ErrInvalidSubject
+	}
+	id, err := uuid.Parse(subject)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrInvalidSubject, err)
+	}
+	if id == uuid.Nil {
+		return uuid.Nil, ErrInvalidSubject
 	}
 	return id, nil
 }
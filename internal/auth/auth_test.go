@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestParseSubject(t *testing.T) {
+	id := uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	tests := []struct {
+		name    string
+		subject string
+		wantErr bool
+	}{
+		{name: "canonical", subject: id.String()},
+		{name: "empty", subject: "", wantErr: true},
+		{name: "short", subject: "6ba7b810-9dad-11d1-80b4", wantErr: true},
+		{name: "one short", subject: id.String()[:35], wantErr: true},
+		{name: "bare hex", subject: "6ba7b8109dad11d180b400c04fd430c8", wantErr: true},
+		{name: "braces", subject: "{" + id.String() + "}", wantErr: true},
+		{name: "urn", subject: "urn:uuid:" + id.String(), wantErr: true},
+		{name: "right length, not hex", subject: "6ba7b810-9dad-11d1-80b4-00c04fd430zz", wantErr: true},
+		{name: "hyphens misplaced", subject: "6ba7b8109-dad-11d1-80b4-00c04fd430c8", wantErr: true},
+		{name: "nil UUID", subject: uuid.Nil.String(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSubject(tt.subject)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSubject) {
+					t.Errorf("parseSubject(%q) error = %v, want ErrInvalidSubject", tt.subject, err)
+				}
+				if got != uuid.Nil {
+					t.Errorf("parseSubject(%q) = %s, want uuid.Nil", tt.subject, got)
+				}
+				return
+			}
+			if err != nil || got != id {
+				t.Errorf("parseSubject(%q) = %s, %v, want %s", tt.subject, got, err, id)
+			}
+		})
+	}
+}
+
+func TestValidateJWTSubject(t *testing.T) {
+	userID := uuid.New()
+	token, err := MakeJWT(userID, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ValidateJWT(token, "secret")
+	if err != nil || got != userID {
+		t.Errorf("ValidateJWT = %s, %v, want %s", got, err, userID)
+	}
+
+	// Signed with the right key, but not about a user
+	braced, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeAccess),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		Subject:   "{" + userID.String() + "}",
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateJWT(braced, "secret")
+	if !errors.Is(err, ErrInvalidSubject) {
+		t.Errorf("ValidateJWT with a braced subject = %v, want ErrInvalidSubject", err)
+	}
+}
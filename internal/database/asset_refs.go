@@ -0,0 +1,104 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+/**
+ * Record which stored assets a video row points at
+ * Its upload and codec renditions, the assets content addressed objects
+ * can be shared through. Runs in the transaction that wrote the row; an
+ * upload's reservations stay until the row holds the asset
+ */
+func writeAssetRefs(tx *sql.Tx, video Video) error {
+	_, err := tx.Exec(`DELETE FROM asset_refs WHERE video_id = ? AND pending = 0`, video.ID)
+	if err != nil {
+		return err
+	}
+	urls := []string{}
+	if video.VideoURL != nil {
+		urls = append(urls, *video.VideoURL)
+	}
+	for _, url := range video.CodecRenditions {
+		urls = append(urls, url)
+	}
+	for _, url := range urls {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO asset_refs (asset_url, video_id, pending) VALUES (?, ?, 0)`, url, video.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Fill asset_refs from the videos table
+ * For databases from before the table existed; codec renditions are read
+ * with json_each, so only whole URLs match
+ */
+func backfillAssetRefs(tx *sql.Tx) error {
+	query := `
+	INSERT OR IGNORE INTO asset_refs (asset_url, video_id, pending)
+	SELECT video_url, id, 0 FROM videos WHERE video_url IS NOT NULL
+	UNION
+	SELECT renditions.value, videos.id, 0
+	FROM videos, json_each(videos.codec_renditions) AS renditions
+	WHERE json_valid(videos.codec_renditions)
+	`
+	_, err := tx.Exec(query)
+	return err
+}
+
+/**
+ * Hold a reference to assetURL for a video before the row points at it
+ * An upload that found its content already stored reserves it first, so
+ * cleanup of another video counts it and keeps the object. UpdateVideo
+ * turns the reservation into a plain reference; ReleaseAssetReference
+ * drops it when the upload fails
+ */
+func (c Client) ReserveAssetReference(assetURL string, videoID uuid.UUID) error {
+	query := `
+	INSERT OR IGNORE INTO asset_refs (asset_url, video_id, pending)
+	VALUES (?, ?, 1)
+	`
+	_, err := c.db.Exec(query, assetURL, videoID)
+	return err
+}
+
+// ReleaseAssetReference drops a reservation the video's row never took up.
+func (c Client) ReleaseAssetReference(assetURL string, videoID uuid.UUID) error {
+	query := `
+	DELETE FROM asset_refs
+	WHERE asset_url = ? AND video_id = ? AND pending = 1
+	`
+	_, err := c.db.Exec(query, assetURL, videoID)
+	return err
+}
+
+/**
+ * Count videos, other than those in excluding, that reference assetURL
+ * Their upload or a codec rendition is stored there, or an upload of
+ * theirs reserved it. Content addressed objects are shared, so this is
+ * their reference count
+ */
+func (c Client) CountAssetReferences(assetURL string, excluding []uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM asset_refs
+	WHERE asset_url = ?
+	`
+	args := []any{assetURL}
+	if len(excluding) > 0 {
+		query += `AND video_id NOT IN (?` + strings.Repeat(", ?", len(excluding)-1) + `)`
+		for _, id := range excluding {
+			args = append(args, id)
+		}
+	}
+
+	var count int
+	err := c.db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+func (c Client) IsHashBanned(hash string) (bool, error) {
+	query := `
+	SELECT 1
+	FROM banned_hashes
+	WHERE hash = ?
+	`
+	var found int
+	err := c.db.QueryRow(query, hash).Scan(&found)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c Client) BanHash(hash, reason string) error {
+	query := `
+	INSERT OR REPLACE INTO banned_hashes (
+		hash,
+		reason,
+		created_at
+	) VALUES (?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, hash, reason)
+	return err
+}
@@ -72,7 +72,160 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	err = c.addColumnIfMissing("users", "tier", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "tenant", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	// Columns added to videos after the initial schema
+	videoColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"has_audio", "BOOLEAN"},
+		{"is_silent", "BOOLEAN"},
+		{"codec_renditions", "TEXT"},
+		{"thumbnail_candidates", "TEXT"},
+		{"aspect_ratio", "TEXT"},
+		{"audio_tracks", "TEXT"},
+		{"file_size", "INTEGER"},
+		{"video_codec", "TEXT"},
+		{"replication_status", "TEXT"},
+		{"keyframe_interval", "REAL"},
+		{"gop_size", "INTEGER"},
+		{"regular_keyframes", "BOOLEAN"},
+		{"thumbnail_variants", "TEXT"},
+		{"expires_at", "TIMESTAMP"},
+		{"status", "TEXT"},
+		{"pending_upload_key", "TEXT"},
+		{"captions", "TEXT"},
+		{"lqip", "TEXT"},
+		{"pending_thumbnail_key", "TEXT"},
+		{"processing_report", "TEXT"},
+		{"resolution_renditions", "TEXT"},
+		{"contact_sheet_url", "TEXT"},
+		{"duration", "REAL"},
+		{"width", "INTEGER"},
+		{"height", "INTEGER"},
+		{"bit_rate", "INTEGER"},
+		{"storyboard_url", "TEXT"},
+		{"storyboard_sprite_url", "TEXT"},
+	}
+	for _, column := range videoColumns {
+		err = c.addColumnIfMissing("videos", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	bannedHashTable := `
+	CREATE TABLE IF NOT EXISTS banned_hashes (
+		hash TEXT PRIMARY KEY,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(bannedHashTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		type TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		payload TEXT,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		last_error TEXT,
+		next_retry_at TIMESTAMP NOT NULL,
+		locked_by TEXT,
+		locked_until TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS jobs_claim ON jobs (status, next_retry_at);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+
+	return c.migrateAssetRefs()
+}
+
+// migrateAssetRefs creates the asset_refs table, filling it from the videos
+// table the first time.
+func (c *Client) migrateAssetRefs() error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var existing int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'asset_refs'`).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+	assetRefTable := `
+	CREATE TABLE asset_refs (
+		asset_url TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		pending BOOLEAN NOT NULL DEFAULT 0,
+		PRIMARY KEY (asset_url, video_id)
+	);
+	CREATE INDEX asset_refs_video ON asset_refs (video_id);
+	`
+	_, err = tx.Exec(assetRefTable)
+	if err != nil {
+		return err
+	}
+	err = backfillAssetRefs(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
 func (c Client) Reset() error {
@@ -85,5 +238,14 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM asset_refs"); err != nil {
+		return fmt.Errorf("failed to reset table asset_refs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM banned_hashes"); err != nil {
+		return fmt.Errorf("failed to reset table banned_hashes: %w", err)
+	}
 	return nil
 }
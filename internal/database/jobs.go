@@ -0,0 +1,286 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobPending    = "pending"
+	JobProcessing = "processing"
+	JobDone       = "done"
+	JobFailed     = "failed"
+)
+
+// ErrJobLeaseLost is returned when a worker finishes a job whose lease ran
+// out and another worker has reclaimed it since.
+var ErrJobLeaseLost = errors.New("job lease was lost to another worker")
+
+type Job struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Type        string    `json:"type"`
+	VideoID     uuid.UUID `json:"video_id"`
+	Payload     string    `json:"payload,omitempty"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	LastError   *string   `json:"last_error,omitempty"`
+	NextRetryAt time.Time `json:"next_retry_at"`
+}
+
+type CreateJobParams struct {
+	Type        string
+	VideoID     uuid.UUID
+	Payload     string
+	MaxAttempts int
+	// RunAt delays the first attempt; zero means now
+	RunAt time.Time
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		type,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		last_error,
+		next_retry_at`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var payload sql.NullString
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Type,
+		&job.VideoID,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.LastError,
+		&job.NextRetryAt,
+	)
+	job.Payload = payload.String
+	return job, err
+}
+
+func (c Client) EnqueueJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		type,
+		video_id,
+		payload,
+		status,
+		max_attempts,
+		next_retry_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	runAt := params.RunAt
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	_, err := c.db.Exec(query, id, params.Type, params.VideoID, params.Payload, JobPending, params.MaxAttempts, runAt.UTC())
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	return scanJob(c.db.QueryRow(query, id))
+}
+
+/**
+ * Claim the next runnable job for workerID
+ * A job is runnable when it is pending and due, or when the worker that
+ * claimed it let its lease run out (e.g. it crashed), and it has attempts
+ * left. The claim is a single UPDATE, so two workers, even in different
+ * processes, can't take the same job. Returns false when there is nothing
+ * to do
+ */
+func (c Client) ClaimJob(workerID string, lease time.Duration, now time.Time) (Job, bool, error) {
+	now = now.UTC()
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		locked_by = ?,
+		locked_until = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id
+		FROM jobs
+		WHERE ((status = ? AND next_retry_at <= ?)
+		OR (status = ? AND locked_until <= ?))
+		AND attempts < max_attempts
+		ORDER BY next_retry_at
+		LIMIT 1
+	)
+	RETURNING` + jobColumns
+
+	job, err := scanJob(c.db.QueryRow(query, JobProcessing, workerID, now.Add(lease), JobPending, now, JobProcessing, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+/**
+ * Fail the jobs whose lease ran out on their last attempt
+ * Their worker died mid-run and ClaimJob won't hand them out again, so
+ * they'd otherwise stay processing forever. Returns the jobs it failed
+ */
+func (c Client) FailExhaustedJobs(now time.Time) ([]Job, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, last_error = ?, locked_by = NULL, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE status = ? AND locked_until <= ? AND attempts >= max_attempts
+	RETURNING` + jobColumns
+
+	rows, err := c.db.Query(query, JobFailed, "lease expired on the last attempt", JobProcessing, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+/**
+ * Mark a job workerID claimed as done
+ * Returns ErrJobLeaseLost when the job is no longer workerID's. The same
+ * goes for RetryJob and FailJob
+ */
+func (c Client) CompleteJob(id uuid.UUID, workerID string) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, locked_by = NULL, locked_until = NULL, last_error = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND locked_by = ?
+	`
+	return leaseHeld(c.db.Exec(query, JobDone, id, workerID))
+}
+
+// RetryJob puts a failed job back in the queue to run again at retryAt.
+func (c Client) RetryJob(id uuid.UUID, workerID, jobErr string, retryAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, last_error = ?, next_retry_at = ?, locked_by = NULL, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND locked_by = ?
+	`
+	return leaseHeld(c.db.Exec(query, JobPending, jobErr, retryAt.UTC(), id, workerID))
+}
+
+// FailJob gives up on a job for good.
+func (c Client) FailJob(id uuid.UUID, workerID, jobErr string) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, last_error = ?, locked_by = NULL, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND locked_by = ?
+	`
+	return leaseHeld(c.db.Exec(query, JobFailed, jobErr, id, workerID))
+}
+
+// leaseHeld turns an update that matched no job into ErrJobLeaseLost.
+func leaseHeld(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrJobLeaseLost
+	}
+	return nil
+}
+
+// HasActiveJob reports whether a job of jobType for videoID is still queued
+// or running.
+func (c Client) HasActiveJob(jobType string, videoID uuid.UUID, payload string) (bool, error) {
+	query := `
+	SELECT 1
+	FROM jobs
+	WHERE type = ? AND video_id = ? AND payload = ? AND status IN (?, ?)
+	LIMIT 1
+	`
+	var found int
+	err := c.db.QueryRow(query, jobType, videoID, payload, JobPending, JobProcessing).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LatestJob returns the most recently queued job of jobType for a video, or
+// false when there is none.
+func (c Client) LatestJob(jobType string, videoID uuid.UUID) (Job, bool, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE type = ? AND video_id = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	job, err := scanJob(c.db.QueryRow(query, jobType, videoID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+// LatestPendingJobRunAt returns when the last pending job of jobType is due,
+// or false when there is none.
+func (c Client) LatestPendingJobRunAt(jobType string) (time.Time, bool, error) {
+	query := `
+	SELECT next_retry_at
+	FROM jobs
+	WHERE type = ? AND status = ?
+	ORDER BY next_retry_at DESC
+	LIMIT 1
+	`
+	var runAt time.Time
+	err := c.db.QueryRow(query, jobType, JobPending).Scan(&runAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return runAt, true, nil
+}
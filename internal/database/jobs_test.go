@@ -0,0 +1,92 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+// TestJobLeaseReclaimed has a slow worker finish a job after its lease ran
+// out and a second worker reclaimed it.
+func TestJobLeaseReclaimed(t *testing.T) {
+	tests := []struct {
+		name       string
+		finish     func(c Client, id uuid.UUID, workerID string) error
+		wantStatus string
+	}{
+		{
+			name:       "complete",
+			finish:     func(c Client, id uuid.UUID, workerID string) error { return c.CompleteJob(id, workerID) },
+			wantStatus: JobDone,
+		},
+		{
+			name: "retry",
+			finish: func(c Client, id uuid.UUID, workerID string) error {
+				return c.RetryJob(id, workerID, "flaky", time.Now().Add(time.Minute))
+			},
+			wantStatus: JobPending,
+		},
+		{
+			name:       "fail",
+			finish:     func(c Client, id uuid.UUID, workerID string) error { return c.FailJob(id, workerID, "broken") },
+			wantStatus: JobFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			job, err := c.EnqueueJob(CreateJobParams{Type: "test", VideoID: uuid.New(), MaxAttempts: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			_, ok, err := c.ClaimJob("slow", time.Minute, now)
+			if err != nil || !ok {
+				t.Fatalf("first ClaimJob = %v, %v, want the job", ok, err)
+			}
+			_, ok, err = c.ClaimJob("fast", time.Minute, now.Add(2*time.Minute))
+			if err != nil || !ok {
+				t.Fatalf("ClaimJob after the lease ran out = %v, %v, want the job", ok, err)
+			}
+
+			err = tt.finish(c, job.ID, "slow")
+			if !errors.Is(err, ErrJobLeaseLost) {
+				t.Fatalf("finishing with the lost lease = %v, want ErrJobLeaseLost", err)
+			}
+			running, err := c.GetJob(job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if running.Status != JobProcessing || running.LastError != nil {
+				t.Fatalf("job is %s with error %v, want still processing for the new worker", running.Status, running.LastError)
+			}
+
+			err = tt.finish(c, job.ID, "fast")
+			if err != nil {
+				t.Fatalf("finishing with the lease held: %v", err)
+			}
+			finished, err := c.GetJob(job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if finished.Status != tt.wantStatus {
+				t.Errorf("job is %s, want %s", finished.Status, tt.wantStatus)
+			}
+			// Finishing frees the lease, so it can't be finished twice
+			if err := tt.finish(c, job.ID, "fast"); !errors.Is(err, ErrJobLeaseLost) {
+				t.Errorf("finishing again = %v, want ErrJobLeaseLost", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StringMap is a map stored as a JSON text column.
+type StringMap map[string]string
+
+func (m StringMap) Value() (driver.Value, error) {
+	return jsonValue(m)
+}
+
+func (m *StringMap) Scan(src any) error {
+	return jsonScan(src, m)
+}
+
+// MarshalXML writes each pair as <entry key="...">value</entry>, sorted by
+// key, since encoding/xml can't encode maps.
+func (m StringMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+		}
+		err = e.EncodeElement(m[key], entry)
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// StringList is a list stored as a JSON text column.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	return jsonValue(l)
+}
+
+func (l *StringList) Scan(src any) error {
+	return jsonScan(src, l)
+}
+
+type AudioTrack struct {
+	Language    string `json:"language" xml:"language"`
+	URL         string `json:"url" xml:"url"`
+	ContentType string `json:"content_type" xml:"content_type"`
+}
+
+// AudioTracks is a list of alternate audio tracks stored as a JSON text
+// column.
+type AudioTracks []AudioTrack
+
+func (t AudioTracks) Value() (driver.Value, error) {
+	return jsonValue(t)
+}
+
+func (t *AudioTracks) Scan(src any) error {
+	return jsonScan(src, t)
+}
+
+// ThumbnailVariant is one stored rendition of a video's thumbnail. Width and
+// Height are zero when unknown. Status is empty for variants that were stored
+// with the upload, otherwise it tracks background generation and URL is only
+// set once it is ready.
+type ThumbnailVariant struct {
+	ContentType string `json:"content_type" xml:"content_type"`
+	Width       int    `json:"width,omitempty" xml:"width,omitempty"`
+	Height      int    `json:"height,omitempty" xml:"height,omitempty"`
+	URL         string `json:"url,omitempty" xml:"url,omitempty"`
+	Status      string `json:"status,omitempty" xml:"status,omitempty"`
+}
+
+const (
+	VariantPending = "pending"
+	VariantReady   = "ready"
+	VariantFailed  = "failed"
+)
+
+// Servable reports whether the variant can be handed to clients.
+func (v ThumbnailVariant) Servable() bool {
+	return v.URL != "" && (v.Status == "" || v.Status == VariantReady)
+}
+
+// ThumbnailVariants is stored as a JSON text column.
+type ThumbnailVariants []ThumbnailVariant
+
+func (v ThumbnailVariants) Value() (driver.Value, error) {
+	return jsonValue(v)
+}
+
+func (v *ThumbnailVariants) Scan(src any) error {
+	return jsonScan(src, v)
+}
+
+// Caption is a WebVTT subtitle track. Source says where it came from, e.g.
+// "embedded" for tracks extracted from the uploaded file.
+type Caption struct {
+	Language string `json:"language" xml:"language"`
+	Label    string `json:"label,omitempty" xml:"label,omitempty"`
+	URL      string `json:"url" xml:"url"`
+	Source   string `json:"source,omitempty" xml:"source,omitempty"`
+}
+
+// Captions is stored as a JSON text column.
+type Captions []Caption
+
+func (c Captions) Value() (driver.Value, error) {
+	return jsonValue(c)
+}
+
+func (c *Captions) Scan(src any) error {
+	return jsonScan(src, c)
+}
+
+// ProcessingReport records what happened while a video was processed.
+type ProcessingReport struct {
+	StartedAt   time.Time        `json:"started_at"`
+	CompletedAt time.Time        `json:"completed_at"`
+	Outcome     string           `json:"outcome"`
+	Input       StringMap        `json:"input,omitempty"`
+	Steps       []ProcessingStep `json:"steps"`
+	Warnings    []string         `json:"warnings,omitempty"`
+}
+
+// ProcessingStep is one stage of the pipeline and the commands it ran.
+type ProcessingStep struct {
+	Name       string   `json:"name"`
+	DurationMS int64    `json:"duration_ms"`
+	Commands   []string `json:"commands,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func (p ProcessingReport) Value() (driver.Value, error) {
+	return jsonValue(p)
+}
+
+func (p *ProcessingReport) Scan(src any) error {
+	return jsonScan(src, p)
+}
+
+func jsonValue(v any) (driver.Value, error) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if string(dat) == "null" {
+		return nil, nil
+	}
+	return string(dat), nil
+}
+
+func jsonScan(src any, dest any) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), dest)
+	case []byte:
+		return json.Unmarshal(src, dest)
+	default:
+		return fmt.Errorf("unsupported JSON column type %T", src)
+	}
+}
@@ -145,3 +145,57 @@ func (c Client) DeleteUser(id uuid.UUID) error {
 	_, err := c.db.Exec(query, id.String())
 	return err
 }
+
+func (c Client) GetUserTier(id uuid.UUID) (string, error) {
+	query := `
+		SELECT tier
+		FROM users
+		WHERE id = ?
+	`
+	var tier string
+	err := c.db.QueryRow(query, id.String()).Scan(&tier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return tier, nil
+}
+
+func (c Client) SetUserTier(id uuid.UUID, tier string) error {
+	query := `
+		UPDATE users
+		SET tier = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, tier, id.String())
+	return err
+}
+
+func (c Client) GetUserTenant(id uuid.UUID) (string, error) {
+	query := `
+		SELECT tenant
+		FROM users
+		WHERE id = ?
+	`
+	var tenant string
+	err := c.db.QueryRow(query, id.String()).Scan(&tenant)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return tenant, nil
+}
+
+func (c Client) SetUserTenant(id uuid.UUID, tenant string) error {
+	query := `
+		UPDATE users
+		SET tenant = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, tenant, id.String())
+	return err
+}
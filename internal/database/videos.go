@@ -2,30 +2,81 @@ package database
 
 import (
 	"database/sql"
+	"encoding/xml"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	XMLName      xml.Name  `json:"-" xml:"video"`
+	ID           uuid.UUID `json:"id" xml:"id"`
+	CreatedAt    time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" xml:"updated_at"`
+	ThumbnailURL *string   `json:"thumbnail_url" xml:"thumbnail_url"`
+	VideoURL     *string   `json:"video_url" xml:"video_url"`
+	HasAudio     *bool     `json:"has_audio" xml:"has_audio"`
+	IsSilent     *bool     `json:"is_silent" xml:"is_silent"`
+	AspectRatio  *string   `json:"aspect_ratio" xml:"aspect_ratio"`
+	FileSize     *int64    `json:"file_size" xml:"file_size"`
+	VideoCodec   *string   `json:"video_codec" xml:"video_codec"`
+	// Ephemeral videos are deleted by the reaper once this passes
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+	// VideoURLExpiresAt is when a presigned VideoURL stops working. Only set
+	// on responses, it isn't stored
+	VideoURLExpiresAt *time.Time `json:"video_url_expires_at,omitempty" xml:"video_url_expires_at,omitempty"`
+	// Status of the copy to the secondary region bucket, if enabled
+	ReplicationStatus *string `json:"replication_status,omitempty" xml:"replication_status,omitempty"`
+	// Keyframe spacing, only measured when keyframe analysis is enabled
+	KeyframeInterval *float64 `json:"keyframe_interval,omitempty" xml:"keyframe_interval,omitempty"`
+	GOPSize          *int     `json:"gop_size,omitempty" xml:"gop_size,omitempty"`
+	RegularKeyframes *bool    `json:"regular_keyframes,omitempty" xml:"regular_keyframes,omitempty"`
+	// Re-encoded copies of the video keyed by codec, e.g. "av1"
+	CodecRenditions StringMap `json:"codec_renditions,omitempty" xml:"codec_renditions,omitempty"`
+	// Auto-generated posters the owner can pick the thumbnail from
+	ThumbnailCandidates StringList `json:"thumbnail_candidates,omitempty" xml:"thumbnail_candidate,omitempty"`
+	// Format and size variants of the current thumbnail
+	ThumbnailVariants ThumbnailVariants `json:"thumbnail_variants,omitempty" xml:"thumbnail_variant,omitempty"`
+	// Alternate language audio, e.g. dubbing
+	AudioTracks AudioTracks `json:"audio_tracks,omitempty" xml:"audio_track,omitempty"`
+	// uploaded while a direct upload awaits processing, ready once servable
+	Status *string `json:"status,omitempty" xml:"status,omitempty"`
+	// Raw object key of a direct upload that has not been completed yet
+	PendingUploadKey *string `json:"-" xml:"-"`
+	// WebVTT subtitle tracks
+	Captions Captions `json:"captions,omitempty" xml:"caption,omitempty"`
+	// Tiny inline placeholder for the thumbnail as a data: URI
+	LQIP *string `json:"lqip,omitempty" xml:"lqip,omitempty"`
+	// Object key of a direct thumbnail upload awaiting completion
+	PendingThumbnailKey *string `json:"-" xml:"-"`
+	// ProcessingReport describes the last processing run, only shown to the
+	// owner through its own endpoint
+	ProcessingReport *ProcessingReport `json:"-" xml:"-"`
+	// ResolutionRenditions maps a rendition like "720p" to its URL
+	ResolutionRenditions StringMap `json:"resolution_renditions,omitempty" xml:"resolution_renditions,omitempty"`
+	// ContactSheetURL is a grid of frames from across the video for review
+	ContactSheetURL *string `json:"contact_sheet_url,omitempty" xml:"contact_sheet_url,omitempty"`
+	// Running time in seconds, frame size and bit rate of the stored video
+	Duration *float64 `json:"duration,omitempty" xml:"duration,omitempty"`
+	Width    *int     `json:"width,omitempty" xml:"width,omitempty"`
+	Height   *int     `json:"height,omitempty" xml:"height,omitempty"`
+	BitRate  *int64   `json:"bit_rate,omitempty" xml:"bit_rate,omitempty"`
+	// StoryboardURL is a WebVTT file mapping positions to tiles of the
+	// StoryboardSpriteURL image, for previews while scrubbing
+	StoryboardURL       *string `json:"storyboard_url,omitempty" xml:"storyboard_url,omitempty"`
+	StoryboardSpriteURL *string `json:"storyboard_sprite_url,omitempty" xml:"storyboard_sprite_url,omitempty"`
 	CreateVideoParams
 }
 
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string    `json:"title" xml:"title"`
+	Description string    `json:"description" xml:"description"`
+	UserID      uuid.UUID `json:"user_id" xml:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +84,93 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		has_audio,
+		is_silent,
+		codec_renditions,
+		thumbnail_candidates,
+		aspect_ratio,
+		audio_tracks,
+		file_size,
+		video_codec,
+		replication_status,
+		keyframe_interval,
+		gop_size,
+		regular_keyframes,
+		thumbnail_variants,
+		expires_at,
+		status,
+		pending_upload_key,
+		captions,
+		lqip,
+		pending_thumbnail_key,
+		processing_report,
+		resolution_renditions,
+		contact_sheet_url,
+		duration,
+		width,
+		height,
+		bit_rate,
+		storyboard_url,
+		storyboard_sprite_url`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.HasAudio,
+		&video.IsSilent,
+		&video.CodecRenditions,
+		&video.ThumbnailCandidates,
+		&video.AspectRatio,
+		&video.AudioTracks,
+		&video.FileSize,
+		&video.VideoCodec,
+		&video.ReplicationStatus,
+		&video.KeyframeInterval,
+		&video.GOPSize,
+		&video.RegularKeyframes,
+		&video.ThumbnailVariants,
+		&video.ExpiresAt,
+		&video.Status,
+		&video.PendingUploadKey,
+		&video.Captions,
+		&video.LQIP,
+		&video.PendingThumbnailKey,
+		&video.ProcessingReport,
+		&video.ResolutionRenditions,
+		&video.ContactSheetURL,
+		&video.Duration,
+		&video.Width,
+		&video.Height,
+		&video.BitRate,
+		&video.StoryboardURL,
+		&video.StoryboardSpriteURL,
+	)
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
+	AND (expires_at IS NULL OR expires_at > ?)
 	ORDER BY created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, userID, time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +178,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -88,29 +210,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -129,27 +234,249 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		has_audio = ?,
+		is_silent = ?,
+		codec_renditions = ?,
+		thumbnail_candidates = ?,
+		aspect_ratio = ?,
+		audio_tracks = ?,
+		file_size = ?,
+		video_codec = ?,
+		replication_status = ?,
+		keyframe_interval = ?,
+		gop_size = ?,
+		regular_keyframes = ?,
+		thumbnail_variants = ?,
+		expires_at = ?,
+		status = ?,
+		pending_upload_key = ?,
+		captions = ?,
+		lqip = ?,
+		pending_thumbnail_key = ?,
+		processing_report = ?,
+		resolution_renditions = ?,
+		contact_sheet_url = ?,
+		duration = ?,
+		width = ?,
+		height = ?,
+		bit_rate = ?,
+		storyboard_url = ?,
+		storyboard_sprite_url = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		video.HasAudio,
+		video.IsSilent,
+		video.CodecRenditions,
+		video.ThumbnailCandidates,
+		video.AspectRatio,
+		video.AudioTracks,
+		video.FileSize,
+		video.VideoCodec,
+		video.ReplicationStatus,
+		video.KeyframeInterval,
+		video.GOPSize,
+		video.RegularKeyframes,
+		video.ThumbnailVariants,
+		video.ExpiresAt,
+		video.Status,
+		video.PendingUploadKey,
+		video.Captions,
+		video.LQIP,
+		video.PendingThumbnailKey,
+		video.ProcessingReport,
+		video.ResolutionRenditions,
+		video.ContactSheetURL,
+		video.Duration,
+		video.Width,
+		video.Height,
+		video.BitRate,
+		video.StoryboardURL,
+		video.StoryboardSpriteURL,
 		video.ID,
 	)
+	if err != nil {
+		return err
+	}
+	// The references change with the row or not at all
+	err = writeAssetRefs(tx, video)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetExpiredVideos returns up to limit videos whose expiry has passed.
+func (c Client) GetExpiredVideos(now time.Time, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE expires_at IS NOT NULL AND expires_at <= ?
+	ORDER BY expires_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+/**
+ * Get uploaded videos stored in any of codecs, oldest first
+ * Relies on the video_codec recorded at upload time
+ */
+func (c Client) GetVideosByCodec(codecs []string, limit int) ([]Video, error) {
+	if len(codecs) == 0 {
+		return []Video{}, nil
+	}
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL AND video_codec IN (?` + strings.Repeat(", ?", len(codecs)-1) + `)
+	ORDER BY created_at
+	LIMIT ?
+	`
+	args := make([]any, 0, len(codecs)+1)
+	for _, codec := range codecs {
+		args = append(args, codec)
+	}
+	args = append(args, limit)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// SumFileSizes adds up the stored sizes of a user's videos, leaving out
+// excluding.
+func (c Client) SumFileSizes(userID, excluding uuid.UUID) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(file_size), 0)
+	FROM videos
+	WHERE user_id = ? AND id != ?
+	`
+	var total int64
+	err := c.db.QueryRow(query, userID, excluding).Scan(&total)
+	return total, err
+}
+
+// IsExpired reports whether an ephemeral video has passed its expiry.
+func (v Video) IsExpired(now time.Time) bool {
+	return v.ExpiresAt != nil && !now.Before(*v.ExpiresAt)
+}
+
+const (
+	VideoStatusUploaded   = "uploaded"
+	VideoStatusPending    = "pending"
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+)
+
+// SetVideoStatus only touches status, for background or failure paths that
+// must not overwrite other changes to the row.
+func (c Client) SetVideoStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+const (
+	ReplicationPending    = "pending"
+	ReplicationReplicated = "replicated"
+	ReplicationFailed     = "failed"
+)
+
+// SetReplicationStatus only touches replication_status so background
+// replication can't overwrite other changes to the row.
+func (c Client) SetReplicationStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET replication_status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
 	return err
 }
 
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
-	return err
+	_, err = tx.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM asset_refs WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetVideoByTitle finds one of the user's videos whose title matches title,
+// ignoring case and differences in whitespace.
+func (c Client) GetVideoByTitle(userID uuid.UUID, title string) (Video, error) {
+	videos, err := c.GetVideos(userID)
+	if err != nil {
+		return Video{}, err
+	}
+	normalized := normalizeTitle(title)
+	for _, video := range videos {
+		if normalizeTitle(video.Title) == normalized {
+			return video, nil
+		}
+	}
+	return Video{}, nil
+}
+
+func normalizeTitle(title string) string {
+	return strings.ToLower(strings.Join(strings.Fields(title), " "))
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// jobType describes how to run one kind of queued job.
+type jobType struct {
+	run         func(ctx context.Context, job database.Job) error
+	maxAttempts int
+	// failed is called once a job has used up its attempts
+	failed func(job database.Job, err error)
+}
+
+/**
+ * jobQueue runs jobs persisted in the jobs table
+ * Claims are leased, so a job that was running when a process died is picked
+ * up again once its lease runs out, by this or any other instance
+ */
+type jobQueue struct {
+	db       database.Client
+	workerID string
+	lease    time.Duration
+	poll     time.Duration
+	types    map[string]jobType
+	wake     chan struct{}
+}
+
+func newJobQueue(db database.Client, lease, poll time.Duration) *jobQueue {
+	hostname, _ := os.Hostname()
+	return &jobQueue{
+		db:       db,
+		workerID: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		lease:    lease,
+		poll:     poll,
+		types:    map[string]jobType{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (q *jobQueue) register(name string, t jobType) {
+	q.types[name] = t
+}
+
+// jobPayload encodes a job payload the way it is stored.
+func jobPayload(payload any) (string, error) {
+	data, err := json.Marshal(payload)
+	return string(data), err
+}
+
+/**
+ * Persist a new job; payload is stored as JSON
+ */
+func (q *jobQueue) enqueue(name string, videoID uuid.UUID, payload any) (database.Job, error) {
+	return q.enqueueAt(name, videoID, payload, time.Time{})
+}
+
+// enqueueAt is enqueue with the first attempt held back until runAt.
+func (q *jobQueue) enqueueAt(name string, videoID uuid.UUID, payload any, runAt time.Time) (database.Job, error) {
+	t, ok := q.types[name]
+	if !ok {
+		return database.Job{}, fmt.Errorf("unknown job type: %s", name)
+	}
+	data, err := jobPayload(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := q.db.EnqueueJob(database.CreateJobParams{
+		Type:        name,
+		VideoID:     videoID,
+		Payload:     data,
+		MaxAttempts: t.maxAttempts,
+		RunAt:       runAt,
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (q *jobQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+func (q *jobQueue) work() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		}
+		q.failExhausted()
+		for q.runNext() {
+		}
+		timer.Reset(q.poll)
+	}
+}
+
+// failExhausted gives up on jobs whose worker died during their last attempt.
+func (q *jobQueue) failExhausted() {
+	jobs, err := q.db.FailExhaustedJobs(time.Now())
+	if err != nil {
+		log.Printf("Couldn't fail exhausted jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		err := fmt.Errorf("lease expired on attempt %d/%d", job.Attempts, job.MaxAttempts)
+		log.Printf("Job %s (%s) for video %s failed for good: %v", job.ID, job.Type, job.VideoID, err)
+		if t, ok := q.types[job.Type]; ok && t.failed != nil {
+			t.failed(job, err)
+		}
+	}
+}
+
+// runNext runs one job and reports whether there was one to run.
+func (q *jobQueue) runNext() bool {
+	job, ok, err := q.db.ClaimJob(q.workerID, q.lease, time.Now())
+	if err != nil {
+		log.Printf("Couldn't claim job: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	t, ok := q.types[job.Type]
+	if !ok {
+		err = fmt.Errorf("unknown job type: %s", job.Type)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), q.lease)
+		err = t.run(ctx, job)
+		cancel()
+	}
+	if err == nil {
+		if err := q.db.CompleteJob(job.ID, q.workerID); err != nil {
+			log.Printf("Couldn't complete job %s: %v", job.ID, err)
+		}
+		return true
+	}
+
+	// A rejected upload fails the same way every time
+	var rejection *uploadRejection
+	if job.Attempts >= job.MaxAttempts || !ok || errors.As(err, &rejection) {
+		log.Printf("Job %s (%s) for video %s failed for good after %d attempts: %v", job.ID, job.Type, job.VideoID, job.Attempts, err)
+		if err := q.db.FailJob(job.ID, q.workerID, err.Error()); err != nil {
+			log.Printf("Couldn't fail job %s: %v", job.ID, err)
+			// Another worker has the job now, its cleanup isn't ours to do
+			if errors.Is(err, database.ErrJobLeaseLost) {
+				return true
+			}
+		}
+		if ok && t.failed != nil {
+			t.failed(job, err)
+		}
+		return true
+	}
+	retryAt := time.Now().Add(jobBackoff(job.Attempts))
+	log.Printf("Job %s (%s) attempt %d/%d failed, retrying at %s: %v", job.ID, job.Type, job.Attempts, job.MaxAttempts, retryAt.Format(time.RFC3339), err)
+	if err := q.db.RetryJob(job.ID, q.workerID, err.Error(), retryAt); err != nil {
+		log.Printf("Couldn't reschedule job %s: %v", job.ID, err)
+	}
+	return true
+}
+
+// jobBackoff doubles the wait after each failed attempt, up to ten minutes.
+func jobBackoff(attempts int) time.Duration {
+	backoff := 5 * time.Second
+	for i := 1; i < attempts && backoff < 10*time.Minute; i++ {
+		backoff *= 2
+	}
+	return min(backoff, 10*time.Minute)
+}
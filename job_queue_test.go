@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func enqueueTestJob(t *testing.T, db database.Client, maxAttempts int) database.Job {
+	job, err := db.EnqueueJob(database.CreateJobParams{Type: "test", VideoID: uuid.New(), MaxAttempts: maxAttempts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestClaimJob(t *testing.T) {
+	db := newTestDB(t)
+	job := enqueueTestJob(t, db, 3)
+	now := time.Now()
+
+	claimed, ok, err := db.ClaimJob("first", time.Minute, now)
+	if err != nil || !ok {
+		t.Fatalf("ClaimJob = %v, %v, want the queued job", ok, err)
+	}
+	if claimed.ID != job.ID || claimed.Status != database.JobProcessing || claimed.Attempts != 1 {
+		t.Errorf("claimed %s (%s, attempt %d), want %s processing on attempt 1", claimed.ID, claimed.Status, claimed.Attempts, job.ID)
+	}
+	// Leased to the first worker
+	_, ok, err = db.ClaimJob("second", time.Minute, now.Add(30*time.Second))
+	if err != nil || ok {
+		t.Errorf("second claim during the lease = %v, %v, want nothing", ok, err)
+	}
+}
+
+func TestJobQueueRetry(t *testing.T) {
+	db := newTestDB(t)
+	q := newJobQueue(db, time.Minute, time.Hour)
+	runs := 0
+	q.register("test", jobType{
+		run: func(ctx context.Context, job database.Job) error {
+			runs++
+			if runs == 1 {
+				return errors.New("flaky")
+			}
+			return nil
+		},
+		maxAttempts: 3,
+	})
+	job, err := q.enqueue("test", uuid.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !q.runNext() {
+		t.Fatal("runNext found nothing to run")
+	}
+	retried, err := db.GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Status != database.JobPending || retried.LastError == nil || *retried.LastError != "flaky" {
+		t.Fatalf("after a failure the job is %s with error %v, want pending with flaky", retried.Status, retried.LastError)
+	}
+	if wait := time.Until(retried.NextRetryAt); wait < jobBackoff(1)-time.Second {
+		t.Errorf("retry is due in %s, want about %s", wait, jobBackoff(1))
+	}
+	// Not due yet
+	if q.runNext() {
+		t.Error("runNext ran the job before its retry was due")
+	}
+
+	_, ok, err := db.ClaimJob("worker", time.Minute, retried.NextRetryAt)
+	if err != nil || !ok {
+		t.Fatalf("ClaimJob once due = %v, %v, want the job", ok, err)
+	}
+	err = db.CompleteJob(job.ID, "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := db.GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != database.JobDone || done.Attempts != 2 || done.LastError != nil {
+		t.Errorf("job is %s after %d attempts with error %v, want done after 2 without one", done.Status, done.Attempts, done.LastError)
+	}
+}
+
+func TestClaimJobAfterRestart(t *testing.T) {
+	db := newTestDB(t)
+	job := enqueueTestJob(t, db, 2)
+	now := time.Now()
+
+	// The first worker dies holding the job
+	_, ok, err := db.ClaimJob("crashed", time.Minute, now)
+	if err != nil || !ok {
+		t.Fatalf("ClaimJob = %v, %v", ok, err)
+	}
+	recovered, ok, err := db.ClaimJob("restarted", time.Minute, now.Add(time.Minute))
+	if err != nil || !ok {
+		t.Fatalf("ClaimJob after the lease = %v, %v, want the job back", ok, err)
+	}
+	if recovered.ID != job.ID || recovered.Attempts != 2 {
+		t.Errorf("recovered %s on attempt %d, want %s on attempt 2", recovered.ID, recovered.Attempts, job.ID)
+	}
+
+	// And so does the second, on the last attempt
+	later := now.Add(2 * time.Minute)
+	_, ok, err = db.ClaimJob("another", time.Minute, later)
+	if err != nil || ok {
+		t.Fatalf("ClaimJob of an exhausted job = %v, %v, want nothing", ok, err)
+	}
+	failed, err := db.FailExhaustedJobs(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ID != job.ID || failed[0].Status != database.JobFailed {
+		t.Fatalf("FailExhaustedJobs = %+v, want %s failed", failed, job.ID)
+	}
+	failed, err = db.FailExhaustedJobs(later)
+	if err != nil || len(failed) != 0 {
+		t.Errorf("second FailExhaustedJobs = %d jobs, %v, want none", len(failed), err)
+	}
+}
+
+func TestJobQueueFailsExhaustedJobs(t *testing.T) {
+	db := newTestDB(t)
+	q := newJobQueue(db, time.Millisecond, time.Hour)
+	var gaveUp []uuid.UUID
+	q.register("test", jobType{
+		run:         func(ctx context.Context, job database.Job) error { return nil },
+		maxAttempts: 1,
+		failed: func(job database.Job, err error) {
+			gaveUp = append(gaveUp, job.ID)
+		},
+	})
+	job, err := q.enqueue("test", uuid.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err := db.ClaimJob("crashed", time.Millisecond, time.Now())
+	if err != nil || !ok {
+		t.Fatalf("ClaimJob = %v, %v", ok, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	q.failExhausted()
+	if q.runNext() {
+		t.Error("runNext ran a job with no attempts left")
+	}
+	stored, err := db.GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.JobFailed || stored.Attempts != 1 {
+		t.Errorf("job is %s after %d attempts, want failed after 1", stored.Status, stored.Attempts)
+	}
+	if len(gaveUp) != 1 || gaveUp[0] != job.ID {
+		t.Errorf("failed callback ran for %v, want %s", gaveUp, job.ID)
+	}
+
+	err = db.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetJob(job.ID)
+	if err == nil {
+		t.Error("job survived Reset")
+	}
+}
@@ -7,11 +7,19 @@ import (
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
-	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	respondWithErrorType(w, code, "", msg, err)
+}
+
+// respondWithErrorType is respondWithError with an explicit problem type,
+// for messages that carry values. An empty problemType is slugged from msg.
+func respondWithErrorType(w http.ResponseWriter, code int, problemType, msg string, err error) {
+	logError(w, code, msg, err)
+	if pw := problemWriterOf(w); pw != nil {
+		if problemType == "" {
+			problemType = problemSlug(msg)
+		}
+		respondWithProblem(w, pw, code, problemType, msg)
+		return
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
@@ -22,7 +30,11 @@ func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, code, "application/json", payload)
+}
+
+func writeJSON(w http.ResponseWriter, code int, contentType string, payload interface{}) {
+	w.Header().Set("Content-Type", contentType)
 	dat, err := json.Marshal(payload)
 	if err != nil {
 		log.Printf("Error marshalling JSON: %s", err)
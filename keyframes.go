@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type gopInfo struct {
+	// Average seconds between keyframes
+	KeyframeInterval float64
+	// Average frames between keyframes
+	GOPSize int
+	// Whether every interval is within 10% of the median
+	Regular bool
+}
+
+// parseFrameRate parses ffprobe rates such as "30000/1001" or "25".
+func parseFrameRate(rate string) (float64, error) {
+	numerator, denominator, ok := strings.Cut(rate, "/")
+	num, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return num, nil
+	}
+	den, err := strconv.ParseFloat(denominator, 64)
+	if err != nil {
+		return 0, err
+	}
+	if den == 0 {
+		return 0, fmt.Errorf("invalid frame rate: %s", rate)
+	}
+	return num / den, nil
+}
+
+/**
+ * Measure keyframe spacing of the first video stream
+ * Only keyframes are decoded, but this still reads the whole file
+ */
+func getGOPInfo(ctx context.Context, filePath string) (gopInfo, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-skip_frame", "nokey",
+		"-show_entries", "frame=best_effort_timestamp_time:stream=avg_frame_rate", "-print_format", "json", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return gopInfo{}, err
+	}
+
+	var ffprobeOutput struct {
+		Streams []struct {
+			AvgFrameRate string `json:"avg_frame_rate"`
+		} `json:"streams"`
+		Frames []struct {
+			Timestamp string `json:"best_effort_timestamp_time"`
+		} `json:"frames"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return gopInfo{}, err
+	}
+	if len(ffprobeOutput.Streams) == 0 {
+		return gopInfo{}, fmt.Errorf("no video stream found")
+	}
+	fps, err := parseFrameRate(ffprobeOutput.Streams[0].AvgFrameRate)
+	if err != nil {
+		return gopInfo{}, err
+	}
+
+	timestamps := []float64{}
+	for _, frame := range ffprobeOutput.Frames {
+		timestamp, err := strconv.ParseFloat(frame.Timestamp, 64)
+		if err != nil {
+			continue
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	return computeGOPInfo(timestamps, fps)
+}
+
+func computeGOPInfo(keyframeTimes []float64, fps float64) (gopInfo, error) {
+	if len(keyframeTimes) < 2 {
+		return gopInfo{}, fmt.Errorf("not enough keyframes to measure GOP")
+	}
+	sort.Float64s(keyframeTimes)
+
+	intervals := make([]float64, 0, len(keyframeTimes)-1)
+	total := 0.0
+	for i := 1; i < len(keyframeTimes); i++ {
+		interval := keyframeTimes[i] - keyframeTimes[i-1]
+		intervals = append(intervals, interval)
+		total += interval
+	}
+	average := total / float64(len(intervals))
+
+	sorted := append([]float64(nil), intervals...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	regular := true
+	for _, interval := range intervals {
+		if median == 0 || math.Abs(interval-median)/median > 0.1 {
+			regular = false
+			break
+		}
+	}
+
+	return gopInfo{
+		KeyframeInterval: average,
+		GOPSize:          int(math.Round(average * fps)),
+		Regular:          regular,
+	}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestParseFrameRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    float64
+		wantErr bool
+	}{
+		{rate: "30/1", want: 30},
+		{rate: "30000/1001", want: 30000.0 / 1001},
+		{rate: "25", want: 25},
+		{rate: "0/0", wantErr: true},
+		{rate: "fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFrameRate(tt.rate)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseFrameRate(%q) = %v, %v, want %v (error %v)", tt.rate, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestComputeGOPInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		times     []float64
+		fps       float64
+		want      gopInfo
+		wantError bool
+	}{
+		{name: "regular", times: []float64{0, 2, 4, 6}, fps: 30, want: gopInfo{KeyframeInterval: 2, GOPSize: 60, Regular: true}},
+		{name: "out of order", times: []float64{4, 0, 2}, fps: 25, want: gopInfo{KeyframeInterval: 2, GOPSize: 50, Regular: true}},
+		{name: "irregular", times: []float64{0, 1, 2, 6}, fps: 30, want: gopInfo{KeyframeInterval: 2, GOPSize: 60, Regular: false}},
+		{name: "one keyframe", times: []float64{0}, fps: 30, wantError: true},
+	}
+	for _, tt := range tests {
+		got, err := computeGOPInfo(tt.times, tt.fps)
+		if (err != nil) != tt.wantError {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantError)
+			continue
+		}
+		if math.Abs(got.KeyframeInterval-tt.want.KeyframeInterval) > 1e-9 || got.GOPSize != tt.want.GOPSize || got.Regular != tt.want.Regular {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetGOPInfo(t *testing.T) {
+	// Keyframes every 2s at 30fps
+	installFakeProcessingTools(t, fakeProbeOutput)
+	got, err := getGOPInfo(context.Background(), "upload.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KeyframeInterval != 2 || got.GOPSize != 60 || !got.Regular {
+		t.Errorf("getGOPInfo = %+v, want a regular 2s, 60 frame GOP", got)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "regexp"
+
+// A pragmatic subset of BCP 47: a 2-3 letter primary language followed by
+// optional script, region or variant subtags, e.g. "en", "pt-BR", "zh-Hant-TW".
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+func isValidLanguageTag(tag string) bool {
+	return languageTagPattern.MatchString(tag)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Serve a file from assetsRoot for /assets/
+ * http.ServeContent answers Range, If-Modified-Since and If-Range, so
+ * players can seek in locally stored media. Directories are never listed
+ */
+func (cfg *apiConfig) handlerLocalAsset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/assets")), "/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(cfg.assetsRoot, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open asset", err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read asset", err)
+		return
+	}
+	if info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
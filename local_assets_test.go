@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLocalAssetRange(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	err := os.WriteFile(filepath.Join(root, "video.mp4"), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(root, "thumbnails"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{assetsRoot: root}
+	modified := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name             string
+		target           string
+		header           http.Header
+		wantCode         int
+		wantContentRange string
+		wantLength       int
+	}{
+		{name: "whole file", target: "/assets/video.mp4", wantCode: http.StatusOK, wantLength: 1000},
+		{name: "first 100 bytes", target: "/assets/video.mp4", header: http.Header{"Range": {"bytes=0-99"}}, wantCode: http.StatusPartialContent, wantContentRange: "bytes 0-99/1000", wantLength: 100},
+		{name: "last 10 bytes", target: "/assets/video.mp4", header: http.Header{"Range": {"bytes=-10"}}, wantCode: http.StatusPartialContent, wantContentRange: "bytes 990-999/1000", wantLength: 10},
+		{name: "past the end", target: "/assets/video.mp4", header: http.Header{"Range": {"bytes=2000-"}}, wantCode: http.StatusRequestedRangeNotSatisfiable, wantContentRange: "bytes */1000"},
+		{name: "not modified", target: "/assets/video.mp4", header: http.Header{"If-Modified-Since": {modified}}, wantCode: http.StatusNotModified},
+		{name: "missing", target: "/assets/gone.mp4", wantCode: http.StatusNotFound},
+		{name: "directory", target: "/assets/thumbnails/", wantCode: http.StatusNotFound},
+		{name: "root", target: "/assets/", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		for key, values := range tt.header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		cfg.handlerLocalAsset(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantCode)
+			continue
+		}
+		if got := w.Header().Get("Content-Range"); got != tt.wantContentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tt.name, got, tt.wantContentRange)
+		}
+		if tt.wantLength != 0 && w.Body.Len() != tt.wantLength {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, w.Body.Len(), tt.wantLength)
+		}
+	}
+}
+
+func TestThumbnailGetRange(t *testing.T) {
+	cfg := &apiConfig{}
+	videoID := uuid.New()
+	videoThumbnails[videoID] = thumbnail{data: bytes.Repeat([]byte{0xff}, 500), mediaType: "image/png"}
+	t.Cleanup(func() { delete(videoThumbnails, videoID) })
+
+	req := httptest.NewRequest(http.MethodGet, "/api/thumbnails/"+videoID.String(), nil)
+	req.SetPathValue("videoID", videoID.String())
+	req.Header.Set("Range", "bytes=0-99")
+	w := httptest.NewRecorder()
+	cfg.handlerThumbnailGet(w, req)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 0-99/500" {
+		t.Errorf("Content-Range = %q, want bytes 0-99/500", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/png" || w.Body.Len() != 100 {
+		t.Errorf("got %d bytes of %s, want 100 bytes of image/png", w.Body.Len(), got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// parseLogLevel reads debug, info, warn or error; empty is info.
+func parseLogLevel(level string) (*slog.LevelVar, error) {
+	logLevel := &slog.LevelVar{}
+	if level != "" {
+		err := logLevel.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q", level)
+		}
+	}
+	return logLevel, nil
+}
+
+/**
+ * Install the process-wide slog logger
+ * format is json (the default) or text. Records below level are dropped;
+ * level can be changed later. The log package writes through it too, so
+ * older log.Printf calls come out as info records
+ */
+func setupLogging(format string, level slog.Leveler) error {
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch format {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, want json or text", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// loggingResponseWriter carries the request's logger and records what was
+// sent for the access log. respondWithError logs through it.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	logger *slog.Logger
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/**
+ * Give every request an ID and log it when it's done
+ * The ID comes from the caller's X-Request-ID when it is sane, is echoed in
+ * the response and is on every record logged for the request
+ */
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+			logger = logger.With("trace_id", spanContext.TraceID().String())
+		}
+		lw := &loggingResponseWriter{ResponseWriter: w, logger: logger}
+		next.ServeHTTP(lw, r)
+
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		lw.logger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"pattern", r.Pattern,
+			"status", lw.status,
+			"bytes", lw.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// validRequestID accepts short printable IDs, so a caller can't forge log
+// lines through the header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r < 0x21 || r > 0x7e
+	})
+}
+
+// loggingWriterOf finds the loggingResponseWriter under w, if any.
+func loggingWriterOf(w http.ResponseWriter) *loggingResponseWriter {
+	for {
+		if lw, ok := w.(*loggingResponseWriter); ok {
+			return lw
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+// requestLogger is the logger of the request behind w, or the default one
+// outside a request.
+func requestLogger(w http.ResponseWriter) *slog.Logger {
+	if lw := loggingWriterOf(w); lw != nil {
+		return lw.logger
+	}
+	return slog.Default()
+}
+
+// addLogFields puts key/value pairs on every later record of the request,
+// the access log line included.
+func addLogFields(w http.ResponseWriter, args ...any) {
+	if lw := loggingWriterOf(w); lw != nil {
+		lw.logger = lw.logger.With(args...)
+	}
+}
+
+// logLevelForStatus is how loudly an error response is logged: server
+// faults are errors, client mistakes only info.
+func logLevelForStatus(code int) slog.Level {
+	if code > 499 {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// logError logs an error response with its cause.
+func logError(w http.ResponseWriter, code int, msg string, err error) {
+	args := []any{"status", code}
+	if err != nil {
+		args = append(args, "error", err.Error())
+	}
+	requestLogger(w).Log(context.Background(), logLevelForStatus(code), msg, args...)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// captureLogs sends slog records to a buffer as JSON for the rest of the
+// test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	logs := &bytes.Buffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+// logRecords decodes captured JSON records, keyed by message.
+func logRecords(t *testing.T, logs *bytes.Buffer) map[string]map[string]any {
+	records := map[string]map[string]any{}
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		record := map[string]any{}
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", line, err)
+		}
+		records[record["msg"].(string)] = record
+	}
+	return records
+}
+
+func TestRequestLogUpload(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+	logs := captureLogs(t)
+
+	req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+	req.Header.Set(requestIDHeader, "upload-42")
+	w := httptest.NewRecorder()
+	requestLogMiddleware(http.HandlerFunc(cfg.handlerUploadVideo)).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get(requestIDHeader); got != "upload-42" {
+		t.Errorf("%s = %q, want the caller's upload-42", requestIDHeader, got)
+	}
+
+	access, ok := logRecords(t, logs)["request"]
+	if !ok {
+		t.Fatalf("no access log in %s", logs)
+	}
+	want := map[string]any{
+		"level":      "INFO",
+		"request_id": "upload-42",
+		"video_id":   video.ID.String(),
+		"user_id":    video.UserID.String(),
+		"media_type": "video/mp4",
+		"method":     http.MethodPost,
+		"status":     float64(http.StatusOK),
+	}
+	for key, value := range want {
+		if access[key] != value {
+			t.Errorf("access log %s = %v, want %v", key, access[key], value)
+		}
+	}
+	for _, key := range []string{"bytes", "duration_ms"} {
+		if _, ok := access[key].(float64); !ok {
+			t.Errorf("access log %s = %v, want a number", key, access[key])
+		}
+	}
+}
+
+func TestRequestLogErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		code      int
+		err       error
+		wantLevel string
+	}{
+		{name: "client error", requestID: "bad-request-1", code: http.StatusBadRequest, err: errors.New("no video field"), wantLevel: "INFO"},
+		{name: "server error", requestID: "server-error-1", code: http.StatusInternalServerError, err: errors.New("disk full"), wantLevel: "ERROR"},
+		{name: "forged request ID", requestID: "x\ninjected", code: http.StatusInternalServerError, err: errors.New("disk full"), wantLevel: "ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			handler := requestLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				addLogFields(w, "video_id", "v1")
+				respondWithError(w, tt.code, "Couldn't upload", tt.err)
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/api/video_upload/v1", nil)
+			req.Header.Set(requestIDHeader, tt.requestID)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			requestID := w.Header().Get(requestIDHeader)
+			if validRequestID(tt.requestID) && requestID != tt.requestID {
+				t.Errorf("%s = %q, want the caller's %q", requestIDHeader, requestID, tt.requestID)
+			}
+			if _, err := uuid.Parse(requestID); !validRequestID(tt.requestID) && err != nil {
+				t.Errorf("%s = %q, want a generated UUID", requestIDHeader, requestID)
+			}
+			record, ok := logRecords(t, logs)["Couldn't upload"]
+			if !ok {
+				t.Fatalf("error wasn't logged: %s", logs)
+			}
+			if record["level"] != tt.wantLevel || record["error"] != tt.err.Error() || record["status"] != float64(tt.code) {
+				t.Errorf("error record = %v, want %s with %q", record, tt.wantLevel, tt.err)
+			}
+			if record["request_id"] != requestID || record["video_id"] != "v1" {
+				t.Errorf("error record = %v, want request %s and video v1", record, requestID)
+			}
+		})
+	}
+}
+
+func TestRequestLogUploadWarnings(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	installFakeTool(t, "ffprobe", `case "$*" in
+*format=format_name*) echo "mov,mp4,m4a,3gp,3g2,mj2" ;;
+*"-select_streams s "*) echo "subtitle stream unreadable" >&2; exit 1 ;;
+*) cat "$(dirname "$(command -v ffmpeg)")/probe.json" ;;
+esac
+`)
+	cfg, _, video, token := newS3Test(t)
+	cfg.extractSubtitles = true
+	logs := captureLogs(t)
+
+	req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+	req.Header.Set(requestIDHeader, "upload-43")
+	w := httptest.NewRecorder()
+	requestLogMiddleware(http.HandlerFunc(cfg.handlerUploadVideo)).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	record, ok := logRecords(t, logs)["Couldn't extract subtitles"]
+	if !ok {
+		t.Fatalf("warning wasn't logged: %s", logs)
+	}
+	if record["level"] != "WARN" || record["request_id"] != "upload-43" || record["video_id"] != video.ID.String() {
+		t.Errorf("warning record = %v, want WARN for request upload-43 and video %s", record, video.ID)
+	}
+	if _, ok := record["error"].(string); !ok {
+		t.Errorf("warning record = %v, want the error", record)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Error("parseLogLevel(loud) succeeded, want an error")
+	}
+	level, err := parseLogLevel("warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	err = setupLogging("json", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if slog.Default().Enabled(ctx, slog.LevelInfo) || !slog.Default().Enabled(ctx, slog.LevelWarn) {
+		t.Error("logger at warn should drop info and keep warn")
+	}
+	level.Set(slog.LevelDebug)
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		t.Error("lowering the level didn't reach the installed logger")
+	}
+}
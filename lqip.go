@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// lqipWidth is the width of the inline placeholder in pixels.
+const lqipWidth = 16
+
+/**
+ * Build a low-quality placeholder for an image as a JPEG data: URI
+ * Quality is lowered until the URI fits in maxBytes
+ */
+func generateLQIP(data []byte, maxBytes int) (string, error) {
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	small := shrinkImage(source, lqipWidth)
+
+	for _, quality := range []int{40, 25, 10} {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return "", err
+		}
+		uri := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		if len(uri) <= maxBytes {
+			return uri, nil
+		}
+	}
+	return "", fmt.Errorf("placeholder doesn't fit in %d bytes", maxBytes)
+}
+
+// shrinkImage box-filters img down to width pixels wide, keeping its aspect
+// ratio.
+func shrinkImage(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := out.PixOffset(x, y)
+			out.Pix[i+0] = uint8(r / n >> 8)
+			out.Pix[i+1] = uint8(g / n >> 8)
+			out.Pix[i+2] = uint8(b / n >> 8)
+			out.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return out
+}
+
+// setVideoLQIP refreshes the placeholder on video from the thumbnail bytes.
+// Failures only drop the placeholder.
+func (cfg *apiConfig) setVideoLQIP(video *database.Video, data []byte) {
+	video.LQIP = nil
+	if !cfg.lqipEnabled {
+		return
+	}
+	uri, err := generateLQIP(data, cfg.lqipMaxBytes)
+	if err != nil {
+		log.Printf("Couldn't generate placeholder for video %s: %v", video.ID, err)
+		return
+	}
+	video.LQIP = &uri
+}
+
+// setVideoLQIPFromObject is setVideoLQIP for a thumbnail stored in S3.
+func (cfg *apiConfig) setVideoLQIPFromObject(ctx context.Context, video *database.Video, bucket, key string) {
+	video.LQIP = nil
+	if !cfg.lqipEnabled {
+		return
+	}
+	path, err := cfg.downloadObjectFromBucket(ctx, bucket, key, "lqip-source")
+	if err != nil {
+		log.Printf("Couldn't download thumbnail %s for placeholder: %v", key, err)
+		return
+	}
+	defer os.Remove(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Couldn't read thumbnail %s for placeholder: %v", key, err)
+		return
+	}
+	cfg.setVideoLQIP(video, data)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGenerateLQIP(t *testing.T) {
+	var fixture bytes.Buffer
+	err := png.Encode(&fixture, testPNG(200, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri, err := generateLQIP(fixture.Bytes(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLQIP(t, uri, 1024)
+
+	if _, err := generateLQIP(fixture.Bytes(), 400); err == nil {
+		t.Error("placeholder fit in 400 bytes, want an error")
+	}
+	if _, err := generateLQIP([]byte("not an image"), 600); err == nil {
+		t.Error("placeholder made from garbage, want an error")
+	}
+}
+
+// assertLQIP checks uri is a JPEG data: URI of a 16 pixel wide image that
+// fits in maxBytes.
+func assertLQIP(t *testing.T, uri string, maxBytes int) {
+	t.Helper()
+	if len(uri) > maxBytes {
+		t.Errorf("placeholder is %d bytes, want at most %d", len(uri), maxBytes)
+	}
+	encoded, ok := strings.CutPrefix(uri, "data:image/jpeg;base64,")
+	if !ok {
+		t.Fatalf("placeholder %.40s... isn't a JPEG data URI", uri)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("placeholder isn't valid base64: %v", err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "jpeg" || config.Width != lqipWidth {
+		t.Errorf("placeholder decodes as %s %dx%d, %v, want a %d wide jpeg", format, config.Width, config.Height, err, lqipWidth)
+	}
+}
+
+func TestVideoJSONIncludesLQIP(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg, video, token := newThumbnailTest(t)
+		cfg.lqipEnabled = enabled
+		cfg.lqipMaxBytes = 1024
+
+		w := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+		}
+		w = httptest.NewRecorder()
+		cfg.handlerVideoGet(w, newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String(), video, token, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("get status = %d: %s", w.Code, w.Body)
+		}
+		var resp map[string]any
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lqip, ok := resp["lqip"].(string)
+		if ok != enabled {
+			t.Errorf("lqip enabled %v: video JSON has lqip = %v", enabled, resp["lqip"])
+		}
+		if ok {
+			assertLQIP(t, lqip, cfg.lqipMaxBytes)
+		}
+	}
+}
@@ -2,12 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 
@@ -26,6 +39,159 @@ type apiConfig struct {
 	s3CfDistribution string
 	port             string
 	s3Client         *s3.Client
+	// s3PrivateBucket stores default bucket videos as "bucket,key" so they
+	// are presigned on read instead of linked through CloudFront
+	s3PrivateBucket bool
+	// store writes uploads to the default bucket; presigning and lookups
+	// still go through s3Client
+	store objectStore
+	// gcs is the default bucket's store when STORAGE_BACKEND is gcs, and
+	// signs its URLs
+	gcs *gcsObjectStore
+	// local is the default bucket's store when STORAGE_BACKEND is local;
+	// lookups and downloads then read its files instead of using s3Client
+	local         *localObjectStore
+	encryption    serverSideEncryption
+	storageClass  types.StorageClass
+	toolLookup    *toolLookup
+	metrics       *uploadMetrics
+	healthTimeout time.Duration
+	// logLevel is the level of the process-wide logger, adjustable while
+	// running
+	logLevel *slog.LevelVar
+
+	processor videoProcessor
+
+	cleanupOldThumbnails   bool
+	presignCache           *presignCache
+	presignExpiry          time.Duration
+	presignMaxExpiry       time.Duration
+	verifyPresignedObjects bool
+	existsCache            *existsCache
+	bannedHashes           bannedHashStore
+	detectSilentAudio      bool
+	adminUserIDs           map[uuid.UUID]bool
+	reencodeCodecs         map[string]bool
+	reencodeLocks          *videoLocker
+	uploadLocks            *videoLocker
+	duplicateUploadAction  string
+	scheduler              *processingScheduler
+	processingRetryAfter   time.Duration
+
+	autoThumbnailCandidates bool
+	thumbnailCandidateCount int
+	thumbnailStreamIndex    int
+	autoThumbnailAt         time.Duration
+
+	minVideoBytes     int64
+	minThumbnailBytes int64
+	userQuotaBytes    int64
+
+	downloadRateLimit int64
+	downloadTierRates map[string]int64
+	downloadPresigned bool
+
+	thumbnailAspectCheck     string
+	thumbnailAspectTolerance float64
+	thumbnailDualFormat      bool
+	stripThumbnailMetadata   bool
+	thumbnailJPEGQuality     int
+	thumbnailSizes           []thumbnailSize
+	thumbnailMaxBytes        int64
+	thumbnailMaxDimension    int
+	thumbnailVariantsAsync   bool
+	thumbnailProxyWidths     []int
+	thumbnailProxyMaxAge     time.Duration
+	thumbnailCacheDir        string
+	thumbnailCacheMaxBytes   int64
+	thumbnailStore           thumbnailStore
+
+	uniqueVideoTitles bool
+
+	replicaBucket          string
+	replicaClient          *s3.Client
+	replicationMaxAttempts int
+
+	cloudFrontClient         *cloudfront.Client
+	cloudFrontDistributionID string
+
+	analyzeKeyframes bool
+
+	maxVideoTTL time.Duration
+
+	checkUploadSize      bool
+	maxDecompressedBytes int64
+
+	maxPixelRate    float64
+	pixelRateAction string
+
+	webhooks *webhookDispatcher
+
+	directUploadMaxBytes int64
+
+	extractSubtitles bool
+
+	unknownAspectAction string
+
+	bulkDeleteMaxIDs int
+
+	jobs *jobQueue
+
+	lqipEnabled  bool
+	lqipMaxBytes int
+
+	tenantBuckets *tenantBuckets
+
+	trimAccurate bool
+
+	processingProfiles map[string]processingProfile
+
+	xmlResponses bool
+
+	filenamePolicy filenamePolicy
+
+	deprecatedCodecs       []string
+	codecMigrationTarget   string
+	codecMigrationInterval time.Duration
+	codecMigrationBatch    int
+
+	contentAddressedKeys bool
+	assetLocks           *assetLocker
+
+	directThumbnailMaxBytes int64
+
+	protectProcessedVideos bool
+	processingReports      bool
+
+	faststartReencodeFallback bool
+	processTimeout            time.Duration
+	streamPassthrough         bool
+	asyncProcessing           bool
+	verifyOutputContainer     bool
+
+	contactSheets         bool
+	contactSheetGrid      contactSheetGrid
+	contactSheetInterval  time.Duration
+	contactSheetTileWidth int
+	storyboards           bool
+	applyRotation         bool
+	storyboardInterval    time.Duration
+	storyboardTileWidth   int
+	storyboardColumns     int
+
+	resolutionRenditions bool
+	renditionSlots       chan struct{}
+
+	eventURLMode string
+	eventURLTTL  time.Duration
+
+	minVideoDuration      time.Duration
+	maxVideoDuration      time.Duration
+	missingDurationAction string
+
+	autoPoster        bool
+	faceDetector      faceDetector
+	faceMinConfidence float64
 }
 
 type thumbnail struct {
@@ -38,6 +204,15 @@ var videoThumbnails = map[uuid.UUID]thumbnail{}
 func main() {
 	godotenv.Load(".env")
 
+	logLevel, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupLogging(os.Getenv("LOG_FORMAT"), logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
@@ -78,22 +253,97 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
+	}
+
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = storageBackendS3
+	}
+	storageEndpoint, err := storageEndpointFor(storageBackend, storageEndpoint{
+		URL:       os.Getenv("S3_ENDPOINT"),
+		PathStyle: envBool("S3_USE_PATH_STYLE", false),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// With a custom endpoint, leaving S3_CF_DISTRO unset links straight to
+	// it; local objects are served from /assets
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
+	if s3CfDistribution == "" {
+		s3CfDistribution = storageEndpoint.assetBaseURL(s3Bucket)
+	}
+	if s3CfDistribution == "" && storageBackend == storageBackendLocal {
+		s3CfDistribution = fmt.Sprintf("http://localhost:%s/assets", port)
+	}
 	if s3CfDistribution == "" {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	encryption, err := parseServerSideEncryption(os.Getenv("S3_SSE"), os.Getenv("S3_SSE_KMS_KEY_ID"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Videos only; see storageClassFor
+	var storageClass types.StorageClass
+	if value := os.Getenv("S3_STORAGE_CLASS"); value != "" {
+		storageClass, err = parseStorageClass(value)
+		if err != nil {
+			log.Fatalf("Invalid S3_STORAGE_CLASS: %v", err)
+		}
+	}
+
+	// Flushed by serve once the server has drained
+	shutdownTracing, err := setupTracing(context.Background(), os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	if err != nil {
+		log.Fatalf("Couldn't set up tracing: %v", err)
 	}
 
-	cfgAws, err := config.LoadDefaultConfig(context.TODO())
+	// Throttling, 5xx and timeouts are retried with jittered exponential
+	// backoff, rewinding file bodies; other errors such as 403 fail at once
+	awsMaxAttempts := envInt("AWS_MAX_ATTEMPTS", 5)
+	awsMaxBackoff := envDuration("AWS_MAX_BACKOFF", 20*time.Second)
+	cfgAws, err := config.LoadDefaultConfig(context.TODO(), config.WithRetryer(func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = awsMaxAttempts
+			o.MaxBackoff = awsMaxBackoff
+		})
+	}))
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
 
-	clientAws := s3.NewFromConfig(cfgAws)
+	clientAws := s3.NewFromConfig(cfgAws, storageEndpoint.clientOptions)
+
+	var metrics *uploadMetrics
+	if envBool("METRICS", true) {
+		metrics = newUploadMetrics()
+	}
+
+	// On gcs the default bucket is written and signed through the Cloud
+	// Storage client; reads keep using the S3 client against its XML API.
+	// On local it is a directory under ASSETS_ROOT, read and written as files
+	var store objectStore = s3ObjectStore{client: clientAws, bucket: s3Bucket, encryption: encryption, storageClass: storageClass, metrics: metrics}
+	var gcsStore *gcsObjectStore
+	var localStore *localObjectStore
+	switch storageBackend {
+	case storageBackendGCS:
+		gcsStore, err = newGCSObjectStore(context.Background(), s3Bucket, metrics)
+		if err != nil {
+			log.Fatalf("Couldn't create Cloud Storage client: %v", err)
+		}
+		store = gcsStore
+	case storageBackendLocal:
+		if envBool("S3_PRIVATE_BUCKET", false) || envBool("DOWNLOAD_PRESIGNED", false) {
+			log.Fatal("S3_PRIVATE_BUCKET and DOWNLOAD_PRESIGNED need a bucket that can presign, the local storage backend can't")
+		}
+		localStore = &localObjectStore{root: assetsRoot}
+		store = localStore
+	}
 
 	cfg := apiConfig{
 		db:               db,
@@ -104,21 +354,385 @@ func main() {
 		s3Bucket:         s3Bucket,
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
+		s3PrivateBucket:  envBool("S3_PRIVATE_BUCKET", false),
 		port:             port,
 		s3Client:         clientAws,
+		store:            store,
+		gcs:              gcsStore,
+		local:            localStore,
+		encryption:       encryption,
+		storageClass:     storageClass,
+		toolLookup:       newToolLookup(),
+		metrics:          metrics,
+		healthTimeout:    envDuration("HEALTH_S3_TIMEOUT", 2*time.Second),
+		logLevel:         logLevel,
+
+		cleanupOldThumbnails: envBool("THUMBNAIL_CLEANUP", true),
+		detectSilentAudio:    envBool("DETECT_SILENT_AUDIO", false),
+		reencodeLocks:        newVideoLocker(),
+		uploadLocks:          newVideoLocker(),
+		assetLocks:           newAssetLocker(),
+		scheduler: newProcessingScheduler(
+			envInt("PROCESSING_CONCURRENCY", runtime.NumCPU()),
+			envInt("PROCESSING_PER_USER", 2),
+			envInt("PROCESSING_MAX_WAITING", 0),
+		),
+		processingRetryAfter: envDuration("PROCESSING_RETRY_AFTER", 30*time.Second),
+
+		autoThumbnailCandidates: envBool("AUTO_THUMBNAIL_CANDIDATES", false),
+		thumbnailCandidateCount: envInt("THUMBNAIL_CANDIDATE_COUNT", 5),
+		thumbnailStreamIndex:    envInt("THUMBNAIL_STREAM_INDEX", -1),
+		autoThumbnailAt:         envDuration("AUTO_THUMBNAIL_AT", time.Second),
+
+		minVideoBytes:     int64(envInt("MIN_VIDEO_UPLOAD_BYTES", 1)),
+		minThumbnailBytes: int64(envInt("MIN_THUMBNAIL_UPLOAD_BYTES", 1)),
+		userQuotaBytes:    int64(envInt("USER_QUOTA_BYTES", 5<<30)),
+
+		downloadRateLimit: int64(envInt("DOWNLOAD_RATE_LIMIT", 0)),
+		downloadPresigned: envBool("DOWNLOAD_PRESIGNED", false),
+
+		thumbnailAspectCheck:     os.Getenv("THUMBNAIL_ASPECT_CHECK"),
+		thumbnailAspectTolerance: envFloat("THUMBNAIL_ASPECT_TOLERANCE", 0.1),
+		thumbnailDualFormat:      envBool("THUMBNAIL_DUAL_FORMAT", false),
+		stripThumbnailMetadata:   envBool("STRIP_THUMBNAIL_METADATA", true),
+		thumbnailJPEGQuality:     envInt("THUMBNAIL_JPEG_QUALITY", 85),
+		thumbnailMaxBytes:        int64(envInt("THUMBNAIL_MAX_BYTES", 10<<20)),
+		thumbnailMaxDimension:    envInt("THUMBNAIL_MAX_DIMENSION", 8192),
+		thumbnailVariantsAsync:   envBool("THUMBNAIL_VARIANTS_ASYNC", false),
+
+		uniqueVideoTitles: envBool("UNIQUE_VIDEO_TITLES", false),
+
+		analyzeKeyframes: envBool("ANALYZE_KEYFRAMES", false),
+
+		maxVideoTTL: envDuration("MAX_VIDEO_TTL", 7*24*time.Hour),
+
+		checkUploadSize:      envBool("UPLOAD_SIZE_CHECK", true),
+		maxDecompressedBytes: int64(envInt("MAX_DECOMPRESSED_UPLOAD_BYTES", 1<<30)),
+
+		maxPixelRate:    envFloat("MAX_PIXEL_RATE", 0),
+		pixelRateAction: os.Getenv("PIXEL_RATE_ACTION"),
+
+		directUploadMaxBytes: int64(envInt("DIRECT_UPLOAD_MAX_BYTES", 1<<30)),
+
+		extractSubtitles: envBool("EXTRACT_SUBTITLES", false),
+
+		unknownAspectAction: os.Getenv("UNKNOWN_ASPECT_ACTION"),
+
+		bulkDeleteMaxIDs: envInt("BULK_DELETE_MAX_IDS", 100),
+
+		lqipEnabled:  envBool("LQIP_ENABLED", false),
+		lqipMaxBytes: envInt("LQIP_MAX_BYTES", 1024),
+
+		trimAccurate: envBool("TRIM_ACCURATE", false),
+	}
+
+	cfg.replicaBucket = os.Getenv("REPLICA_BUCKET")
+	if cfg.replicaBucket != "" {
+		replicaRegion := os.Getenv("REPLICA_REGION")
+		if replicaRegion == "" {
+			log.Fatal("REPLICA_REGION must be set when REPLICA_BUCKET is set")
+		}
+		cfg.replicaClient = s3.NewFromConfig(cfgAws, func(o *s3.Options) {
+			o.Region = replicaRegion
+		})
+		cfg.replicationMaxAttempts = envInt("REPLICATION_MAX_ATTEMPTS", 5)
+	}
+
+	cfg.cloudFrontDistributionID = os.Getenv("CLOUDFRONT_DISTRIBUTION_ID")
+	if cfg.cloudFrontDistributionID != "" {
+		cfg.cloudFrontClient = cloudfront.NewFromConfig(cfgAws)
+	}
+
+	cfg.adminUserIDs, err = parseAdminUserIDs(os.Getenv("ADMIN_USER_IDS"))
+	if err != nil {
+		log.Fatalf("Couldn't parse ADMIN_USER_IDS: %v", err)
+	}
+
+	reencodeCodecList := os.Getenv("REENCODE_CODECS")
+	if reencodeCodecList == "" {
+		reencodeCodecList = "av1,vp9,hevc"
+	}
+	cfg.reencodeCodecs, err = parseReencodeCodecs(reencodeCodecList)
+	if err != nil {
+		log.Fatalf("Couldn't parse REENCODE_CODECS: %v", err)
+	}
+
+	cfg.presignExpiry = envDuration("PRESIGN_EXPIRY", 15*time.Minute)
+	cfg.presignMaxExpiry = envDuration("PRESIGN_MAX_EXPIRY", 12*time.Hour)
+	if cfg.presignExpiry <= 0 || cfg.presignExpiry > cfg.presignMaxExpiry {
+		log.Fatal("PRESIGN_EXPIRY must be positive and no longer than PRESIGN_MAX_EXPIRY")
+	}
+	if size := envInt("PRESIGN_CACHE_SIZE", 1000); size > 0 {
+		cfg.presignCache = newPresignCache(size, envDuration("PRESIGN_CACHE_TTL", 10*time.Minute))
+	}
+
+	if cfg.thumbnailAspectCheck == "" {
+		cfg.thumbnailAspectCheck = thumbnailAspectCheckOff
+	}
+	err = validateThumbnailAspectCheck(cfg.thumbnailAspectCheck)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg.tenantBuckets, err = parseTenantBuckets(os.Getenv("TENANT_BUCKETS"), os.Getenv("TENANT_BUCKET_PATTERN"))
+	if err != nil {
+		log.Fatalf("Couldn't parse tenant buckets: %v", err)
+	}
+
+	thumbnailWidthList := os.Getenv("THUMBNAIL_PROXY_WIDTHS")
+	if thumbnailWidthList == "" {
+		thumbnailWidthList = "160,320,640,1280"
+	}
+	cfg.thumbnailProxyWidths, err = parseThumbnailWidths(thumbnailWidthList)
+	if err != nil {
+		log.Fatalf("Couldn't parse THUMBNAIL_PROXY_WIDTHS: %v", err)
+	}
+	cfg.thumbnailProxyMaxAge = envDuration("THUMBNAIL_PROXY_MAX_AGE", 7*24*time.Hour)
+	cfg.thumbnailCacheDir = os.Getenv("THUMBNAIL_CACHE_DIR")
+	if cfg.thumbnailCacheDir == "" {
+		cfg.thumbnailCacheDir = filepath.Join(os.TempDir(), "thumbnail-cache")
+	}
+	cfg.thumbnailCacheMaxBytes = int64(envInt("THUMBNAIL_CACHE_MAX_BYTES", 256<<20))
+	cfg.processor = ffmpegProcessor{cfg: &cfg}
+	// Fail the deploy rather than the first upload
+	if envBool("CHECK_PROCESSING_TOOLS", true) {
+		err = cfg.checkProcessingTools(context.Background(), os.Getenv("FFMPEG_MIN_VERSION"))
+		if err != nil {
+			log.Fatalf("Processing tools aren't usable: %v", err)
+		}
+	}
+
+	// Local thumbnails only work for a single instance, S3 ones are shared
+	cfg.thumbnailStore = localThumbnailStore{cfg: &cfg}
+	if envBool("USE_S3_THUMBNAILS", false) {
+		cfg.thumbnailStore = s3ThumbnailStore{cfg: &cfg}
+	}
+
+	cfg.xmlResponses = envBool("XML_RESPONSES", false)
+
+	cfg.protectProcessedVideos = envBool("PROTECT_PROCESSED_VIDEOS", false)
+	cfg.processingReports = envBool("PROCESSING_REPORTS", false)
+	cfg.faststartReencodeFallback = envBool("FASTSTART_REENCODE_FALLBACK", false)
+	cfg.processTimeout = envDuration("PROCESS_TIMEOUT", time.Minute)
+	cfg.streamPassthrough = envBool("STREAM_PASSTHROUGH", false)
+	cfg.asyncProcessing = envBool("ASYNC_PROCESSING", false)
+	cfg.verifyOutputContainer = envBool("VERIFY_OUTPUT_CONTAINER", false)
+
+	cfg.contactSheets = envBool("CONTACT_SHEETS", false)
+	contactSheetGridValue := os.Getenv("CONTACT_SHEET_GRID")
+	if contactSheetGridValue == "" {
+		contactSheetGridValue = "4x4"
+	}
+	cfg.contactSheetGrid, err = parseContactSheetGrid(contactSheetGridValue)
+	if err != nil {
+		log.Fatalf("Couldn't parse CONTACT_SHEET_GRID: %v", err)
+	}
+	cfg.contactSheetInterval = envDuration("CONTACT_SHEET_INTERVAL", 0)
+	cfg.contactSheetTileWidth = envInt("CONTACT_SHEET_TILE_WIDTH", 320)
+	cfg.storyboards = envBool("STORYBOARDS", false)
+	cfg.applyRotation = envBool("APPLY_ROTATION", true)
+	cfg.storyboardInterval = envDuration("STORYBOARD_INTERVAL", 5*time.Second)
+	cfg.storyboardTileWidth = envInt("STORYBOARD_TILE_WIDTH", 160)
+	cfg.storyboardColumns = envInt("STORYBOARD_COLUMNS", 10)
+	if cfg.storyboardInterval <= 0 || cfg.storyboardTileWidth < 2 || cfg.storyboardColumns < 1 {
+		log.Fatal("STORYBOARD_INTERVAL, STORYBOARD_TILE_WIDTH and STORYBOARD_COLUMNS must be positive")
+	}
+
+	cfg.resolutionRenditions = envBool("RESOLUTION_RENDITIONS", false)
+	renditionConcurrency := envInt("RENDITION_CONCURRENCY", 2)
+	if renditionConcurrency < 1 {
+		log.Fatal("RENDITION_CONCURRENCY must be at least 1")
+	}
+	cfg.renditionSlots = make(chan struct{}, renditionConcurrency)
+
+	cfg.eventURLMode = os.Getenv("EVENT_URL_MODE")
+	if cfg.eventURLMode == "" {
+		cfg.eventURLMode = eventURLStored
+	}
+	if cfg.eventURLMode != eventURLStored && cfg.eventURLMode != eventURLSigned && cfg.eventURLMode != eventURLKey {
+		log.Fatalf("Unsupported EVENT_URL_MODE: %s", cfg.eventURLMode)
+	}
+	cfg.eventURLTTL = envDuration("EVENT_URL_TTL", 15*time.Minute)
+
+	cfg.minVideoDuration = envDuration("MIN_VIDEO_DURATION", 0)
+	cfg.maxVideoDuration = envDuration("MAX_VIDEO_DURATION", 0)
+	if cfg.minVideoDuration > 0 && cfg.maxVideoDuration > 0 && cfg.minVideoDuration > cfg.maxVideoDuration {
+		log.Fatal("MIN_VIDEO_DURATION must not be longer than MAX_VIDEO_DURATION")
+	}
+	cfg.missingDurationAction = os.Getenv("MISSING_DURATION_ACTION")
+	if cfg.missingDurationAction == "" {
+		cfg.missingDurationAction = missingDurationAllow
+	}
+	if cfg.missingDurationAction != missingDurationAllow && cfg.missingDurationAction != missingDurationReject {
+		log.Fatalf("Unsupported MISSING_DURATION_ACTION: %s", cfg.missingDurationAction)
+	}
+
+	cfg.autoPoster = envBool("AUTO_POSTER", false)
+	cfg.faceMinConfidence = envFloat("FACE_MIN_CONFIDENCE", 0.6)
+	if envBool("POSTER_FACE_DETECTION", false) {
+		detector, err := newCommandFaceDetector(os.Getenv("FACE_DETECTOR_COMMAND"))
+		if err != nil {
+			log.Fatalf("Couldn't set up face detection: %v", err)
+		}
+		cfg.faceDetector = detector
+	}
+
+	cfg.directThumbnailMaxBytes = int64(envInt("DIRECT_THUMBNAIL_MAX_BYTES", 10<<20))
+	cfg.contentAddressedKeys = envBool("CONTENT_ADDRESSED_KEYS", false)
+
+	cfg.deprecatedCodecs = parseDeprecatedCodecs(os.Getenv("DEPRECATED_CODECS"))
+	cfg.codecMigrationTarget = os.Getenv("CODEC_MIGRATION_TARGET")
+	if cfg.codecMigrationTarget == "" {
+		cfg.codecMigrationTarget = "h264"
+	}
+	if _, ok := reencodeCodecs[cfg.codecMigrationTarget]; !ok {
+		log.Fatalf("Unsupported CODEC_MIGRATION_TARGET: %s", cfg.codecMigrationTarget)
+	}
+	if cfg.isDeprecatedCodec(cfg.codecMigrationTarget) {
+		log.Fatal("CODEC_MIGRATION_TARGET can't be a deprecated codec")
+	}
+	cfg.codecMigrationInterval = envDuration("CODEC_MIGRATION_INTERVAL", time.Minute)
+	cfg.codecMigrationBatch = envInt("CODEC_MIGRATION_BATCH", 500)
+	cfg.filenamePolicy = filenamePolicy{
+		Enabled:              envBool("FILENAME_POLICY_ENABLED", true),
+		MaxLength:            envInt("FILENAME_MAX_LENGTH", 255),
+		AllowDoubleExtension: envBool("FILENAME_ALLOW_DOUBLE_EXTENSION", false),
+	}
+
+	processingFormat := os.Getenv("PROCESSING_FORMAT")
+	if processingFormat == "" {
+		processingFormat = defaultOutputFormat
+	}
+	cfg.processingProfiles, err = parseProcessingProfiles(os.Getenv("PROCESSING_PROFILES"), envDuration("PROCESSING_DEADLINE", 15*time.Minute), processingFormat)
+	if err != nil {
+		log.Fatalf("Couldn't parse processing profiles: %v", err)
+	}
+
+	cfg.duplicateUploadAction = os.Getenv("DUPLICATE_UPLOAD_ACTION")
+	switch cfg.duplicateUploadAction {
+	case "":
+		cfg.duplicateUploadAction = duplicateUploadReject
+	case duplicateUploadReject, duplicateUploadQueue:
+	default:
+		log.Fatalf("unknown duplicate upload action: %s", cfg.duplicateUploadAction)
+	}
+
+	if cfg.unknownAspectAction == "" {
+		cfg.unknownAspectAction = unknownAspectOther
+	}
+	if cfg.thumbnailJPEGQuality < 1 || cfg.thumbnailJPEGQuality > 100 {
+		log.Fatal("THUMBNAIL_JPEG_QUALITY must be between 1 and 100")
+	}
+	thumbnailSizesValue, ok := os.LookupEnv("THUMBNAIL_SIZES")
+	if !ok {
+		thumbnailSizesValue = "320,640,1280"
+	}
+	cfg.thumbnailSizes, err = parseThumbnailSizes(thumbnailSizesValue, cfg.thumbnailJPEGQuality)
+	if err != nil {
+		log.Fatalf("Couldn't parse THUMBNAIL_SIZES: %v", err)
+	}
+	err = validateUnknownAspectAction(cfg.unknownAspectAction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if path := os.Getenv("WEBHOOKS_FILE"); path != "" {
+		cfg.webhooks, err = loadWebhookDispatcher(
+			path,
+			os.Getenv("WEBHOOK_SECRET"),
+			envInt("WEBHOOK_ATTEMPTS", 3),
+			envDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+		)
+		if err != nil {
+			log.Fatalf("Couldn't load webhooks: %v", err)
+		}
+	}
+	if arn := os.Getenv("EVENTS_TARGET_ARN"); arn != "" {
+		publisher, err := newEventPublisher(cfgAws, arn)
+		if err != nil {
+			log.Fatalf("Couldn't set up event publishing: %v", err)
+		}
+		cfg.webhooks = cfg.webhooks.addPublisher(publisher, envInt("EVENTS_PUBLISH_ATTEMPTS", 5))
+	}
+
+	if cfg.pixelRateAction == "" {
+		cfg.pixelRateAction = pixelRateActionReject
+	}
+	err = validatePixelRateAction(cfg.pixelRateAction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg.downloadTierRates, err = parseTierRates(os.Getenv("DOWNLOAD_TIER_RATES"))
+	if err != nil {
+		log.Fatalf("Couldn't parse DOWNLOAD_TIER_RATES: %v", err)
+	}
+
+	cfg.verifyPresignedObjects = envBool("PRESIGN_VERIFY_EXISTS", false)
+	if ttl := envDuration("PRESIGN_EXISTS_CACHE_TTL", 30*time.Second); cfg.verifyPresignedObjects && ttl > 0 {
+		if size := envInt("PRESIGN_EXISTS_CACHE_SIZE", 10000); size > 0 {
+			cfg.existsCache = newExistsCache(ttl, size)
+		}
+	}
+
+	cfg.bannedHashes, err = newBannedHashStore(os.Getenv("BANNED_HASHES_SOURCE"), os.Getenv("BANNED_HASHES_FILE"), db)
+	if err != nil {
+		log.Fatalf("Couldn't load banned hashes: %v", err)
+	}
+	if cfg.bannedHashes != nil {
+		// Reload the banned hash list on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reloadBannedHashesOn(cfg.bannedHashes, hup)
+	}
+
+	// Clean up multipart uploads orphaned by a crash
+	if envBool("MULTIPART_CLEANUP", false) {
+		prefixList := os.Getenv("MULTIPART_CLEANUP_PREFIXES")
+		if prefixList == "" {
+			prefixList = "landscape/,portrait/,other/," + contentKeyPrefix
+		}
+		prefixes := parsePrefixList(prefixList)
+		maxAge := envDuration("MULTIPART_CLEANUP_MAX_AGE", 24*time.Hour)
+		go func() {
+			aborted, err := abortStaleMultipartUploads(context.Background(), cfg.s3Client, cfg.s3Bucket, prefixes, maxAge)
+			if err != nil {
+				log.Printf("Multipart upload cleanup failed: %v", err)
+			}
+			log.Printf("Multipart upload cleanup aborted %d upload(s)", aborted)
+		}()
 	}
 
 	err = cfg.ensureAssetsDir()
 	if err != nil {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
+	err = os.MkdirAll(cfg.thumbnailCacheDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create thumbnail cache directory: %v", err)
+	}
+
+	cfg.jobs = newJobQueue(db, envDuration("JOB_LEASE", 30*time.Minute), envDuration("JOB_POLL_INTERVAL", 2*time.Second))
+	cfg.jobs.register(jobTypeReencode, jobType{run: cfg.runReencodeJob, maxAttempts: 3, failed: cfg.reencodeJobFailed})
+	cfg.jobs.register(jobTypeReplicate, jobType{run: cfg.runReplicateJob, maxAttempts: cfg.replicationMaxAttempts, failed: cfg.replicateJobFailed})
+	cfg.jobs.register(jobTypeThumbnailVariants, jobType{run: cfg.runThumbnailVariantsJob, maxAttempts: 3, failed: cfg.thumbnailVariantsJobFailed})
+	cfg.jobs.register(jobTypeProcessUpload, jobType{run: cfg.runProcessUploadJob, maxAttempts: 3, failed: cfg.processUploadJobFailed})
+	cfg.jobs.register(jobTypeCodecMigrate, jobType{run: cfg.runCodecMigrateJob, maxAttempts: 3, failed: cfg.codecMigrateJobFailed})
+	cfg.jobs.start(envInt("JOB_WORKERS", 2))
+
+	cfg.startReaper(envDuration("REAPER_INTERVAL", time.Minute))
 
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.Handle("/assets/", noCacheMiddleware(http.HandlerFunc(cfg.handlerLocalAsset)))
+	mux.HandleFunc("GET /assets/thumb/{videoID}", cfg.handlerThumbnailProxy)
+
+	mux.Handle("GET /healthz", noCacheMiddleware(http.HandlerFunc(cfg.handlerHealth)))
+	if cfg.metrics != nil {
+		mux.Handle("GET /metrics", cfg.metrics.handler())
+	}
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
@@ -127,20 +741,89 @@ func main() {
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.metrics.instrumentUpload("thumbnail", cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.metrics.instrumentUpload("video", cfg.handlerUploadVideo))
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
 	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/videos/bulk-delete", cfg.handlerVideosBulkDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/reencode", cfg.handlerVideoReencode)
+	mux.HandleFunc("POST /api/videos/{videoID}/trim", cfg.handlerTrimVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/select", cfg.handlerThumbnailSelect)
+	mux.HandleFunc("GET /api/videos/{videoID}/download", cfg.handlerVideoDownload)
+	mux.HandleFunc("POST /api/videos/{videoID}/audio-track", cfg.handlerUploadAudioTrack)
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerUploadCaption)
+	mux.HandleFunc("GET /api/videos/{videoID}/manifest", cfg.handlerVideoManifest)
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnail", cfg.handlerThumbnailNegotiate)
+	mux.HandleFunc("POST /api/videos/{videoID}/direct-upload", cfg.handlerDirectUploadCreate)
+	mux.HandleFunc("POST /api/videos/{videoID}/direct-upload/complete", cfg.handlerDirectUploadComplete)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-url", cfg.handlerCreateUploadURL)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-url/complete", cfg.handlerDirectUploadComplete)
+	mux.HandleFunc("POST /api/videos/{videoID}/refresh-url", cfg.handlerVideoRefreshURL)
+	mux.HandleFunc("GET /api/videos/{videoID}/report", cfg.handlerVideoReport)
+	mux.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerVideoStatus)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail-url", cfg.handlerThumbnailUploadURL)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail-url/complete", cfg.handlerThumbnailUploadComplete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/codec-migration", cfg.handlerAdminCodecMigration)
+	mux.HandleFunc("POST /admin/banned-hashes", cfg.handlerBanHash)
+
+	problemTypeBase := os.Getenv("PROBLEM_TYPE_BASE_URI")
+	if problemTypeBase == "" {
+		problemTypeBase = "/problems/"
+	}
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: tracingMiddleware(requestLogMiddleware(problemDetailsMiddleware(problemTypeBase, mux))),
 	}
 
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Couldn't listen on port %s: %v", port, err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	err = serve(ctx, srv, listener, envDuration("SHUTDOWN_TIMEOUT", 30*time.Second), shutdownTracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/**
+ * Serve on listener until ctx is done, then shut down gracefully
+ * In-flight requests get shutdownTimeout to finish, then the spans still
+ * buffered are flushed with shutdownTracing
+ */
+func serve(ctx context.Context, srv *http.Server, listener net.Listener, shutdownTimeout time.Duration, shutdownTracing func(context.Context) error) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %s for requests in flight", shutdownTimeout)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err == nil {
+		err = srv.Shutdown(shutdownCtx)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("server stopped: %w", err)
+	}
+	tracingErr := shutdownTracing(shutdownCtx)
+	if tracingErr != nil {
+		tracingErr = fmt.Errorf("couldn't flush traces: %w", tracingErr)
+	}
+	return errors.Join(err, tracingErr)
 }
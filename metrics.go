@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// uploadMetrics are the Prometheus metrics served on /metrics. A nil
+// *uploadMetrics records nothing.
+type uploadMetrics struct {
+	registry          *prometheus.Registry
+	uploads           *prometheus.CounterVec
+	uploadsInFlight   *prometheus.GaugeVec
+	transcodeDuration *prometheus.HistogramVec
+	s3PutBytes        prometheus.Counter
+}
+
+func newUploadMetrics() *uploadMetrics {
+	m := &uploadMetrics{
+		registry: prometheus.NewRegistry(),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "uploads_total",
+			Help: "Finished upload requests by upload type and response status.",
+		}, []string{"type", "status"}),
+		uploadsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "uploads_in_flight",
+			Help: "Upload requests being handled right now.",
+		}, []string{"type"}),
+		transcodeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "transcode_duration_seconds",
+			Help: "Time spent converting uploads to their output format.",
+			// Remuxes take well under a second, transcodes of long videos minutes
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+		}, []string{"format"}),
+		s3PutBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3_put_bytes_total",
+			Help: "Bytes written to the object store.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.uploads,
+		m.uploadsInFlight,
+		m.transcodeDuration,
+		m.s3PutBytes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *uploadMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+/**
+ * Count an upload handler's requests and track how many are running
+ * status is the response code, read from the request's logging writer
+ */
+func (m *uploadMetrics) instrumentUpload(uploadType string, next http.HandlerFunc) http.HandlerFunc {
+	if m == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight := m.uploadsInFlight.WithLabelValues(uploadType)
+		inFlight.Inc()
+		defer inFlight.Dec()
+		next(w, r)
+
+		status := "unknown"
+		if lw := loggingWriterOf(w); lw != nil {
+			code := lw.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			status = strconv.Itoa(code)
+		}
+		m.uploads.WithLabelValues(uploadType, status).Inc()
+	}
+}
+
+func (m *uploadMetrics) observeTranscode(format string, seconds float64) {
+	if m != nil {
+		m.transcodeDuration.WithLabelValues(format).Observe(seconds)
+	}
+}
+
+func (m *uploadMetrics) addPutBytes(n int64) {
+	if m != nil {
+		m.s3PutBytes.Add(float64(n))
+	}
+}
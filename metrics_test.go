@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUploadMetrics(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.metrics = newUploadMetrics()
+	// Through the real S3 store, which counts the bytes it puts
+	cfg.store = s3ObjectStore{client: cfg.s3Client, bucket: cfg.s3Bucket, metrics: cfg.metrics}
+	uploadVideo := requestLogMiddleware(cfg.metrics.instrumentUpload("video", cfg.handlerUploadVideo))
+	uploadThumbnail := requestLogMiddleware(cfg.metrics.instrumentUpload("thumbnail", cfg.handlerUploadThumbnail))
+
+	w := httptest.NewRecorder()
+	uploadVideo.ServeHTTP(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("video upload status = %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	uploadThumbnail.ServeHTTP(w, newThumbnailUploadRequest(t, video, "not a token"))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("thumbnail upload status = %d, want 401: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.metrics.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d", w.Code)
+	}
+	scraped, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := 0
+	for _, data := range store.objects {
+		stored += len(data)
+	}
+	if stored == 0 {
+		t.Fatal("upload stored nothing")
+	}
+	for _, want := range []string{
+		`uploads_total{status="200",type="video"} 1`,
+		`uploads_total{status="401",type="thumbnail"} 1`,
+		`uploads_in_flight{type="video"} 0`,
+		`uploads_in_flight{type="thumbnail"} 0`,
+		`transcode_duration_seconds_count{format="mp4"} 1`,
+		`s3_put_bytes_total ` + strconv.Itoa(stored),
+	} {
+		if !strings.Contains(string(scraped), want+"\n") {
+			t.Errorf("/metrics doesn't have %s", want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// multipartClient is the part of the S3 API the cleanup needs.
+type multipartClient interface {
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+/**
+ * Abort multipart uploads under prefixes that were started before maxAge ago
+ * These are left behind when the server dies mid-upload and are billed until
+ * aborted. Returns the number of uploads aborted.
+ */
+func abortStaleMultipartUploads(ctx context.Context, client multipartClient, bucket string, prefixes []string, maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	aborted := 0
+
+	for _, prefix := range prefixes {
+		input := &s3.ListMultipartUploadsInput{
+			Bucket: &bucket,
+			Prefix: &prefix,
+		}
+		for {
+			output, err := client.ListMultipartUploads(ctx, input)
+			if err != nil {
+				return aborted, err
+			}
+
+			for _, upload := range output.Uploads {
+				if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+					continue
+				}
+				_, err := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+					Bucket:   &bucket,
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				})
+				if err != nil {
+					log.Printf("Couldn't abort multipart upload %s of %s: %v", *upload.UploadId, *upload.Key, err)
+					continue
+				}
+				log.Printf("Aborted stale multipart upload %s of %s started %s", *upload.UploadId, *upload.Key, upload.Initiated.Format(time.RFC3339))
+				aborted++
+			}
+
+			if output.IsTruncated == nil || !*output.IsTruncated {
+				break
+			}
+			input.KeyMarker = output.NextKeyMarker
+			input.UploadIdMarker = output.NextUploadIdMarker
+		}
+	}
+	return aborted, nil
+}
+
+func parsePrefixList(value string) []string {
+	prefixes := []string{}
+	for _, prefix := range strings.Split(value, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeMultipartClient lists its uploads one page at a time and records
+// which ones are aborted.
+type fakeMultipartClient struct {
+	uploads   []types.MultipartUpload
+	pageSize  int
+	failAbort string
+	aborted   []string
+}
+
+func (c *fakeMultipartClient) ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	matching := []types.MultipartUpload{}
+	for _, upload := range c.uploads {
+		if strings.HasPrefix(*upload.Key, aws.ToString(params.Prefix)) {
+			matching = append(matching, upload)
+		}
+	}
+	start := 0
+	if params.UploadIdMarker != nil {
+		start = slices.IndexFunc(matching, func(u types.MultipartUpload) bool { return *u.UploadId == *params.UploadIdMarker }) + 1
+	}
+	end := min(start+c.pageSize, len(matching))
+	output := &s3.ListMultipartUploadsOutput{Uploads: matching[start:end]}
+	if end < len(matching) {
+		output.IsTruncated = aws.Bool(true)
+		output.NextKeyMarker = matching[end-1].Key
+		output.NextUploadIdMarker = matching[end-1].UploadId
+	}
+	return output, nil
+}
+
+func (c *fakeMultipartClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if *params.UploadId == c.failAbort {
+		return nil, errors.New("access denied")
+	}
+	c.aborted = append(c.aborted, *params.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestAbortStaleMultipartUploads(t *testing.T) {
+	now := time.Now()
+	upload := func(id, key string, age time.Duration) types.MultipartUpload {
+		return types.MultipartUpload{UploadId: aws.String(id), Key: aws.String(key), Initiated: aws.Time(now.Add(-age))}
+	}
+	client := &fakeMultipartClient{
+		uploads: []types.MultipartUpload{
+			upload("stale-1", "landscape/a.mp4", 48*time.Hour),
+			upload("fresh", "landscape/b.mp4", time.Hour),
+			upload("stale-2", "portrait/c.mp4", 25*time.Hour),
+			upload("stale-3", "landscape/d.mp4", 72*time.Hour),
+			upload("denied", "landscape/e.mp4", 72*time.Hour),
+			// Not under a prefix this app writes to
+			upload("foreign", "backups/f.tar", 72*time.Hour),
+		},
+		pageSize:  2,
+		failAbort: "denied",
+	}
+
+	aborted, err := abortStaleMultipartUploads(context.Background(), client, "tubely-test", []string{"landscape/", "portrait/"}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"stale-1", "stale-3", "stale-2"}
+	if aborted != len(want) || !slices.Equal(client.aborted, want) {
+		t.Errorf("aborted %d: %v, want %v", aborted, client.aborted, want)
+	}
+}
+
+func TestParsePrefixList(t *testing.T) {
+	got := parsePrefixList(" landscape/, ,portrait/,")
+	if want := []string{"landscape/", "portrait/"}; !slices.Equal(got, want) {
+		t.Errorf("parsePrefixList = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectStore is where uploaded files are written. Keys are relative to the
+// store, e.g. "landscape/<name>.mp4".
+type objectStore interface {
+	put(ctx context.Context, key string, body io.Reader, contentType string) error
+	delete(ctx context.Context, key string) error
+}
+
+// s3ObjectStore keeps objects in one bucket.
+type s3ObjectStore struct {
+	client       *s3.Client
+	bucket       string
+	encryption   serverSideEncryption
+	storageClass types.StorageClass
+	metrics      *uploadMetrics
+}
+
+/**
+ * Write body to key
+ * A seekable body is handed to the SDK as is: it needs to seek to sign the
+ * payload, send a Content-Length and rewind on retries. Its size is taken
+ * from the seeks. Other readers are counted as they are read and go through
+ * the multipart uploader, which buffers one part at a time
+ */
+func (s s3ObjectStore) put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	var size func() int64
+	seekable := false
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		remaining, err := remainingBytes(seeker)
+		if err != nil {
+			return err
+		}
+		size = func() int64 { return remaining }
+		seekable = true
+	} else {
+		counted := &countingReader{r: body}
+		body = counted
+		size = func() int64 { return counted.n }
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        body,
+		ContentType: &contentType,
+	}
+	if strings.HasPrefix(key, contentKeyPrefix) {
+		cacheControl := immutableCacheControl
+		input.CacheControl = &cacheControl
+	}
+	s.encryption.applyPut(input)
+	input.StorageClass = storageClassFor(ctx, key, contentType, s.storageClass)
+	var err error
+	if seekable {
+		_, err = s.client.PutObject(ctx, input)
+	} else {
+		_, err = manager.NewUploader(s.client).Upload(ctx, input)
+	}
+	if err == nil {
+		s.metrics.addPutBytes(size())
+	}
+	return err
+}
+
+// remainingBytes is how much of r is left to read, found without reading it.
+func remainingBytes(r io.Seeker) (int64, error) {
+	current, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = r.Seek(current, io.SeekStart)
+	return end - current, err
+}
+
+func (s s3ObjectStore) delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	return err
+}
+
+// localObjectStore keeps objects as files under root.
+type localObjectStore struct {
+	root string
+}
+
+// path maps key into root, refusing keys that would escape it.
+func (s localObjectStore) path(key string) (string, error) {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(s.root)+string(filepath.Separator)) {
+		return "", errors.New("object key escapes the store")
+	}
+	return path, nil
+}
+
+func (s localObjectStore) put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// open opens the file behind key for reading.
+func (s localObjectStore) open(key string) (*os.File, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s localObjectStore) exists(key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// list returns the keys of the files under prefix.
+func (s localObjectStore) list(prefix string) ([]string, error) {
+	dir, err := s.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+func (s localObjectStore) delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// objectStoreFor is the store writing to bucket: cfg.store for the default
+// bucket, S3 for tenant buckets.
+func (cfg *apiConfig) objectStoreFor(bucket string) objectStore {
+	if bucket == cfg.s3Bucket {
+		return cfg.store
+	}
+	return s3ObjectStore{client: cfg.s3Client, bucket: bucket, encryption: cfg.encryption, storageClass: cfg.storageClass, metrics: cfg.metrics}
+}
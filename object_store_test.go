@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// putRecorder is an S3 endpoint that keeps the last PutObject it got. The
+// first failures PUTs are answered with failCode, a 500 when unset, so the
+// client retries.
+type putRecorder struct {
+	mu            sync.Mutex
+	failures      int
+	failCode      int
+	attempts      int
+	body          []byte
+	contentLength int64
+	header        http.Header
+}
+
+func (p *putRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	if p.attempts <= p.failures {
+		w.WriteHeader(cmp.Or(p.failCode, http.StatusInternalServerError))
+		return
+	}
+	p.body = data
+	p.contentLength = r.ContentLength
+	p.header = r.Header.Clone()
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestS3ObjectStorePut(t *testing.T) {
+	content := bytes.Repeat([]byte("video bytes "), 10000)
+	tests := []struct {
+		name     string
+		body     func(t *testing.T) io.Reader
+		failures int
+		want     []byte
+	}{
+		{name: "file", body: func(t *testing.T) io.Reader { return openTempFile(t, content) }, want: content},
+		{name: "bytes", body: func(*testing.T) io.Reader { return bytes.NewReader(content) }, want: content},
+		{
+			name: "file read part way",
+			body: func(t *testing.T) io.Reader {
+				file := openTempFile(t, content)
+				file.Seek(100, io.SeekStart)
+				return file
+			},
+			want: content[100:],
+		},
+		{name: "retried", body: func(t *testing.T) io.Reader { return openTempFile(t, content) }, failures: 1, want: content},
+		{name: "retried twice", body: func(t *testing.T) io.Reader { return openTempFile(t, content) }, failures: 2, want: content},
+		{name: "stream", body: func(*testing.T) io.Reader { return io.MultiReader(bytes.NewReader(content)) }, want: content},
+		{name: "stream, retried", body: func(*testing.T) io.Reader { return io.MultiReader(bytes.NewReader(content)) }, failures: 1, want: content},
+		{
+			name: "streamed thumbnail, retried",
+			body: func(t *testing.T) io.Reader {
+				upload, err := readThumbnailUpload(openTempFile(t, content))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return upload.reader()
+			},
+			failures: 1,
+			want:     content,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &putRecorder{failures: tt.failures}
+			server := httptest.NewServer(recorder)
+			t.Cleanup(server.Close)
+			metrics := newUploadMetrics()
+			store := s3ObjectStore{client: newEndpointS3Client(server.URL), bucket: "tubely-test", metrics: metrics}
+
+			err := store.put(context.Background(), "landscape/video.mp4", tt.body(t), "video/mp4")
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if !bytes.Equal(recorder.body, tt.want) {
+				t.Errorf("stored %d bytes, want %d", len(recorder.body), len(tt.want))
+			}
+			if recorder.contentLength != int64(len(tt.want)) {
+				t.Errorf("Content-Length = %d, want %d", recorder.contentLength, len(tt.want))
+			}
+			if recorder.attempts != tt.failures+1 {
+				t.Errorf("got %d attempts, want %d", recorder.attempts, tt.failures+1)
+			}
+			var putBytes dto.Metric
+			metrics.s3PutBytes.Write(&putBytes)
+			if got := putBytes.GetCounter().GetValue(); got != float64(len(tt.want)) {
+				t.Errorf("s3_put_bytes_total = %v, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestS3ObjectStorePutFailsFast(t *testing.T) {
+	recorder := &putRecorder{failures: 5, failCode: http.StatusForbidden}
+	server := httptest.NewServer(recorder)
+	t.Cleanup(server.Close)
+	store := s3ObjectStore{client: newEndpointS3Client(server.URL), bucket: "tubely-test"}
+
+	err := store.put(context.Background(), "landscape/video.mp4", openTempFile(t, []byte(testMP4)), "video/mp4")
+	if err == nil {
+		t.Fatal("put succeeded, want the 403")
+	}
+	if recorder.attempts != 1 {
+		t.Errorf("got %d attempts, want a 403 not to be retried", recorder.attempts)
+	}
+}
+
+func TestLocalObjectStore(t *testing.T) {
+	root := t.TempDir()
+	store := localObjectStore{root: root}
+	ctx := context.Background()
+
+	err := store.put(ctx, "landscape/abc.mp4", strings.NewReader(testMP4), "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "landscape", "abc.mp4")
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != testMP4 {
+		t.Fatalf("stored %q, %v, want the upload", data, err)
+	}
+	for _, key := range []string{"../escape.mp4", "landscape/../../escape.mp4"} {
+		if err := store.put(ctx, key, strings.NewReader("x"), "video/mp4"); err == nil {
+			t.Errorf("put(%s) succeeded, want keys kept inside the root", key)
+		}
+	}
+
+	if exists, err := store.exists("landscape/abc.mp4"); !exists || err != nil {
+		t.Errorf("exists = %v, %v, want true", exists, err)
+	}
+	keys, err := store.list("landscape/")
+	if err != nil || len(keys) != 1 || keys[0] != "landscape/abc.mp4" {
+		t.Errorf("list = %v, %v, want [landscape/abc.mp4]", keys, err)
+	}
+
+	err = store.delete(ctx, "landscape/abc.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.exists("landscape/abc.mp4"); exists || err != nil {
+		t.Errorf("exists after delete = %v, %v, want false", exists, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("deleted file still there: %v", err)
+	}
+	// Deleting twice is fine
+	err = store.delete(ctx, "landscape/abc.mp4")
+	if err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+}
+
+func TestUploadVideoPutsThroughObjectStore(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if store.puts != 1 || len(store.contentTypes) != 1 {
+		t.Fatalf("%d puts of %v, want one", store.puts, store.contentTypes)
+	}
+	for key, contentType := range store.contentTypes {
+		if !strings.HasPrefix(key, "landscape/") || !strings.HasSuffix(key, ".mp4") || contentType != "video/mp4" {
+			t.Errorf("put %s as %q, want landscape/<name>.mp4 as video/mp4", key, contentType)
+		}
+		if string(store.objects[key]) != testMP4 {
+			t.Errorf("%s holds %q, want the processed upload", key, store.objects[key])
+		}
+	}
+}
+
+func TestUploadVideoLocalBackend(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+	cfg.local = &localObjectStore{root: cfg.assetsRoot}
+	cfg.store = cfg.local
+	cfg.s3CfDistribution = "http://localhost:" + cfg.port + "/assets"
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil || stored.VideoURL == nil {
+		t.Fatalf("video not stored: %v", err)
+	}
+	path, ok := strings.CutPrefix(*stored.VideoURL, "http://localhost:"+cfg.port)
+	if !ok || !strings.HasPrefix(path, "/assets/landscape/") {
+		t.Fatalf("video URL = %s, want it under %s/landscape/", *stored.VideoURL, cfg.s3CfDistribution)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerLocalAsset(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK || w.Body.String() != testMP4 {
+		t.Fatalf("serving %s: status %d, body %q", path, w.Code, w.Body)
+	}
+
+	err = cfg.deleteAssetByURL(context.Background(), *stored.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.assetsRoot, filepath.FromSlash(strings.TrimPrefix(path, "/assets/")))); !os.IsNotExist(err) {
+		t.Errorf("deleted video still on disk: %v", err)
+	}
+}
+
+func TestRemainingBytes(t *testing.T) {
+	r := strings.NewReader("0123456789")
+	r.Seek(4, io.SeekStart)
+	n, err := remainingBytes(r)
+	if err != nil || n != 6 {
+		t.Fatalf("remainingBytes = %d, %v, want 6, nil", n, err)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "456789" {
+		t.Errorf("reader moved to %q, want it left at the sixth byte", rest)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// outputFormat is the container a processing profile stores videos in.
+type outputFormat struct {
+	Name        string
+	Extension   string
+	ContentType string
+	// ProbeFormat is ffprobe's format_name for output in this format
+	ProbeFormat string
+	// Segmented formats are a playlist with segment files beside it
+	Segmented          bool
+	SegmentContentType string
+}
+
+// Every format a profile can produce, keyed by the name used in config
+var outputFormats = map[string]outputFormat{
+	"mp4": {
+		Name:        "mp4",
+		Extension:   ".mp4",
+		ContentType: "video/mp4",
+		ProbeFormat: "mov,mp4,m4a,3gp,3g2,mj2",
+	},
+	"webm": {
+		Name:        "webm",
+		Extension:   ".webm",
+		ContentType: "video/webm",
+		ProbeFormat: "matroska,webm",
+	},
+	"hls": {
+		Name:               "hls",
+		Extension:          ".m3u8",
+		ContentType:        "application/vnd.apple.mpegurl",
+		ProbeFormat:        "hls",
+		Segmented:          true,
+		SegmentContentType: "video/mp2t",
+	},
+}
+
+const defaultOutputFormat = "mp4"
+
+/**
+ * Build the object key of a processed video
+ * Segmented formats get a folder of their own, e.g.
+ * "landscape/abc/index.m3u8" with its segments next to it
+ */
+func (f outputFormat) objectKey(prefix, name string) string {
+	if f.Segmented {
+		return prefix + "/" + name + "/index" + f.Extension
+	}
+	return prefix + "/" + name + f.Extension
+}
+
+// contentTypeForKey returns the content type of a stored video from its
+// extension, mp4 when it isn't one of the output formats.
+func contentTypeForKey(key string) string {
+	for _, format := range outputFormats {
+		if path.Ext(key) == format.Extension {
+			return format.ContentType
+		}
+	}
+	return outputFormats[defaultOutputFormat].ContentType
+}
+
+// isSegmentedKey reports whether key is a playlist whose segments share
+// its folder.
+func isSegmentedKey(key string) bool {
+	for _, format := range outputFormats {
+		if format.Segmented && strings.HasSuffix(key, "/index"+format.Extension) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Convert an upload of inputType into format
+ * Returns the processed file. For segmented formats that is the playlist,
+ * inside a temp folder with its segments; the folder is returned too and
+ * the caller removes it
+ */
+func (cfg *apiConfig) convertForOutput(ctx context.Context, filePath string, format outputFormat, inputType string) (string, string, error) {
+	start := time.Now()
+	outputPath, segmentsDir, err := cfg.convertToFormat(ctx, filePath, format, inputType)
+	if err == nil {
+		cfg.metrics.observeTranscode(format.Name, time.Since(start).Seconds())
+	}
+	if err != nil || !cfg.verifyOutputContainer {
+		return outputPath, segmentsDir, err
+	}
+	// The object is labeled format.ContentType, so make sure that's true
+	err = checkOutputContainer(ctx, outputPath, format)
+	if err != nil {
+		os.Remove(outputPath)
+		if segmentsDir != "" {
+			os.RemoveAll(segmentsDir)
+		}
+		return "", "", err
+	}
+	return outputPath, segmentsDir, nil
+}
+
+// convertToFormat runs the ffmpeg conversion behind convertForOutput.
+func (cfg *apiConfig) convertToFormat(ctx context.Context, filePath string, format outputFormat, inputType string) (string, string, error) {
+	switch format.Name {
+	case "webm":
+		outputPath := filePath + ".processing.webm"
+		args := append([]string{"-y", "-i", filePath}, reencodeCodecs["vp9"].args...)
+		err := runFFmpeg(ctx, append(args, outputPath)...)
+		return outputPath, "", err
+	case "hls":
+		segmentsDir, err := os.MkdirTemp("", "hls-output")
+		if err != nil {
+			return "", "", err
+		}
+		playlistPath := filepath.Join(segmentsDir, "index.m3u8")
+		// Only mp4 uploads can be assumed to carry H.264 that fits in TS segments
+		videoArgs := []string{"-c:v", "copy"}
+		if inputType != "video/mp4" {
+			videoArgs = []string{"-c:v", "libx264", "-preset", "medium", "-crf", "23", "-pix_fmt", "yuv420p"}
+		}
+		args := append([]string{"-i", filePath}, videoArgs...)
+		args = append(args, "-c:a", "aac",
+			"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(segmentsDir, "segment-%04d.ts"), playlistPath)
+		err = runFFmpeg(ctx, args...)
+		if err != nil {
+			os.RemoveAll(segmentsDir)
+			return "", "", err
+		}
+		return playlistPath, segmentsDir, nil
+	}
+	outputPath, err := cfg.processor.fastStart(ctx, filePath, inputType)
+	if err != nil && inputType == "video/mp4" && cfg.faststartReencodeFallback && !errors.Is(err, errProcessTimeout) {
+		// Stream copy trips over e.g. broken timestamps, a full re-encode
+		// rewrites them
+		log.Printf("Stream-copy faststart failed, retrying with a re-encode: %v", err)
+		processingRecorderFrom(ctx).warn("stream-copy faststart failed, re-encoded instead")
+		outputPath, err = reencodeForFastStart(ctx, filePath)
+		if err == nil {
+			log.Printf("Faststart succeeded with a re-encode for %s", filepath.Base(filePath))
+		}
+		return outputPath, "", err
+	}
+	if err == nil && inputType == "video/mp4" {
+		log.Printf("Faststart succeeded with a stream copy for %s", filepath.Base(filePath))
+	}
+	return outputPath, "", err
+}
+
+// checkOutputContainer probes the container of a processed file and fails
+// when it isn't the one format promises.
+func checkOutputContainer(ctx context.Context, filePath string, format outputFormat) error {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=format_name", "-of", "default=noprint_wrappers=1:nokey=1", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+	err := command.Run()
+	if err != nil {
+		return fmt.Errorf("couldn't probe output container: %w", err)
+	}
+	container := strings.TrimSpace(out.String())
+	if container != format.ProbeFormat {
+		return fmt.Errorf("output container is %q, expected %q for %s", container, format.ProbeFormat, format.ContentType)
+	}
+	return nil
+}
+
+func runFFmpeg(ctx context.Context, args ...string) error {
+	command := commandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+/**
+ * Upload the segments of a segmented output next to its playlist key
+ * segmentsDir is the folder convertForOutput returned
+ */
+func (cfg *apiConfig) uploadSegments(ctx context.Context, bucket, playlistKey, segmentsDir string, format outputFormat) error {
+	entries, err := os.ReadDir(segmentsDir)
+	if err != nil {
+		return err
+	}
+	folder := path.Dir(playlistKey)
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == path.Base(playlistKey) {
+			continue
+		}
+		err := cfg.uploadFileToBucket(ctx, bucket, folder+"/"+entry.Name(), filepath.Join(segmentsDir, entry.Name()), format.SegmentContentType)
+		if err != nil {
+			return fmt.Errorf("couldn't upload segment %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// deleteSegments removes everything in a segmented output's folder.
+func (cfg *apiConfig) deleteSegments(ctx context.Context, bucket, playlistKey string) error {
+	prefix := path.Dir(playlistKey) + "/"
+	if cfg.local != nil && bucket == cfg.s3Bucket {
+		keys, err := cfg.local.list(prefix)
+		if err != nil {
+			return err
+		}
+		for key, err := range cfg.deleteObjects(ctx, bucket, keys) {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return nil
+	}
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+	}
+	for key, err := range deleteObjectsBatched(ctx, cfg.s3Client, bucket, keys) {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// dirSize adds up the sizes of the files directly in dir.
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputFormatObjectKey(t *testing.T) {
+	tests := []struct {
+		format          string
+		wantKey         string
+		wantContentType string
+	}{
+		{format: "mp4", wantKey: "landscape/abc.mp4", wantContentType: "video/mp4"},
+		{format: "webm", wantKey: "landscape/abc.webm", wantContentType: "video/webm"},
+		{format: "hls", wantKey: "landscape/abc/index.m3u8", wantContentType: "application/vnd.apple.mpegurl"},
+	}
+	for _, tt := range tests {
+		format := outputFormats[tt.format]
+		key := format.objectKey("landscape", "abc")
+		if key != tt.wantKey {
+			t.Errorf("%s key = %s, want %s", tt.format, key, tt.wantKey)
+		}
+		if got := contentTypeForKey(key); got != tt.wantContentType {
+			t.Errorf("contentTypeForKey(%s) = %s, want %s", key, got, tt.wantContentType)
+		}
+		if got := isSegmentedKey(key); got != format.Segmented {
+			t.Errorf("isSegmentedKey(%s) = %v, want %v", key, got, format.Segmented)
+		}
+	}
+	// Keys from before formats existed are mp4
+	if got := contentTypeForKey("landscape/legacy"); got != "video/mp4" {
+		t.Errorf("contentTypeForKey without an extension = %s, want video/mp4", got)
+	}
+}
+
+func TestUploadVideoProfileFormat(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tests := []struct {
+		profile         string
+		wantSuffix      string
+		wantContentType string
+	}{
+		{profile: "", wantSuffix: ".mp4", wantContentType: "video/mp4"},
+		{profile: "web", wantSuffix: ".webm", wantContentType: "video/webm"},
+		{profile: "stream", wantSuffix: "/index.m3u8", wantContentType: "application/vnd.apple.mpegurl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			profiles, err := parseProcessingProfiles("web:1m:webm,stream:1m:hls", time.Minute, "mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.processingProfiles = profiles
+
+			req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+			req.URL.RawQuery = url.Values{"profile": {tt.profile}}.Encode()
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.VideoURL)
+			if !strings.HasPrefix(key, "landscape/") || !strings.HasSuffix(key, tt.wantSuffix) {
+				t.Errorf("stored at %s, want landscape/...%s", key, tt.wantSuffix)
+			}
+			if got := store.contentTypes[key]; got != tt.wantContentType {
+				t.Errorf("%s stored as %q, want %q", key, got, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestUploadVideoFastStartFallback(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Stream copy fails like it does on broken timestamps, re-encodes work
+	installFakeTool(t, "ffmpeg", `case "$*" in
+*"-c copy"*) echo "non monotonically increasing dts" >&2; exit 1 ;;
+*.processing) echo "$*" > "$FAKE_FFMPEG_REENCODE" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	tests := []struct {
+		name     string
+		fallback bool
+		wantCode int
+	}{
+		{name: "fallback", fallback: true, wantCode: http.StatusOK},
+		{name: "no fallback", wantCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reencode := filepath.Join(t.TempDir(), "reencode")
+			t.Setenv("FAKE_FFMPEG_REENCODE", reencode)
+			cfg, store, video, token := newS3Test(t)
+			cfg.faststartReencodeFallback = tt.fallback
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			args, _ := os.ReadFile(reencode)
+			if !tt.fallback {
+				if len(args) != 0 || len(store.objects) != 0 {
+					t.Errorf("re-encoded with %q and stored %d files, want neither", args, len(store.objects))
+				}
+				return
+			}
+			for _, want := range []string{"-c:v libx264", "-c:a aac", "-movflags faststart"} {
+				if !strings.Contains(string(args), want) {
+					t.Errorf("re-encoded with %q, want %s", args, want)
+				}
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.VideoURL == nil {
+				t.Error("re-encoded video wasn't saved")
+			}
+		})
+	}
+}
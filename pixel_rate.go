@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	pixelRateActionReject    = "reject"
+	pixelRateActionDownscale = "downscale"
+	pixelRateActionFrameDrop = "framedrop"
+)
+
+func validatePixelRateAction(action string) error {
+	switch action {
+	case pixelRateActionReject, pixelRateActionDownscale, pixelRateActionFrameDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown pixel rate action: %s", action)
+}
+
+// videoGeometry is the size and average frame rate of a video stream.
+type videoGeometry struct {
+	Width  int
+	Height int
+	FPS    float64
+}
+
+// PixelRate is the number of pixels decoded per second of playback.
+func (g videoGeometry) PixelRate() float64 {
+	return float64(g.Width) * float64(g.Height) * g.FPS
+}
+
+func getVideoGeometry(ctx context.Context, filePath string) (videoGeometry, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-print_format", "json", "-show_entries", "stream=width,height,avg_frame_rate", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return videoGeometry{}, err
+	}
+
+	var ffprobeOutput struct {
+		Streams []struct {
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return videoGeometry{}, err
+	}
+	if len(ffprobeOutput.Streams) == 0 {
+		return videoGeometry{}, errors.New("no video stream found")
+	}
+	stream := ffprobeOutput.Streams[0]
+	fps, err := parseFrameRate(stream.AvgFrameRate)
+	if err != nil {
+		return videoGeometry{}, err
+	}
+	return videoGeometry{Width: stream.Width, Height: stream.Height, FPS: fps}, nil
+}
+
+/**
+ * Re-encode a video so its pixel rate fits under maxPixelRate
+ * downscale keeps the frame rate and shrinks the picture; framedrop keeps
+ * the resolution and lowers the frame rate. Returns the new file path
+ */
+func limitPixelRate(ctx context.Context, filePath string, geometry videoGeometry, maxPixelRate float64, action string) (string, error) {
+	ratio := maxPixelRate / geometry.PixelRate()
+	var filter string
+	switch action {
+	case pixelRateActionDownscale:
+		scale := math.Sqrt(ratio)
+		// libx264 needs even dimensions
+		width := int(float64(geometry.Width)*scale) &^ 1
+		height := int(float64(geometry.Height)*scale) &^ 1
+		if width < 2 || height < 2 {
+			return "", fmt.Errorf("can't downscale %dx%d far enough", geometry.Width, geometry.Height)
+		}
+		filter = fmt.Sprintf("scale=%d:%d", width, height)
+	case pixelRateActionFrameDrop:
+		filter = "fps=" + strconv.FormatFloat(math.Floor(geometry.FPS*ratio*1000)/1000, 'f', 3, 64)
+	default:
+		return "", fmt.Errorf("pixel rate action %s doesn't re-encode", action)
+	}
+
+	outputPath := filePath + ".limited.mp4"
+	command := commandContext(ctx, "ffmpeg", "-y", "-i", filePath, "-vf", filter, "-c:v", "libx264", "-c:a", "copy", outputPath)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return outputPath, nil
+}
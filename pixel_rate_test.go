@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ffprobe output for a 4K clip at 120fps, about 995M pixels per second
+const highPixelRateProbeOutput = `{
+	"streams": [{"index": 0, "codec_type": "video", "width": 3840, "height": 2160, "avg_frame_rate": "120/1"}],
+	"format": {"duration": "12.500000"}
+}`
+
+func TestLimitPixelRate(t *testing.T) {
+	installFakeProcessingTools(t, highPixelRateProbeOutput)
+	// Records the filter each re-encode uses
+	installFakeTool(t, "ffmpeg", `prev=""
+for arg in "$@"; do
+	if [ "$prev" = "-vf" ]; then
+		echo "$arg" >> "$FAKE_FFMPEG_FILTERS"
+	fi
+	prev="$arg"
+done
+echo limited > "$prev"
+`)
+	tests := []struct {
+		name       string
+		action     string
+		wantFilter string
+	}{
+		// A quarter of the pixel rate is half of each side
+		{name: "downscale", action: pixelRateActionDownscale, wantFilter: "scale=1920:1080"},
+		{name: "framedrop", action: pixelRateActionFrameDrop, wantFilter: "fps=30.000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := filepath.Join(t.TempDir(), "filters")
+			t.Setenv("FAKE_FFMPEG_FILTERS", filters)
+			source := filepath.Join(t.TempDir(), "upload.mp4")
+			err := os.WriteFile(source, []byte("video"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			geometry, err := getVideoGeometry(context.Background(), source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path, err := limitPixelRate(context.Background(), source, geometry, 3840*2160*30, tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(path)
+			got, _ := os.ReadFile(filters)
+			if strings.TrimSpace(string(got)) != tt.wantFilter {
+				t.Errorf("re-encoded with %q, want %q", got, tt.wantFilter)
+			}
+			if path == source {
+				t.Errorf("processing %s, want a reduced copy", path)
+			}
+		})
+	}
+}
+
+func TestUploadVideoPixelRate(t *testing.T) {
+	installFakeProcessingTools(t, highPixelRateProbeOutput)
+	tests := []struct {
+		name     string
+		limit    float64
+		wantCode int
+	}{
+		{name: "under the limit", limit: 3840 * 2160 * 120, wantCode: http.StatusOK},
+		{name: "over the limit", limit: 3840 * 2160 * 30, wantCode: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, server, video, token := newS3Test(t)
+			cfg.maxPixelRate = tt.limit
+			cfg.pixelRateAction = pixelRateActionReject
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if stored := len(server.objects) != 0; stored != (tt.wantCode == http.StatusOK) {
+				t.Errorf("video stored = %v with status %d", stored, w.Code)
+			}
+		})
+	}
+}
+
+func TestVideoGeometryPixelRate(t *testing.T) {
+	geometry := videoGeometry{Width: 1920, Height: 1080, FPS: 30000.0 / 1001}
+	if got, want := geometry.PixelRate(), 1920*1080*30000.0/1001; got != want {
+		t.Errorf("PixelRate = %v, want %v", got, want)
+	}
+}
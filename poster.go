@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// faceBox is a detected face, in coordinates normalized to the frame size
+// (0,0 is the top left corner, 1,1 the bottom right).
+type faceBox struct {
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+	Width      float64 `json:"width"`
+	Height     float64 `json:"height"`
+	Confidence float64 `json:"confidence"`
+}
+
+// faceDetector finds faces in a still image.
+type faceDetector interface {
+	DetectFaces(ctx context.Context, imagePath string) ([]faceBox, error)
+}
+
+/**
+ * commandFaceDetector runs an external detector once per frame
+ * The command gets the image path as its last argument and prints a JSON
+ * array of faceBox objects
+ */
+type commandFaceDetector struct {
+	command string
+	args    []string
+}
+
+func newCommandFaceDetector(commandLine string) (*commandFaceDetector, error) {
+	fields := strings.Fields(commandLine)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("face detector command is empty")
+	}
+	return &commandFaceDetector{command: fields[0], args: fields[1:]}, nil
+}
+
+func (d *commandFaceDetector) DetectFaces(ctx context.Context, imagePath string) ([]faceBox, error) {
+	command := commandContext(ctx, d.command, append(d.args, imagePath)...)
+	var out, stderr strings.Builder
+	command.Stdout = &out
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return nil, fmt.Errorf("face detector failed: %w: %s", err, stderr.String())
+	}
+	faces := []faceBox{}
+	err = json.Unmarshal([]byte(out.String()), &faces)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse face detector output: %w", err)
+	}
+	return faces, nil
+}
+
+// Faces smaller than this share of the frame are background extras
+const minPosterFaceArea = 0.02
+
+/**
+ * Score how well a face would work on a poster, 0 meaning not at all
+ * Faces that are big enough, fully in frame and near the upper middle,
+ * where titles don't cover them, score best
+ */
+func posterFaceScore(face faceBox, minConfidence float64) float64 {
+	if face.Confidence < minConfidence || face.Width <= 0 || face.Height <= 0 {
+		return 0
+	}
+	if face.X < 0 || face.Y < 0 || face.X+face.Width > 1 || face.Y+face.Height > 1 {
+		// Cut off at the frame edge
+		return 0
+	}
+	area := face.Width * face.Height
+	if area < minPosterFaceArea {
+		return 0
+	}
+	// Extreme close-ups score lower than a head and shoulders shot
+	size := math.Min(area, 0.25) / 0.25
+	centerX := face.X + face.Width/2
+	centerY := face.Y + face.Height/2
+	offset := math.Hypot(centerX-0.5, centerY-0.4)
+	placement := math.Max(0, 1-offset/0.6)
+	return face.Confidence * (0.5*size + 0.5*placement)
+}
+
+/**
+ * Pick the poster from candidate frames
+ * With a detector, the frame with the best framed face wins. Without one,
+ * or when no frame has a usable face, the middle candidate is used as the
+ * most representative frame
+ */
+func (cfg *apiConfig) choosePosterFrame(ctx context.Context, framePaths []string) int {
+	representative := len(framePaths) / 2
+	if cfg.faceDetector == nil {
+		return representative
+	}
+
+	best, bestScore := representative, 0.0
+	for i, framePath := range framePaths {
+		faces, err := cfg.faceDetector.DetectFaces(ctx, framePath)
+		if err != nil {
+			// One bad frame shouldn't lose the whole set
+			continue
+		}
+		for _, face := range faces {
+			score := posterFaceScore(face, cfg.faceMinConfidence)
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// presignCache is a size-bounded LRU cache of presigned URLs keyed by
+// bucket/key. It is safe for concurrent use.
+type presignCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type presignCacheEntry struct {
+	key       string
+	url       string
+	expiresAt time.Time
+	// urlExpiresAt is when the URL itself stops working
+	urlExpiresAt time.Time
+}
+
+func newPresignCache(capacity int, ttl time.Duration) *presignCache {
+	return &presignCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// maxPresignExpiry is the longest a SigV4 presigned URL can last.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+/**
+ * Get a cached URL that still works for at least lifetime
+ * Also returns when it stops working. An entry with less left is a miss, so
+ * a request never gets a shorter URL than it asked for
+ */
+func (c *presignCache) get(key string, lifetime time.Duration) (string, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	entry := elem.Value.(*presignCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return "", time.Time{}, false
+	}
+	if time.Until(entry.urlExpiresAt) < lifetime {
+		return "", time.Time{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.url, entry.urlExpiresAt, true
+}
+
+// signingLifetime is how long to sign a URL that has to last lifetime, with
+// room to be served from the cache for its TTL.
+func (c *presignCache) signingLifetime(lifetime time.Duration) time.Duration {
+	return min(lifetime+c.ttl, maxPresignExpiry)
+}
+
+/**
+ * Store a presigned URL that is valid until urlExpiresAt
+ * The entry expires before the URL does so we never hand out a dead link
+ */
+func (c *presignCache) add(key, url string, urlExpiresAt time.Time) {
+	lifetime := time.Until(urlExpiresAt) * 9 / 10
+	if c.ttl > 0 && c.ttl < lifetime {
+		lifetime = c.ttl
+	}
+	expiresAt := time.Now().Add(lifetime)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*presignCacheEntry)
+		entry.url = url
+		entry.expiresAt = expiresAt
+		entry.urlExpiresAt = urlExpiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&presignCacheEntry{
+		key:          key,
+		url:          url,
+		expiresAt:    expiresAt,
+		urlExpiresAt: urlExpiresAt,
+	})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*presignCacheEntry).key)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// newCountingS3Client signs like newEndpointS3Client and counts every
+// operation it runs, presigning included.
+func newCountingS3Client(calls *atomic.Int64) *s3.Client {
+	count := middleware.InitializeMiddlewareFunc("count", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		calls.Add(1)
+		return next.HandleInitialize(ctx, in)
+	})
+	return s3.New(s3.Options{
+		Region:       "us-east-2",
+		BaseEndpoint: aws.String("http://s3.example.com"),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+		APIOptions: []func(*middleware.Stack) error{
+			func(stack *middleware.Stack) error {
+				return stack.Initialize.Add(count, middleware.Before)
+			},
+		},
+	})
+}
+
+func TestPresignGetURLCache(t *testing.T) {
+	var signs atomic.Int64
+	cfg := &apiConfig{
+		s3Client:     newCountingS3Client(&signs),
+		presignCache: newPresignCache(10, time.Minute),
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		key       string
+		expiry    time.Duration
+		overrides presignOverrides
+		wantSigns int64
+	}{
+		{name: "first request", key: "landscape/a.mp4", expiry: time.Hour, wantSigns: 1},
+		{name: "same key within TTL", key: "landscape/a.mp4", expiry: time.Hour, wantSigns: 1},
+		{name: "shorter expiry", key: "landscape/a.mp4", expiry: time.Minute, wantSigns: 1},
+		// The cached URL doesn't last long enough
+		{name: "longer expiry", key: "landscape/a.mp4", expiry: 2 * time.Hour, wantSigns: 2},
+		{name: "longer expiry again", key: "landscape/a.mp4", expiry: 2 * time.Hour, wantSigns: 2},
+		{name: "other overrides", key: "landscape/a.mp4", expiry: time.Hour, overrides: presignOverrides{ContentDisposition: "attachment"}, wantSigns: 3},
+		{name: "other key", key: "landscape/b.mp4", expiry: time.Hour, wantSigns: 4},
+		{name: "other key again", key: "landscape/b.mp4", expiry: time.Hour, wantSigns: 4},
+	}
+	var previous string
+	for i, tt := range tests {
+		url, expiresAt, err := cfg.presignGetURL(ctx, "tubely-test", tt.key, tt.expiry, tt.overrides)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := signs.Load(); got != tt.wantSigns {
+			t.Errorf("%s: signed %d times, want %d", tt.name, got, tt.wantSigns)
+		}
+		if until := time.Until(expiresAt); until < tt.expiry-time.Second {
+			t.Errorf("%s: URL expires in %s, want at least %s", tt.name, until, tt.expiry)
+		}
+		if i > 0 && tt.wantSigns == tests[i-1].wantSigns && url != previous {
+			t.Errorf("%s: got a new URL for a cached request", tt.name)
+		}
+		previous = url
+	}
+
+	// Without the cache every request signs
+	cfg.presignCache = nil
+	for i := 0; i < 2; i++ {
+		_, _, err := cfg.presignGetURL(ctx, "tubely-test", "landscape/a.mp4", time.Hour, presignOverrides{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := signs.Load(); got != 6 {
+		t.Errorf("signed %d times without a cache, want 6", got)
+	}
+}
+
+func TestPresignCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		urlLasts time.Duration
+	}{
+		{name: "cache TTL", ttl: time.Millisecond, urlLasts: time.Hour},
+		// The entry goes before the URL it holds does
+		{name: "URL expiry", ttl: time.Hour, urlLasts: 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newPresignCache(10, tt.ttl)
+			urlExpiresAt := time.Now().Add(tt.urlLasts)
+			cache.add("bucket/key", "https://signed", urlExpiresAt)
+			url, expiresAt, ok := cache.get("bucket/key", 0)
+			if !ok || url != "https://signed" || !expiresAt.Equal(urlExpiresAt) {
+				t.Fatalf("get = %s, %s, %v, want the fresh entry", url, expiresAt, ok)
+			}
+			time.Sleep(min(tt.ttl, tt.urlLasts))
+			if _, _, ok := cache.get("bucket/key", 0); ok {
+				t.Error("expired entry was returned")
+			}
+			if len(cache.entries) != 0 || cache.order.Len() != 0 {
+				t.Errorf("expired entry is still held")
+			}
+		})
+	}
+}
+
+func TestPresignCacheLifetime(t *testing.T) {
+	cache := newPresignCache(10, time.Hour)
+	cache.add("bucket/key", "https://short-lived", time.Now().Add(time.Minute))
+	if _, _, ok := cache.get("bucket/key", time.Hour); ok {
+		t.Error("a URL with a minute left was reused for an hour long request")
+	}
+	if url, _, ok := cache.get("bucket/key", 30*time.Second); !ok || url != "https://short-lived" {
+		t.Errorf("get = %s, %v, want the cached URL for a shorter request", url, ok)
+	}
+}
+
+func TestPresignCacheLRU(t *testing.T) {
+	cache := newPresignCache(2, time.Minute)
+	expiresAt := time.Now().Add(time.Hour)
+	cache.add("a", "url-a", expiresAt)
+	cache.add("b", "url-b", expiresAt)
+	// a is now the most recently used, so b goes first
+	cache.get("a", 0)
+	cache.add("c", "url-c", expiresAt)
+
+	tests := []struct {
+		key    string
+		wantOK bool
+	}{
+		{key: "a", wantOK: true},
+		{key: "b", wantOK: false},
+		{key: "c", wantOK: true},
+	}
+	for _, tt := range tests {
+		if _, _, ok := cache.get(tt.key, 0); ok != tt.wantOK {
+			t.Errorf("get(%s) found = %v, want %v", tt.key, ok, tt.wantOK)
+		}
+	}
+
+	// Replacing an entry doesn't grow the cache
+	cache.add("c", "url-c2", expiresAt)
+	if url, _, _ := cache.get("c", 0); url != "url-c2" || cache.order.Len() != 2 {
+		t.Errorf("after replacing c: %s with %d entries, want url-c2 with 2", url, cache.order.Len())
+	}
+}
+
+func TestPresignCacheConcurrent(t *testing.T) {
+	cache := newPresignCache(8, time.Minute)
+	expiresAt := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key-%d", (i+j)%12)
+				if _, _, ok := cache.get(key, 0); !ok {
+					cache.add(key, "url-"+key, expiresAt)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(cache.entries) > 8 || len(cache.entries) != cache.order.Len() {
+		t.Errorf("cache holds %d entries and %d in order, want at most 8 of each", len(cache.entries), cache.order.Len())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem types of errors whose messages carry values, like a limit or a
+// size. The message can't be slugged into a type that stays the same.
+const (
+	problemUploadTooLarge          = "upload-too-large"
+	problemUploadTruncated         = "upload-truncated"
+	problemUnsupportedEncoding     = "unsupported-content-encoding"
+	problemRejectedFilename        = "rejected-filename"
+	problemExpiresInTooLong        = "expires-in-too-long"
+	problemInvalidTrimRange        = "invalid-trim-range"
+	problemInvalidExpiry           = "invalid-expiry"
+	problemTooManyVideoIDs         = "too-many-video-ids"
+	problemPixelRateTooHigh        = "pixel-rate-too-high"
+	problemVideoDuration           = "video-duration-rejected"
+	problemThumbnailTooLarge       = "thumbnail-dimensions-too-large"
+	problemThumbnailAspectMismatch = "thumbnail-aspect-mismatch"
+	problemMalformedCaption        = "malformed-caption"
+)
+
+// problemResponseWriter marks a response whose client asked for RFC 9457
+// Problem Details. respondWithError looks for it under any later wrappers.
+type problemResponseWriter struct {
+	http.ResponseWriter
+	typeBase string
+	instance string
+}
+
+func (w *problemResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *problemResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// problemDetailsMiddleware switches error responses to application/problem+json
+// for clients that send it in their Accept header.
+func problemDetailsMiddleware(typeBase string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsProblemDetails(r.Header.Get("Accept")) {
+			w = &problemResponseWriter{
+				ResponseWriter: w,
+				typeBase:       typeBase,
+				instance:       r.URL.Path,
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// problemWriterOf finds the problemResponseWriter under w, if any.
+func problemWriterOf(w http.ResponseWriter) *problemResponseWriter {
+	for {
+		if pw, ok := w.(*problemResponseWriter); ok {
+			return pw
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+func acceptsProblemDetails(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == problemContentType {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Build a stable type slug from an error message
+ * "Couldn't find JWT" becomes "couldnt-find-jwt"
+ */
+func problemSlug(msg string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(msg) {
+		switch {
+		case r == '\'':
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// respondWithProblem writes through w, so wrappers above pw see the
+// response too.
+func respondWithProblem(w http.ResponseWriter, pw *problemResponseWriter, code int, problemType, msg string) {
+	type problem struct {
+		Type     string `json:"type"`
+		Title    string `json:"title"`
+		Status   int    `json:"status"`
+		Detail   string `json:"detail"`
+		Instance string `json:"instance"`
+	}
+	writeJSON(w, code, problemContentType, problem{
+		Type:     pw.typeBase + problemType,
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   msg,
+		Instance: pw.instance,
+	})
+}
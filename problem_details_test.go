@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// statusWriter stands in for any wrapper a handler or middleware puts
+// around the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestProblemDetailsMiddleware(t *testing.T) {
+	var wrapped *statusWriter
+	handler := requestLogMiddleware(problemDetailsMiddleware("https://example.com/problems/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped = &statusWriter{ResponseWriter: w}
+		respondWithError(wrapped, http.StatusNotFound, "Couldn't find video", errors.New("no rows"))
+	})))
+
+	tests := []struct {
+		name        string
+		accept      string
+		wantProblem bool
+	}{
+		{name: "problem details", accept: "application/problem+json", wantProblem: true},
+		{name: "among others", accept: "text/html, application/problem+json;q=0.9", wantProblem: true},
+		{name: "plain JSON", accept: "application/json", wantProblem: false},
+		{name: "no accept", accept: "", wantProblem: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/videos/42", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound || wrapped.status != http.StatusNotFound {
+				t.Fatalf("status = %d, through the wrapper %d, want 404", w.Code, wrapped.status)
+			}
+			if !tt.wantProblem {
+				var body struct {
+					Error string `json:"error"`
+				}
+				err := json.NewDecoder(w.Body).Decode(&body)
+				if err != nil || body.Error != "Couldn't find video" {
+					t.Errorf("body = %+v, %v, want the plain error", body, err)
+				}
+				if got := w.Header().Get("Content-Type"); got != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", got)
+				}
+				return
+			}
+
+			if got := w.Header().Get("Content-Type"); got != problemContentType {
+				t.Errorf("Content-Type = %q, want %s", got, problemContentType)
+			}
+			var problem map[string]any
+			err := json.NewDecoder(w.Body).Decode(&problem)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]any{
+				"type":     "https://example.com/problems/couldnt-find-video",
+				"title":    "Not Found",
+				"status":   float64(http.StatusNotFound),
+				"detail":   "Couldn't find video",
+				"instance": "/api/videos/42",
+			}
+			for field, value := range want {
+				if problem[field] != value {
+					t.Errorf("%s = %v, want %v", field, problem[field], value)
+				}
+			}
+		})
+	}
+}
+
+func TestProblemSlug(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{msg: "Couldn't find JWT", want: "couldnt-find-jwt"},
+		{msg: "Upload is larger than 1024 bytes", want: "upload-is-larger-than-1024-bytes"},
+		{msg: "  Invalid ID!", want: "invalid-id"},
+	}
+	for _, tt := range tests {
+		if got := problemSlug(tt.msg); got != tt.want {
+			t.Errorf("problemSlug(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestProblemTypeIgnoresValues(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	tests := []struct {
+		name     string
+		respond  func(w http.ResponseWriter, value int)
+		wantType string
+	}{
+		{
+			name: "body over the cap",
+			respond: func(w http.ResponseWriter, value int) {
+				respondWithBodyError(w, &http.MaxBytesError{Limit: int64(value)})
+			},
+			wantType: problemUploadTooLarge,
+		},
+		{
+			name: "too many IDs to bulk delete",
+			respond: func(w http.ResponseWriter, value int) {
+				cfg.bulkDeleteMaxIDs = value
+				ids := make([]uuid.UUID, value+1)
+				for i := range ids {
+					ids[i] = uuid.New()
+				}
+				body, _ := json.Marshal(map[string][]uuid.UUID{"ids": ids})
+				cfg.handlerVideosBulkDelete(w, newVideoRequest(http.MethodPost, "/api/videos/bulk-delete", video, token, string(body)))
+			},
+			wantType: problemTooManyVideoIDs,
+		},
+		{
+			name: "pixel rate rejection",
+			respond: func(w http.ResponseWriter, value int) {
+				respondWithUploadError(w, context.Background(), "Couldn't check video", &uploadRejection{
+					status:      http.StatusUnprocessableEntity,
+					message:     fmt.Sprintf("Video pixel rate %d exceeds the limit", value),
+					problemType: problemPixelRateTooHigh,
+				})
+			},
+			wantType: problemPixelRateTooHigh,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			details := map[string]bool{}
+			for _, value := range []int{2, 3} {
+				handler := problemDetailsMiddleware("https://example.com/problems/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					tt.respond(w, value)
+				}))
+				req := httptest.NewRequest(http.MethodPost, "/api/videos", nil)
+				req.Header.Set("Accept", problemContentType)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+
+				var problem struct {
+					Type   string `json:"type"`
+					Detail string `json:"detail"`
+				}
+				err := json.NewDecoder(w.Body).Decode(&problem)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := "https://example.com/problems/" + tt.wantType; problem.Type != want {
+					t.Errorf("with %d: type = %s, want %s", value, problem.Type, want)
+				}
+				details[problem.Detail] = true
+			}
+			if len(details) != 2 {
+				t.Errorf("details %v, want the values in each message", details)
+			}
+		})
+	}
+}
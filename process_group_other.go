@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves the default of killing only the process itself.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errProcessTimeout is returned when one ffmpeg or ffprobe run takes longer
+// than processTimeout, usually because a malformed file made it hang.
+var errProcessTimeout = errors.New("video processing timed out")
+
+// withProcessTimeout bounds a single ffmpeg or ffprobe run by processTimeout,
+// within whatever deadline ctx already has.
+func (cfg *apiConfig) withProcessTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.processTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, cfg.processTimeout, errProcessTimeout)
+}
+
+// processTimeoutError marks err as errProcessTimeout when the run under ctx
+// was killed by withProcessTimeout.
+func processTimeoutError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), errProcessTimeout) {
+		return fmt.Errorf("%w: %v", errProcessTimeout, err)
+	}
+	return err
+}
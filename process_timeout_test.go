@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadVideoProcessTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		tool string
+	}{
+		{name: "aspect ratio probe hangs", tool: "ffprobe"},
+		{name: "faststart hangs", tool: "ffmpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, fakeProbeOutput)
+			installFakeTool(t, tt.tool, "exec sleep 30\n")
+			cfg, store, video, token := newS3Test(t)
+			cfg.processTimeout = 200 * time.Millisecond
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "Video processing timed out") {
+				t.Fatalf("status = %d, want 422 timed out: %s", w.Code, w.Body)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("took %s, want the hung %s killed after the timeout", elapsed, tt.tool)
+			}
+			if len(store.objects) != 0 {
+				t.Errorf("timed out upload stored %d files", len(store.objects))
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	reportOutcomeReady  = "ready"
+	reportOutcomeFailed = "failed"
+)
+
+/**
+ * Collects a processing report while the pipeline runs
+ * A nil recorder ignores every call, so steps can be recorded unconditionally
+ */
+type processingRecorder struct {
+	mu      sync.Mutex
+	report  database.ProcessingReport
+	current int
+}
+
+type processingRecorderKey struct{}
+
+// newProcessingRecorder starts a report when reports are enabled.
+func (cfg *apiConfig) newProcessingRecorder() *processingRecorder {
+	if !cfg.processingReports {
+		return nil
+	}
+	return &processingRecorder{
+		report:  database.ProcessingReport{StartedAt: time.Now().UTC(), Input: database.StringMap{}, Steps: []database.ProcessingStep{}},
+		current: -1,
+	}
+}
+
+func withProcessingRecorder(ctx context.Context, recorder *processingRecorder) context.Context {
+	if recorder == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, processingRecorderKey{}, recorder)
+}
+
+func processingRecorderFrom(ctx context.Context) *processingRecorder {
+	recorder, _ := ctx.Value(processingRecorderKey{}).(*processingRecorder)
+	return recorder
+}
+
+// input records a piece of detected input metadata.
+func (p *processingRecorder) input(key, value string) {
+	if p == nil || value == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Input[key] = value
+}
+
+func (p *processingRecorder) warn(message string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Warnings = append(p.report.Warnings, redactReportText(message))
+}
+
+// step starts a named step. Calling the returned func ends it, err is the
+// step's outcome.
+func (p *processingRecorder) step(name string) func(err error) {
+	if p == nil {
+		return func(error) {}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Steps = append(p.report.Steps, database.ProcessingStep{Name: name})
+	index := len(p.report.Steps) - 1
+	p.current = index
+	started := time.Now()
+	return func(err error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.report.Steps[index].DurationMS = time.Since(started).Milliseconds()
+		if err != nil {
+			p.report.Steps[index].Error = redactReportText(err.Error())
+		}
+		if p.current == index {
+			p.current = -1
+		}
+	}
+}
+
+// command records a command line under the running step.
+func (p *processingRecorder) command(name string, args []string) {
+	if p == nil {
+		return
+	}
+	parts := []string{name}
+	for _, arg := range args {
+		parts = append(parts, redactReportArg(arg))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current < 0 {
+		return
+	}
+	step := &p.report.Steps[p.current]
+	step.Commands = append(step.Commands, strings.Join(parts, " "))
+}
+
+// finish stamps the outcome and returns a copy of the report.
+func (p *processingRecorder) finish(outcome string) *database.ProcessingReport {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.CompletedAt = time.Now().UTC()
+	p.report.Outcome = outcome
+	report := p.report
+	return &report
+}
+
+// commandContext is exec.CommandContext that also records the command line
+// in the processing report carried by ctx. Cancelling ctx kills the whole
+// process group.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	processingRecorderFrom(ctx).command(name, args)
+	command := exec.CommandContext(ctx, name, args...)
+	killProcessGroup(command)
+	command.WaitDelay = time.Second
+	return command
+}
+
+/**
+ * Strip what a report shouldn't leak from a command argument
+ * Local paths are cut to their file name and URLs lose credentials and
+ * query strings, which is where presigned signatures live
+ */
+func redactReportArg(arg string) string {
+	if parsed, err := url.Parse(arg); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		parsed.User = nil
+		parsed.RawQuery = ""
+		parsed.Fragment = ""
+		return parsed.String()
+	}
+	if filepath.IsAbs(arg) {
+		return filepath.Base(arg)
+	}
+	return arg
+}
+
+// redactReportText applies redactReportArg to every word of a message.
+func redactReportText(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = redactReportArg(word)
+	}
+	return strings.Join(words, " ")
+}
+
+// saveFailedReport attaches the report of a failed run to the video, best
+// effort.
+func (cfg *apiConfig) saveFailedReport(videoID uuid.UUID, recorder *processingRecorder) {
+	if recorder == nil {
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
+		return
+	}
+	video.ProcessingReport = recorder.finish(reportOutcomeFailed)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		log.Printf("Couldn't save processing report for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) handlerVideoReport(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+	if video.ProcessingReport == nil {
+		respondWithError(w, http.StatusNotFound, "No processing report for this video", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video.ProcessingReport)
+}
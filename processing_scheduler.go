@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errSchedulerFull is returned by AcquireBounded when maxWaiting requests
+// are already queued.
+var errSchedulerFull = errors.New("too many uploads waiting to be processed")
+
+/**
+ * processingScheduler hands out slots for ffmpeg work
+ * At most global jobs run at once and at most perUser of them belong to the
+ * same user. Waiters are served in arrival order, but a waiter whose user is
+ * already at the cap is skipped so other users aren't starved behind them
+ */
+type processingScheduler struct {
+	mu         sync.Mutex
+	global     int
+	perUser    int
+	maxWaiting int
+	running    int
+	active     map[uuid.UUID]int
+	waiting    *list.List
+}
+
+type schedulerWaiter struct {
+	userID uuid.UUID
+	ready  chan struct{}
+}
+
+// newProcessingScheduler returns a scheduler; a cap of 0 or less means
+// unlimited. maxWaiting only applies to AcquireBounded.
+func newProcessingScheduler(global, perUser, maxWaiting int) *processingScheduler {
+	return &processingScheduler{
+		global:     global,
+		perUser:    perUser,
+		maxWaiting: maxWaiting,
+		active:     make(map[uuid.UUID]int),
+		waiting:    list.New(),
+	}
+}
+
+func (s *processingScheduler) hasRoom(userID uuid.UUID) bool {
+	if s.global > 0 && s.running >= s.global {
+		return false
+	}
+	return s.perUser <= 0 || s.active[userID] < s.perUser
+}
+
+func (s *processingScheduler) start(userID uuid.UUID) {
+	s.running++
+	s.active[userID]++
+}
+
+/**
+ * Block until userID may start a job, or ctx is done
+ * The returned release func must be called once the job finishes
+ */
+func (s *processingScheduler) Acquire(ctx context.Context, userID uuid.UUID) (func(), error) {
+	return s.acquire(ctx, userID, false)
+}
+
+// AcquireBounded is Acquire for requests: instead of joining a queue that is
+// already maxWaiting long it fails with errSchedulerFull. Background jobs use
+// Acquire and always wait.
+func (s *processingScheduler) AcquireBounded(ctx context.Context, userID uuid.UUID) (func(), error) {
+	return s.acquire(ctx, userID, true)
+}
+
+func (s *processingScheduler) acquire(ctx context.Context, userID uuid.UUID, bounded bool) (func(), error) {
+	s.mu.Lock()
+	if s.waiting.Len() == 0 && s.hasRoom(userID) {
+		s.start(userID)
+		s.mu.Unlock()
+		return s.releaseFunc(userID), nil
+	}
+	if bounded && s.maxWaiting > 0 && s.waiting.Len() >= s.maxWaiting {
+		s.mu.Unlock()
+		return nil, errSchedulerFull
+	}
+	waiter := &schedulerWaiter{userID: userID, ready: make(chan struct{})}
+	elem := s.waiting.PushBack(waiter)
+	// Another user's waiter may fit even though the head of the queue doesn't
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return s.releaseFunc(userID), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-waiter.ready:
+			// Granted while we were giving up, hand the slot back
+			s.finish(userID)
+		default:
+			s.waiting.Remove(elem)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *processingScheduler) releaseFunc(userID uuid.UUID) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.finish(userID)
+		})
+	}
+}
+
+func (s *processingScheduler) finish(userID uuid.UUID) {
+	s.running--
+	s.active[userID]--
+	if s.active[userID] <= 0 {
+		delete(s.active, userID)
+	}
+	s.dispatch()
+}
+
+// dispatch starts every waiter that fits, oldest first. Callers hold mu.
+func (s *processingScheduler) dispatch() {
+	for elem := s.waiting.Front(); elem != nil; {
+		if s.global > 0 && s.running >= s.global {
+			return
+		}
+		next := elem.Next()
+		waiter := elem.Value.(*schedulerWaiter)
+		if s.hasRoom(waiter.userID) {
+			s.waiting.Remove(elem)
+			s.start(waiter.userID)
+			close(waiter.ready)
+		}
+		elem = next
+	}
+}
+
+/**
+ * Respond to a request that couldn't get a processing slot
+ * A full queue is a 503 with Retry-After, anything else means the client
+ * went away while waiting
+ */
+func respondWithSchedulerError(w http.ResponseWriter, retryAfter time.Duration, err error) {
+	if errors.Is(err, errSchedulerFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		respondWithError(w, http.StatusServiceUnavailable, "Too many uploads waiting to be processed, try again later", err)
+		return
+	}
+	respondWithError(w, http.StatusServiceUnavailable, "Upload cancelled while waiting to be processed", err)
+}
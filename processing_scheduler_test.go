@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// waitForWaiters blocks until n acquires are queued on s.
+func waitForWaiters(t *testing.T, s *processingScheduler, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		queued := s.waiting.Len()
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d acquires queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessingSchedulerFairness(t *testing.T) {
+	s := newProcessingScheduler(3, 1, 10)
+	heavy, light := uuid.New(), uuid.New()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// One heavy job runs, four more wait behind the per-user cap
+	release, err := s.Acquire(ctx, heavy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	running, maxRunning := 1, 1
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.Acquire(ctx, heavy)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			release()
+		}()
+	}
+	waitForWaiters(t, s, 4)
+
+	// Global capacity is free, so the other user goes straight past the queue
+	lightCtx, lightCancel := context.WithTimeout(ctx, time.Second)
+	defer lightCancel()
+	releaseLight, err := s.Acquire(lightCtx, light)
+	if err != nil {
+		t.Fatalf("second user was starved: %v", err)
+	}
+	releaseLight()
+
+	mu.Lock()
+	running--
+	mu.Unlock()
+	release()
+	wg.Wait()
+	if maxRunning > 1 {
+		t.Errorf("%d of one user's jobs ran at once, want at most 1", maxRunning)
+	}
+	if s.running != 0 || len(s.active) != 0 {
+		t.Errorf("after every release %d jobs are running for %d users", s.running, len(s.active))
+	}
+}
+
+func TestProcessingSchedulerCancel(t *testing.T) {
+	s := newProcessingScheduler(1, 0, 10)
+	ctx := context.Background()
+	release, err := s.Acquire(ctx, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	waited := make(chan error, 1)
+	go func() {
+		_, err := s.Acquire(cancelled, uuid.New())
+		waited <- err
+	}()
+	waitForWaiters(t, s, 1)
+	cancel()
+	if err := <-waited; !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire = %v, want it to wait until cancelled", err)
+	}
+	// A cancelled waiter leaves the queue
+	waitForWaiters(t, s, 0)
+
+	release()
+	if s.running != 0 || len(s.active) != 0 {
+		t.Errorf("after every release %d jobs are running for %d users", s.running, len(s.active))
+	}
+}
+
+func TestUploadVideoConcurrencyLimit(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	inFlight := t.TempDir()
+	counts := filepath.Join(t.TempDir(), "counts")
+	t.Setenv("FAKE_FFMPEG_INFLIGHT", inFlight)
+	t.Setenv("FAKE_FFMPEG_COUNTS", counts)
+	// Logs how many ffmpeg runs are going at once
+	installFakeTool(t, "ffmpeg", `touch "$FAKE_FFMPEG_INFLIGHT/$$"
+ls "$FAKE_FFMPEG_INFLIGHT" | wc -l >> "$FAKE_FFMPEG_COUNTS"
+sleep 0.1
+rm "$FAKE_FFMPEG_INFLIGHT/$$"
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	const limit, uploads = 2, 6
+	cfg, _, video, token := newS3Test(t)
+	cfg.scheduler = newProcessingScheduler(limit, 0, 0)
+
+	requests := []*http.Request{}
+	for i := range uploads {
+		upload, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: fmt.Sprintf("upload %d", i), UserID: video.UserID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, newVideoUploadRequest(t, upload, token, "video/mp4", testMP4))
+	}
+	codes := make(chan int, uploads)
+	var wg sync.WaitGroup
+	for _, req := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("upload status = %d, want 200", code)
+		}
+	}
+
+	data, err := os.ReadFile(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := strings.Fields(string(data))
+	peak := 0
+	for _, sample := range samples {
+		n, _ := strconv.Atoi(sample)
+		peak = max(peak, n)
+	}
+	if len(samples) != uploads || peak > limit {
+		t.Errorf("%d ffmpeg runs with up to %d at once, want %d with at most %d", len(samples), peak, uploads, limit)
+	}
+}
+
+func TestUploadVideoSchedulerFull(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.scheduler = newProcessingScheduler(1, 0, 1)
+	cfg.processingRetryAfter = 30 * time.Second
+	queued, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "queued", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedReq := newVideoUploadRequest(t, queued, token, "video/mp4", testMP4)
+	fullReq := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+
+	// Something else is processing and one upload waits behind it
+	release, err := cfg.scheduler.Acquire(context.Background(), uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedW := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg.handlerUploadVideo(queuedW, queuedReq)
+	}()
+	waitForWaiters(t, cfg.scheduler, 1)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, fullReq)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("full queue: status = %d with Retry-After %q, want 503 with 30", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	release()
+	<-done
+	if queuedW.Code != http.StatusOK {
+		t.Errorf("queued upload status = %d, want 200: %s", queuedW.Code, queuedW.Body)
+	}
+	if store.puts != 1 {
+		t.Errorf("%d puts, want only the queued upload's", store.puts)
+	}
+}
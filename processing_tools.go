@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processingTools are the binaries processing shells out to.
+var processingTools = []string{"ffmpeg", "ffprobe"}
+
+// toolLookup remembers where binaries were found on PATH. Misses aren't
+// remembered, so a node heals once the tool is installed.
+type toolLookup struct {
+	mu    sync.Mutex
+	found map[string]string
+}
+
+func newToolLookup() *toolLookup {
+	return &toolLookup{found: map[string]string{}}
+}
+
+func (t *toolLookup) lookPath(name string) (string, error) {
+	t.mu.Lock()
+	path, ok := t.found[name]
+	t.mu.Unlock()
+	if ok {
+		return path, nil
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	t.found[name] = path
+	t.mu.Unlock()
+	return path, nil
+}
+
+/**
+ * Check at startup that ffmpeg and ffprobe can run
+ * Each must be on PATH and answer -version. With minVersion set (e.g.
+ * "6.0") older releases are refused; git builds report no release number
+ * and are let through with a warning
+ */
+func (cfg *apiConfig) checkProcessingTools(ctx context.Context, minVersion string) error {
+	for _, tool := range processingTools {
+		path, err := cfg.toolLookup.lookPath(tool)
+		if err != nil {
+			return fmt.Errorf("%s not found on PATH: %w", tool, err)
+		}
+		versionCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		out, err := exec.CommandContext(versionCtx, path, "-version").Output()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s -version failed: %w", path, err)
+		}
+		version, ok := parseToolVersion(string(out), tool)
+		if minVersion == "" {
+			continue
+		}
+		if !ok {
+			log.Printf("Couldn't tell the release of %s, skipping the %s minimum", path, minVersion)
+			continue
+		}
+		if compareVersions(version, minVersion) < 0 {
+			return fmt.Errorf("%s is version %s, need at least %s", path, version, minVersion)
+		}
+	}
+	return nil
+}
+
+/**
+ * Get the release number from `<tool> -version` output
+ * The first line reads "ffmpeg version 6.1.1-3ubuntu5 Copyright ...";
+ * static builds prefix an "n". ok is false for git builds ("N-113000-g...")
+ */
+func parseToolVersion(output, tool string) (string, bool) {
+	firstLine, _, _ := strings.Cut(output, "\n")
+	rest, ok := strings.CutPrefix(strings.TrimSpace(firstLine), tool+" version ")
+	if !ok {
+		return "", false
+	}
+	field, _, _ := strings.Cut(rest, " ")
+	field = strings.TrimPrefix(field, "n")
+	end := 0
+	for end < len(field) && (field[end] == '.' || (field[end] >= '0' && field[end] <= '9')) {
+		end++
+	}
+	version := strings.Trim(field[:end], ".")
+	return version, version != ""
+}
+
+/**
+ * Compare dotted release numbers, e.g. "6.1.1" and "6.1"
+ * Missing parts count as 0. Negative when a is older than b
+ */
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < max(len(aParts), len(bParts)); i++ {
+		aPart, bPart := 0, 0
+		if i < len(aParts) {
+			aPart, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bPart, _ = strconv.Atoi(bParts[i])
+		}
+		if aPart != bPart {
+			return aPart - bPart
+		}
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeProbeOutput answers every JSON ffprobe query about a 12.5s 1280x720
+// H.264 clip at 30fps with an AAC track; each caller reads its fields.
+const fakeProbeOutput = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "width": 1280, "height": 720,
+		 "display_aspect_ratio": "16:9", "avg_frame_rate": "30/1", "bit_rate": "2500000",
+		 "disposition": {"default": 1, "attached_pic": 0}},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "bit_rate": "128000"}
+	],
+	"frames": [
+		{"best_effort_timestamp_time": "0.000000"},
+		{"best_effort_timestamp_time": "2.000000"},
+		{"best_effort_timestamp_time": "4.000000"}
+	],
+	"format": {"duration": "12.500000", "bit_rate": "2600000"}
+}`
+
+// fakeFFprobe prints probe.json from its own directory, except for the
+// container and subtitle queries that expect something else.
+const fakeFFprobe = `#!/bin/sh
+case "$*" in
+*format=format_name*) echo "mov,mp4,m4a,3gp,3g2,mj2" ;;
+*"-select_streams s "*) echo '{"streams": []}' ;;
+*) cat "$(dirname "$0")/probe.json" ;;
+esac
+`
+
+// fakeFFmpeg copies its first input to its output, the last argument.
+const fakeFFmpeg = `#!/bin/sh
+input=""
+prev=""
+for arg in "$@"; do
+	if [ "$prev" = "-i" ] && [ -z "$input" ]; then
+		input="$arg"
+	fi
+	prev="$arg"
+done
+case "$prev" in
+-|pipe:*) exit 0 ;;
+esac
+cp "$input" "$prev"
+`
+
+/**
+ * Put fake ffmpeg and ffprobe first on PATH for the rest of the test
+ * ffprobe answers with probeJSON, ffmpeg passes its input through. Enough
+ * to run the pipeline without the real tools; skipped where there is no sh
+ */
+func installFakeProcessingTools(t *testing.T, probeJSON string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake processing tools are shell scripts")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"ffprobe":    fakeFFprobe,
+		"ffmpeg":     fakeFFmpeg,
+		"probe.json": probeJSON,
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// installFakeTool puts a shell script named name first on PATH, ahead of
+// any fake installed before.
+func installFakeTool(t *testing.T, name, script string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake processing tools are shell scripts")
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestParseToolVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+		wantOK bool
+	}{
+		{output: "ffmpeg version 6.1.1-3ubuntu5 Copyright (c) 2000-2023 the FFmpeg developers\nbuilt with gcc 13", want: "6.1.1", wantOK: true},
+		{output: "ffmpeg version n7.0 Copyright (c) 2000-2024", want: "7.0", wantOK: true},
+		{output: "ffmpeg version 4.4.2-0ubuntu0.22.04.1", want: "4.4.2", wantOK: true},
+		{output: "ffmpeg version N-113000-g1234abcd Copyright", wantOK: false},
+		{output: "avconv version 12", wantOK: false},
+		{output: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := parseToolVersion(tt.output, "ffmpeg")
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseToolVersion(%q) = %q, %v, want %q, %v", tt.output, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "6.1.1", b: "6.1", want: 1},
+		{a: "6.0", b: "6", want: 0},
+		{a: "4.4.2", b: "5.0", want: -1},
+		{a: "10.0", b: "9.9", want: 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("compareVersions(%s, %s) = %d, want the sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckProcessingTools(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub tools are shell scripts")
+	}
+	tests := []struct {
+		name       string
+		tools      map[string]string
+		minVersion string
+		wantErr    string
+	}{
+		{name: "installed", tools: map[string]string{"ffmpeg": "6.1.1", "ffprobe": "6.1.1"}},
+		{name: "new enough", tools: map[string]string{"ffmpeg": "n6.1", "ffprobe": "6.1.1"}, minVersion: "6.0"},
+		{name: "too old", tools: map[string]string{"ffmpeg": "6.1.1", "ffprobe": "4.4.2"}, minVersion: "6.0", wantErr: "ffprobe is version 4.4.2, need at least 6.0"},
+		{name: "git build", tools: map[string]string{"ffmpeg": "N-113000-g1234abcd", "ffprobe": "N-113000-g1234abcd"}, minVersion: "6.0"},
+		{name: "no ffprobe", tools: map[string]string{"ffmpeg": "6.1.1"}, wantErr: "ffprobe not found on PATH"},
+		{name: "no tools", wantErr: "ffmpeg not found on PATH"},
+		{name: "broken", tools: map[string]string{"ffmpeg": ""}, wantErr: "ffmpeg -version failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, version := range tt.tools {
+				script := "#!/bin/sh\necho \"" + name + " version " + version + " Copyright (c) 2000-2024\"\n"
+				if version == "" {
+					script = "#!/bin/sh\nexit 1\n"
+				}
+				err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", dir)
+			cfg := &apiConfig{toolLookup: newToolLookup()}
+
+			err := cfg.checkProcessingTools(context.Background(), tt.minVersion)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkProcessingTools: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkProcessingTools error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
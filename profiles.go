@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const defaultProfileName = "default"
+
+// processingProfile is a named set of processing options an upload can ask
+// for with the "profile" form field.
+type processingProfile struct {
+	Name string
+	// Deadline caps the total time spent processing one upload
+	Deadline time.Duration
+	// Format is the container processed videos are stored in
+	Format outputFormat
+}
+
+/**
+ * Parse PROCESSING_PROFILES, e.g. "default:15m,long:1h,stream:30m:hls"
+ * Each profile is name:deadline with an optional :format (mp4, webm or hls,
+ * mp4 when left out). The default profile always exists and uses
+ * defaultDeadline and defaultFormat unless listed
+ */
+func parseProcessingProfiles(value string, defaultDeadline time.Duration, defaultFormat string) (map[string]processingProfile, error) {
+	format, ok := outputFormats[defaultFormat]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", defaultFormat)
+	}
+	profiles := map[string]processingProfile{
+		defaultProfileName: {Name: defaultProfileName, Deadline: defaultDeadline, Format: format},
+	}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid processing profile %q", part)
+		}
+		name := strings.TrimSpace(fields[0])
+		deadline, err := time.ParseDuration(strings.TrimSpace(fields[1]))
+		if err != nil || deadline <= 0 {
+			return nil, fmt.Errorf("invalid deadline for profile %s: %q", name, fields[1])
+		}
+		formatName := defaultOutputFormat
+		if len(fields) == 3 {
+			formatName = strings.TrimSpace(fields[2])
+		}
+		format, ok := outputFormats[formatName]
+		if !ok {
+			return nil, fmt.Errorf("unknown output format %q for profile %s", formatName, name)
+		}
+		profiles[name] = processingProfile{Name: name, Deadline: deadline, Format: format}
+	}
+	return profiles, nil
+}
+
+// processingProfileFor looks up a profile by name; "" is the default.
+func (cfg *apiConfig) processingProfileFor(name string) (processingProfile, bool) {
+	if name == "" {
+		name = defaultProfileName
+	}
+	profile, ok := cfg.processingProfiles[name]
+	return profile, ok
+}
+
+/**
+ * Remove an asset this request stored for a video that then wasn't saved
+ * The upload's reservation of a shared object is dropped; the object stays
+ * while any video, this one's saved row included, references it. A failed
+ * delete leaves an object nothing references, logged so it can be swept
+ * up later
+ */
+func (cfg *apiConfig) rollbackAsset(ctx context.Context, url string, videoID uuid.UUID) {
+	err := cfg.db.ReleaseAssetReference(url, videoID)
+	if err == nil {
+		err = cfg.deleteAssetIfUnreferenced(ctx, url)
+	}
+	if err != nil {
+		log.Printf("ERROR: orphaned asset %s of video %s, couldn't roll it back: %v", url, videoID, err)
+		return
+	}
+	log.Printf("Rolled back asset %s of unsaved video %s", url, videoID)
+}
+
+/**
+ * Respond to a failed processing step
+ * When the upload's deadline is what stopped it, the client gets a 504
+ * instead of the step's own error, and a 422 when one ffmpeg or ffprobe
+ * run hung past processTimeout
+ */
+func respondWithProcessingError(w http.ResponseWriter, procCtx context.Context, code int, msg string, err error) {
+	if errors.Is(procCtx.Err(), context.DeadlineExceeded) {
+		respondWithError(w, http.StatusGatewayTimeout, "Processing took longer than allowed", err)
+		return
+	}
+	if errors.Is(err, errProcessTimeout) {
+		respondWithError(w, http.StatusUnprocessableEntity, "Video processing timed out", err)
+		return
+	}
+	respondWithError(w, code, msg, err)
+}
+
+/**
+ * Clean up after an upload that didn't make it to the database
+ * Assets stored along the way are removed. If the deadline was hit the video
+ * is marked failed so clients don't wait for it
+ */
+func (cfg *apiConfig) abortUpload(procCtx context.Context, videoID uuid.UUID, createdAssets []string) {
+	// procCtx is often what ran out
+	cleanupCtx, cancel := cleanupContext()
+	defer cancel()
+	for _, url := range createdAssets {
+		cfg.rollbackAsset(cleanupCtx, url, videoID)
+	}
+	if !errors.Is(procCtx.Err(), context.DeadlineExceeded) {
+		return
+	}
+	log.Printf("Upload of video %s hit its processing deadline", videoID)
+	err := cfg.db.SetVideoStatus(videoID, database.VideoStatusFailed)
+	if err != nil {
+		log.Printf("Couldn't mark video %s failed: %v", videoID, err)
+	}
+	cfg.webhooks.dispatch(webhookEventFailed, videoID, map[string]string{"stage": "deadline"})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestUploadVideoProcessingDeadline(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Conversion outlasts the quick profile's deadline
+	installFakeTool(t, "ffmpeg", `exec sleep 5
+`)
+	tests := []struct {
+		profile    string
+		wantCode   int
+		wantStatus string
+	}{
+		{profile: "quick", wantCode: http.StatusGatewayTimeout, wantStatus: database.VideoStatusFailed},
+		// Only the one hung run fails, the video isn't marked
+		{profile: "slow", wantCode: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			profiles, err := parseProcessingProfiles("quick:200ms,slow:1m", time.Minute, "mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.processingProfiles = profiles
+			// A single run is cut short well before the slow deadline
+			cfg.processTimeout = 500 * time.Millisecond
+
+			req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+			req.URL.RawQuery = url.Values{"profile": {tt.profile}}.Encode()
+			w := httptest.NewRecorder()
+			start := time.Now()
+			cfg.handlerUploadVideo(w, req)
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("upload took %s, want it stopped at its deadline", elapsed)
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if len(store.objects) != 0 {
+				t.Errorf("aborted upload left %d files behind", len(store.objects))
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.VideoURL != nil {
+				t.Errorf("aborted upload was saved as %s", *stored.VideoURL)
+			}
+			status := ""
+			if stored.Status != nil {
+				status = *stored.Status
+			}
+			if status != tt.wantStatus {
+				t.Errorf("video status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAbortUploadAfterDeadline(t *testing.T) {
+	cfg, store, video, _ := newS3Test(t)
+	err := store.put(context.Background(), "thumbnails/abandoned.jpg", strings.NewReader("jpeg"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	procCtx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-procCtx.Done()
+
+	cfg.abortUpload(procCtx, video.ID, []string{cfg.assetURLForObject(cfg.s3Bucket, "thumbnails/abandoned.jpg")})
+	if _, ok := store.objects["thumbnails/abandoned.jpg"]; ok {
+		t.Error("asset stored before the deadline wasn't rolled back")
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status == nil || *stored.Status != database.VideoStatusFailed {
+		t.Errorf("video status = %v, want %s", stored.Status, database.VideoStatusFailed)
+	}
+}
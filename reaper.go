@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// reaperBatchSize caps how many videos one reaper pass deletes.
+const reaperBatchSize = 100
+
+/**
+ * Periodically delete videos that are due for removal
+ * Each pass removes the S3/disk assets first and the row after, so a failed
+ * asset delete is retried on the next pass
+ */
+func (cfg *apiConfig) startReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			cfg.reapExpiredVideos(time.Now())
+		}
+	}()
+}
+
+func (cfg *apiConfig) reapExpiredVideos(now time.Time) {
+	videos, err := cfg.db.GetExpiredVideos(now, reaperBatchSize)
+	if err != nil {
+		log.Printf("Reaper couldn't list expired videos: %v", err)
+		return
+	}
+	for _, video := range videos {
+		ctx, cancel := cleanupContext()
+		err := cfg.deleteVideoAssets(ctx, video)
+		cancel()
+		if err != nil {
+			log.Printf("Reaper couldn't delete assets of video %s: %v", video.ID, err)
+			continue
+		}
+		err = cfg.db.DeleteVideo(video.ID)
+		if err != nil {
+			log.Printf("Reaper couldn't delete video %s: %v", video.ID, err)
+			continue
+		}
+		log.Printf("Reaper deleted expired video %s", video.ID)
+		cfg.webhooks.dispatch(webhookEventDeleted, video.ID, map[string]string{"reason": "expired"})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestUploadVideoExpiresIn(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tests := []struct {
+		expiresIn string
+		wantCode  int
+		wantTTL   time.Duration
+	}{
+		{expiresIn: "", wantCode: http.StatusOK},
+		{expiresIn: "1h", wantCode: http.StatusOK, wantTTL: time.Hour},
+		{expiresIn: "-1h", wantCode: http.StatusBadRequest},
+		{expiresIn: "a day", wantCode: http.StatusBadRequest},
+		{expiresIn: "169h", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		cfg, _, video, token := newS3Test(t)
+		cfg.maxVideoTTL = 7 * 24 * time.Hour
+
+		req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+		req.URL.RawQuery = url.Values{"expiresIn": {tt.expiresIn}}.Encode()
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("expiresIn %q: status = %d, want %d: %s", tt.expiresIn, w.Code, tt.wantCode, w.Body)
+			continue
+		}
+		stored, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.wantTTL == 0 {
+			if stored.ExpiresAt != nil {
+				t.Errorf("expiresIn %q: video expires at %s, want never", tt.expiresIn, stored.ExpiresAt)
+			}
+			continue
+		}
+		if stored.ExpiresAt == nil {
+			t.Errorf("expiresIn %q: video never expires", tt.expiresIn)
+		} else if until := time.Until(*stored.ExpiresAt); until > tt.wantTTL || until < tt.wantTTL-time.Minute {
+			t.Errorf("expiresIn %q: video expires in %s", tt.expiresIn, until)
+		}
+	}
+}
+
+func TestVideoGetAfterExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		wantCode  int
+	}{
+		{name: "not yet expired", expiresIn: time.Hour, wantCode: http.StatusOK},
+		{name: "expired", expiresIn: -time.Second, wantCode: http.StatusGone},
+	}
+	for _, tt := range tests {
+		cfg, _, video, token := newS3Test(t)
+		expiresAt := time.Now().UTC().Add(tt.expiresIn)
+		video.ExpiresAt = &expiresAt
+		err := cfg.db.UpdateVideo(video)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		cfg.handlerVideoGet(w, newVideoRequest(http.MethodGet, "/api/videos/"+video.ID.String(), video, token, ""))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+	}
+}
+
+func TestReapExpiredVideos(t *testing.T) {
+	cfg, store, video, _ := newS3Test(t)
+	kept, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "kept", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []*database.Video{&video, &kept} {
+		key := fmt.Sprintf("landscape/%d.mp4", i)
+		store.objects[key] = []byte("video")
+		videoURL := cfg.s3CfDistribution + "/" + key
+		v.VideoURL = &videoURL
+	}
+	expired := time.Now().UTC().Add(-time.Minute)
+	video.ExpiresAt = &expired
+	later := time.Now().UTC().Add(time.Hour)
+	kept.ExpiresAt = &later
+	for _, v := range []database.Video{video, kept} {
+		err := cfg.db.UpdateVideo(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.reapExpiredVideos(time.Now())
+
+	if reaped, err := cfg.db.GetVideo(video.ID); err == nil && reaped.ID != uuid.Nil {
+		t.Error("expired video is still stored")
+	}
+	if _, ok := store.objects["landscape/0.mp4"]; ok {
+		t.Error("expired video's file is still in the bucket")
+	}
+	if stillThere, err := cfg.db.GetVideo(kept.ID); err != nil || stillThere.ID != kept.ID {
+		t.Errorf("unexpired video was reaped: %v", err)
+	}
+	if _, ok := store.objects["landscape/1.mp4"]; !ok {
+		t.Error("unexpired video's file was deleted")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) replicationEnabled() bool {
+	return cfg.replicaClient != nil && cfg.replicaBucket != ""
+}
+
+const jobTypeReplicate = "replicate"
+
+type replicatePayload struct {
+	Key string `json:"key"`
+}
+
+/**
+ * Copy an uploaded object to the secondary region bucket
+ * Runs as a queued job; the queue retries with backoff and the outcome is
+ * recorded on the video row
+ */
+func (cfg *apiConfig) runReplicateJob(ctx context.Context, job database.Job) error {
+	payload := replicatePayload{}
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return err
+	}
+
+	copySource := url.PathEscape(cfg.s3Bucket) + "/" + url.PathEscape(payload.Key)
+	_, err = cfg.replicaClient.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &cfg.replicaBucket,
+		Key:        &payload.Key,
+		CopySource: &copySource,
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.db.SetReplicationStatus(job.VideoID, database.ReplicationReplicated)
+}
+
+func (cfg *apiConfig) replicateJobFailed(job database.Job, err error) {
+	if err := cfg.db.SetReplicationStatus(job.VideoID, database.ReplicationFailed); err != nil {
+		log.Printf("Couldn't record replication status for video %s: %v", job.VideoID, err)
+	}
+}
+
+// replicateObject queues a copy of key to the replica bucket.
+func (cfg *apiConfig) replicateObject(videoID uuid.UUID, key string) {
+	_, err := cfg.jobs.enqueue(jobTypeReplicate, videoID, replicatePayload{Key: key})
+	if err != nil {
+		log.Printf("Couldn't queue replication of %s: %v", key, err)
+		cfg.replicateJobFailed(database.Job{VideoID: videoID}, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// fakeReplica records the copies made into a secondary region bucket.
+type fakeReplica struct {
+	mu     sync.Mutex
+	copies map[string]string
+	fail   bool
+}
+
+func newFakeReplica(t *testing.T, cfg *apiConfig) *fakeReplica {
+	const bucket = "tubely-replica"
+	replica := &fakeReplica{copies: map[string]string{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replica.mu.Lock()
+		defer replica.mu.Unlock()
+		source := r.Header.Get("X-Amz-Copy-Source")
+		if r.Method != http.MethodPut || source == "" || replica.fail {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		source, _ = url.PathUnescape(source)
+		replica.copies[strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")] = source
+		w.Write([]byte("<CopyObjectResult><ETag>\"fake\"</ETag></CopyObjectResult>"))
+	}))
+	t.Cleanup(server.Close)
+	cfg.replicaClient = newEndpointS3Client(server.URL)
+	cfg.replicaBucket = bucket
+	return replica
+}
+
+func TestReplicateObject(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       bool
+		wantStatus string
+	}{
+		{name: "replicated", wantStatus: database.ReplicationReplicated},
+		{name: "replica unavailable", fail: true, wantStatus: database.ReplicationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, _ := newS3Test(t)
+			cfg.jobs = newJobQueue(cfg.db, time.Minute, time.Hour)
+			cfg.jobs.register(jobTypeReplicate, jobType{run: cfg.runReplicateJob, maxAttempts: 1, failed: cfg.replicateJobFailed})
+			replica := newFakeReplica(t, cfg)
+			replica.fail = tt.fail
+			const key = "landscape/video.mp4"
+
+			cfg.replicateObject(video.ID, key)
+			if !cfg.jobs.runNext() {
+				t.Fatal("no replication job was queued")
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.ReplicationStatus == nil || *stored.ReplicationStatus != tt.wantStatus {
+				t.Errorf("replication status = %v, want %s", stored.ReplicationStatus, tt.wantStatus)
+			}
+			if tt.fail {
+				return
+			}
+			if source := replica.copies[key]; source != cfg.s3Bucket+"/"+key {
+				t.Errorf("replica copy of %s came from %q, want the primary bucket's", key, source)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// resolutionRendition is a rendition size, by the video's shorter side so
+// portrait videos get the same ladder.
+type resolutionRendition struct {
+	Name   string
+	Height int
+}
+
+var resolutionLadder = []resolutionRendition{
+	{Name: "1080p", Height: 1080},
+	{Name: "720p", Height: 720},
+	{Name: "480p", Height: 480},
+}
+
+// renditionsFor lists the ladder sizes a source can fill without upscaling.
+func renditionsFor(geometry videoGeometry) []resolutionRendition {
+	shortSide := min(geometry.Width, geometry.Height)
+	renditions := []resolutionRendition{}
+	for _, rendition := range resolutionLadder {
+		if rendition.Height <= shortSide {
+			renditions = append(renditions, rendition)
+		}
+	}
+	return renditions
+}
+
+// scaleFilter sizes the shorter side to height, keeping the aspect ratio
+// with an even length for the other side.
+func (r resolutionRendition) scaleFilter(geometry videoGeometry) string {
+	if geometry.Height > geometry.Width {
+		return fmt.Sprintf("scale=%d:-2", r.Height)
+	}
+	return fmt.Sprintf("scale=-2:%d", r.Height)
+}
+
+/**
+ * Encode and upload the resolution renditions of a video
+ * Encodes run in parallel but each waits for one of the renditionSlots, so
+ * the server never runs more than RENDITION_CONCURRENCY of them. Keys are
+ * prefix/<name>/<rendition>.mp4. On error the renditions uploaded so far
+ * are deleted again
+ */
+func (cfg *apiConfig) generateResolutionRenditions(ctx context.Context, filePath, bucket, prefix string) (database.StringMap, error) {
+	geometry, err := getVideoGeometry(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't probe video geometry: %w", err)
+	}
+	name, err := randomAssetName()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	renditions := database.StringMap{}
+	errs := []error{}
+	for _, rendition := range renditionsFor(geometry) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url, err := cfg.encodeResolutionRendition(ctx, filePath, bucket, fmt.Sprintf("%s/%s/%s.mp4", prefix, name, rendition.Name), rendition, geometry)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", rendition.Name, err))
+				return
+			}
+			renditions[rendition.Name] = url
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+		cfg.deleteResolutionRenditions(cleanupCtx, renditions, nil)
+		return nil, errors.Join(errs...)
+	}
+	return renditions, nil
+}
+
+func (cfg *apiConfig) encodeResolutionRendition(ctx context.Context, filePath, bucket, key string, rendition resolutionRendition, geometry videoGeometry) (string, error) {
+	select {
+	case cfg.renditionSlots <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-cfg.renditionSlots }()
+
+	outputPath := fmt.Sprintf("%s.%s.mp4", filePath, rendition.Name)
+	defer os.Remove(outputPath)
+	args := []string{"-y", "-i", filePath, "-vf", rendition.scaleFilter(geometry)}
+	args = append(args, reencodeCodecs["h264"].args...)
+	err := runFFmpeg(ctx, append(args, outputPath)...)
+	if err != nil {
+		return "", err
+	}
+	err = cfg.uploadFileToBucket(ctx, bucket, key, outputPath, "video/mp4")
+	if err != nil {
+		return "", err
+	}
+	return cfg.assetURLForObject(bucket, key), nil
+}
+
+// deleteResolutionRenditions removes the renditions in old that current no
+// longer points at, best effort.
+func (cfg *apiConfig) deleteResolutionRenditions(ctx context.Context, old, current database.StringMap) {
+	for name, url := range old {
+		if current[name] == url {
+			continue
+		}
+		err := cfg.deleteAssetByURL(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't delete %s rendition %s: %v", name, url, err)
+		}
+	}
+}
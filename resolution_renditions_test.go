@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRenditionsFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry videoGeometry
+		want     []string
+	}{
+		{name: "1080p", geometry: videoGeometry{Width: 1920, Height: 1080}, want: []string{"1080p", "720p", "480p"}},
+		{name: "720p", geometry: videoGeometry{Width: 1280, Height: 720}, want: []string{"720p", "480p"}},
+		{name: "480p", geometry: videoGeometry{Width: 854, Height: 480}, want: []string{"480p"}},
+		{name: "portrait 480p", geometry: videoGeometry{Width: 480, Height: 854}, want: []string{"480p"}},
+		{name: "360p", geometry: videoGeometry{Width: 640, Height: 360}, want: []string{}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, rendition := range renditionsFor(tt.geometry) {
+			got = append(got, rendition.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: renditions = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadVideoResolutionRenditions(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  string
+		height string
+		want   []string
+	}{
+		{name: "480p source", width: "854", height: "480", want: []string{"480p"}},
+		{name: "720p source", width: "1280", height: "720", want: []string{"480p", "720p"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe := strings.Replace(fakeProbeOutput, `"width": 1280, "height": 720`, `"width": `+tt.width+`, "height": `+tt.height, 1)
+			installFakeProcessingTools(t, probe)
+			cfg, store, video, token := newS3Test(t)
+			cfg.resolutionRenditions = true
+			cfg.renditionSlots = make(chan struct{}, 1)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for name, renditionURL := range stored.ResolutionRenditions {
+				got = append(got, name)
+				key, _ := cfg.s3KeyFromURL(renditionURL)
+				if !strings.HasPrefix(key, "landscape/") || !strings.HasSuffix(key, "/"+name+".mp4") {
+					t.Errorf("%s rendition stored at %s, want landscape/<name>/%s.mp4", name, key, name)
+				}
+				if _, ok := store.objects[key]; !ok {
+					t.Errorf("%s rendition %s wasn't uploaded", name, key)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("renditions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
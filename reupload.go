@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// isFullyProcessed reports whether a video has been published and has
+// assets derived from its upload that a re-upload would leave behind.
+func isFullyProcessed(video database.Video) bool {
+	if video.VideoURL == nil || (video.Status != nil && *video.Status != database.VideoStatusReady) {
+		return false
+	}
+	return len(video.CodecRenditions) > 0 || len(video.ResolutionRenditions) > 0 || len(video.ThumbnailCandidates) > 0 || len(video.Captions) > 0
+}
+
+/**
+ * Apply PROTECT_PROCESSED_VIDEOS to a new upload for video
+ * Replacing a processed video needs ?force=true; without it the 409 is
+ * written and ok is false. forced reports that the upload replaces one
+ */
+func (cfg *apiConfig) allowReupload(w http.ResponseWriter, r *http.Request, video database.Video) (forced bool, ok bool) {
+	if !cfg.protectProcessedVideos || !isFullyProcessed(video) {
+		return false, true
+	}
+	if r.URL.Query().Get("force") != "true" {
+		respondWithError(w, http.StatusConflict, "Video is already processed, re-upload with force=true to replace it", nil)
+		return false, false
+	}
+	return true, true
+}
+
+/**
+ * Delete what a forced re-upload replaced
+ * previous is the video before the re-upload. The old upload (with its
+ * segments) and its codec renditions go; candidates and captions are
+ * already swapped out by the upload itself
+ */
+func (cfg *apiConfig) cleanupReuploadedVideo(ctx context.Context, video database.Video, previous database.Video) {
+	urls := []string{}
+	if previous.VideoURL != nil && (video.VideoURL == nil || *previous.VideoURL != *video.VideoURL) {
+		urls = append(urls, *previous.VideoURL)
+	}
+	for _, url := range previous.CodecRenditions {
+		urls = append(urls, url)
+	}
+	for _, url := range urls {
+		err := cfg.deleteAssetIfUnreferenced(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't delete replaced asset %s of video %s: %v", url, video.ID, err)
+		}
+	}
+}
+
+/**
+ * Clear what was derived from the upload a new one replaces
+ * For pipelines that don't regenerate them, so the video doesn't keep
+ * renditions, candidates, storyboards or embedded captions of other content.
+ * Thumbnails and captions the owner uploaded stay
+ */
+func dropDerivedAssets(video *database.Video) {
+	if video.ThumbnailURL != nil && slices.Contains(video.ThumbnailCandidates, *video.ThumbnailURL) {
+		video.ThumbnailURL = nil
+		video.ThumbnailVariants = nil
+		video.LQIP = nil
+	}
+	video.ThumbnailCandidates = nil
+	video.CodecRenditions = nil
+	video.ResolutionRenditions = nil
+	video.ContactSheetURL = nil
+	video.StoryboardURL, video.StoryboardSpriteURL = nil, nil
+	captions := database.Captions{}
+	for _, caption := range video.Captions {
+		if caption.Source != captionSourceEmbedded {
+			captions = append(captions, caption)
+		}
+	}
+	video.Captions = captions
+}
+
+/**
+ * Delete the assets of previous that a re-upload replaced
+ * Call once video is saved. Anything video still points at is kept; forced
+ * re-uploads also drop the old upload and its codec renditions
+ */
+func (cfg *apiConfig) cleanupReplacedAssets(ctx context.Context, video, previous database.Video, forced bool) {
+	if forced {
+		cfg.cleanupReuploadedVideo(ctx, video, previous)
+	}
+	cfg.invalidateReplacedVideo(ctx, previous)
+	cfg.cleanupReplacedCandidates(ctx, video, previous.ThumbnailCandidates)
+	cfg.deleteResolutionRenditions(ctx, previous.ResolutionRenditions, video.ResolutionRenditions)
+
+	replaced := storyboardURLs(previous)
+	if previous.ContactSheetURL != nil {
+		replaced = append(replaced, *previous.ContactSheetURL)
+	}
+	for _, caption := range previous.Captions {
+		if caption.Source == captionSourceEmbedded {
+			replaced = append(replaced, caption.URL)
+		}
+	}
+	current := videoAssetURLs(video)
+	for _, url := range replaced {
+		if slices.Contains(current, url) {
+			continue
+		}
+		err := cfg.deleteAssetByURL(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't delete replaced asset %s of video %s: %v", url, video.ID, err)
+		}
+	}
+}
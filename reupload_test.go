@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestCleanupReplacedAssets(t *testing.T) {
+	cfg, store, video, _ := newS3Test(t)
+	keys := []string{
+		"landscape/old.mp4",
+		"landscape/old.av1.mp4",
+		"landscape/old.480p.mp4",
+		"thumbnails/candidate-0.jpg",
+		"thumbnails/candidate-1.jpg",
+		"thumbnails/owner.jpg",
+		"sheets/old.jpg",
+		"storyboards/old.vtt",
+		"storyboards/old.jpg",
+		"captions/embedded.vtt",
+		"captions/owner.vtt",
+		"landscape/new.mp4",
+	}
+	url := func(key string) string {
+		return cfg.assetURLForObject(cfg.s3Bucket, key)
+	}
+	ptr := func(key string) *string {
+		u := url(key)
+		return &u
+	}
+
+	tests := []struct {
+		name      string
+		thumbnail string
+		wantKept  []string
+	}{
+		{
+			name:      "owner thumbnail",
+			thumbnail: "thumbnails/owner.jpg",
+			wantKept:  []string{"thumbnails/owner.jpg", "captions/owner.vtt", "landscape/new.mp4"},
+		},
+		{
+			name:      "candidate poster",
+			thumbnail: "thumbnails/candidate-1.jpg",
+			wantKept:  []string{"thumbnails/owner.jpg", "captions/owner.vtt", "landscape/new.mp4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range keys {
+				store.objects[key] = []byte(key)
+			}
+			ready := database.VideoStatusReady
+			previous := video
+			previous.Status = &ready
+			previous.VideoURL = ptr("landscape/old.mp4")
+			previous.CodecRenditions = database.StringMap{"av1": url("landscape/old.av1.mp4")}
+			previous.ResolutionRenditions = database.StringMap{"480p": url("landscape/old.480p.mp4")}
+			previous.ThumbnailCandidates = []string{url("thumbnails/candidate-0.jpg"), url("thumbnails/candidate-1.jpg")}
+			previous.ThumbnailURL = ptr(tt.thumbnail)
+			previous.ContactSheetURL = ptr("sheets/old.jpg")
+			previous.StoryboardURL, previous.StoryboardSpriteURL = ptr("storyboards/old.vtt"), ptr("storyboards/old.jpg")
+			previous.Captions = database.Captions{
+				{Language: "en", URL: url("captions/embedded.vtt"), Source: captionSourceEmbedded},
+				{Language: "de", URL: url("captions/owner.vtt"), Source: captionSourceUpload},
+			}
+
+			replaced := previous
+			dropDerivedAssets(&replaced)
+			replaced.VideoURL = ptr("landscape/new.mp4")
+			err := cfg.db.UpdateVideo(replaced)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced.ThumbnailURL != nil && *replaced.ThumbnailURL != url("thumbnails/owner.jpg") {
+				t.Errorf("thumbnail after the re-upload = %s, want the owner's or none", *replaced.ThumbnailURL)
+			}
+			if len(replaced.Captions) != 1 || replaced.Captions[0].Source != captionSourceUpload {
+				t.Errorf("captions after the re-upload = %+v, want only the owner's", replaced.Captions)
+			}
+
+			cfg.cleanupReplacedAssets(context.Background(), replaced, previous, true)
+			kept := map[string]bool{}
+			for _, key := range tt.wantKept {
+				kept[key] = true
+			}
+			for _, key := range keys {
+				_, stored := store.objects[key]
+				if stored != kept[key] {
+					t.Errorf("%s stored = %v, want %v", key, stored, kept[key])
+				}
+			}
+		})
+	}
+}
+
+func TestIsFullyProcessed(t *testing.T) {
+	ready := database.VideoStatusReady
+	uploaded := database.VideoStatusUploaded
+	videoURL := "https://cdn.example.com/landscape/a.mp4"
+	tests := []struct {
+		name  string
+		video database.Video
+		want  bool
+	}{
+		{name: "not uploaded", video: database.Video{}, want: false},
+		{name: "uploaded only", video: database.Video{VideoURL: &videoURL, Status: &ready}, want: false},
+		{name: "with renditions", video: database.Video{VideoURL: &videoURL, Status: &ready, CodecRenditions: database.StringMap{"av1": videoURL}}, want: true},
+		{name: "not ready", video: database.Video{VideoURL: &videoURL, Status: &uploaded, CodecRenditions: database.StringMap{"av1": videoURL}}, want: false},
+		{name: "with candidates", video: database.Video{VideoURL: &videoURL, ThumbnailCandidates: []string{videoURL}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isFullyProcessed(tt.video); got != tt.want {
+				t.Errorf("isFullyProcessed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadVideoProtectsProcessed(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tests := []struct {
+		name     string
+		protect  bool
+		query    string
+		wantCode int
+	}{
+		{name: "processed without force", protect: true, wantCode: http.StatusConflict},
+		{name: "processed with force", protect: true, query: "force=true", wantCode: http.StatusOK},
+		{name: "force not true", protect: true, query: "force=1", wantCode: http.StatusConflict},
+		{name: "protection off", protect: false, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, video, token := newS3Test(t)
+			cfg.protectProcessedVideos = tt.protect
+			ready := database.VideoStatusReady
+			videoURL := cfg.s3CfDistribution + "/landscape/a.mp4"
+			video.VideoURL = &videoURL
+			video.Status = &ready
+			video.CodecRenditions = database.StringMap{"av1": cfg.s3CfDistribution + "/landscape/a.av1.mp4"}
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+			req.URL.RawQuery = tt.query
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
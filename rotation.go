@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// probeSideData is a stream's side_data_list entry as reported by ffprobe.
+// Phones record their orientation as a display matrix rotation.
+type probeSideData struct {
+	Rotation float64 `json:"rotation"`
+}
+
+/**
+ * Get how far a stream is rotated for display, in degrees from 0 to 359
+ * The display matrix wins over the rotate tag older ffmpeg versions wrote.
+ * A display matrix of -90 and a rotate tag of 270 mean the same turn
+ */
+func streamRotation(sideData []probeSideData, rotateTag string) int {
+	degrees := 0.0
+	found := false
+	for _, data := range sideData {
+		if data.Rotation != 0 {
+			degrees = data.Rotation
+			found = true
+			break
+		}
+	}
+	if !found {
+		tag, err := strconv.ParseFloat(rotateTag, 64)
+		if err != nil {
+			return 0
+		}
+		// The tag is clockwise, the display matrix counter-clockwise
+		degrees = -tag
+	}
+	return ((int(math.Round(degrees)) % 360) + 360) % 360
+}
+
+// isQuarterTurn reports whether rotation swaps width and height.
+func isQuarterTurn(rotation int) bool {
+	return rotation == 90 || rotation == 270
+}
+
+// swapAspectRatio turns "16:9" into "9:16".
+func swapAspectRatio(ratio string) string {
+	width, height, ok := strings.Cut(ratio, ":")
+	if !ok {
+		return ratio
+	}
+	return height + ":" + width
+}
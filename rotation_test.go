@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rotatedProbeOutput is fakeProbeOutput recorded by a phone held upright:
+// 1280x720 frames turned a quarter for display.
+var rotatedProbeOutput = strings.Replace(fakeProbeOutput, `"disposition"`,
+	`"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}], "disposition"`, 1)
+
+func TestStreamRotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		sideData  []probeSideData
+		rotateTag string
+		want      int
+	}{
+		{name: "none", want: 0},
+		{name: "display matrix -90", sideData: []probeSideData{{Rotation: -90}}, want: 270},
+		{name: "display matrix 90", sideData: []probeSideData{{Rotation: 90}}, want: 90},
+		{name: "display matrix 180", sideData: []probeSideData{{Rotation: 180}}, want: 180},
+		{name: "rotate tag 90", rotateTag: "90", want: 270},
+		{name: "rotate tag 270", rotateTag: "270", want: 90},
+		{name: "display matrix wins", sideData: []probeSideData{{}, {Rotation: -90}}, rotateTag: "90", want: 270},
+		{name: "unreadable tag", rotateTag: "sideways", want: 0},
+	}
+	for _, tt := range tests {
+		if got := streamRotation(tt.sideData, tt.rotateTag); got != tt.want {
+			t.Errorf("%s: streamRotation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetVideoAspectRatioRotated(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams string
+		want    string
+	}{
+		{name: "display matrix", streams: `{"codec_type": "video", "width": 1920, "height": 1080, "display_aspect_ratio": "16:9", "side_data_list": [{"rotation": -90}]}`, want: "9:16"},
+		{name: "rotate tag", streams: `{"codec_type": "video", "width": 1920, "height": 1080, "display_aspect_ratio": "16:9", "tags": {"rotate": "90"}}`, want: "9:16"},
+		{name: "coded size", streams: `{"codec_type": "video", "width": 1920, "height": 1080, "side_data_list": [{"rotation": 90}]}`, want: "9:16"},
+		{name: "upside down", streams: `{"codec_type": "video", "width": 1920, "height": 1080, "display_aspect_ratio": "16:9", "side_data_list": [{"rotation": 180}]}`, want: "16:9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeProcessingTools(t, `{"streams": [`+tt.streams+`]}`)
+			got, err := getVideoAspectRatio(context.Background(), writeTempFile(t, "upload.mp4", testMP4))
+			if err != nil || got != tt.want {
+				t.Errorf("getVideoAspectRatio = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadVideoRotated(t *testing.T) {
+	installFakeProcessingTools(t, rotatedProbeOutput)
+	installFakeTool(t, "ffmpeg", `case "$*" in
+*.processing) echo "$*" > "$FAKE_FFMPEG_REENCODE" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	tests := []struct {
+		name         string
+		apply        bool
+		wantReencode bool
+	}{
+		{name: "applied", apply: true, wantReencode: true},
+		{name: "left to players"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reencode := filepath.Join(t.TempDir(), "reencode")
+			t.Setenv("FAKE_FFMPEG_REENCODE", reencode)
+			cfg, _, video, token := newS3Test(t)
+			cfg.applyRotation = tt.apply
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := cfg.s3KeyFromURL(*stored.VideoURL)
+			if !strings.HasPrefix(key, "portrait/") {
+				t.Errorf("stored at %s, want under portrait/", key)
+			}
+			if stored.AspectRatio == nil || *stored.AspectRatio != "9:16" {
+				t.Errorf("aspect ratio = %v, want 9:16", stored.AspectRatio)
+			}
+			args, _ := os.ReadFile(reencode)
+			if reencoded := strings.Contains(string(args), "-c:v libx264"); reencoded != tt.wantReencode {
+				t.Errorf("re-encoded = %v with %q, want %v", reencoded, args, tt.wantReencode)
+			}
+		})
+	}
+}
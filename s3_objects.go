@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+/**
+ * Download an object from bucket into a temp file
+ * The caller is responsible for removing the file. Get bucket and key of a
+ * stored asset from s3ObjectFromURL
+ */
+func (cfg *apiConfig) downloadObjectFromBucket(ctx context.Context, bucket, key, pattern string) (string, error) {
+	body, err := cfg.getObject(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tmpFile, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, body)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// getObject opens an object for reading, from disk when the default bucket
+// is local.
+func (cfg *apiConfig) getObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	if cfg.local != nil && bucket == cfg.s3Bucket {
+		return cfg.local.open(key)
+	}
+	output, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+/**
+ * Upload a local file to bucket under key
+ * New assets of a video go to bucketForUser(video.UserID); the stored URL
+ * is then assetURLForObject(bucket, key)
+ */
+func (cfg *apiConfig) uploadFileToBucket(ctx context.Context, bucket, key, filePath, contentType string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return cfg.objectStoreFor(bucket).put(ctx, key, file, contentType)
+}
+
+// maxDeleteObjectsKeys is the most keys S3 takes in one DeleteObjects call.
+const maxDeleteObjectsKeys = 1000
+
+/**
+ * Delete keys from bucket in DeleteObjects batches
+ * Returns the error for each key that couldn't be deleted; a failed batch
+ * marks every key in it
+ */
+func deleteObjectsBatched(ctx context.Context, client *s3.Client, bucket string, keys []string) map[string]error {
+	failed := map[string]error{}
+	for start := 0; start < len(keys); start += maxDeleteObjectsKeys {
+		batch := keys[start:min(start+maxDeleteObjectsKeys, len(keys))]
+		objects := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			objects = append(objects, types.ObjectIdentifier{Key: &key})
+		}
+
+		output, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, key := range batch {
+				failed[key] = err
+			}
+			continue
+		}
+		for _, objectErr := range output.Errors {
+			if objectErr.Key == nil {
+				continue
+			}
+			failed[*objectErr.Key] = fmt.Errorf("%s: %s", aws.ToString(objectErr.Code), aws.ToString(objectErr.Message))
+		}
+	}
+	return failed
+}
+
+// deleteObjects deletes keys from bucket, file by file when the default
+// bucket is local. Returns the error for each key that couldn't be deleted.
+func (cfg *apiConfig) deleteObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	if cfg.local == nil || bucket != cfg.s3Bucket {
+		return deleteObjectsBatched(ctx, cfg.s3Client, bucket, keys)
+	}
+	failed := map[string]error{}
+	for _, key := range keys {
+		if err := cfg.local.delete(ctx, key); err != nil {
+			failed[key] = err
+		}
+	}
+	return failed
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+// isS3NotFound reports whether err means the requested object doesn't exist.
+func isS3NotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &notFound) || errors.As(err, &noSuchKey) || errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	var responseErr *smithyhttp.ResponseError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+/**
+ * Check that an object exists with HeadObject
+ * Results are cached for a short while so hot keys don't cost a request each time
+ */
+func (cfg *apiConfig) objectExists(ctx context.Context, bucket, key string) (bool, error) {
+	cacheKey := bucket + "/" + key
+	if cfg.existsCache != nil {
+		if exists, ok := cfg.existsCache.get(cacheKey); ok {
+			return exists, nil
+		}
+	}
+
+	exists, err := cfg.headObject(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	if cfg.existsCache != nil {
+		cfg.existsCache.add(cacheKey, exists)
+	}
+	return exists, nil
+}
+
+func (cfg *apiConfig) headObject(ctx context.Context, bucket, key string) (bool, error) {
+	if cfg.local != nil && bucket == cfg.s3Bucket {
+		return cfg.local.exists(key)
+	}
+	_, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// existsCache remembers HeadObject results for ttl, holding at most
+// capacity of them.
+type existsCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	capacity int
+	entries  map[string]existsCacheEntry
+}
+
+type existsCacheEntry struct {
+	exists    bool
+	expiresAt time.Time
+}
+
+func newExistsCache(ttl time.Duration, capacity int) *existsCache {
+	return &existsCache{ttl: ttl, capacity: capacity, entries: make(map[string]existsCacheEntry)}
+}
+
+func (c *existsCache) get(key string) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	if !time.Now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return false, false
+	}
+	return entry.exists, true
+}
+
+/**
+ * Remember a HeadObject result
+ * Expired entries are only swept once the cache is full; if that frees
+ * nothing, an arbitrary entry makes room
+ */
+func (c *existsCache) add(key string, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.capacity {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.capacity {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = existsCacheEntry{exists: exists, expiresAt: now.Add(c.ttl)}
+}
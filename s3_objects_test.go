@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestIsS3NotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no such key", err: fmt.Errorf("get: %w", &types.NoSuchKey{}), want: true},
+		{name: "not found", err: &types.NotFound{}, want: true},
+		{name: "404 response", err: &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}}, want: true},
+		{name: "403 response", err: &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusForbidden}}}, want: false},
+		{name: "other error", err: errors.New("connection reset"), want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isS3NotFound(tt.err); got != tt.want {
+				t.Errorf("isS3NotFound(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistsCacheCapacity(t *testing.T) {
+	cache := newExistsCache(time.Minute, 3)
+	for i := 0; i < 10; i++ {
+		cache.add(fmt.Sprintf("bucket/key-%d", i), true)
+		if len(cache.entries) > 3 {
+			t.Fatalf("cache holds %d entries, capacity is 3", len(cache.entries))
+		}
+	}
+	exists, ok := cache.get("bucket/key-9")
+	if !ok || !exists {
+		t.Errorf("get of the newest entry = %v, %v, want true, true", exists, ok)
+	}
+}
+
+func TestExistsCacheExpiry(t *testing.T) {
+	cache := newExistsCache(time.Millisecond, 10)
+	cache.add("bucket/key", false)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.get("bucket/key"); ok {
+		t.Error("expired entry was returned")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storage backends for the default bucket. Tenant buckets are always S3.
+const (
+	storageBackendS3    = "s3"
+	storageBackendGCS   = "gcs"
+	storageBackendLocal = "local"
+)
+
+// gcsXMLEndpoint is Cloud Storage's XML API. It speaks the S3 protocol to
+// clients signing with an HMAC key.
+const gcsXMLEndpoint = "https://storage.googleapis.com"
+
+// storageEndpoint is where the S3 client sends requests. An empty URL is
+// AWS itself.
+type storageEndpoint struct {
+	URL       string
+	PathStyle bool
+}
+
+/**
+ * Get the endpoint of a storage backend
+ * custom, from S3_ENDPOINT, sends S3 calls to MinIO or LocalStack during
+ * development. gcs writes and signs through the Cloud Storage client, but
+ * lookups, downloads and browser uploads still use the S3 client, so it
+ * points at the XML API and the AWS credential chain must hold an HMAC key.
+ * local keeps the default bucket on disk and never calls it, so any custom
+ * endpoint is left to tenant buckets
+ */
+func storageEndpointFor(backend string, custom storageEndpoint) (storageEndpoint, error) {
+	switch backend {
+	case storageBackendS3:
+	case storageBackendGCS:
+		if custom.URL == "" {
+			custom = storageEndpoint{URL: gcsXMLEndpoint, PathStyle: true}
+		}
+	case storageBackendLocal:
+	default:
+		return storageEndpoint{}, fmt.Errorf("unknown storage backend %q, want s3, gcs or local", backend)
+	}
+	if custom.URL == "" {
+		return storageEndpoint{PathStyle: custom.PathStyle}, nil
+	}
+	parsed, err := url.Parse(custom.URL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return storageEndpoint{}, fmt.Errorf("invalid S3 endpoint %q", custom.URL)
+	}
+	custom.URL = strings.TrimSuffix(custom.URL, "/")
+	return custom, nil
+}
+
+// clientOptions sends the S3 client's calls to endpoint.
+func (e storageEndpoint) clientOptions(o *s3.Options) {
+	if e.URL != "" {
+		o.BaseEndpoint = aws.String(e.URL)
+	}
+	o.UsePathStyle = e.PathStyle
+}
+
+/**
+ * Get the base of stored asset URLs when no CDN is configured
+ * Plain AWS has no default: S3_CF_DISTRO must be set. With S3_ENDPOINT the
+ * bucket is read straight from the endpoint, which only serves a publicly
+ * readable bucket; videos are still handed out as presigned URLs either way
+ */
+func (e storageEndpoint) assetBaseURL(bucket string) string {
+	if e.URL == "" {
+		return ""
+	}
+	if e.PathStyle {
+		return fmt.Sprintf("%s/%s", e.URL, bucket)
+	}
+	scheme, host, _ := strings.Cut(e.URL, "://")
+	return fmt.Sprintf("%s://%s.%s", scheme, bucket, host)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestStorageEndpointFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		custom  storageEndpoint
+		want    storageEndpoint
+		wantErr string
+	}{
+		{name: "aws", backend: "s3", want: storageEndpoint{}},
+		{name: "aws path style", backend: "s3", custom: storageEndpoint{PathStyle: true}, want: storageEndpoint{PathStyle: true}},
+		{name: "minio", backend: "s3", custom: storageEndpoint{URL: "http://localhost:9000/", PathStyle: true}, want: storageEndpoint{URL: "http://localhost:9000", PathStyle: true}},
+		{name: "bad endpoint", backend: "s3", custom: storageEndpoint{URL: "localhost:9000"}, wantErr: "invalid S3 endpoint"},
+		{name: "gcs", backend: "gcs", want: storageEndpoint{URL: gcsXMLEndpoint, PathStyle: true}},
+		{name: "gcs custom", backend: "gcs", custom: storageEndpoint{URL: "http://localhost:4443", PathStyle: true}, want: storageEndpoint{URL: "http://localhost:4443", PathStyle: true}},
+		{name: "local", backend: "local", want: storageEndpoint{}},
+		{name: "unknown", backend: "azure", wantErr: "unknown storage backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storageEndpointFor(tt.backend, tt.custom)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("storageEndpointFor error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("storageEndpointFor: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("storageEndpointFor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssetBaseURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint storageEndpoint
+		want     string
+	}{
+		{name: "aws", endpoint: storageEndpoint{}, want: ""},
+		{name: "path style", endpoint: storageEndpoint{URL: "http://localhost:9000", PathStyle: true}, want: "http://localhost:9000/tubely"},
+		{name: "virtual host", endpoint: storageEndpoint{URL: "https://s3.example.com"}, want: "https://tubely.s3.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.endpoint.assetBaseURL("tubely"); got != tt.want {
+				t.Errorf("assetBaseURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingHTTPClient answers every request with 200 and keeps its URL.
+type recordingHTTPClient struct {
+	urls []string
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.urls = append(c.urls, req.URL.String())
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+func TestStorageEndpointClientOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint storageEndpoint
+		wantURL  string
+	}{
+		{name: "minio path style", endpoint: storageEndpoint{URL: "http://localhost:9000", PathStyle: true}, wantURL: "http://localhost:9000/tubely/landscape/a.mp4"},
+		{name: "localstack virtual host", endpoint: storageEndpoint{URL: "http://localhost.localstack.cloud:4566"}, wantURL: "http://tubely.localhost.localstack.cloud:4566/landscape/a.mp4"},
+		{name: "aws", endpoint: storageEndpoint{}, wantURL: "https://tubely.s3.us-east-2.amazonaws.com/landscape/a.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient := &recordingHTTPClient{}
+			client := s3.New(s3.Options{
+				Region:     "us-east-2",
+				HTTPClient: httpClient,
+				Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+					return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+				}),
+			}, tt.endpoint.clientOptions)
+
+			_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+				Bucket: aws.String("tubely"),
+				Key:    aws.String("landscape/a.mp4"),
+				Body:   strings.NewReader("video"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(httpClient.urls) != 1 || strings.Split(httpClient.urls[0], "?")[0] != tt.wantURL {
+				t.Errorf("requested %v, want %s", httpClient.urls, tt.wantURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+/**
+ * Parse an S3 storage class name
+ * Only classes that serve reads straight away are accepted: GLACIER and
+ * DEEP_ARCHIVE objects have to be restored before they can be streamed
+ */
+func parseStorageClass(value string) (types.StorageClass, error) {
+	class := types.StorageClass(strings.ToUpper(strings.TrimSpace(value)))
+	switch class {
+	case types.StorageClassGlacier, types.StorageClassDeepArchive:
+		return "", fmt.Errorf("storage class %s can't be streamed without a restore", class)
+	case types.StorageClassOutposts, types.StorageClassSnow:
+		return "", fmt.Errorf("storage class %s isn't supported", class)
+	}
+	for _, known := range class.Values() {
+		if class == known {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("unknown storage class %q", value)
+}
+
+/**
+ * Get the storage class of a new object
+ * Only stored videos (video/* content outside raw/) are affected; raw
+ * uploads are deleted within minutes, and thumbnails, captions and other
+ * small assets are read all the time, so those stay STANDARD
+ */
+func storageClassFor(ctx context.Context, key, contentType string, class types.StorageClass) types.StorageClass {
+	if !strings.HasPrefix(contentType, "video/") || strings.HasPrefix(key, "raw/") {
+		return ""
+	}
+	if override := storageClassFrom(ctx); override != "" {
+		return override
+	}
+	return class
+}
+
+type storageClassKey struct{}
+
+// withStorageClass makes videos stored under ctx use class instead of the
+// configured one, e.g. for an archival upload.
+func withStorageClass(ctx context.Context, class types.StorageClass) context.Context {
+	if class == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, storageClassKey{}, class)
+}
+
+func storageClassFrom(ctx context.Context) types.StorageClass {
+	class, _ := ctx.Value(storageClassKey{}).(types.StorageClass)
+	return class
+}
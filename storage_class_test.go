@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseStorageClass(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    types.StorageClass
+		wantErr bool
+	}{
+		{value: "STANDARD_IA", want: types.StorageClassStandardIa},
+		{value: " glacier_ir ", want: types.StorageClassGlacierIr},
+		{value: "INTELLIGENT_TIERING", want: types.StorageClassIntelligentTiering},
+		{value: "GLACIER", wantErr: true},
+		{value: "DEEP_ARCHIVE", wantErr: true},
+		{value: "OUTPOSTS", wantErr: true},
+		{value: "COLD", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStorageClass(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseStorageClass(%q) = %q, %v, want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestS3ObjectStorePutStorageClass(t *testing.T) {
+	archival := withStorageClass(context.Background(), types.StorageClassGlacierIr)
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		key         string
+		contentType string
+		want        string
+	}{
+		{name: "video", ctx: context.Background(), key: "landscape/a.mp4", contentType: "video/mp4", want: "STANDARD_IA"},
+		{name: "archival video", ctx: archival, key: "landscape/a.mp4", contentType: "video/mp4", want: "GLACIER_IR"},
+		{name: "raw upload", ctx: archival, key: "raw/a.mp4", contentType: "video/mp4"},
+		{name: "thumbnail", ctx: archival, key: "thumbnails/a.png", contentType: "image/png"},
+		{name: "captions", ctx: context.Background(), key: "captions/a/en.vtt", contentType: "text/vtt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &putRecorder{}
+			server := httptest.NewServer(recorder)
+			t.Cleanup(server.Close)
+			store := s3ObjectStore{client: newEndpointS3Client(server.URL), bucket: "tubely-test", storageClass: types.StorageClassStandardIa}
+
+			err := store.put(tt.ctx, tt.key, strings.NewReader("content"), tt.contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recorder.header.Get("X-Amz-Storage-Class"); got != tt.want {
+				t.Errorf("storage class = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadVideoInvalidStorageClass(t *testing.T) {
+	cfg, store, video, token := newS3Test(t)
+
+	req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+	req.URL.RawQuery = url.Values{"storageClass": {"DEEP_ARCHIVE"}}.Encode()
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid storageClass") {
+		t.Errorf("status = %d, want 400 Invalid storageClass: %s", w.Code, w.Body)
+	}
+	if len(store.objects) != 0 {
+		t.Errorf("rejected upload stored %d files", len(store.objects))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// storyboardMaxTiles caps the sprite size; longer videos get a wider
+// interval instead of a taller image.
+const storyboardMaxTiles = 400
+
+// storyboardLayout is how the tiles of a sprite are placed.
+type storyboardLayout struct {
+	Interval   float64
+	Tiles      int
+	Columns    int
+	TileWidth  int
+	TileHeight int
+}
+
+func (l storyboardLayout) Rows() int {
+	return (l.Tiles + l.Columns - 1) / l.Columns
+}
+
+/**
+ * Work out the sprite layout for a video of duration seconds and width x height
+ * There is one tile per interval, starting at 0. The tile height keeps the
+ * frame's shape and is rounded to an even number for the JPEG encoder
+ */
+func newStoryboardLayout(duration float64, width, height int, interval time.Duration, tileWidth, columns int) (storyboardLayout, error) {
+	if duration <= 0 {
+		return storyboardLayout{}, errDurationUnknown
+	}
+	if width <= 0 || height <= 0 {
+		return storyboardLayout{}, fmt.Errorf("video has no frame size")
+	}
+	layout := storyboardLayout{
+		Interval:  interval.Seconds(),
+		Columns:   columns,
+		TileWidth: tileWidth,
+	}
+	layout.Tiles = int(math.Ceil(duration / layout.Interval))
+	if layout.Tiles > storyboardMaxTiles {
+		layout.Tiles = storyboardMaxTiles
+		layout.Interval = duration / storyboardMaxTiles
+	}
+	layout.Columns = min(layout.Columns, layout.Tiles)
+	layout.TileHeight = max(2, int(math.Round(float64(tileWidth)*float64(height)/float64(width)/2))*2)
+	return layout, nil
+}
+
+/**
+ * Write the WebVTT cues that map each interval to its tile in spriteName
+ * The sprite is referenced by name so it resolves next to the cue file
+ */
+func (l storyboardLayout) cues(spriteName string, duration float64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for i := 0; i < l.Tiles; i++ {
+		start := float64(i) * l.Interval
+		end := min(start+l.Interval, duration)
+		x := (i % l.Columns) * l.TileWidth
+		y := (i / l.Columns) * l.TileHeight
+		fmt.Fprintf(&buf, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end), spriteName, x, y, l.TileWidth, l.TileHeight)
+	}
+	return buf.Bytes()
+}
+
+// formatVTTTimestamp formats seconds as HH:MM:SS.mmm.
+func formatVTTTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+/**
+ * Build a scrubbing storyboard of a video and upload it to S3
+ * Frames every storyboardInterval are tiled into one JPEG sprite, with a
+ * WebVTT file players read to show the tile for a position. Returns the
+ * URLs of the cue file and the sprite
+ */
+func (cfg *apiConfig) generateStoryboard(ctx context.Context, bucket string, videoID uuid.UUID, filePath string) (string, string, error) {
+	metadata, err := getVideoMetadata(ctx, filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't probe video: %w", err)
+	}
+	layout, err := newStoryboardLayout(metadata.Duration, metadata.Width, metadata.Height, cfg.storyboardInterval, cfg.storyboardTileWidth, cfg.storyboardColumns)
+	if err != nil {
+		return "", "", err
+	}
+
+	spritePath := filePath + ".storyboard.jpg"
+	defer os.Remove(spritePath)
+	// Frames whose shape differs from the stored size, e.g. non-square pixels,
+	// are padded rather than stretched into the tile
+	filter := fmt.Sprintf("fps=%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:-1:-1,tile=%dx%d",
+		strconv.FormatFloat(1/layout.Interval, 'f', -1, 64),
+		layout.TileWidth, layout.TileHeight, layout.TileWidth, layout.TileHeight, layout.Columns, layout.Rows())
+	err = runFFmpeg(ctx, "-y", "-i", filePath, "-map", "0:v:0", "-vf", filter, "-frames:v", "1", "-q:v", "5", spritePath)
+	if err != nil {
+		return "", "", err
+	}
+
+	name, err := randomAssetName()
+	if err != nil {
+		return "", "", err
+	}
+	prefix := fmt.Sprintf("storyboards/%s/%s", videoID, name)
+	err = cfg.uploadFileToBucket(ctx, bucket, prefix+".jpg", spritePath, "image/jpeg")
+	if err != nil {
+		return "", "", err
+	}
+	spriteURL := cfg.assetURLForObject(bucket, prefix+".jpg")
+	err = cfg.objectStoreFor(bucket).put(ctx, prefix+".vtt", bytes.NewReader(layout.cues(name+".jpg", metadata.Duration)), "text/vtt")
+	if err != nil {
+		cfg.rollbackAsset(ctx, spriteURL, videoID)
+		return "", "", err
+	}
+	return cfg.assetURLForObject(bucket, prefix+".vtt"), spriteURL, nil
+}
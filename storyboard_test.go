@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewStoryboardLayout(t *testing.T) {
+	tests := []struct {
+		name         string
+		duration     float64
+		width        int
+		height       int
+		interval     time.Duration
+		wantTiles    int
+		wantColumns  int
+		wantRows     int
+		wantHeight   int
+		wantInterval float64
+		wantErr      bool
+	}{
+		{name: "short clip", duration: 12.5, width: 1280, height: 720, interval: 2 * time.Second, wantTiles: 7, wantColumns: 5, wantRows: 2, wantHeight: 90, wantInterval: 2},
+		{name: "fewer tiles than columns", duration: 4, width: 1280, height: 720, interval: 2 * time.Second, wantTiles: 2, wantColumns: 2, wantRows: 1, wantHeight: 90, wantInterval: 2},
+		{name: "portrait", duration: 10, width: 1080, height: 1920, interval: 5 * time.Second, wantTiles: 2, wantColumns: 2, wantRows: 1, wantHeight: 284, wantInterval: 5},
+		{name: "long video is capped", duration: 4000, width: 1280, height: 720, interval: time.Second, wantTiles: storyboardMaxTiles, wantColumns: 5, wantRows: 80, wantHeight: 90, wantInterval: 10},
+		{name: "no duration", width: 1280, height: 720, interval: time.Second, wantErr: true},
+		{name: "no frame size", duration: 10, interval: time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		layout, err := newStoryboardLayout(tt.duration, tt.width, tt.height, tt.interval, 160, 5)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if layout.Tiles != tt.wantTiles || layout.Columns != tt.wantColumns || layout.Rows() != tt.wantRows ||
+			layout.TileHeight != tt.wantHeight || layout.Interval != tt.wantInterval {
+			t.Errorf("%s: got %d tiles in %dx%d of height %d every %vs, want %d in %dx%d of height %d every %vs", tt.name,
+				layout.Tiles, layout.Columns, layout.Rows(), layout.TileHeight, layout.Interval,
+				tt.wantTiles, tt.wantColumns, tt.wantRows, tt.wantHeight, tt.wantInterval)
+		}
+	}
+}
+
+func TestStoryboardCues(t *testing.T) {
+	layout, err := newStoryboardLayout(12.5, 1280, 720, 2*time.Second, 160, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues := string(layout.cues("sprite.jpg", 12.5))
+	if !strings.HasPrefix(cues, "WEBVTT\n") {
+		t.Errorf("cues don't start with the WebVTT header: %q", cues)
+	}
+	if n := strings.Count(cues, " --> "); n != layout.Tiles {
+		t.Errorf("%d cues, want one per tile (%d)", n, layout.Tiles)
+	}
+	for _, want := range []string{
+		"00:00:00.000 --> 00:00:02.000\nsprite.jpg#xywh=0,0,160,90\n",
+		"00:00:10.000 --> 00:00:12.000\nsprite.jpg#xywh=0,90,160,90\n",
+		// The last tile ends with the video
+		"00:00:12.000 --> 00:00:12.500\nsprite.jpg#xywh=160,90,160,90\n",
+	} {
+		if !strings.Contains(cues, want) {
+			t.Errorf("cues don't contain %q:\n%s", want, cues)
+		}
+	}
+}
+
+func TestUploadVideoStoryboard(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	sprite := filepath.Join(t.TempDir(), "sprite")
+	t.Setenv("FAKE_FFMPEG_SPRITE", sprite)
+	// Records how the sprite is tiled
+	installFakeTool(t, "ffmpeg", `case "$*" in
+*.storyboard.jpg) echo "$*" > "$FAKE_FFMPEG_SPRITE" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	cfg, store, video, token := newS3Test(t)
+	cfg.storyboards = true
+	cfg.storyboardInterval = 2 * time.Second
+	cfg.storyboardTileWidth = 160
+	cfg.storyboardColumns = 5
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	args, _ := os.ReadFile(sprite)
+	// 7 tiles for the 12.5 second video
+	if !strings.Contains(string(args), "fps=0.5,scale=160:90:force_original_aspect_ratio=decrease,pad=160:90:-1:-1,tile=5x2 ") {
+		t.Errorf("sprite built with %q, want 2s frames tiled 5x2", args)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.StoryboardURL == nil || stored.StoryboardSpriteURL == nil {
+		t.Fatalf("storyboard URLs = %v and %v, want both saved", stored.StoryboardURL, stored.StoryboardSpriteURL)
+	}
+	_, cuesKey, _ := cfg.s3ObjectFromURL(*stored.StoryboardURL)
+	_, spriteKey, _ := cfg.s3ObjectFromURL(*stored.StoryboardSpriteURL)
+	if store.contentTypes[cuesKey] != "text/vtt" || store.contentTypes[spriteKey] != "image/jpeg" {
+		t.Errorf("stored %s as %q and %s as %q, want text/vtt and image/jpeg", cuesKey, store.contentTypes[cuesKey], spriteKey, store.contentTypes[spriteKey])
+	}
+	cues := string(store.objects[cuesKey])
+	if n := strings.Count(cues, " --> "); n != 7 {
+		t.Errorf("%d cues, want 7", n)
+	}
+	if !strings.Contains(cues, filepath.Base(spriteKey)+"#xywh=") {
+		t.Errorf("cues don't point at the sprite %s:\n%s", spriteKey, cues)
+	}
+}
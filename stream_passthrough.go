@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// passthroughPrefixBytes is how much of an upload is buffered to find and
+// probe its moov box before streaming the rest.
+const passthroughPrefixBytes = 4 << 20
+
+/**
+ * Report whether an upload can skip the temp file and ffmpeg entirely
+ * Only plain mp4 uploads into the mp4 format qualify, and only while no
+ * enabled feature needs the whole file: trimming, pixel rate and duration
+ * limits, banned hashes, audio and keyframe analysis or any derived asset
+ */
+func (cfg *apiConfig) canStreamPassthrough(video database.Video, mediaType string, header textproto.MIMEHeader, trim *trimRange, profile processingProfile) bool {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	switch {
+	case !cfg.streamPassthrough:
+		return false
+	case mediaType != "video/mp4" || (encoding != "" && encoding != "identity"):
+		return false
+	case trim != nil || profile.Format.Name != "mp4":
+		return false
+	case cfg.maxPixelRate > 0 || cfg.minVideoDuration > 0 || cfg.maxVideoDuration > 0:
+		return false
+	case cfg.bannedHashes != nil:
+		return false
+	case cfg.detectSilentAudio || cfg.analyzeKeyframes || cfg.extractSubtitles:
+		return false
+	case cfg.autoThumbnailCandidates || cfg.contactSheets || cfg.storyboards || cfg.resolutionRenditions:
+		return false
+	case cfg.autoThumbnailAt > 0 && video.ThumbnailURL == nil:
+		return false
+	}
+	return true
+}
+
+/**
+ * Report whether the top-level boxes of an mp4 put moov before mdat
+ * That is what faststart means, and what lets the prefix alone be probed.
+ * Unknown when the prefix ends before either box is found
+ */
+func isFastStartMP4(prefix []byte) bool {
+	offset := 0
+	for offset+8 <= len(prefix) {
+		size := uint64(binary.BigEndian.Uint32(prefix[offset:]))
+		boxType := string(prefix[offset+4 : offset+8])
+		headerSize := uint64(8)
+		if size == 1 {
+			if offset+16 > len(prefix) {
+				return false
+			}
+			size = binary.BigEndian.Uint64(prefix[offset+8:])
+			headerSize = 16
+		}
+		switch boxType {
+		case "moov":
+			return true
+		case "mdat":
+			return false
+		}
+		if size < headerSize || size > uint64(len(prefix)-offset) {
+			return false
+		}
+		offset += int(size)
+	}
+	return false
+}
+
+// passthroughProbe is what the upload prefix told us about the video.
+type passthroughProbe struct {
+	AspectRatio string
+	HasAudio    bool
+	Metadata    videoMetadata
+}
+
+/**
+ * Probe the buffered start of a faststart mp4
+ * Only the prefix is written to disk. ok is false when the upload has to go
+ * through the temp-file path instead
+ */
+func (cfg *apiConfig) probeFastStartPrefix(ctx context.Context, prefix []byte) (passthroughProbe, bool) {
+	if !isFastStartMP4(prefix) {
+		return passthroughProbe{}, false
+	}
+	prefixFile, err := os.CreateTemp("", "video-prefix")
+	if err != nil {
+		log.Printf("Couldn't create prefix file for stream passthrough: %v", err)
+		return passthroughProbe{}, false
+	}
+	defer os.Remove(prefixFile.Name())
+	_, err = prefixFile.Write(prefix)
+	if closeErr := prefixFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Couldn't write prefix file for stream passthrough: %v", err)
+		return passthroughProbe{}, false
+	}
+
+	probe := passthroughProbe{}
+	probe.AspectRatio, err = cfg.resolveAspectRatio(ctx, prefixFile.Name())
+	if err != nil {
+		return passthroughProbe{}, false
+	}
+	audio, err := getAudioInfo(ctx, prefixFile.Name())
+	if err != nil {
+		return passthroughProbe{}, false
+	}
+	probe.HasAudio = audio.HasAudio
+	probe.Metadata, err = getVideoMetadata(ctx, prefixFile.Name())
+	if err != nil {
+		return passthroughProbe{}, false
+	}
+	if cfg.applyRotation && probe.Metadata.Rotation != 0 {
+		// Turning the frames needs a transcode
+		return passthroughProbe{}, false
+	}
+	if cfg.verifyOutputContainer {
+		// The stream is stored as is and labeled video/mp4
+		err = checkOutputContainer(ctx, prefixFile.Name(), outputFormats["mp4"])
+		if err != nil {
+			log.Printf("Stream passthrough container check failed: %v", err)
+			return passthroughProbe{}, false
+		}
+	}
+	return probe, true
+}
+
+/**
+ * Stream a faststart mp4 upload straight into the bucket
+ * body is the whole upload, prefix included. Instead of two full copies on
+ * disk (the upload and the faststart output) only the 4MB prefix is
+ * written, and the store holds at most its in-flight parts in memory.
+ * Storing shares the profile's deadline. Size checks happen once the stream
+ * ends; a short upload is deleted again
+ */
+func (cfg *apiConfig) handleStreamPassthrough(w http.ResponseWriter, r *http.Request, videoDb, previousVideo database.Video, forced bool, expiresAt *time.Time, profile processingProfile, probe passthroughProbe, body io.Reader, header textproto.MIMEHeader) {
+	ctx, cancel := context.WithTimeout(r.Context(), profile.Deadline)
+	defer cancel()
+	recorder := cfg.newProcessingRecorder()
+	recorder.input("content_type", "video/mp4")
+	recorder.input("aspect_ratio", probe.AspectRatio)
+
+	bucket, err := cfg.bucketForUser(videoDb.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve storage bucket", err)
+		return
+	}
+	err = cfg.validateBucket(ctx, bucket)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Storage bucket isn't available", err)
+		return
+	}
+	prefix := "other"
+	switch probe.AspectRatio {
+	case "16:9":
+		prefix = "landscape"
+	case "9:16":
+		prefix = "portrait"
+	}
+	name, err := randomAssetName()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		return
+	}
+	format := outputFormats["mp4"]
+	key := format.objectKey(prefix, name)
+	videoURL := cfg.assetURLForObject(bucket, key)
+
+	received := &countingReader{r: body}
+	hasher := sha256.New()
+	endStep := recorder.step("stream_passthrough")
+	err = cfg.objectStoreFor(bucket).put(ctx, key, io.TeeReader(received, hasher), format.ContentType)
+	endStep(err)
+	if respondWithBodyError(w, received.err) {
+		return
+	}
+	if err != nil {
+		cfg.abortUpload(ctx, videoDb.ID, nil)
+		respondWithProcessingError(w, ctx, http.StatusInternalServerError, "Couldn't upload file to S3", err)
+		return
+	}
+	addLogFields(w, "bytes", received.n)
+	reject, rejectType := "", ""
+	declared := declaredPartSize(header)
+	switch {
+	case cfg.checkUploadSize && declared >= 0 && received.n != declared:
+		reject = fmt.Sprintf("Upload truncated: expected %d bytes, received %d", declared, received.n)
+		rejectType = problemUploadTruncated
+	case received.n < cfg.minVideoBytes:
+		reject = "Empty or truncated file"
+	}
+	if reject != "" {
+		if err := cfg.deleteAssetByURL(r.Context(), videoURL); err != nil {
+			log.Printf("Couldn't delete rejected upload %s: %v", key, err)
+		}
+		respondWithErrorType(w, http.StatusBadRequest, rejectType, reject, nil)
+		return
+	}
+	err = cfg.checkUploadQuota(videoDb, received.n)
+	if err != nil {
+		if err := cfg.deleteAssetByURL(r.Context(), videoURL); err != nil {
+			log.Printf("Couldn't delete over-quota upload %s: %v", key, err)
+		}
+		if errors.Is(err, errUploadQuotaExceeded) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	recorder.input("size", fmt.Sprint(received.n))
+	recorder.input("sha256", hex.EncodeToString(hasher.Sum(nil)))
+
+	// The hash is only known now the stream is stored, so the object moves
+	// to its content key afterwards
+	if cfg.contentAddressedKeys {
+		endStep := recorder.step("content_key")
+		contentKey, err := cfg.moveToContentKey(ctx, bucket, videoDb.ID, key, hasher.Sum(nil), format.Extension, format.ContentType)
+		endStep(err)
+		if err != nil {
+			if err := cfg.deleteAssetByURL(r.Context(), videoURL); err != nil {
+				log.Printf("Couldn't delete staged upload %s: %v", key, err)
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't store video by content", err)
+			return
+		}
+		key = contentKey
+		videoURL = cfg.assetURLForObject(bucket, key)
+	}
+
+	videoDb.VideoURL = &videoURL
+	videoDb.ExpiresAt = expiresAt
+	videoDb.AspectRatio = nil
+	if probe.AspectRatio != "" {
+		videoDb.AspectRatio = &probe.AspectRatio
+	}
+	videoDb.HasAudio = &probe.HasAudio
+	videoDb.IsSilent = nil
+	videoDb.KeyframeInterval, videoDb.GOPSize, videoDb.RegularKeyframes = nil, nil, nil
+	videoDb.FileSize = &received.n
+	if probe.Metadata.Duration > 0 {
+		// ffprobe only saw the prefix, so work the rate out from the whole file
+		probe.Metadata.BitRate = int64(float64(received.n*8) / probe.Metadata.Duration)
+	}
+	probe.Metadata.apply(&videoDb)
+	videoDb.ResolutionRenditions = nil
+	videoDb.ContactSheetURL = nil
+	videoDb.StoryboardURL, videoDb.StoryboardSpriteURL = nil, nil
+	ready := database.VideoStatusReady
+	videoDb.Status = &ready
+	videoDb.ReplicationStatus = nil
+	if cfg.replicationEnabled() && bucket == cfg.s3Bucket {
+		pending := database.ReplicationPending
+		videoDb.ReplicationStatus = &pending
+	}
+	videoDb.ProcessingReport = recorder.finish(reportOutcomeReady)
+	err = cfg.db.UpdateVideo(videoDb)
+	if err != nil {
+		cfg.rollbackAsset(r.Context(), videoURL, videoDb.ID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	cfg.cleanupReplacedAssets(ctx, videoDb, previousVideo, forced)
+	if cfg.replicationEnabled() && bucket == cfg.s3Bucket {
+		cfg.replicateObject(videoDb.ID, key)
+	}
+	cfg.webhooks.dispatch(webhookEventReady, videoDb.ID, cfg.videoEventData(r.Context(), videoDb))
+	videoDb, err = cfg.dbVideoToSignedVideo(ctx, videoDb, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	cfg.respondWithContent(w, r, http.StatusOK, newUploadVideoResponse(videoDb, probe.Metadata))
+}
+
+// readUploadPrefix buffers up to passthroughPrefixBytes of an upload.
+func readUploadPrefix(file io.Reader) ([]byte, error) {
+	prefix := make([]byte, passthroughPrefixBytes)
+	n, err := io.ReadFull(file, prefix)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return prefix[:n], err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// testFastStartMP4 is ftyp, moov, then mdat: the box order of a faststart
+// mp4, which is all passthrough looks at before probing.
+const testFastStartMP4 = "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41" +
+	"\x00\x00\x00\x10moov\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"\x00\x00\x00\x18mdatnot really video data"
+
+func TestStreamPassthroughContentAddressed(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.streamPassthrough = true
+	cfg.contentAddressedKeys = true
+	other, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "same bytes", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(testFastStartMP4))
+	wantKey := contentKey(sum[:], ".mp4")
+	wantURL := cfg.assetURLForObject(cfg.s3Bucket, wantKey)
+	for _, v := range []database.Video{video, other} {
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, v, token, "video/mp4", testFastStartMP4))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		stored, err := cfg.db.GetVideo(v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.VideoURL == nil || *stored.VideoURL != wantURL {
+			t.Errorf("video URL = %v, want %s", stored.VideoURL, wantURL)
+		}
+	}
+
+	// Both streams were staged, only the first was copied into place
+	if len(store.objects) != 1 || store.copies != 1 {
+		keys := []string{}
+		for key := range store.objects {
+			keys = append(keys, key)
+		}
+		t.Errorf("bucket holds %s after %d copies, want only %s after 1", strings.Join(keys, ", "), store.copies, wantKey)
+	}
+	if string(store.objects[wantKey]) != testFastStartMP4 {
+		t.Errorf("%s holds %q, want the upload", wantKey, store.objects[wantKey])
+	}
+}
+
+func TestStreamPassthroughResponse(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+	cfg.streamPassthrough = true
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testFastStartMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	// The same shape as a processed upload's response
+	var resp map[string]any
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp["duration_seconds"] != 12.5 || resp["aspect_ratio"] != "16:9" {
+		t.Errorf("response has duration_seconds %v and aspect_ratio %v, want 12.5 and 16:9", resp["duration_seconds"], resp["aspect_ratio"])
+	}
+}
+
+// blockingStore holds every put until its context ends.
+type blockingStore struct{}
+
+func (blockingStore) put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingStore) delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func TestStreamPassthroughDeadline(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+	cfg.streamPassthrough = true
+	cfg.store = blockingStore{}
+	profiles, err := parseProcessingProfiles("quick:200ms", time.Minute, "mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.processingProfiles = profiles
+
+	req := newVideoUploadRequest(t, video, token, "video/mp4", testFastStartMP4)
+	req.URL.RawQuery = url.Values{"profile": {"quick"}}.Encode()
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, req)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoURL != nil || stored.Status == nil || *stored.Status != database.VideoStatusFailed {
+		t.Errorf("video saved as %v with status %v, want no URL and failed", stored.VideoURL, stored.Status)
+	}
+}
+
+func TestStreamPassthroughVerifiesContainer(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Probes fine, but isn't an mp4 container
+	installFakeTool(t, "ffprobe", `case "$*" in
+*format=format_name*) echo "matroska,webm" ;;
+*) cat <<'EOF'
+`+fakeProbeOutput+`
+EOF
+;;
+esac
+`)
+	cfg, store, video, token := newS3Test(t)
+	cfg.streamPassthrough = true
+	cfg.verifyOutputContainer = true
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testFastStartMP4))
+	if w.Code == http.StatusOK {
+		t.Fatalf("status = 200, want the upload refused")
+	}
+	if store.puts != 0 {
+		t.Errorf("stored %v, want nothing labeled video/mp4", store.contentTypes)
+	}
+}
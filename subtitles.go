@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const captionSourceEmbedded = "embedded"
+
+// subtitleStream is one text subtitle stream as reported by ffprobe.
+type subtitleStream struct {
+	Index     int    `json:"index"`
+	CodecName string `json:"codec_name"`
+	Tags      struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+	} `json:"tags"`
+}
+
+func getSubtitleStreams(ctx context.Context, filePath string) ([]subtitleStream, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "s", "-print_format", "json", "-show_entries", "stream=index,codec_name:stream_tags=language,title", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	var ffprobeOutput struct {
+		Streams []subtitleStream `json:"streams"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return nil, err
+	}
+	return ffprobeOutput.Streams, nil
+}
+
+// captionLanguage maps a stream language tag to the one stored on the
+// caption. ffmpeg writes "und" when the language is unknown.
+func captionLanguage(tag string) string {
+	if tag == "" || !isValidLanguageTag(tag) {
+		return "und"
+	}
+	return tag
+}
+
+/**
+ * Extract embedded subtitle streams to WebVTT and upload them
+ * Bitmap subtitles (e.g. PGS) can't become WebVTT and are skipped
+ */
+func (cfg *apiConfig) extractEmbeddedCaptions(ctx context.Context, bucket string, videoID uuid.UUID, filePath string) (database.Captions, error) {
+	streams, err := getSubtitleStreams(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list subtitle streams: %w", err)
+	}
+
+	captions := database.Captions{}
+	for i, stream := range streams {
+		switch stream.CodecName {
+		case "hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle":
+			continue
+		}
+
+		outputPath := fmt.Sprintf("%s.subtitle-%d.vtt", filePath, i)
+		command := commandContext(ctx, "ffmpeg", "-y", "-i", filePath, "-map", fmt.Sprintf("0:s:%d", i), "-f", "webvtt", outputPath)
+		var stderr strings.Builder
+		command.Stderr = &stderr
+		err := command.Run()
+		if err != nil {
+			os.Remove(outputPath)
+			return nil, fmt.Errorf("ffmpeg failed on subtitle stream %d: %w: %s", stream.Index, err, stderr.String())
+		}
+
+		language := captionLanguage(stream.Tags.Language)
+		name, err := randomAssetName()
+		if err != nil {
+			os.Remove(outputPath)
+			return nil, err
+		}
+		key := fmt.Sprintf("captions/%s/%s-%s.vtt", videoID, language, name)
+		err = cfg.uploadFileToBucket(ctx, bucket, key, outputPath, "text/vtt")
+		os.Remove(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, database.Caption{
+			Language: language,
+			Label:    stream.Tags.Title,
+			URL:      cfg.assetURLForObject(bucket, key),
+			Source:   captionSourceEmbedded,
+		})
+	}
+	return captions, nil
+}
+
+/**
+ * Swap a video's embedded captions for a freshly extracted set
+ * Captions from other sources are kept
+ */
+func replaceEmbeddedCaptions(video *database.Video, extracted database.Captions) {
+	kept := database.Captions{}
+	for _, caption := range video.Captions {
+		if caption.Source != captionSourceEmbedded {
+			kept = append(kept, caption)
+		}
+	}
+	video.Captions = append(kept, extracted...)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// installFakeSubtitleProbe makes ffprobe report subtitleJSON for subtitle
+// stream queries and leaves everything else to the fake installed before.
+func installFakeSubtitleProbe(t *testing.T, subtitleJSON string) {
+	installFakeTool(t, "ffprobe", `case "$*" in
+*"-select_streams s "*) echo '`+subtitleJSON+`' ;;
+*) PATH="${PATH#*:}" exec ffprobe "$@" ;;
+esac
+`)
+}
+
+func TestUploadVideoExtractsSubtitles(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	installFakeSubtitleProbe(t, `{"streams": [
+		{"index": 2, "codec_name": "mov_text", "tags": {"language": "en", "title": "English"}},
+		{"index": 3, "codec_name": "hdmv_pgs_subtitle", "tags": {"language": "fr"}},
+		{"index": 4, "codec_name": "mov_text", "tags": {"language": "not a tag"}}
+	]}`)
+	for _, extract := range []bool{false, true} {
+		cfg, store, video, token := newS3Test(t)
+		cfg.extractSubtitles = extract
+		// An uploaded caption survives re-extraction
+		uploaded := database.Caption{Language: "de", URL: "https://cdn.example.com/de.vtt", Source: "upload"}
+		video.Captions = database.Captions{uploaded}
+		err := cfg.db.UpdateVideo(video)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+		if w.Code != http.StatusOK {
+			t.Fatalf("extract %v: status = %d: %s", extract, w.Code, w.Body)
+		}
+		stored, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !extract {
+			if len(stored.Captions) != 1 {
+				t.Errorf("captions = %+v with extraction off, want only the uploaded one", stored.Captions)
+			}
+			continue
+		}
+
+		// The bitmap track can't be WebVTT
+		if len(stored.Captions) != 3 || stored.Captions[0] != uploaded {
+			t.Fatalf("captions = %+v, want the uploaded one and two extracted", stored.Captions)
+		}
+		for i, want := range []database.Caption{{Language: "en", Label: "English"}, {Language: "und"}} {
+			caption := stored.Captions[i+1]
+			if caption.Language != want.Language || caption.Label != want.Label || caption.Source != captionSourceEmbedded {
+				t.Errorf("caption %d = %+v, want %s %q from the embedded tracks", i, caption, want.Language, want.Label)
+			}
+			key, ok := cfg.s3KeyFromURL(caption.URL)
+			if !ok || !strings.HasPrefix(key, "captions/"+video.ID.String()+"/"+want.Language+"-") || !strings.HasSuffix(key, ".vtt") {
+				t.Errorf("caption %d is stored at %s", i, caption.URL)
+			}
+			if _, ok := store.objects[key]; !ok {
+				t.Errorf("caption %d's %s isn't in the bucket", i, key)
+			}
+		}
+	}
+}
+
+func TestUploadVideoWithoutSubtitles(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+	cfg.extractSubtitles = true
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Captions) != 0 {
+		t.Errorf("captions = %+v for a video without subtitle tracks", stored.Captions)
+	}
+}
+
+func TestCaptionLanguage(t *testing.T) {
+	tests := map[string]string{"": "und", "en": "en", "pt-BR": "pt-BR", "not a tag": "und"}
+	for tag, want := range tests {
+		if got := captionLanguage(tag); got != want {
+			t.Errorf("captionLanguage(%q) = %s, want %s", tag, got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// tenantNamePattern limits tenant names to what is safe inside a bucket name.
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,30}[a-z0-9]$`)
+
+/**
+ * tenantBuckets maps a user's tenant to the bucket their videos live in
+ * Explicit mappings win over the naming pattern (e.g. "tubely-%s"); users
+ * without a tenant, or with neither configured, use the default bucket
+ */
+type tenantBuckets struct {
+	mapping map[string]string
+	pattern string
+
+	mu        sync.Mutex
+	validated map[string]bool
+}
+
+func parseTenantBuckets(mapping, pattern string) (*tenantBuckets, error) {
+	buckets := &tenantBuckets{
+		mapping:   map[string]string{},
+		pattern:   pattern,
+		validated: map[string]bool{},
+	}
+	if pattern != "" && strings.Count(pattern, "%s") != 1 {
+		return nil, fmt.Errorf("tenant bucket pattern must contain %%s exactly once: %s", pattern)
+	}
+	for _, part := range strings.Split(mapping, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tenant, bucket, ok := strings.Cut(part, ":")
+		if !ok || strings.TrimSpace(bucket) == "" {
+			return nil, fmt.Errorf("invalid tenant bucket %q", part)
+		}
+		buckets.mapping[strings.TrimSpace(tenant)] = strings.TrimSpace(bucket)
+	}
+	return buckets, nil
+}
+
+func (b *tenantBuckets) enabled() bool {
+	return b != nil && (len(b.mapping) > 0 || b.pattern != "")
+}
+
+/**
+ * Get the bucket a user's uploads go to
+ */
+func (cfg *apiConfig) bucketForUser(userID uuid.UUID) (string, error) {
+	if !cfg.tenantBuckets.enabled() {
+		return cfg.s3Bucket, nil
+	}
+	tenant, err := cfg.db.GetUserTenant(userID)
+	if err != nil {
+		return "", err
+	}
+	if tenant == "" {
+		return cfg.s3Bucket, nil
+	}
+	if bucket, ok := cfg.tenantBuckets.mapping[tenant]; ok {
+		return bucket, nil
+	}
+	if cfg.tenantBuckets.pattern == "" {
+		return cfg.s3Bucket, nil
+	}
+	if !tenantNamePattern.MatchString(tenant) {
+		return "", fmt.Errorf("tenant %q can't be used in a bucket name", tenant)
+	}
+	return fmt.Sprintf(cfg.tenantBuckets.pattern, tenant), nil
+}
+
+// isKnownBucket reports whether bucket is one this server stores assets in.
+func (cfg *apiConfig) isKnownBucket(bucket string) bool {
+	if bucket == cfg.s3Bucket {
+		return true
+	}
+	if !cfg.tenantBuckets.enabled() {
+		return false
+	}
+	for _, mapped := range cfg.tenantBuckets.mapping {
+		if mapped == bucket {
+			return true
+		}
+	}
+	if prefix, suffix, ok := strings.Cut(cfg.tenantBuckets.pattern, "%s"); ok {
+		tenant, found := strings.CutPrefix(bucket, prefix)
+		tenant, hasSuffix := strings.CutSuffix(tenant, suffix)
+		return found && hasSuffix && tenantNamePattern.MatchString(tenant)
+	}
+	return false
+}
+
+/**
+ * Check that a tenant bucket exists and is reachable
+ * Successful checks are remembered for the life of the process
+ */
+func (cfg *apiConfig) validateBucket(ctx context.Context, bucket string) error {
+	if bucket == cfg.s3Bucket {
+		return nil
+	}
+	cfg.tenantBuckets.mu.Lock()
+	ok := cfg.tenantBuckets.validated[bucket]
+	cfg.tenantBuckets.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket})
+	if err != nil {
+		return fmt.Errorf("bucket %s isn't usable: %w", bucket, err)
+	}
+	cfg.tenantBuckets.mu.Lock()
+	cfg.tenantBuckets.validated[bucket] = true
+	cfg.tenantBuckets.mu.Unlock()
+	return nil
+}
+
+// assetURLForObject builds the stored URL of an object. The CloudFront
+// distribution only fronts the default bucket, so tenant objects, and every
+// object when the default bucket is private, use the "bucket,key" form and
+// are signed on read.
+func (cfg *apiConfig) assetURLForObject(bucket, key string) string {
+	if bucket == cfg.s3Bucket && !cfg.s3PrivateBucket {
+		return fmt.Sprintf("%s/%s", cfg.s3CfDistribution, key)
+	}
+	return bucket + "," + key
+}
+
+/**
+ * Get the bucket and key behind a stored asset URL
+ * Only buckets this server writes to are accepted
+ */
+func (cfg *apiConfig) s3ObjectFromURL(assetURL string) (string, string, bool) {
+	if key, ok := cfg.s3KeyFromURL(assetURL); ok {
+		return cfg.s3Bucket, key, true
+	}
+	bucket, key, ok := strings.Cut(assetURL, ",")
+	if !ok || key == "" || !cfg.isKnownBucket(bucket) {
+		return "", "", false
+	}
+	return bucket, key, true
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// fakeTenantS3 serves the tenant buckets that exist and records what is
+// written to each.
+type fakeTenantS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func newFakeTenantS3(t *testing.T, buckets ...string) (*fakeTenantS3, string) {
+	fake := &fakeTenantS3{buckets: map[string]map[string][]byte{}}
+	for _, bucket := range buckets {
+		fake.buckets[bucket] = map[string][]byte{}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		objects, ok := fake.buckets[bucket]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == http.MethodHead && key == "":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			objects[key] = data
+		case r.Method == http.MethodHead || r.Method == http.MethodGet:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			if r.Method == http.MethodGet {
+				w.Write(data)
+			}
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func TestParseTenantBuckets(t *testing.T) {
+	buckets, err := parseTenantBuckets(" globex:globex-videos , acme:acme-media", "tubely-%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets.mapping) != 2 || buckets.mapping["globex"] != "globex-videos" || buckets.mapping["acme"] != "acme-media" {
+		t.Errorf("mapping = %v", buckets.mapping)
+	}
+	for _, tt := range []struct{ mapping, pattern string }{
+		{mapping: "globex"},
+		{mapping: "globex:"},
+		{pattern: "tubely"},
+		{pattern: "%s-%s"},
+	} {
+		if _, err := parseTenantBuckets(tt.mapping, tt.pattern); err == nil {
+			t.Errorf("parseTenantBuckets(%q, %q) succeeded, want an error", tt.mapping, tt.pattern)
+		}
+	}
+}
+
+func TestUploadVideoTenantBuckets(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, _, _ := newS3Test(t)
+	tenants, err := parseTenantBuckets("globex:globex-videos", "tubely-%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.tenantBuckets = tenants
+	fake, endpoint := newFakeTenantS3(t, cfg.s3Bucket, "globex-videos", "tubely-acme")
+	cfg.s3Client = newEndpointS3Client(endpoint)
+	cfg.store = s3ObjectStore{client: cfg.s3Client, bucket: cfg.s3Bucket}
+
+	tests := []struct {
+		tenant     string
+		wantCode   int
+		wantBucket string
+	}{
+		{tenant: "", wantCode: http.StatusOK, wantBucket: cfg.s3Bucket},
+		{tenant: "globex", wantCode: http.StatusOK, wantBucket: "globex-videos"},
+		{tenant: "acme", wantCode: http.StatusOK, wantBucket: "tubely-acme"},
+		// The pattern names a bucket that doesn't exist
+		{tenant: "initech", wantCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		user, err := cfg.db.CreateUser(database.CreateUserParams{Email: tt.tenant + "@example.com", Password: "hash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.tenant != "" {
+			err = cfg.db.SetUserTenant(user.ID, tt.tenant)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "upload", UserID: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+		if w.Code != tt.wantCode {
+			t.Errorf("tenant %q: status = %d, want %d: %s", tt.tenant, w.Code, tt.wantCode, w.Body)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		stored, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket, key, ok := cfg.s3ObjectFromURL(*stored.VideoURL)
+		if !ok || bucket != tt.wantBucket {
+			t.Errorf("tenant %q: video stored in %q, want %s", tt.tenant, bucket, tt.wantBucket)
+			continue
+		}
+		if string(fake.buckets[bucket][key]) != testMP4 {
+			t.Errorf("tenant %q: %s/%s wasn't written", tt.tenant, bucket, key)
+		}
+	}
+}
+
+func TestDirectUploadTenantBucket(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, _, _ := newS3Test(t)
+	cfg.minVideoBytes = 1
+	tenants, err := parseTenantBuckets("globex:globex-videos", "tubely-%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.tenantBuckets = tenants
+	fake, endpoint := newFakeTenantS3(t, cfg.s3Bucket, "globex-videos")
+	cfg.s3Client = newEndpointS3Client(endpoint)
+	cfg.store = s3ObjectStore{client: cfg.s3Client, bucket: cfg.s3Bucket}
+
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "globex@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.db.SetUserTenant(user.ID, "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "direct", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerCreateUploadURL(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload-url", video, token, `{"size": 2048}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		URL string `json:"url"`
+		Key string `json:"key"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.URL, "/globex-videos/"+resp.Key+"?") {
+		t.Fatalf("upload URL %s, want the raw upload staged in globex-videos", resp.URL)
+	}
+
+	// What the browser would PUT to the presigned URL
+	fake.buckets["globex-videos"][resp.Key] = []byte(testMP4)
+	w = httptest.NewRecorder()
+	cfg.handlerDirectUploadComplete(w, newVideoRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/direct-upload/complete", video, token, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("completion status = %d: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(*stored.VideoURL)
+	if !ok || bucket != "globex-videos" || string(fake.buckets[bucket][key]) != testMP4 {
+		t.Errorf("video stored as %s, want it in globex-videos", *stored.VideoURL)
+	}
+	if _, ok := fake.buckets["globex-videos"][resp.Key]; ok {
+		t.Errorf("raw upload %s is still stored", resp.Key)
+	}
+	if len(fake.buckets[cfg.s3Bucket]) != 0 {
+		t.Errorf("default bucket holds %d objects, want none", len(fake.buckets[cfg.s3Bucket]))
+	}
+}
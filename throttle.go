@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// throttledWriter caps the average throughput written to w at bytesPerSec.
+type throttledWriter struct {
+	w           io.Writer
+	bytesPerSec int64
+	start       time.Time
+	written     int64
+}
+
+// newThrottledWriter returns w unchanged when bytesPerSec is not positive.
+func newThrottledWriter(w io.Writer, bytesPerSec int64) io.Writer {
+	if bytesPerSec <= 0 {
+		return w
+	}
+	return &throttledWriter{w: w, bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	// Write in slices of roughly 100ms worth of bytes so the stream stays smooth
+	maxChunk := int(t.bytesPerSec/10) + 1
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		n, err := t.w.Write(chunk)
+		total += n
+		t.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		if flusher, ok := t.w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		expected := time.Duration(float64(t.written) / float64(t.bytesPerSec) * float64(time.Second))
+		if wait := expected - time.Since(t.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return total, nil
+}
+
+/**
+ * Parse per-tier download rates, e.g. "free:1048576,premium:0"
+ * A rate of 0 means unlimited
+ */
+func parseTierRates(value string) (map[string]int64, error) {
+	rates := map[string]int64{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tier, rate, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier rate %q", part)
+		}
+		parsed, err := strconv.ParseInt(strings.TrimSpace(rate), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate for tier %s: %w", tier, err)
+		}
+		rates[strings.TrimSpace(tier)] = parsed
+	}
+	return rates, nil
+}
+
+// downloadRateForUser returns the proxied download rate in bytes per second
+// for the user's tier, falling back to the default rate.
+func (cfg *apiConfig) downloadRateForUser(userID uuid.UUID) (int64, error) {
+	tier, err := cfg.db.GetUserTier(userID)
+	if err != nil {
+		return 0, err
+	}
+	if rate, ok := cfg.downloadTierRates[tier]; ok {
+		return rate, nil
+	}
+	return cfg.downloadRateLimit, nil
+}
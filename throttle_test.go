@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestThrottledWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		bytesPerSec int64
+		want        time.Duration
+	}{
+		{name: "one write", size: 40 << 10, bytesPerSec: 100 << 10, want: 400 * time.Millisecond},
+		{name: "small rate", size: 3000, bytesPerSec: 10000, want: 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := newThrottledWriter(&out, tt.bytesPerSec)
+			data := bytes.Repeat([]byte("x"), tt.size)
+			start := time.Now()
+			n, err := w.Write(data)
+			elapsed := time.Since(start)
+			if err != nil || n != tt.size || out.Len() != tt.size {
+				t.Fatalf("Write = %d, %v with %d written, want all %d", n, err, out.Len(), tt.size)
+			}
+			// Some slack for timer granularity
+			if floor := tt.want - 100*time.Millisecond; elapsed < floor {
+				t.Errorf("%d bytes at %d/s took %s, want at least %s", tt.size, tt.bytesPerSec, elapsed, floor)
+			}
+			if elapsed > 3*tt.want {
+				t.Errorf("%d bytes at %d/s took %s, want about %s", tt.size, tt.bytesPerSec, elapsed, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottledWriterUnlimited(t *testing.T) {
+	var out bytes.Buffer
+	if w := newThrottledWriter(&out, 0); w != &out {
+		t.Error("a rate of 0 should leave the writer unthrottled")
+	}
+}
+
+func TestParseTierRates(t *testing.T) {
+	rates, err := parseTierRates(" free:1048576 , premium:0,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 2 || rates["free"] != 1048576 || rates["premium"] != 0 {
+		t.Errorf("parseTierRates = %v, want free 1048576 and premium 0", rates)
+	}
+	for _, value := range []string{"free", "free:fast"} {
+		if _, err := parseTierRates(value); err == nil {
+			t.Errorf("parseTierRates(%q) succeeded, want an error", value)
+		}
+	}
+}
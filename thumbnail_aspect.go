@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbnailAspectCheckOff    = "off"
+	thumbnailAspectCheckWarn   = "warn"
+	thumbnailAspectCheckReject = "reject"
+)
+
+func validateThumbnailAspectCheck(mode string) error {
+	switch mode {
+	case thumbnailAspectCheckOff, thumbnailAspectCheckWarn, thumbnailAspectCheckReject:
+		return nil
+	}
+	return fmt.Errorf("unknown thumbnail aspect check mode: %s", mode)
+}
+
+// parseAspectRatio turns an ffprobe ratio such as "16:9" into a number.
+func parseAspectRatio(ratio string) (float64, error) {
+	widthString, heightString, ok := strings.Cut(ratio, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid aspect ratio: %s", ratio)
+	}
+	width, err := strconv.ParseFloat(widthString, 64)
+	if err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseFloat(heightString, 64)
+	if err != nil {
+		return 0, err
+	}
+	if width <= 0 || height <= 0 {
+		return 0, fmt.Errorf("invalid aspect ratio: %s", ratio)
+	}
+	return width / height, nil
+}
+
+/**
+ * Compare a thumbnail's aspect ratio to the video's
+ * Returns a non-empty message when they differ by more than tolerance
+ */
+func thumbnailAspectMismatch(r io.Reader, videoRatio string, tolerance float64) (string, error) {
+	expected, err := parseAspectRatio(videoRatio)
+	if err != nil {
+		return "", err
+	}
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", err
+	}
+	if config.Width == 0 || config.Height == 0 {
+		return "", fmt.Errorf("thumbnail has no dimensions")
+	}
+
+	actual := float64(config.Width) / float64(config.Height)
+	if math.Abs(actual-expected)/expected <= tolerance {
+		return "", nil
+	}
+	return fmt.Sprintf("Thumbnail is %dx%d but the video is %s", config.Width, config.Height, videoRatio), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// errDurationUnknown means the container doesn't report a duration, e.g. a
+// stream that was cut off while recording.
+var errDurationUnknown = errors.New("video duration is unknown")
+
+func getVideoDuration(ctx context.Context, filePath string) (float64, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_entries", "format=duration", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return 0, err
+	}
+
+	var ffprobeOutput struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return 0, err
+	}
+	if ffprobeOutput.Format.Duration == "" || ffprobeOutput.Format.Duration == "N/A" {
+		return 0, errDurationUnknown
+	}
+	return strconv.ParseFloat(ffprobeOutput.Format.Duration, 64)
+}
+
+// videoStream is one video stream as reported by ffprobe.
+type videoStream struct {
+	Index       int `json:"index"`
+	Disposition struct {
+		Default     int `json:"default"`
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+}
+
+func getVideoStreams(ctx context.Context, filePath string) ([]videoStream, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v", "-print_format", "json", "-show_entries", "stream=index:stream_disposition=default,attached_pic", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	var ffprobeOutput struct {
+		Streams []videoStream `json:"streams"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return nil, err
+	}
+	return ffprobeOutput.Streams, nil
+}
+
+/**
+ * Pick which video stream thumbnails are taken from
+ * configured is a position among the video streams (0 is the first one);
+ * a negative value picks the default-disposition stream, skipping cover art
+ */
+func selectThumbnailStream(streams []videoStream, configured int) (int, error) {
+	if len(streams) == 0 {
+		return 0, fmt.Errorf("no video streams found")
+	}
+	if configured >= 0 {
+		if configured >= len(streams) {
+			return 0, fmt.Errorf("thumbnail stream %d out of range, file has %d video streams", configured, len(streams))
+		}
+		return configured, nil
+	}
+
+	for i, stream := range streams {
+		if stream.Disposition.Default == 1 && stream.Disposition.AttachedPic == 0 {
+			return i, nil
+		}
+	}
+	for i, stream := range streams {
+		if stream.Disposition.AttachedPic == 0 {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+/**
+ * Extract a single JPEG frame at timestamp (seconds) into outputPath
+ * streamIndex selects the video stream, counted among video streams only
+ */
+func extractFrame(ctx context.Context, filePath string, streamIndex int, timestamp float64, outputPath string) error {
+	command := commandContext(ctx, "ffmpeg", "-y", "-ss", strconv.FormatFloat(timestamp, 'f', 3, 64), "-i", filePath, "-map", fmt.Sprintf("0:v:%d", streamIndex), "-frames:v", "1", "-q:v", "2", outputPath)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// candidateTimestamps spreads count timestamps evenly across duration,
+// skipping the very first and last frames.
+func candidateTimestamps(duration float64, count int) []float64 {
+	timestamps := make([]float64, 0, count)
+	for i := 1; i <= count; i++ {
+		timestamps = append(timestamps, duration*float64(i)/float64(count+1))
+	}
+	return timestamps
+}
+
+/**
+ * Generate poster candidates for a video and upload them to S3
+ * Returns the URLs of the uploaded candidates in timestamp order and the
+ * index of the one picked as the poster
+ */
+func (cfg *apiConfig) generateThumbnailCandidates(ctx context.Context, bucket string, videoID uuid.UUID, filePath string) ([]string, int, error) {
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't get duration: %w", err)
+	}
+	streams, err := getVideoStreams(ctx, filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't list video streams: %w", err)
+	}
+	streamIndex, err := selectThumbnailStream(streams, cfg.thumbnailStreamIndex)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	framePaths := []string{}
+	defer func() {
+		for _, framePath := range framePaths {
+			os.Remove(framePath)
+		}
+	}()
+	for i, timestamp := range candidateTimestamps(duration, cfg.thumbnailCandidateCount) {
+		framePath := fmt.Sprintf("%s.candidate-%d.jpg", filePath, i)
+		err := extractFrame(ctx, filePath, streamIndex, timestamp, framePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		framePaths = append(framePaths, framePath)
+	}
+	poster := cfg.choosePosterFrame(ctx, framePaths)
+
+	urls := []string{}
+	for _, framePath := range framePaths {
+		name, err := randomAssetName()
+		if err != nil {
+			return nil, 0, err
+		}
+		key := fmt.Sprintf("thumbnails/%s/%s.jpg", videoID, name)
+		err = cfg.uploadFileToBucket(ctx, bucket, key, framePath, "image/jpeg")
+		if err != nil {
+			return nil, 0, err
+		}
+		urls = append(urls, cfg.assetURLForObject(bucket, key))
+	}
+	return urls, poster, nil
+}
+
+/**
+ * Delete candidates that were replaced by a new set
+ * Anything still referenced by the video is kept
+ */
+func (cfg *apiConfig) cleanupReplacedCandidates(ctx context.Context, video database.Video, oldCandidates []string) {
+	for _, url := range oldCandidates {
+		if video.ThumbnailURL != nil && *video.ThumbnailURL == url {
+			continue
+		}
+		if slices.Contains(video.ThumbnailCandidates, url) {
+			continue
+		}
+		err := cfg.deleteAssetByURL(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't delete old thumbnail candidate %s: %v", url, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) handlerThumbnailSelect(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Index int `json:"index"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+	if params.Index < 0 || params.Index >= len(video.ThumbnailCandidates) {
+		respondWithError(w, http.StatusBadRequest, "Invalid candidate index", nil)
+		return
+	}
+
+	previous := video
+	selected := video.ThumbnailCandidates[params.Index]
+	video.ThumbnailURL = &selected
+	video.ThumbnailVariants = database.ThumbnailVariants{
+		{ContentType: "image/jpeg", URL: selected},
+	}
+	if bucket, key, ok := cfg.s3ObjectFromURL(selected); ok {
+		cfg.setVideoLQIPFromObject(r.Context(), &video, bucket, key)
+	} else {
+		video.LQIP = nil
+	}
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.cleanupReplacedThumbnail(r.Context(), video, previous)
+	cfg.invalidateReplacedThumbnail(r.Context(), previous)
+
+	video, err = cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
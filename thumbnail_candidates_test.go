@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCandidateTimestamps(t *testing.T) {
+	tests := []struct {
+		duration float64
+		count    int
+		want     []float64
+	}{
+		{duration: 12, count: 1, want: []float64{6}},
+		{duration: 12, count: 3, want: []float64{3, 6, 9}},
+		{duration: 10, count: 4, want: []float64{2, 4, 6, 8}},
+		{duration: 12, count: 0, want: []float64{}},
+	}
+	for _, tt := range tests {
+		got := candidateTimestamps(tt.duration, tt.count)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("candidateTimestamps(%v, %d) = %v, want %v", tt.duration, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateThumbnailCandidates(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	for _, count := range []int{1, 3, 5} {
+		cfg, server, video, _ := newS3Test(t)
+		cfg.thumbnailCandidateCount = count
+		cfg.thumbnailStreamIndex = -1
+		source := filepath.Join(t.TempDir(), "upload.mp4")
+		err := os.WriteFile(source, []byte("frame"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		urls, _, err := cfg.generateThumbnailCandidates(context.Background(), cfg.s3Bucket, video.ID, source)
+		if err != nil {
+			t.Fatalf("%d candidates: %v", count, err)
+		}
+		if len(urls) != count || len(server.objects) != count {
+			t.Errorf("%d candidates: got %d URLs and %d stored files", count, len(urls), len(server.objects))
+		}
+		for _, url := range urls {
+			key, ok := cfg.s3KeyFromURL(url)
+			if !ok || !strings.HasPrefix(key, "thumbnails/"+video.ID.String()+"/") {
+				t.Errorf("candidate %s isn't stored under the video's prefix", url)
+			}
+		}
+		// Frames are cleaned up once uploaded
+		leftover, _ := filepath.Glob(source + ".candidate-*")
+		if len(leftover) != 0 {
+			t.Errorf("frames left behind: %v", leftover)
+		}
+	}
+}
+
+// fakeFaceDetector returns canned faces per frame path, failing for paths in
+// failing.
+type fakeFaceDetector struct {
+	faces   map[string][]faceBox
+	failing map[string]bool
+}
+
+func (d fakeFaceDetector) DetectFaces(ctx context.Context, imagePath string) ([]faceBox, error) {
+	if d.failing[imagePath] {
+		return nil, errors.New("detector crashed")
+	}
+	return d.faces[imagePath], nil
+}
+
+func TestChoosePosterFrame(t *testing.T) {
+	frames := []string{"frame-0.jpg", "frame-1.jpg", "frame-2.jpg", "frame-3.jpg", "frame-4.jpg"}
+	// A head and shoulders shot in the upper middle
+	wellFramed := faceBox{X: 0.35, Y: 0.15, Width: 0.3, Height: 0.4, Confidence: 0.95}
+	tests := []struct {
+		name     string
+		detector faceDetector
+		want     int
+	}{
+		{name: "detection disabled", detector: nil, want: 2},
+		{name: "no faces", detector: fakeFaceDetector{}, want: 2},
+		{name: "one face", detector: fakeFaceDetector{faces: map[string][]faceBox{"frame-0.jpg": {wellFramed}}}, want: 0},
+		{name: "better framed face wins", detector: fakeFaceDetector{faces: map[string][]faceBox{
+			"frame-1.jpg": {wellFramed},
+			"frame-4.jpg": {{X: 0.8, Y: 0.7, Width: 0.15, Height: 0.2, Confidence: 0.95}},
+		}}, want: 1},
+		{name: "background extra", detector: fakeFaceDetector{faces: map[string][]faceBox{"frame-4.jpg": {{X: 0.5, Y: 0.5, Width: 0.05, Height: 0.05, Confidence: 0.99}}}}, want: 2},
+		{name: "cut off at the edge", detector: fakeFaceDetector{faces: map[string][]faceBox{"frame-4.jpg": {{X: 0.8, Y: 0.2, Width: 0.3, Height: 0.4, Confidence: 0.99}}}}, want: 2},
+		{name: "low confidence", detector: fakeFaceDetector{faces: map[string][]faceBox{"frame-4.jpg": {{X: 0.35, Y: 0.15, Width: 0.3, Height: 0.4, Confidence: 0.3}}}}, want: 2},
+		{name: "failing frame is skipped", detector: fakeFaceDetector{
+			faces:   map[string][]faceBox{"frame-3.jpg": {wellFramed}},
+			failing: map[string]bool{"frame-0.jpg": true},
+		}, want: 3},
+	}
+	for _, tt := range tests {
+		cfg := &apiConfig{faceDetector: tt.detector, faceMinConfidence: 0.6}
+		if got := cfg.choosePosterFrame(context.Background(), frames); got != tt.want {
+			t.Errorf("%s: poster = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateThumbnailCandidatesFaceDetection(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, _ := newS3Test(t)
+	cfg.thumbnailCandidateCount = 3
+	cfg.thumbnailStreamIndex = -1
+	cfg.faceMinConfidence = 0.6
+	source := filepath.Join(t.TempDir(), "upload.mp4")
+	err := os.WriteFile(source, []byte("frame"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the first frame has someone in it
+	cfg.faceDetector = fakeFaceDetector{faces: map[string][]faceBox{
+		source + ".candidate-0.jpg": {{X: 0.35, Y: 0.15, Width: 0.3, Height: 0.4, Confidence: 0.95}},
+	}}
+
+	urls, poster, err := cfg.generateThumbnailCandidates(context.Background(), cfg.s3Bucket, video.ID, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 3 || poster != 0 {
+		t.Errorf("got %d candidates with poster %d, want 3 with the face in frame 0", len(urls), poster)
+	}
+}
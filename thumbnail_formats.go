@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+/**
+ * Re-encode an uploaded thumbnail as JPEG
+ * Transparent areas are flattened onto white since JPEG has no alpha
+ */
+func encodeThumbnailJPEG(data []byte) ([]byte, error) {
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return encodeImageJPEG(source)
+}
+
+// encodeImageJPEG flattens img onto white and encodes it as JPEG.
+func encodeImageJPEG(img image.Image) ([]byte, error) {
+	return encodeImageJPEGQuality(img, 85)
+}
+
+func encodeImageJPEGQuality(img image.Image, quality int) ([]byte, error) {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: quality})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeThumbnailWebP converts an image file to WebP with ffmpeg, since the
+// standard library can only decode WebP.
+func encodeThumbnailWebP(ctx context.Context, inputPath, outputPath string) error {
+	command := commandContext(ctx, "ffmpeg", "-y", "-i", inputPath, "-c:v", "libwebp", "-quality", "80", "-frames:v", "1", outputPath)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// encodeThumbnailDataWebP is encodeThumbnailWebP for an image in memory.
+func encodeThumbnailDataWebP(ctx context.Context, data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "thumbnail-webp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	inputPath := filepath.Join(dir, "source")
+	err = os.WriteFile(inputPath, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	outputPath := filepath.Join(dir, "output.webp")
+	err = encodeThumbnailWebP(ctx, inputPath, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outputPath)
+}
+
+// localAssetURL is the URL a file in assetsRoot is served from.
+func (cfg *apiConfig) localAssetURL(fileName string) string {
+	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, fileName)
+}
+
+/**
+ * Store JPEG and WebP renditions of an uploaded thumbnail next to it
+ * data is the stored upload. The JPEG is listed first as it is the
+ * default and the fallback for clients that can't negotiate. On error the
+ * renditions already stored are returned so the caller can remove them
+ */
+func (cfg *apiConfig) storeThumbnailFormats(ctx context.Context, data []byte, mediaType, sourceURL, name string) (string, []thumbnailRendition, error) {
+	renditions := []thumbnailRendition{}
+
+	jpegURL := sourceURL
+	jpegData := data
+	if mediaType != "image/jpeg" {
+		var err error
+		jpegData, err = encodeThumbnailJPEG(data)
+		if err != nil {
+			return "", nil, fmt.Errorf("couldn't encode JPEG: %w", err)
+		}
+		jpegURL, err = cfg.thumbnailStore.put(ctx, name+".jpeg", bytes.NewReader(jpegData), "image/jpeg")
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	renditions = append(renditions, thumbnailRendition{data: jpegData, contentType: "image/jpeg", url: jpegURL})
+
+	if mediaType != "image/webp" {
+		webpData, err := encodeThumbnailDataWebP(ctx, data)
+		if err != nil {
+			return "", renditions, fmt.Errorf("couldn't encode WebP: %w", err)
+		}
+		webpURL, err := cfg.thumbnailStore.put(ctx, name+".webp", bytes.NewReader(webpData), "image/webp")
+		if err != nil {
+			return "", renditions, err
+		}
+		renditions = append(renditions, thumbnailRendition{data: webpData, contentType: "image/webp", url: webpURL})
+	}
+
+	if mediaType != "image/jpeg" {
+		// Keep the original too, e.g. a PNG with transparency or the
+		// uploaded WebP
+		renditions = append(renditions, thumbnailRendition{data: data, contentType: mediaType, url: sourceURL})
+	}
+	return jpegURL, renditions, nil
+}
+
+type thumbnailRendition struct {
+	data        []byte
+	contentType string
+	url         string
+}
+
+const jobTypeThumbnailVariants = "thumbnail_variants"
+
+type thumbnailVariantsPayload struct {
+	FileName  string `json:"file_name"`
+	Name      string `json:"name"`
+	MediaType string `json:"media_type"`
+}
+
+// pendingThumbnailVariants are the placeholders for renditions a background
+// job will fill in.
+func pendingThumbnailVariants(mediaType string) []database.ThumbnailVariant {
+	pending := []database.ThumbnailVariant{}
+	if mediaType != "image/webp" {
+		pending = append(pending, database.ThumbnailVariant{ContentType: "image/webp", Status: database.VariantPending})
+	}
+	if mediaType != "image/jpeg" {
+		pending = append([]database.ThumbnailVariant{{ContentType: "image/jpeg", Status: database.VariantPending}}, pending...)
+	}
+	return pending
+}
+
+/**
+ * Backfill the renditions of an uploaded thumbnail
+ * Shares the processing slots with video work. If the thumbnail was replaced
+ * while the job waited, the renditions are thrown away
+ */
+func (cfg *apiConfig) runThumbnailVariantsJob(ctx context.Context, job database.Job) error {
+	payload := thumbnailVariantsPayload{}
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return err
+	}
+	sourceURL := cfg.thumbnailStore.url(payload.FileName)
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ThumbnailURL == nil || *video.ThumbnailURL != sourceURL {
+		return nil
+	}
+
+	release, err := cfg.scheduler.Acquire(ctx, video.UserID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	data, err := cfg.thumbnailStore.get(ctx, payload.FileName)
+	if err != nil {
+		return err
+	}
+	jpegURL, renditions, err := cfg.storeThumbnailFormats(ctx, data, payload.MediaType, sourceURL, payload.Name)
+	if err != nil {
+		return err
+	}
+
+	// Reload so a thumbnail change during encoding wins
+	video, err = cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ThumbnailURL == nil || *video.ThumbnailURL != sourceURL {
+		for _, rendition := range renditions {
+			if rendition.url != sourceURL {
+				cfg.deleteAssetByURL(ctx, rendition.url)
+			}
+		}
+		return nil
+	}
+	// Resized copies were stored with the upload and stay
+	sized := database.ThumbnailVariants{}
+	for _, variant := range video.ThumbnailVariants {
+		if variant.Status == "" && variant.URL != sourceURL {
+			sized = append(sized, variant)
+		}
+	}
+	video.ThumbnailURL = &jpegURL
+	video.ThumbnailVariants = database.ThumbnailVariants{}
+	for _, rendition := range renditions {
+		variant := newThumbnailVariant(rendition.data, rendition.contentType, rendition.url)
+		variant.Status = database.VariantReady
+		video.ThumbnailVariants = append(video.ThumbnailVariants, variant)
+	}
+	video.ThumbnailVariants = append(video.ThumbnailVariants, sized...)
+	return cfg.db.UpdateVideo(video)
+}
+
+// thumbnailVariantsJobFailed marks the pending renditions as failed so
+// clients stop waiting for them.
+func (cfg *apiConfig) thumbnailVariantsJobFailed(job database.Job, err error) {
+	video, getErr := cfg.db.GetVideo(job.VideoID)
+	if getErr != nil || video.ID == uuid.Nil {
+		return
+	}
+	for i := range video.ThumbnailVariants {
+		if video.ThumbnailVariants[i].Status == database.VariantPending {
+			video.ThumbnailVariants[i].Status = database.VariantFailed
+		}
+	}
+	if updateErr := cfg.db.UpdateVideo(video); updateErr != nil {
+		log.Printf("Couldn't mark thumbnail variants failed for video %s: %v", job.VideoID, updateErr)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestUploadThumbnailDualFormat(t *testing.T) {
+	// The fake ffmpeg copies the PNG through as the WebP
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, video, token := newThumbnailTest(t)
+	cfg.thumbnailDualFormat = true
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := map[string]string{}
+	for _, variant := range stored.ThumbnailVariants {
+		urls[variant.ContentType] = variant.URL
+	}
+	for _, contentType := range []string{"image/jpeg", "image/webp", "image/png"} {
+		url, ok := urls[contentType]
+		if !ok {
+			t.Errorf("no %s variant in %+v", contentType, stored.ThumbnailVariants)
+			continue
+		}
+		key := path.Base(url)
+		if _, err := os.Stat(filepath.Join(cfg.assetsRoot, key)); err != nil {
+			t.Errorf("%s variant %s wasn't stored: %v", contentType, key, err)
+		}
+		if extension := "." + strings.TrimPrefix(contentType, "image/"); !strings.HasSuffix(key, extension) {
+			t.Errorf("%s variant is stored as %s", contentType, key)
+		}
+	}
+	// JPEG is the default for clients that can't negotiate
+	if stored.ThumbnailURL == nil || *stored.ThumbnailURL != urls["image/jpeg"] {
+		t.Errorf("thumbnail URL = %v, want the JPEG %s", stored.ThumbnailURL, urls["image/jpeg"])
+	}
+	if n := assetCount(t, cfg); n != 3 {
+		t.Errorf("assets hold %d files, want the PNG, JPEG and WebP", n)
+	}
+}
+
+func TestUploadThumbnailVariantsAsync(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	tests := []struct {
+		name       string
+		ffmpeg     string
+		wantStatus string
+	}{
+		{name: "backfilled", wantStatus: database.VariantReady},
+		{name: "encoding fails", ffmpeg: "exit 1", wantStatus: database.VariantFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ffmpeg != "" {
+				installFakeTool(t, "ffmpeg", tt.ffmpeg)
+			}
+			cfg, video, token := newThumbnailTest(t)
+			cfg.thumbnailDualFormat = true
+			cfg.thumbnailVariantsAsync = true
+			cfg.jobs = newJobQueue(cfg.db, time.Minute, time.Hour)
+			cfg.jobs.register(jobTypeThumbnailVariants, jobType{run: cfg.runThumbnailVariantsJob, maxAttempts: 1, failed: cfg.thumbnailVariantsJobFailed})
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			// Only the primary is stored before the response
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := assetCount(t, cfg); n != 1 || stored.ThumbnailURL == nil {
+				t.Fatalf("assets hold %d files with thumbnail %v, want just the primary", n, stored.ThumbnailURL)
+			}
+			primary := *stored.ThumbnailURL
+			if !strings.HasSuffix(primary, ".png") {
+				t.Errorf("thumbnail URL = %s, want the uploaded PNG until the variants are ready", primary)
+			}
+			for _, contentType := range []string{"image/jpeg", "image/webp"} {
+				if got := thumbnailVariantStatus(stored, contentType); got != database.VariantPending {
+					t.Errorf("%s variant is %q before the job ran, want pending", contentType, got)
+				}
+			}
+
+			if !cfg.jobs.runNext() {
+				t.Fatal("no thumbnail variants job was queued")
+			}
+			stored, err = cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, contentType := range []string{"image/jpeg", "image/webp"} {
+				if got := thumbnailVariantStatus(stored, contentType); got != tt.wantStatus {
+					t.Errorf("%s variant is %q after the job ran, want %s", contentType, got, tt.wantStatus)
+				}
+			}
+			if tt.wantStatus == database.VariantFailed {
+				if *stored.ThumbnailURL != primary {
+					t.Errorf("thumbnail URL = %s, want the primary %s kept", *stored.ThumbnailURL, primary)
+				}
+				return
+			}
+			if n := assetCount(t, cfg); n != 3 {
+				t.Errorf("assets hold %d files, want the PNG, JPEG and WebP", n)
+			}
+			if !strings.HasSuffix(*stored.ThumbnailURL, ".jpeg") {
+				t.Errorf("thumbnail URL = %s, want the backfilled JPEG", *stored.ThumbnailURL)
+			}
+		})
+	}
+}
+
+// thumbnailVariantStatus is the status of video's variant of contentType,
+// or "missing".
+func thumbnailVariantStatus(video database.Video, contentType string) string {
+	for _, variant := range video.ThumbnailVariants {
+		if variant.ContentType == contentType {
+			return variant.Status
+		}
+	}
+	return "missing"
+}
+
+// assetCount is the number of files in cfg.assetsRoot.
+func assetCount(t *testing.T, cfg *apiConfig) int {
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
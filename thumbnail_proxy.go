@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// parseThumbnailWidths parses a comma separated list of widths in pixels.
+func parseThumbnailWidths(value string) ([]int, error) {
+	widths := []int{}
+	for _, part := range parsePrefixList(value) {
+		width, err := strconv.Atoi(part)
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid width %q", part)
+		}
+		widths = append(widths, width)
+	}
+	if len(widths) == 0 {
+		return nil, errors.New("no widths given")
+	}
+	slices.Sort(widths)
+	return slices.Compact(widths), nil
+}
+
+// clampThumbnailWidth picks the smallest allowed width that covers
+// requested, or the largest one.
+func clampThumbnailWidth(allowed []int, requested int) int {
+	for _, width := range allowed {
+		if width >= requested {
+			return width
+		}
+	}
+	return allowed[len(allowed)-1]
+}
+
+/**
+ * Serve a video's thumbnail resized to the requested width
+ * Widths snap to THUMBNAIL_PROXY_WIDTHS so arbitrary values can't fill the
+ * cache. Sizes are cached on disk, keyed by the master's URL, so replacing
+ * the thumbnail never serves a stale size. The cache is kept under
+ * THUMBNAIL_CACHE_MAX_BYTES by dropping the least recently served sizes
+ */
+func (cfg *apiConfig) handlerThumbnailProxy(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	requested := cfg.thumbnailProxyWidths[len(cfg.thumbnailProxyWidths)-1]
+	if value := r.URL.Query().Get("w"); value != "" {
+		requested, err = strconv.Atoi(value)
+		if err != nil || requested <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid width", err)
+			return
+		}
+	}
+	width := clampThumbnailWidth(cfg.thumbnailProxyWidths, requested)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.ThumbnailURL == nil {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", nil)
+		return
+	}
+	if video.IsExpired(time.Now()) {
+		respondWithError(w, http.StatusGone, "Video has expired", nil)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(*video.ThumbnailURL))
+	cacheName := fmt.Sprintf("%s-%d.jpg", hex.EncodeToString(sum[:16]), width)
+	cachePath := filepath.Join(cfg.thumbnailCacheDir, cacheName)
+	data, err := os.ReadFile(cachePath)
+	if err == nil {
+		// The modification time doubles as the last use for pruning
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = cfg.resizeThumbnail(r.Context(), *video.ThumbnailURL, width)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't resize thumbnail", err)
+			return
+		}
+		err = writeFileAtomic(cachePath, data)
+		if err == nil {
+			pruneErr := pruneThumbnailCache(cfg.thumbnailCacheDir, cfg.thumbnailCacheMaxBytes)
+			if pruneErr != nil {
+				log.Printf("Couldn't prune thumbnail cache: %v", pruneErr)
+			}
+		}
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cache thumbnail", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.thumbnailProxyMaxAge.Seconds())))
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(cacheName, ".jpg")+`"`)
+	http.ServeContent(w, r, cacheName, time.Time{}, bytes.NewReader(data))
+}
+
+// resizeThumbnail loads the master thumbnail and scales it down to width as
+// a JPEG. Masters narrower than width are only re-encoded.
+func (cfg *apiConfig) resizeThumbnail(ctx context.Context, masterURL string, width int) ([]byte, error) {
+	data, err := cfg.readThumbnailMaster(ctx, masterURL)
+	if err != nil {
+		return nil, err
+	}
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return encodeImageJPEG(shrinkImage(source, width))
+}
+
+// readThumbnailMaster reads a thumbnail from the assets directory or the
+// bucket it was stored in.
+func (cfg *apiConfig) readThumbnailMaster(ctx context.Context, masterURL string) ([]byte, error) {
+	if name, ok := strings.CutPrefix(masterURL, cfg.localAssetURL("")); ok {
+		return os.ReadFile(filepath.Join(cfg.assetsRoot, filepath.Base(name)))
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(masterURL)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized asset URL: %s", masterURL)
+	}
+	path, err := cfg.downloadObjectFromBucket(ctx, bucket, key, "thumbnail-master")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	return os.ReadFile(path)
+}
+
+/**
+ * Remove the least recently used files until dir holds at most maxBytes
+ * Files in flight (writeFileAtomic's temp files) are left alone. A
+ * maxBytes of zero or less means no limit
+ */
+func pruneThumbnailCache(dir string, maxBytes int64) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []cachedFile{}
+	total := int64(0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Pruned by another request
+			continue
+		}
+		files = append(files, cachedFile{path: filepath.Join(dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	slices.SortFunc(files, func(a, b cachedFile) int { return a.modTime.Compare(b.modTime) })
+	for _, file := range files {
+		if total <= maxBytes {
+			break
+		}
+		err := os.Remove(file.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= file.size
+	}
+	return nil
+}
+
+// writeFileAtomic writes data next to path and renames it into place, so
+// concurrent readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
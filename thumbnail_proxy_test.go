@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClampThumbnailWidth(t *testing.T) {
+	allowed := []int{160, 320, 640}
+	tests := []struct {
+		requested int
+		want      int
+	}{
+		{requested: 1, want: 160},
+		{requested: 160, want: 160},
+		{requested: 161, want: 320},
+		{requested: 640, want: 640},
+		{requested: 5000, want: 640},
+	}
+	for _, tt := range tests {
+		if got := clampThumbnailWidth(allowed, tt.requested); got != tt.want {
+			t.Errorf("clampThumbnailWidth(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestThumbnailProxyWidths(t *testing.T) {
+	cfg, _, video, _ := newS3Test(t)
+	cfg.assetsRoot = t.TempDir()
+	cfg.thumbnailCacheDir = t.TempDir()
+	cfg.thumbnailProxyWidths = []int{160, 320}
+	var master bytes.Buffer
+	err := png.Encode(&master, testPNG(400, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(cfg.assetsRoot, "master.png"), master.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterURL := cfg.localAssetURL("master.png")
+	video.ThumbnailURL = &masterURL
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantWidth int
+	}{
+		{query: "", wantCode: http.StatusOK, wantWidth: 320},
+		{query: "?w=160", wantCode: http.StatusOK, wantWidth: 160},
+		{query: "?w=320", wantCode: http.StatusOK, wantWidth: 320},
+		// Snapped to an allowed width, never made as asked
+		{query: "?w=100", wantCode: http.StatusOK, wantWidth: 160},
+		{query: "?w=161", wantCode: http.StatusOK, wantWidth: 320},
+		{query: "?w=5000", wantCode: http.StatusOK, wantWidth: 320},
+		{query: "?w=0", wantCode: http.StatusBadRequest},
+		{query: "?w=-160", wantCode: http.StatusBadRequest},
+		{query: "?w=wide", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/assets/thumb/"+video.ID.String()+tt.query, nil)
+		req.SetPathValue("videoID", video.ID.String())
+		w := httptest.NewRecorder()
+		cfg.handlerThumbnailProxy(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.query, w.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		config, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if config.Width != tt.wantWidth {
+			t.Errorf("%s: served %d wide, want %d", tt.query, config.Width, tt.wantWidth)
+		}
+	}
+
+	// One cached file per allowed width, whatever was asked for
+	entries, err := os.ReadDir(cfg.thumbnailCacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(cfg.thumbnailProxyWidths) {
+		t.Errorf("cache holds %d files, want %d", len(entries), len(cfg.thumbnailProxyWidths))
+	}
+}
+
+func TestPruneThumbnailCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{name: "oldest.jpg", age: 3 * time.Hour},
+		{name: "older.jpg", age: 2 * time.Hour},
+		{name: "recent.jpg", age: time.Hour},
+		{name: ".tmp-in-flight", age: 4 * time.Hour},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		err := os.WriteFile(path, make([]byte, 100), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, now.Add(-file.age), now.Add(-file.age))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := pruneThumbnailCache(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file.name))
+		wantKept := file.name != "oldest.jpg"
+		if kept := err == nil; kept != wantKept {
+			t.Errorf("%s kept = %v, want %v", file.name, kept, wantKept)
+		}
+	}
+
+	// No limit
+	err = pruneThumbnailCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("unlimited prune left %d files, want 3", len(entries))
+	}
+}
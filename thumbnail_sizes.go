@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// thumbnailSize is one resized JPEG rendition made of every uploaded
+// thumbnail.
+type thumbnailSize struct {
+	Width   int
+	Quality int
+}
+
+/**
+ * Parse THUMBNAIL_SIZES, e.g. "320:70,640,1280:85"
+ * Each entry is a width with an optional JPEG quality; entries without one
+ * use defaultQuality. An empty value turns resizing off
+ */
+func parseThumbnailSizes(value string, defaultQuality int) ([]thumbnailSize, error) {
+	sizes := []thumbnailSize{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		width, quality, hasQuality := strings.Cut(entry, ":")
+		size := thumbnailSize{Quality: defaultQuality}
+		var err error
+		size.Width, err = strconv.Atoi(strings.TrimSpace(width))
+		if err != nil || size.Width < 1 {
+			return nil, fmt.Errorf("invalid thumbnail width %q", width)
+		}
+		if hasQuality {
+			size.Quality, err = strconv.Atoi(strings.TrimSpace(quality))
+			if err != nil || size.Quality < 1 || size.Quality > 100 {
+				return nil, fmt.Errorf("invalid JPEG quality %q for width %d", quality, size.Width)
+			}
+		}
+		sizes = append(sizes, size)
+	}
+	slices.SortStableFunc(sizes, func(a, b thumbnailSize) int { return a.Width - b.Width })
+	return slices.CompactFunc(sizes, func(a, b thumbnailSize) bool { return a.Width == b.Width }), nil
+}
+
+/**
+ * Store narrower JPEG copies of a thumbnail for small tiles
+ * Only sizes narrower than the source are made, so nothing is upscaled.
+ * Each lands next to the source as <name>-<width>w.jpeg. On error the
+ * copies already stored are returned so the caller can remove them
+ */
+func (cfg *apiConfig) storeThumbnailSizes(ctx context.Context, data []byte, name string) ([]thumbnailRendition, error) {
+	if len(cfg.thumbnailSizes) == 0 {
+		return nil, nil
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var source image.Image
+	renditions := []thumbnailRendition{}
+	for _, size := range cfg.thumbnailSizes {
+		if size.Width >= config.Width {
+			break
+		}
+		if source == nil {
+			source, _, err = image.Decode(bytes.NewReader(data))
+			if err != nil {
+				return renditions, err
+			}
+		}
+		sized, err := encodeImageJPEGQuality(shrinkImage(source, size.Width), size.Quality)
+		if err != nil {
+			return renditions, err
+		}
+		url, err := cfg.thumbnailStore.put(ctx, fmt.Sprintf("%s-%dw.jpeg", name, size.Width), bytes.NewReader(sized), "image/jpeg")
+		if err != nil {
+			return renditions, err
+		}
+		renditions = append(renditions, thumbnailRendition{data: sized, contentType: "image/jpeg", url: url})
+	}
+	return renditions, nil
+}
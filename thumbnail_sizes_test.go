@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseThumbnailSizes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []thumbnailSize
+		wantErr bool
+	}{
+		{value: "", want: []thumbnailSize{}},
+		{value: "320,640,1280", want: []thumbnailSize{{Width: 320, Quality: 80}, {Width: 640, Quality: 80}, {Width: 1280, Quality: 80}}},
+		{value: "1280:90, 320:70", want: []thumbnailSize{{Width: 320, Quality: 70}, {Width: 1280, Quality: 90}}},
+		{value: "640,640:50", want: []thumbnailSize{{Width: 640, Quality: 80}}},
+		{value: "wide", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "320:101", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseThumbnailSizes(tt.value, 80)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseThumbnailSizes(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !slices.Equal(got, tt.want) {
+			t.Errorf("parseThumbnailSizes(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUploadThumbnailSizes(t *testing.T) {
+	tests := []struct {
+		name       string
+		width      int
+		wantWidths []int
+	}{
+		{name: "400px", width: 400, wantWidths: []int{320}},
+		{name: "1500px", width: 1500, wantWidths: []int{320, 640, 1280}},
+		{name: "narrower than every size", width: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.thumbnailStore = s3ThumbnailStore{cfg: cfg}
+			cfg.thumbnailSizes = []thumbnailSize{{Width: 320, Quality: 70}, {Width: 640, Quality: 80}, {Width: 1280, Quality: 80}}
+			var source bytes.Buffer
+			err := png.Encode(&source, testPNG(tt.width, tt.width*3/4))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video, token, "image/png", source.Bytes()))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var resp struct {
+				Sizes map[string]string `json:"sizes"`
+			}
+			err = json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Sizes) != len(tt.wantWidths) {
+				t.Errorf("sizes = %v, want widths %v", resp.Sizes, tt.wantWidths)
+			}
+			for _, width := range tt.wantWidths {
+				url, ok := resp.Sizes[strconv.Itoa(width)]
+				if !ok {
+					t.Errorf("no %dpx size in %v", width, resp.Sizes)
+					continue
+				}
+				key, _ := cfg.s3KeyFromURL(url)
+				if !strings.HasSuffix(key, "-"+strconv.Itoa(width)+"w.jpeg") || store.contentTypes[key] != "image/jpeg" {
+					t.Errorf("%dpx size stored at %s as %q", width, key, store.contentTypes[key])
+				}
+				config, format, err := image.DecodeConfig(bytes.NewReader(store.objects[key]))
+				if err != nil || format != "jpeg" {
+					t.Errorf("%dpx size isn't a JPEG: %v", width, err)
+					continue
+				}
+				if config.Width != width || config.Height != width*3/4 {
+					t.Errorf("%dpx size is %dx%d, want the aspect ratio kept", width, config.Width, config.Height)
+				}
+			}
+		})
+	}
+}
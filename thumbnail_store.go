@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// thumbnailStore is where uploaded thumbnails and their renditions are
+// kept. fileName is a flat name like "<random>.jpg".
+type thumbnailStore interface {
+	put(ctx context.Context, fileName string, body io.Reader, contentType string) (string, error)
+	get(ctx context.Context, fileName string) ([]byte, error)
+	url(fileName string) string
+}
+
+// localThumbnailStore keeps thumbnails in assetsRoot, served by /assets/.
+// Only works with a single instance.
+type localThumbnailStore struct {
+	cfg *apiConfig
+}
+
+func (s localThumbnailStore) put(ctx context.Context, fileName string, body io.Reader, contentType string) (string, error) {
+	err := localObjectStore{root: s.cfg.assetsRoot}.put(ctx, fileName, body, contentType)
+	if err != nil {
+		return "", err
+	}
+	return s.url(fileName), nil
+}
+
+func (s localThumbnailStore) get(ctx context.Context, fileName string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.cfg.assetsRoot, fileName))
+}
+
+func (s localThumbnailStore) url(fileName string) string {
+	return s.cfg.localAssetURL(fileName)
+}
+
+// s3ThumbnailStore keeps thumbnails in the bucket under thumbnails/, served
+// through CloudFront like videos.
+type s3ThumbnailStore struct {
+	cfg *apiConfig
+}
+
+func (s s3ThumbnailStore) key(fileName string) string {
+	return "thumbnails/" + fileName
+}
+
+func (s s3ThumbnailStore) put(ctx context.Context, fileName string, body io.Reader, contentType string) (string, error) {
+	err := s.cfg.store.put(ctx, s.key(fileName), body, contentType)
+	if err != nil {
+		return "", err
+	}
+	return s.url(fileName), nil
+}
+
+func (s s3ThumbnailStore) get(ctx context.Context, fileName string) ([]byte, error) {
+	body, err := s.cfg.getObject(ctx, s.cfg.s3Bucket, s.key(fileName))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (s s3ThumbnailStore) url(fileName string) string {
+	return fmt.Sprintf("%s/%s", s.cfg.s3CfDistribution, s.key(fileName))
+}
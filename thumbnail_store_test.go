@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailStores(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   func(cfg *apiConfig) thumbnailStore
+		urlPrefix string
+		stored    func(cfg *apiConfig, store *fakeS3Server, fileName string) bool
+	}{
+		{
+			name:      "local",
+			backend:   func(cfg *apiConfig) thumbnailStore { return localThumbnailStore{cfg: cfg} },
+			urlPrefix: "http://localhost:8091/assets/",
+			stored: func(cfg *apiConfig, _ *fakeS3Server, fileName string) bool {
+				_, err := os.Stat(filepath.Join(cfg.assetsRoot, fileName))
+				return err == nil
+			},
+		},
+		{
+			name:      "s3",
+			backend:   func(cfg *apiConfig) thumbnailStore { return s3ThumbnailStore{cfg: cfg} },
+			urlPrefix: "https://cdn.example.com/thumbnails/",
+			stored: func(_ *apiConfig, store *fakeS3Server, fileName string) bool {
+				_, ok := store.objects["thumbnails/"+fileName]
+				return ok
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.thumbnailStore = tt.backend(cfg)
+
+			url, err := cfg.thumbnailStore.put(context.Background(), "direct.png", strings.NewReader("thumbnail"), "image/png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url != tt.urlPrefix+"direct.png" || url != cfg.thumbnailStore.url("direct.png") {
+				t.Errorf("put returned %s, want %sdirect.png", url, tt.urlPrefix)
+			}
+			data, err := cfg.thumbnailStore.get(context.Background(), "direct.png")
+			if err != nil || string(data) != "thumbnail" {
+				t.Errorf("get = %q, %v, want what was put", data, err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, video, token))
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileName, ok := strings.CutPrefix(*stored.ThumbnailURL, tt.urlPrefix)
+			if !ok || !strings.HasSuffix(fileName, ".png") {
+				t.Fatalf("thumbnail URL = %s, want a random .png under %s", *stored.ThumbnailURL, tt.urlPrefix)
+			}
+			if !tt.stored(cfg, store, fileName) {
+				t.Errorf("%s wasn't stored in the %s backend", fileName, tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+)
+
+// thumbnailExtensions maps the accepted thumbnail media types to the
+// extension the stored file gets.
+var thumbnailExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+var errAnimatedGIF = errors.New("animated GIFs aren't supported as thumbnails")
+
+// checkStaticGIF rejects GIFs with more than one frame.
+func checkStaticGIF(r io.Reader) error {
+	decoded, err := gif.DecodeAll(r)
+	if err != nil {
+		return fmt.Errorf("couldn't decode GIF: %w", err)
+	}
+	if len(decoded.Image) > 1 {
+		return errAnimatedGIF
+	}
+	return nil
+}
+
+var errThumbnailTooLarge = errors.New("thumbnail dimensions are too large")
+
+// checkThumbnailDimensions rejects images wider or taller than maxDimension.
+// Only the header is read, so a huge image is never decoded.
+func checkThumbnailDimensions(r io.Reader, maxDimension int) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("couldn't read thumbnail dimensions: %w", err)
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return fmt.Errorf("%w: %dx%d, the limit is %d on either side", errThumbnailTooLarge, config.Width, config.Height, maxDimension)
+	}
+	return nil
+}
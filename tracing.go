@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is looked up on every span rather than once, so spans go to the
+// provider installed last, e.g. by a test.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter")
+}
+
+/**
+ * Export traces over OTLP/HTTP to endpoint
+ * Without an endpoint the global no-op tracer provider stays in place
+ */
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return installTracerProvider(exporter), nil
+}
+
+// installTracerProvider batches spans to exporter and makes it the global
+// provider. The returned shutdown flushes what is still buffered.
+func installTracerProvider(exporter sdktrace.SpanExporter) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("tubely"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// tracingMiddleware starts a server span for every request, continuing any
+// trace context sent by the caller.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		r = r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+		if r.Pattern != "" {
+			span.SetName(r.Pattern)
+		}
+	})
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func videoIDAttribute(videoID string) attribute.KeyValue {
+	return attribute.String("video.id", videoID)
+}
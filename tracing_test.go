@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// keptSpansExporter is an in-memory exporter whose spans outlive its
+// shutdown, which would otherwise clear them.
+type keptSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpansExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestServeFlushesTracesOnShutdown(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdownTracing := installTracerProvider(keptSpansExporter{exporter})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracer().Start(r.Context(), "video.load")
+		span.End()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := &http.Server{Handler: tracingMiddleware(mux)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, srv, listener, 5*time.Second, shutdownTracing)
+	}()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/api/videos/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Still buffered by the batcher
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Fatalf("%d spans exported before shutdown, want them batched", len(spans))
+	}
+
+	// What SIGTERM does
+	stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve didn't return after its context ended")
+	}
+
+	names := map[string]bool{}
+	for _, span := range exporter.GetSpans() {
+		names[span.Name] = true
+	}
+	for _, want := range []string{"GET /api/videos/{videoID}", "video.load"} {
+		if !names[want] {
+			t.Errorf("span %q wasn't flushed on shutdown, got %v", want, names)
+		}
+	}
+}
+
+// recordSpans exports every span ended for the rest of the test to the
+// returned in-memory exporter, synchronously.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+/**
+ * Check that each of children was exported as a child of the request span
+ * Returns the spans by name, the request span under "request"
+ */
+func requestSpans(t *testing.T, exporter *tracetest.InMemoryExporter, children ...string) map[string]tracetest.SpanStub {
+	t.Helper()
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanKind == trace.SpanKindServer {
+			spans["request"] = span
+			continue
+		}
+		spans[span.Name] = span
+	}
+	request, ok := spans["request"]
+	if !ok {
+		t.Fatalf("no request span among %d spans", len(exporter.GetSpans()))
+	}
+	for _, name := range children {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != request.SpanContext.SpanID() || span.SpanContext.TraceID() != request.SpanContext.TraceID() {
+			t.Errorf("%s isn't a child of the request span", name)
+		}
+	}
+	return spans
+}
+
+// spanAttribute is the value of key on span, or an invalid value.
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestUploadVideoSpans(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+	exporter := recordSpans(t)
+
+	w := httptest.NewRecorder()
+	tracingMiddleware(http.HandlerFunc(cfg.handlerUploadVideo)).ServeHTTP(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	spans := requestSpans(t, exporter, "upload.auth", "upload.probe", "upload.faststart", "upload.s3_put")
+	request := spans["request"]
+	if got := spanAttribute(request, "video.id").AsString(); got != video.ID.String() {
+		t.Errorf("request video.id = %q, want %s", got, video.ID)
+	}
+	if got := spanAttribute(request, "upload.size").AsInt64(); got != int64(len(testMP4)) {
+		t.Errorf("request upload.size = %d, want %d", got, len(testMP4))
+	}
+	if got := spanAttribute(request, "video.orientation").AsString(); got != "landscape" {
+		t.Errorf("request video.orientation = %q, want landscape", got)
+	}
+	if got := spanAttribute(spans["upload.faststart"], "output.format").AsString(); got != "mp4" {
+		t.Errorf("upload.faststart output.format = %q, want mp4", got)
+	}
+	if got := spanAttribute(spans["upload.s3_put"], "s3.key").AsString(); !strings.HasPrefix(got, "landscape/") {
+		t.Errorf("upload.s3_put s3.key = %q, want the stored key", got)
+	}
+}
+
+func TestUploadThumbnailSpans(t *testing.T) {
+	cfg, video, token := newThumbnailTest(t)
+	exporter := recordSpans(t)
+
+	w := httptest.NewRecorder()
+	tracingMiddleware(http.HandlerFunc(cfg.handlerUploadThumbnail)).ServeHTTP(w, newThumbnailUploadRequest(t, video, token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	spans := requestSpans(t, exporter, "thumbnail.auth", "thumbnail.probe", "thumbnail.store")
+	if got := spanAttribute(spans["request"], "video.id").AsString(); got != video.ID.String() {
+		t.Errorf("request video.id = %q, want %s", got, video.ID)
+	}
+	if got := spanAttribute(spans["thumbnail.probe"], "image.media_type").AsString(); got != "image/png" {
+		t.Errorf("thumbnail.probe image.media_type = %q, want image/png", got)
+	}
+	if got := spanAttribute(spans["thumbnail.store"], "thumbnail.file").AsString(); !strings.HasSuffix(got, ".png") {
+		t.Errorf("thumbnail.store thumbnail.file = %q, want the stored file", got)
+	}
+}
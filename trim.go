@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// keyframeTolerance is how close a cut has to be to a keyframe, in seconds,
+// for a stream copy to land on it.
+const keyframeTolerance = 0.01
+
+// trimRange is the part of an upload to keep, in seconds. A zero End means
+// the end of the video.
+type trimRange struct {
+	Start    float64
+	End      float64
+	Accurate bool
+}
+
+/**
+ * Parse the optional trimStart/trimEnd upload fields
+ * Returns nil when neither is set
+ */
+func parseTrimRange(start, end, accurate string, accurateDefault bool) (*trimRange, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	trim := &trimRange{Accurate: accurateDefault}
+	var err error
+	if start != "" {
+		trim.Start, err = strconv.ParseFloat(start, 64)
+		if err != nil || trim.Start < 0 {
+			return nil, fmt.Errorf("invalid trimStart: %q", start)
+		}
+	}
+	if end != "" {
+		trim.End, err = strconv.ParseFloat(end, 64)
+		if err != nil || trim.End <= trim.Start {
+			return nil, fmt.Errorf("trimEnd must be a number after trimStart: %q", end)
+		}
+	}
+	if accurate != "" {
+		trim.Accurate, err = strconv.ParseBool(accurate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trimAccurate: %q", accurate)
+		}
+	}
+	return trim, nil
+}
+
+// validate checks the range against the probed duration of the video.
+func (t trimRange) validate(duration float64) error {
+	if t.Start >= duration {
+		return fmt.Errorf("trimStart %.3fs is past the end of the %.3fs video", t.Start, duration)
+	}
+	if t.End > duration {
+		return fmt.Errorf("trimEnd %.3fs is past the end of the %.3fs video", t.End, duration)
+	}
+	return nil
+}
+
+/**
+ * Cut the trim range out of a video into a new file
+ * Fast mode stream-copies from the keyframe before Start, so the cut can be
+ * slightly early; accurate mode re-encodes to land on the exact frame
+ */
+func trimVideo(ctx context.Context, filePath string, trim trimRange) (string, error) {
+	outputPath := filePath + ".trimmed.mp4"
+	start := strconv.FormatFloat(trim.Start, 'f', 3, 64)
+
+	args := []string{"-y"}
+	if !trim.Accurate {
+		args = append(args, "-ss", start)
+	}
+	args = append(args, "-i", filePath)
+	if trim.Accurate {
+		args = append(args, "-ss", start)
+	}
+	if trim.End > 0 {
+		// -t rather than -to, as -to is relative to the input when -ss
+		// comes before -i
+		args = append(args, "-t", strconv.FormatFloat(trim.End-trim.Start, 'f', 3, 64))
+	}
+	if trim.Accurate {
+		args = append(args, "-c:v", "libx264", "-c:a", "aac")
+	} else {
+		args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero")
+	}
+	args = append(args, outputPath)
+
+	command := commandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return outputPath, nil
+}
+
+/**
+ * Report whether a video has a keyframe at seconds
+ * Only keyframes in the second around it are read, not the whole file
+ */
+func isKeyframeAt(ctx context.Context, filePath string, seconds float64) (bool, error) {
+	if seconds == 0 {
+		return true, nil
+	}
+	interval := fmt.Sprintf("%s%%+2", strconv.FormatFloat(max(seconds-1, 0), 'f', 3, 64))
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-skip_frame", "nokey",
+		"-read_intervals", interval, "-show_entries", "frame=best_effort_timestamp_time", "-print_format", "json", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return false, err
+	}
+
+	var ffprobeOutput struct {
+		Frames []struct {
+			Timestamp string `json:"best_effort_timestamp_time"`
+		} `json:"frames"`
+	}
+	err = json.Unmarshal([]byte(out.String()), &ffprobeOutput)
+	if err != nil {
+		return false, err
+	}
+	for _, frame := range ffprobeOutput.Frames {
+		timestamp, err := strconv.ParseFloat(frame.Timestamp, 64)
+		if err == nil && math.Abs(timestamp-seconds) <= keyframeTolerance {
+			return true, nil
+		}
+	}
+	return false, nil
+}
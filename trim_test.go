@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTrimRange(t *testing.T) {
+	tests := []struct {
+		name                 string
+		start, end, accurate string
+		accurateDefault      bool
+		want                 *trimRange
+		wantErr              bool
+	}{
+		{name: "no trim", want: nil},
+		{name: "start only", start: "2", want: &trimRange{Start: 2}},
+		{name: "both", start: "2", end: "6.5", want: &trimRange{Start: 2, End: 6.5}},
+		{name: "accurate by default", end: "4", accurateDefault: true, want: &trimRange{End: 4, Accurate: true}},
+		{name: "accurate requested", start: "1", accurate: "true", want: &trimRange{Start: 1, Accurate: true}},
+		{name: "negative start", start: "-1", wantErr: true},
+		{name: "end before start", start: "5", end: "2", wantErr: true},
+		{name: "not a number", start: "two", wantErr: true},
+		{name: "bad accurate flag", start: "1", accurate: "maybe", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTrimRange(tt.start, tt.end, tt.accurate, tt.accurateDefault)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("%s: parseTrimRange = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadVideoTrim(t *testing.T) {
+	// The probed video is 12.5s long
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Records the arguments of the trim
+	installFakeTool(t, "ffmpeg", `for last in "$@"; do :; done
+case "$last" in
+*.trimmed.mp4) echo "$*" > "$FAKE_FFMPEG_TRIM" ;;
+esac
+PATH="${PATH#*:}" exec ffmpeg "$@"
+`)
+	tests := []struct {
+		name     string
+		query    url.Values
+		wantCode int
+		wantArgs []string
+	}{
+		{name: "fast", query: url.Values{"trimStart": {"2"}, "trimEnd": {"6"}}, wantCode: http.StatusOK, wantArgs: []string{"-ss 2.000 -i", "-t 4.000", "-c copy"}},
+		{name: "accurate", query: url.Values{"trimStart": {"2"}, "trimAccurate": {"true"}}, wantCode: http.StatusOK, wantArgs: []string{"-ss 2.000 -c:v libx264"}},
+		{name: "to the end", query: url.Values{"trimEnd": {"12.5"}}, wantCode: http.StatusOK, wantArgs: []string{"-t 12.500"}},
+		{name: "start past the end", query: url.Values{"trimStart": {"20"}}, wantCode: http.StatusBadRequest},
+		{name: "end past the end", query: url.Values{"trimStart": {"2"}, "trimEnd": {"15"}}, wantCode: http.StatusBadRequest},
+		{name: "end before start", query: url.Values{"trimStart": {"6"}, "trimEnd": {"2"}}, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := filepath.Join(t.TempDir(), "args")
+			t.Setenv("FAKE_FFMPEG_TRIM", args)
+			cfg, store, video, token := newS3Test(t)
+
+			req := newVideoUploadRequest(t, video, token, "video/mp4", testMP4)
+			req.URL.RawQuery = tt.query.Encode()
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			recorded, err := os.ReadFile(args)
+			if tt.wantCode != http.StatusOK {
+				if err == nil {
+					t.Errorf("video was trimmed: ffmpeg %s", recorded)
+				}
+				if len(store.objects) != 0 {
+					t.Errorf("rejected trim stored %d files", len(store.objects))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("video wasn't trimmed: %v", err)
+			}
+			for _, want := range tt.wantArgs {
+				if !strings.Contains(string(recorded), want) {
+					t.Errorf("ffmpeg %s, want %q", strings.TrimSpace(string(recorded)), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// maxUploadFieldBytes caps the text fields sent ahead of the file part.
+const maxUploadFieldBytes = 64 << 10
+
+/**
+ * A multipart upload read as a stream
+ * Nothing is spooled to memory or disk: the text fields in front of the
+ * file part are collected and the file part is handed out unread. Fields
+ * after the file are never seen, so clients put them first or in the
+ * query string
+ */
+type uploadForm struct {
+	query  url.Values
+	fields url.Values
+	file   *multipart.Part
+}
+
+// readUploadForm reads r's multipart body up to the part named fileField.
+func readUploadForm(r *http.Request, fileField string) (*uploadForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &uploadForm{query: r.URL.Query(), fields: url.Values{}}
+	remaining := int64(maxUploadFieldBytes)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == fileField {
+			form.file = part
+			return form, nil
+		}
+		if part.FileName() != "" {
+			// Other files aren't ours to read
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, remaining+1))
+		if err != nil {
+			return nil, err
+		}
+		remaining -= int64(len(value))
+		if remaining < 0 {
+			return nil, fmt.Errorf("form fields are larger than %d bytes", maxUploadFieldBytes)
+		}
+		form.fields.Add(part.FormName(), string(value))
+	}
+}
+
+// value is the field sent before the file, else the query parameter, the
+// same precedence as r.FormValue.
+func (f *uploadForm) value(key string) string {
+	if values := f.fields[key]; len(values) > 0 {
+		return values[0]
+	}
+	return f.query.Get(key)
+}
+
+/**
+ * Respond to an error reading the request body
+ * Over the size cap is a 413 and a body that ended early a truncated
+ * upload. Returns false, without responding, for any other error
+ */
+func respondWithBodyError(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		respondWithErrorType(w, http.StatusRequestEntityTooLarge, problemUploadTooLarge, fmt.Sprintf("Upload is larger than %d bytes", tooLarge.Limit), err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// The client went away mid-upload
+		respondWithError(w, http.StatusBadRequest, "Upload truncated", err)
+	default:
+		return false
+	}
+	return true
+}
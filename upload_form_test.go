@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadUploadForm(t *testing.T) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("profile", "archive")
+	file, err := form.CreateFormFile("video", "upload.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(testMP4))
+	form.WriteField("expiresIn", "1h")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/id?profile=ignored&trimStart=2", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	upload, err := readUploadForm(req, "video")
+	if err != nil {
+		t.Fatalf("readUploadForm: %v", err)
+	}
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{field: "profile", want: "archive"},
+		{field: "trimStart", want: "2"},
+		// Sent after the file, too late to be read
+		{field: "expiresIn", want: ""},
+	}
+	for _, tt := range tests {
+		if got := upload.value(tt.field); got != tt.want {
+			t.Errorf("value(%s) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+	data, err := io.ReadAll(upload.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.file.FileName() != "upload.mp4" || string(data) != testMP4 {
+		t.Errorf("file part %s holds %q, want upload.mp4 with the upload", upload.file.FileName(), data)
+	}
+}
+
+func TestReadUploadFormWithoutFile(t *testing.T) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("profile", "archive")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/id", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	_, err := readUploadForm(req, "video")
+	if !errors.Is(err, http.ErrMissingFile) {
+		t.Errorf("readUploadForm without a video part: %v, want http.ErrMissingFile", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var errUploadQuotaExceeded = errors.New("upload would exceed the storage quota")
+
+/**
+ * Check that storing size bytes for video keeps its owner within quota
+ * size is measured after processing. The video's current file doesn't
+ * count, a re-upload replaces it. Filling the quota exactly is allowed
+ */
+func (cfg *apiConfig) checkUploadQuota(video database.Video, size int64) error {
+	if cfg.userQuotaBytes <= 0 {
+		return nil
+	}
+	used, err := cfg.db.SumFileSizes(video.UserID, video.ID)
+	if err != nil {
+		return err
+	}
+	if used+size > cfg.userQuotaBytes {
+		return fmt.Errorf("%w: %d bytes used of %d, upload is %d", errUploadQuotaExceeded, used, cfg.userQuotaBytes, size)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestUploadVideoQuota(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	// Processing grows the file, the quota counts what's stored
+	installFakeTool(t, "ffmpeg", `PATH="${PATH#*:}" ffmpeg "$@" || exit 1
+for last; do :; done
+printf 'moov' >> "$last"
+`)
+	const existing = 1000
+	processed := int64(len(testMP4) + len("moov"))
+	tests := []struct {
+		name     string
+		quota    int64
+		wantCode int
+	}{
+		{name: "under quota", quota: existing + processed + 1, wantCode: http.StatusOK},
+		{name: "at the limit", quota: existing + processed, wantCode: http.StatusOK},
+		{name: "over quota", quota: existing + processed - 1, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "no quota", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store, video, token := newS3Test(t)
+			cfg.userQuotaBytes = tt.quota
+			// Counted: another video of the same user
+			stored, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "stored", UserID: video.UserID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := int64(existing)
+			stored.FileSize = &size
+			err = cfg.db.UpdateVideo(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Not counted: the file this upload replaces
+			replaced := int64(1 << 40)
+			video.FileSize = &replaced
+			err = cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			uploaded, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode != http.StatusOK {
+				if len(store.objects) != 0 || uploaded.VideoURL != nil {
+					t.Errorf("over-quota upload stored %d files and saved %v", len(store.objects), uploaded.VideoURL)
+				}
+				return
+			}
+			if uploaded.FileSize == nil || *uploaded.FileSize != processed {
+				t.Errorf("file size = %v, want the processed %d bytes", uploaded.FileSize, processed)
+			}
+		})
+	}
+}
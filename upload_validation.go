@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// uploadRejection is an upload the checks refused. status and message are
+// what the client is told; retrying can't change the outcome.
+type uploadRejection struct {
+	status  int
+	message string
+	// problemType is set when message carries values
+	problemType string
+}
+
+func (e *uploadRejection) Error() string {
+	return e.message
+}
+
+// videoSource is a local copy of an upload that is about to be processed.
+type videoSource struct {
+	path      string
+	mediaType string
+	// head and sha256 describe the bytes as uploaded, which differ from
+	// path once it was trimmed. Both are read from path when empty
+	head   []byte
+	sha256 string
+}
+
+/**
+ * Run the checks every new video goes through before it is processed
+ * Multipart, direct and queued uploads and trimmed clips all come through
+ * here: the content must be of the declared type, its hash must not be
+ * banned, and its pixel rate and duration must be within limits. Returns
+ * the path to process, a reduced copy when the pixel rate was over the
+ * limit; the caller removes it when it differs from source.path
+ */
+func (cfg *apiConfig) validateVideoSource(ctx context.Context, video database.Video, source videoSource) (string, error) {
+	recorder := processingRecorderFrom(ctx)
+	head := source.head
+	if head == nil {
+		file, err := os.Open(source.path)
+		if err != nil {
+			return "", err
+		}
+		head, _, err = peekUpload(file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if !contentMatchesMediaType(source.mediaType, head) {
+		return "", &uploadRejection{status: http.StatusBadRequest, message: "File content doesn't match its media type"}
+	}
+
+	if cfg.bannedHashes != nil {
+		hash := source.sha256
+		if hash == "" {
+			var err error
+			hash, err = sha256File(source.path)
+			if err != nil {
+				return "", err
+			}
+		}
+		err := cfg.checkBannedHash(hash, video)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Guard against videos that are too heavy to decode, e.g. 4K at 120fps
+	sourcePath := source.path
+	if cfg.maxPixelRate > 0 {
+		endStep := recorder.step("probe_geometry")
+		geometry, err := getVideoGeometry(ctx, sourcePath)
+		endStep(err)
+		if err != nil {
+			return "", fmt.Errorf("couldn't probe video geometry: %w", err)
+		}
+		recorder.input("width", strconv.Itoa(geometry.Width))
+		recorder.input("height", strconv.Itoa(geometry.Height))
+		recorder.input("fps", strconv.FormatFloat(geometry.FPS, 'f', -1, 64))
+		if geometry.PixelRate() > cfg.maxPixelRate {
+			if cfg.pixelRateAction == pixelRateActionReject {
+				return "", &uploadRejection{
+					status:      http.StatusUnprocessableEntity,
+					message:     fmt.Sprintf("Video pixel rate %.0f exceeds the limit of %.0f pixels per second", geometry.PixelRate(), cfg.maxPixelRate),
+					problemType: problemPixelRateTooHigh,
+				}
+			}
+			recorder.warn(fmt.Sprintf("pixel rate %.0f is over the limit of %.0f, reduced with %s", geometry.PixelRate(), cfg.maxPixelRate, cfg.pixelRateAction))
+			endStep := recorder.step("limit_pixel_rate")
+			limitedPath, err := limitPixelRate(ctx, sourcePath, geometry, cfg.maxPixelRate, cfg.pixelRateAction)
+			endStep(err)
+			if err != nil {
+				return "", fmt.Errorf("couldn't reduce video pixel rate: %w", err)
+			}
+			sourcePath = limitedPath
+		}
+	}
+
+	// Catch accidental sub-second clips and overly long videos
+	endStep := recorder.step("check_duration")
+	rejection, err := cfg.checkVideoDuration(ctx, sourcePath)
+	endStep(err)
+	if err == nil && rejection != "" {
+		recorder.warn(rejection)
+		err = &uploadRejection{status: http.StatusUnprocessableEntity, message: rejection, problemType: problemVideoDuration}
+	}
+	if err != nil {
+		if sourcePath != source.path {
+			os.Remove(sourcePath)
+		}
+		return "", err
+	}
+	return sourcePath, nil
+}
+
+// checkBannedHash rejects content whose hex SHA-256 is on the banned list,
+// leaving an audit line for every match.
+func (cfg *apiConfig) checkBannedHash(hash string, video database.Video) error {
+	if cfg.bannedHashes == nil {
+		return nil
+	}
+	banned, err := cfg.bannedHashes.IsBanned(hash)
+	if err != nil {
+		return fmt.Errorf("couldn't check upload hash: %w", err)
+	}
+	if banned {
+		log.Printf("audit: rejected banned upload hash=%s video=%s user=%s", hash, video.ID, video.UserID)
+		return &uploadRejection{status: http.StatusUnavailableForLegalReasons, message: "This content is not allowed"}
+	}
+	return nil
+}
+
+// sha256File returns the hex SHA-256 of a file's contents.
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+ * Respond to an error from the upload pipeline
+ * Rejections and quota errors are the client's, anything else is answered
+ * like other processing errors
+ */
+func respondWithUploadError(w http.ResponseWriter, procCtx context.Context, msg string, err error) {
+	var rejection *uploadRejection
+	switch {
+	case errors.As(err, &rejection):
+		respondWithErrorType(w, rejection.status, rejection.problemType, rejection.message, err)
+	case errors.Is(err, errUploadQuotaExceeded):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", err)
+	default:
+		respondWithProcessingError(w, procCtx, http.StatusInternalServerError, msg, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// How video URLs appear in event payloads (EVENT_URL_MODE)
+const (
+	// The URL as stored on the video
+	eventURLStored = "stored"
+	// A short-lived presigned URL plus where to get a new one
+	eventURLSigned = "signed"
+	// Only the object key plus where to get a URL
+	eventURLKey = "key"
+)
+
+// videoEventData is the video as sent in events, with what consumers need
+// to get a working link once the one in the payload has expired.
+type videoEventData struct {
+	database.Video
+	VideoKey     string     `json:"video_key,omitempty"`
+	RefreshURL   string     `json:"refresh_url,omitempty"`
+	URLExpiresAt *time.Time `json:"url_expires_at,omitempty"`
+}
+
+func refreshURLPath(videoID uuid.UUID) string {
+	return fmt.Sprintf("/api/videos/%s/refresh-url", videoID)
+}
+
+/**
+ * Build the event payload for a video according to EVENT_URL_MODE
+ * Falls back to the stored URL when the video can't be signed
+ */
+func (cfg *apiConfig) videoEventData(ctx context.Context, video database.Video) any {
+	if cfg.eventURLMode == eventURLStored || video.VideoURL == nil {
+		return video
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(*video.VideoURL)
+	if !ok {
+		return video
+	}
+
+	data := videoEventData{Video: video, RefreshURL: refreshURLPath(video.ID)}
+	if cfg.eventURLMode == eventURLKey {
+		data.VideoURL = nil
+		data.VideoKey = key
+		return data
+	}
+	url, err := cfg.signGetURL(ctx, bucket, key, cfg.eventURLTTL, presignOverrides{})
+	if err != nil {
+		log.Printf("Couldn't sign event URL for video %s: %v", video.ID, err)
+		return video
+	}
+	expiresAt := time.Now().UTC().Add(cfg.eventURLTTL)
+	data.VideoURL = &url
+	data.URLExpiresAt = &expiresAt
+	return data
+}
+
+/**
+ * Hand out a freshly signed video URL
+ * For event consumers whose payload link has expired; every call signs anew
+ * instead of reusing a cached URL
+ */
+func (cfg *apiConfig) handlerVideoRefreshURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoURL  string    `json:"video_url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID && !cfg.isAdmin(userID) {
+		respondWithError(w, http.StatusForbidden, "Not your video", nil)
+		return
+	}
+	if video.IsExpired(time.Now()) {
+		respondWithError(w, http.StatusGone, "Video has expired", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has not been uploaded yet", nil)
+		return
+	}
+	bucket, key, ok := cfg.s3ObjectFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	url, err := cfg.signGetURL(r.Context(), bucket, key, cfg.eventURLTTL, presignOverrides{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		VideoURL:  url,
+		ExpiresAt: time.Now().UTC().Add(cfg.eventURLTTL),
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestVideoEventData(t *testing.T) {
+	cfg, _, video, _ := newS3Test(t)
+	cfg.eventURLTTL = 5 * time.Minute
+	videoURL := cfg.s3CfDistribution + "/landscape/event.mp4"
+	video.VideoURL = &videoURL
+
+	tests := []struct {
+		mode        string
+		wantSigned  bool
+		wantKey     string
+		wantRefresh bool
+	}{
+		{mode: eventURLStored},
+		{mode: eventURLSigned, wantSigned: true, wantRefresh: true},
+		{mode: eventURLKey, wantKey: "landscape/event.mp4", wantRefresh: true},
+	}
+	for _, tt := range tests {
+		cfg.eventURLMode = tt.mode
+		var got struct {
+			VideoURL     *string    `json:"video_url"`
+			VideoKey     string     `json:"video_key"`
+			RefreshURL   string     `json:"refresh_url"`
+			URLExpiresAt *time.Time `json:"url_expires_at"`
+		}
+		err := json.Unmarshal([]byte(mustJSON(t, cfg.videoEventData(context.Background(), video))), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case tt.wantSigned:
+			if got.VideoURL == nil || !strings.Contains(*got.VideoURL, "X-Amz-Signature=") || got.URLExpiresAt == nil {
+				t.Errorf("%s: video URL = %v expiring %v, want a signed URL with its expiry", tt.mode, got.VideoURL, got.URLExpiresAt)
+			}
+		case tt.wantKey != "":
+			if got.VideoURL != nil || got.VideoKey != tt.wantKey {
+				t.Errorf("%s: video URL = %v and key %q, want only the key %s", tt.mode, got.VideoURL, got.VideoKey, tt.wantKey)
+			}
+		default:
+			if got.VideoURL == nil || *got.VideoURL != videoURL {
+				t.Errorf("%s: video URL = %v, want the stored %s", tt.mode, got.VideoURL, videoURL)
+			}
+		}
+		if wantRefresh := refreshURLPath(video.ID); (got.RefreshURL == wantRefresh) != tt.wantRefresh {
+			t.Errorf("%s: refresh URL = %q", tt.mode, got.RefreshURL)
+		}
+	}
+}
+
+func TestVideoRefreshURL(t *testing.T) {
+	cfg, _, video, token := newS3Test(t)
+	var signs atomic.Int64
+	cfg.s3Client = newCountingS3Client(&signs)
+	// Refreshing must not hand back a cached link
+	cfg.presignCache = newPresignCache(10, time.Hour)
+	cfg.eventURLTTL = 5 * time.Minute
+	videoURL := cfg.s3CfDistribution + "/landscape/event.mp4"
+	video.VideoURL = &videoURL
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminID := uuid.New()
+	cfg.adminUserIDs = map[uuid.UUID]bool{adminID: true}
+	adminToken, err := auth.MakeJWT(adminID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "not uploaded", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		video     database.Video
+		token     string
+		wantCode  int
+		wantSigns int64
+	}{
+		{name: "owner", video: video, token: token, wantCode: http.StatusOK, wantSigns: 1},
+		{name: "owner again", video: video, token: token, wantCode: http.StatusOK, wantSigns: 2},
+		{name: "admin", video: video, token: adminToken, wantCode: http.StatusOK, wantSigns: 3},
+		{name: "someone else", video: video, token: otherToken, wantCode: http.StatusForbidden, wantSigns: 3},
+		{name: "not uploaded", video: pending, token: token, wantCode: http.StatusNotFound, wantSigns: 3},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoRefreshURL(w, newVideoRequest(http.MethodPost, refreshURLPath(tt.video.ID), tt.video, tt.token, ""))
+		if w.Code != tt.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+		if got := signs.Load(); got != tt.wantSigns {
+			t.Errorf("%s: signed %d times, want %d", tt.name, got, tt.wantSigns)
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			VideoURL  string    `json:"video_url"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := url.Parse(resp.VideoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := signed.Query()
+		if query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") != "300" {
+			t.Errorf("%s: URL %s isn't signed for 5 minutes", tt.name, resp.VideoURL)
+		}
+		signedAt, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+		if err != nil || time.Since(signedAt) > time.Minute {
+			t.Errorf("%s: URL was signed at %s, want just now", tt.name, query.Get("X-Amz-Date"))
+		}
+		if until := time.Until(resp.ExpiresAt); until > cfg.eventURLTTL || until < cfg.eventURLTTL-time.Minute {
+			t.Errorf("%s: expires in %s, want about %s", tt.name, until, cfg.eventURLTTL)
+		}
+	}
+
+	// Expired videos get no new links
+	expired := time.Now().Add(-time.Minute)
+	video.ExpiresAt = &expired
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerVideoRefreshURL(w, newVideoRequest(http.MethodPost, refreshURLPath(video.ID), video, token, ""))
+	if w.Code != http.StatusGone {
+		t.Errorf("expired video: status = %d, want 410", w.Code)
+	}
+}
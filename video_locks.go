@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// videoLocker tracks which videos have work in flight so the same video is
+// never processed twice at once.
+type videoLocker struct {
+	mu sync.Mutex
+	// Closed when the lock is released, to wake up waiters
+	locked map[uuid.UUID]chan struct{}
+}
+
+func newVideoLocker() *videoLocker {
+	return &videoLocker{locked: make(map[uuid.UUID]chan struct{})}
+}
+
+// TryLock reports whether the lock was acquired. It never blocks.
+func (l *videoLocker) TryLock(videoID uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.locked[videoID]; ok {
+		return false
+	}
+	l.locked[videoID] = make(chan struct{})
+	return true
+}
+
+// Lock waits for the lock until ctx is done.
+func (l *videoLocker) Lock(ctx context.Context, videoID uuid.UUID) error {
+	for {
+		l.mu.Lock()
+		released, ok := l.locked[videoID]
+		if !ok {
+			l.locked[videoID] = make(chan struct{})
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *videoLocker) Unlock(videoID uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if released, ok := l.locked[videoID]; ok {
+		close(released)
+		delete(l.locked, videoID)
+	}
+}
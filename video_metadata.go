@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoMetadata is what one ffprobe run tells us about the first video
+// stream. Zero values mean ffprobe didn't report the field.
+type videoMetadata struct {
+	Codec string
+	// Width and Height are the displayed size, after Rotation
+	Width    int
+	Height   int
+	BitRate  int64
+	Duration float64
+	// Rotation is the display rotation in degrees, 0 when upright
+	Rotation int
+}
+
+/**
+ * Probe the codec, size, bit rate and running time of a video
+ * Duration comes from the format section, since stream durations are often
+ * missing from mkv and webm; the stream's is only a fallback. Bit rate is
+ * the video stream's, then the container's
+ */
+func getVideoMetadata(ctx context.Context, filePath string) (videoMetadata, error) {
+	command := commandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-print_format", "json",
+		"-show_entries", "stream=codec_name,width,height,bit_rate,duration:stream_side_data=rotation:stream_tags=rotate:format=duration,bit_rate", filePath)
+	var out strings.Builder
+	command.Stdout = &out
+
+	err := command.Run()
+	if err != nil {
+		return videoMetadata{}, err
+	}
+	return parseVideoMetadata([]byte(out.String()))
+}
+
+func parseVideoMetadata(data []byte) (videoMetadata, error) {
+	var ffprobeOutput struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			BitRate   string `json:"bit_rate"`
+			Duration  string `json:"duration"`
+			// Listed by stream_side_data, but ffprobe nests it as side_data_list
+			SideDataList []probeSideData `json:"side_data_list"`
+			Tags         struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			BitRate  string `json:"bit_rate"`
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	err := json.Unmarshal(data, &ffprobeOutput)
+	if err != nil {
+		return videoMetadata{}, err
+	}
+
+	metadata := videoMetadata{
+		BitRate:  parseProbeInt(ffprobeOutput.Format.BitRate),
+		Duration: parseProbeFloat(ffprobeOutput.Format.Duration),
+	}
+	if len(ffprobeOutput.Streams) == 0 {
+		return metadata, nil
+	}
+	stream := ffprobeOutput.Streams[0]
+	metadata.Codec = stream.CodecName
+	metadata.Width = stream.Width
+	metadata.Height = stream.Height
+	metadata.Rotation = streamRotation(stream.SideDataList, stream.Tags.Rotate)
+	if isQuarterTurn(metadata.Rotation) {
+		metadata.Width, metadata.Height = metadata.Height, metadata.Width
+	}
+	if bitRate := parseProbeInt(stream.BitRate); bitRate > 0 {
+		metadata.BitRate = bitRate
+	}
+	if metadata.Duration == 0 {
+		metadata.Duration = parseProbeFloat(stream.Duration)
+	}
+	return metadata, nil
+}
+
+// parseProbeInt reads an ffprobe number, treating "N/A" and garbage as 0.
+func parseProbeInt(value string) int64 {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+func parseProbeFloat(value string) float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return 0
+	}
+	return f
+}
+
+// apply stores metadata on video, clearing whatever wasn't reported.
+func (m videoMetadata) apply(video *database.Video) {
+	video.VideoCodec, video.Width, video.Height, video.BitRate, video.Duration = nil, nil, nil, nil, nil
+	if m.Codec != "" {
+		video.VideoCodec = &m.Codec
+	}
+	if m.Width > 0 && m.Height > 0 {
+		video.Width = &m.Width
+		video.Height = &m.Height
+	}
+	if m.BitRate > 0 {
+		video.BitRate = &m.BitRate
+	}
+	if m.Duration > 0 {
+		video.Duration = &m.Duration
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ffprobe output for a phone recording held upright, trimmed to the
+// entries getVideoMetadata asks for
+const phoneProbeOutput = `{
+	"programs": [],
+	"streams": [
+		{
+			"codec_name": "hevc",
+			"width": 1920,
+			"height": 1080,
+			"bit_rate": "7812345",
+			"duration": "8.433333",
+			"side_data_list": [
+				{"side_data_type": "Display Matrix", "displaymatrix": "\n00000000:            0       65536           0\n", "rotation": -90}
+			],
+			"tags": {"rotate": "270"}
+		}
+	],
+	"format": {"duration": "8.450000", "bit_rate": "7950123"}
+}`
+
+func TestParseVideoMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   videoMetadata
+	}{
+		{
+			name:   "phone recording",
+			output: phoneProbeOutput,
+			want:   videoMetadata{Codec: "hevc", Width: 1080, Height: 1920, BitRate: 7812345, Duration: 8.45, Rotation: 270},
+		},
+		{
+			name:   "webm without stream duration or bit rate",
+			output: `{"streams": [{"codec_name": "vp9", "width": 1280, "height": 720}], "format": {"duration": "30.016000", "bit_rate": "1503221"}}`,
+			want:   videoMetadata{Codec: "vp9", Width: 1280, Height: 720, BitRate: 1503221, Duration: 30.016},
+		},
+		{
+			name:   "container without duration",
+			output: `{"streams": [{"codec_name": "h264", "width": 640, "height": 480, "bit_rate": "N/A", "duration": "4.000000"}], "format": {"duration": "N/A", "bit_rate": "N/A"}}`,
+			want:   videoMetadata{Codec: "h264", Width: 640, Height: 480, Duration: 4},
+		},
+		{
+			name:   "no video stream",
+			output: `{"streams": [], "format": {"duration": "12.500000", "bit_rate": "128000"}}`,
+			want:   videoMetadata{BitRate: 128000, Duration: 12.5},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseVideoMetadata([]byte(tt.output))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := parseVideoMetadata([]byte("not json")); err == nil {
+		t.Error("parsing garbage succeeded")
+	}
+}
+
+func TestUploadVideoStoresMetadata(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, _, video, token := newS3Test(t)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Width    int     `json:"width"`
+		Height   int     `json:"height"`
+		Duration float64 `json:"duration_seconds"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Width != 1280 || resp.Height != 720 || resp.Duration != 12.5 {
+		t.Errorf("response has %dx%d for %vs, want 1280x720 for 12.5s", resp.Width, resp.Height, resp.Duration)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoCodec == nil || *stored.VideoCodec != "h264" || stored.BitRate == nil || *stored.BitRate != 2500000 ||
+		stored.Width == nil || *stored.Width != 1280 || stored.Duration == nil || *stored.Duration != 12.5 {
+		t.Errorf("stored metadata = %s, want h264 1280x720 at 2500000 b/s for 12.5s", mustJSON(t, stored))
+	}
+}
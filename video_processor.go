@@ -0,0 +1,27 @@
+package main
+
+import "context"
+
+// videoProcessor is what probes and remuxes uploads. ffmpegProcessor is the
+// one in use; a native mp4 parser could stand in for it.
+type videoProcessor interface {
+	aspectRatio(ctx context.Context, filePath string) (string, error)
+	fastStart(ctx context.Context, filePath, inputType string) (string, error)
+}
+
+// ffmpegProcessor shells out to ffprobe and ffmpeg, each run bounded by
+// processTimeout.
+type ffmpegProcessor struct {
+	cfg *apiConfig
+}
+
+func (p ffmpegProcessor) aspectRatio(ctx context.Context, filePath string) (string, error) {
+	probeCtx, cancel := p.cfg.withProcessTimeout(ctx)
+	defer cancel()
+	ratio, err := getVideoAspectRatio(probeCtx, filePath)
+	return ratio, processTimeoutError(probeCtx, err)
+}
+
+func (p ffmpegProcessor) fastStart(ctx context.Context, filePath, inputType string) (string, error) {
+	return p.cfg.processVideoForFastStart(ctx, filePath, inputType)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// stubProcessor answers with a fixed aspect ratio and "remuxes" by
+// prefixing the file with "faststart:".
+type stubProcessor struct {
+	ratio string
+}
+
+func (p stubProcessor) aspectRatio(ctx context.Context, filePath string) (string, error) {
+	return p.ratio, nil
+}
+
+func (p stubProcessor) fastStart(ctx context.Context, filePath, inputType string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	outputPath := filePath + ".processing"
+	return outputPath, os.WriteFile(outputPath, append([]byte("faststart:"), data...), 0600)
+}
+
+func TestUploadVideoUsesProcessor(t *testing.T) {
+	// The other probes still come from the fake tools, which say 16:9
+	installFakeProcessingTools(t, fakeProbeOutput)
+	cfg, store, video, token := newS3Test(t)
+	cfg.processor = stubProcessor{ratio: "9:16"}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if len(store.objects) != 1 {
+		t.Fatalf("stored %d files, want 1", len(store.objects))
+	}
+	for key, data := range store.objects {
+		if !strings.HasPrefix(key, "portrait/") {
+			t.Errorf("stored at %s, want the processor's portrait/ prefix", key)
+		}
+		if string(data) != "faststart:"+testMP4 {
+			t.Errorf("stored %q, want the processor's output", data)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	webhookEventReady   = "video.ready"
+	webhookEventFailed  = "video.failed"
+	webhookEventDeleted = "video.deleted"
+)
+
+var webhookEventTypes = []string{webhookEventReady, webhookEventFailed, webhookEventDeleted}
+
+// webhookEndpoint is one subscriber. An empty Events list receives every
+// event type.
+type webhookEndpoint struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (e webhookEndpoint) wants(event string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, event)
+}
+
+type webhookEvent struct {
+	Type      string    `json:"type"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data,omitempty"`
+}
+
+// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+// request body, keyed with WEBHOOK_SECRET.
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+type webhookDispatcher struct {
+	endpoints []webhookEndpoint
+	client    *http.Client
+	secret    []byte
+	attempts  int
+	// SNS topics or SQS queues that get every event
+	publishers      []eventPublisher
+	publishAttempts int
+}
+
+/**
+ * Read webhook endpoints from a JSON file
+ * The file holds a list of {"url": ..., "events": [...]} objects. Requests
+ * are signed with secret when it is set and tried up to attempts times
+ */
+func loadWebhookDispatcher(path, secret string, attempts int, timeout time.Duration) (*webhookDispatcher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []webhookEndpoint{}
+	err = json.Unmarshal(data, &endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", path, err)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.URL == "" {
+			return nil, fmt.Errorf("webhook endpoint without url in %s", path)
+		}
+		for _, event := range endpoint.Events {
+			if !slices.Contains(webhookEventTypes, event) {
+				return nil, fmt.Errorf("unknown webhook event type %q for %s", event, endpoint.URL)
+			}
+		}
+	}
+	return &webhookDispatcher{
+		endpoints: endpoints,
+		client:    &http.Client{Timeout: timeout},
+		secret:    []byte(secret),
+		attempts:  max(attempts, 1),
+	}, nil
+}
+
+/**
+ * Send an event to every endpoint subscribed to its type and to every
+ * publisher
+ * Delivery happens in the background and failures are only logged
+ */
+func (d *webhookDispatcher) dispatch(eventType string, videoID uuid.UUID, data any) {
+	if d == nil {
+		return
+	}
+	event := webhookEvent{
+		Type:      eventType,
+		VideoID:   videoID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Couldn't encode webhook event %s: %v", eventType, err)
+		return
+	}
+
+	for _, endpoint := range d.endpoints {
+		if !endpoint.wants(eventType) {
+			continue
+		}
+		go d.deliver(endpoint, eventType, body)
+	}
+	for _, publisher := range d.publishers {
+		go d.publish(publisher, eventType, body)
+	}
+}
+
+// signature is the webhookSignatureHeader value for body, or "" when no
+// secret is configured.
+func (d *webhookDispatcher) signature(body []byte) string {
+	if len(d.secret) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * POST one event to an endpoint, retrying with backoff
+ * Network errors, 429 and 5xx responses are retried; any other status means
+ * the receiver has seen the event
+ */
+func (d *webhookDispatcher) deliver(endpoint webhookEndpoint, eventType string, body []byte) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= d.attempts; attempt++ {
+		var retry bool
+		retry, err = d.post(endpoint, eventType, body)
+		if !retry {
+			return
+		}
+		if attempt < d.attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Printf("Couldn't deliver %s webhook to %s after %d attempts: %v", eventType, endpoint.URL, d.attempts, err)
+}
+
+func (d *webhookDispatcher) post(endpoint webhookEndpoint, eventType string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Couldn't build webhook request for %s: %v", endpoint.URL, err)
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", eventType)
+	if signature := d.signature(body); signature != "" {
+		req.Header.Set(webhookSignatureHeader, signature)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook %s to %s returned %s", eventType, endpoint.URL, resp.Status)
+	}
+	return false, nil
+}
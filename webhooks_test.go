@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type webhookDelivery struct {
+	endpoint string
+	event    string
+}
+
+func TestWebhookEventFiltering(t *testing.T) {
+	deliveries := make(chan webhookDelivery, 16)
+	endpoints := []webhookEndpoint{
+		{Events: []string{webhookEventReady}},
+		// No filter gets everything
+		{},
+		{Events: []string{webhookEventFailed, webhookEventDeleted}},
+	}
+	for i := range endpoints {
+		name := fmt.Sprintf("endpoint-%d", i)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			event := webhookEvent{}
+			err := json.NewDecoder(r.Body).Decode(&event)
+			if err != nil || event.Type != r.Header.Get("X-Webhook-Event") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			deliveries <- webhookDelivery{endpoint: name, event: event.Type}
+		}))
+		t.Cleanup(server.Close)
+		endpoints[i].URL = server.URL
+	}
+	config := writeTempFile(t, "webhooks.json", mustJSON(t, endpoints))
+	dispatcher, err := loadWebhookDispatcher(config, "secret", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range webhookEventTypes {
+		dispatcher.dispatch(event, uuid.New(), nil)
+	}
+	want := []string{
+		"endpoint-0 " + webhookEventReady,
+		"endpoint-1 " + webhookEventDeleted,
+		"endpoint-1 " + webhookEventFailed,
+		"endpoint-1 " + webhookEventReady,
+		"endpoint-2 " + webhookEventDeleted,
+		"endpoint-2 " + webhookEventFailed,
+	}
+	got := []string{}
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case delivery := <-deliveries:
+			got = append(got, delivery.endpoint+" "+delivery.event)
+		case <-timeout:
+			t.Fatalf("only got %v", got)
+		}
+	}
+	// Nothing else turns up
+	select {
+	case delivery := <-deliveries:
+		got = append(got, delivery.endpoint+" "+delivery.event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestLoadWebhookDispatcherRejectsUnknownEvents(t *testing.T) {
+	config := writeTempFile(t, "webhooks.json", `[{"url": "http://example.com", "events": ["video.uploaded"]}]`)
+	_, err := loadWebhookDispatcher(config, "", 1, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "video.uploaded") {
+		t.Errorf("loadWebhookDispatcher = %v, want an unknown event type error", err)
+	}
+}
+
+func TestUploadVideoReadyWebhook(t *testing.T) {
+	installFakeProcessingTools(t, fakeProbeOutput)
+	const secret = "webhook-secret"
+	bodies := make(chan []byte, 4)
+	var attempts atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The first delivery hits a receiver that's down
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- body
+	}))
+	t.Cleanup(server.Close)
+	config := writeTempFile(t, "webhooks.json", mustJSON(t, []webhookEndpoint{{URL: server.URL, Events: []string{webhookEventReady}}}))
+	dispatcher, err := loadWebhookDispatcher(config, secret, 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, video, token := newS3Test(t)
+	cfg.webhooks = dispatcher
+	cfg.eventURLMode = eventURLStored
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, video, token, "video/mp4", testMP4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no signed ready webhook after %d attempts", attempts.Load())
+	}
+	var event struct {
+		Type    string    `json:"type"`
+		VideoID uuid.UUID `json:"video_id"`
+		Data    struct {
+			UserID   uuid.UUID `json:"user_id"`
+			VideoURL *string   `json:"video_url"`
+			Status   string    `json:"status"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhookEventReady || event.VideoID != video.ID || event.Data.UserID != video.UserID || event.Data.Status != "ready" {
+		t.Errorf("event = %s", body)
+	}
+	if event.Data.VideoURL == nil || stored.VideoURL == nil || *event.Data.VideoURL != *stored.VideoURL {
+		t.Errorf("event = %s, want the stored video URL", body)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}